@@ -21,6 +21,7 @@ type Actor struct {
 	// }
 	ActorRaw json.RawMessage `json:"act,omitempty" caddy:"namespace=ssh.actors inline_key=action"`
 	handler  session.Handler `json:"-"`
+	name     string
 
 	// Whether the session shoul be closed upon execution of the actor
 	Final bool `json:"final,omitempty"`
@@ -69,6 +70,7 @@ func (actors ActorList) ProvisionHandlers(ctx caddy.Context) error {
 			return fmt.Errorf("route %d: loading actor modules: %v", i, err)
 		}
 		actors[i].handler = actorIface.(session.Handler)
+		actors[i].name = actorIface.(caddy.Module).CaddyModule().ID.Name()
 	}
 	return nil
 }
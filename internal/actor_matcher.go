@@ -285,7 +285,7 @@ type MatchGroup struct {
 func (MatchGroup) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "ssh.actor_matchers.group",
-		New: func() caddy.Module { return new(MatchUser) },
+		New: func() caddy.Module { return new(MatchGroup) },
 	}
 }
 
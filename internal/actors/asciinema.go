@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,11 +17,15 @@ import (
 	"sync"
 	"time"
 
+	"filippo.io/age"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/certmagic"
+	"github.com/kadeessh/kadeessh/internal/metrics"
 	"github.com/kadeessh/kadeessh/internal/session"
 	"github.com/kadeessh/kadeessh/internal/ssh"
+	"github.com/kadeessh/kadeessh/recording"
 	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 const (
@@ -46,13 +51,24 @@ func tempFilePattern() string {
 
 var unsafeFilenameChar = regexp.MustCompile(`[^A-Za-z0-9_-]`)
 
+// defaultRedactPrompt matches the prompts for passwords, passphrases, and codes, whose answer is redacted
+// from the captured input
+const defaultRedactPrompt = `(?i)(password|passphrase|passcode|verification code)[^\n]*:\s*$`
+
+// maxPromptLen caps the length of the last line of the output kept to match the prompts against
+const maxPromptLen = 256
+
+// ansiEscape matches the CSI sequences, e.g. colors, stripped from the prompts before matching them
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
 func init() {
 	caddy.RegisterModule(AsciinemaRecorder{})
 }
 
 // AsciinemaRecorder wraps another handler to record the SSH session output
 // in asciinema cast v2 format, which is then saved in Caddy storage.
-// Only output is captured for security reasons (no input/keystrokes).
+// Only output is captured by default for security reasons (no input/keystrokes);
+// see CaptureInput for the guarded capture of the input.
 //
 // EXPERIMENTAL: this module is under active development. Its configuration
 // surface (option names, defaults, on-disk temp-file layout, recovered
@@ -101,9 +117,42 @@ type AsciinemaRecorder struct {
 	// the current process are always skipped. Default: true.
 	RecoverOrphans *bool `json:"recover_orphans,omitempty"`
 
-	handler session.Handler
-	storage certmagic.Storage
-	logger  *zap.Logger
+	// Optional: Also record the input of PTY sessions in "i" events, but
+	// only while the terminal echoes it, as reported by the `shell` actor,
+	// and with the answers to the prompts matching RedactPrompts redacted.
+	// The input of sessions whose handler doesn't report the echo of its
+	// terminal is not captured. Since the recorder is configured per actor,
+	// the capture is opted into per matcher set. The input injected by the
+	// observers of the `shadow` actor is captured when the recorder is
+	// wrapped by it. The header of the cast records whether the input was
+	// captured. Default: false
+	CaptureInput bool `json:"capture_input,omitempty"`
+
+	// Optional: Regular expressions matching the prompts, at the end of the
+	// last line of the output, whose answer is redacted from the captured
+	// input up to the next line break. Default: prompts for passwords,
+	// passphrases, passcodes, and verification codes.
+	RedactPrompts []string `json:"redact_prompts,omitempty"`
+
+	// Optional: The age X25519 recipients, i.e. `age1...` public keys, to
+	// encrypt the recordings to before they're saved to the storage, which
+	// may be shared. The encrypted recordings are saved with the `.age`
+	// suffix, including the recovered ones. The in-progress temp files on the
+	// local disk aren't encrypted.
+	Recipients []string `json:"recipients,omitempty"`
+
+	// Optional: Path to the Ed25519 private key, in the PKCS #8 PEM or the
+	// OpenSSH format, signing the recordings. The detached signature covers
+	// the saved recording and a hash chain over its events, and is saved next
+	// to it with the `.sig` suffix. Recordings are verified with the
+	// `github.com/kadeessh/kadeessh/recording` package.
+	SigningKeyFile string `json:"signing_key_file,omitempty"`
+
+	handler       session.Handler
+	redactPrompts []*regexp.Regexp
+	sealer        recordingSealer
+	storage       certmagic.Storage
+	logger        *zap.Logger
 }
 
 // CaddyModule returns the Caddy module information.
@@ -178,6 +227,36 @@ func (a *AsciinemaRecorder) Provision(ctx caddy.Context) error {
 		return fmt.Errorf("temp_dir %q is not a directory", a.TempDir)
 	}
 
+	// Compile the prompts whose answers are redacted from the input.
+	if a.CaptureInput && len(a.RedactPrompts) == 0 {
+		a.RedactPrompts = []string{defaultRedactPrompt}
+	}
+	a.redactPrompts = a.redactPrompts[:0]
+	for _, expr := range a.RedactPrompts {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("redact_prompts: invalid pattern %q: %v", expr, err)
+		}
+		a.redactPrompts = append(a.redactPrompts, re)
+	}
+
+	// Parse the recipients and the signing key sealing the saved recordings.
+	a.sealer = recordingSealer{}
+	for _, r := range a.Recipients {
+		recipient, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return fmt.Errorf("recipients: invalid age X25519 recipient %q: %v", r, err)
+		}
+		a.sealer.recipients = append(a.sealer.recipients, recipient)
+	}
+	if a.SigningKeyFile != "" {
+		key, err := loadSigningKey(a.SigningKeyFile)
+		if err != nil {
+			return fmt.Errorf("signing_key_file: %v", err)
+		}
+		a.sealer.key = key
+	}
+
 	// Default recover_orphans to true.
 	if a.RecoverOrphans == nil {
 		trueVal := true
@@ -264,7 +343,8 @@ func (a *AsciinemaRecorder) newRecorder(sess session.Session) (*asciinemaRecorde
 	// Use path (forward-slash) for storage keys — storage backends treat
 	// keys as opaque paths, not host-filesystem paths.
 	basePath := path.Join("ssh", "recordings", dateStr)
-	storagePath := path.Join(basePath, fmt.Sprintf("%s-%s.cast", safeUser, safeSessionID))
+	ext := a.sealer.extension()
+	storagePath := path.Join(basePath, fmt.Sprintf("%s-%s%s", safeUser, safeSessionID, ext))
 
 	// If a recording already exists at this key (e.g. leftover from a crashed
 	// session with a colliding ID), append a nanosecond suffix so we never
@@ -273,7 +353,7 @@ func (a *AsciinemaRecorder) newRecorder(sess session.Session) (*asciinemaRecorde
 		probeCtx, cancel := context.WithTimeout(context.Background(), storeTimeout)
 		if a.storage.Exists(probeCtx, storagePath) {
 			storagePath = path.Join(basePath,
-				fmt.Sprintf("%s-%s-%d.cast", safeUser, safeSessionID, now.UnixNano()))
+				fmt.Sprintf("%s-%s-%d%s", safeUser, safeSessionID, now.UnixNano(), ext))
 		}
 		cancel()
 	}
@@ -329,15 +409,26 @@ func (a *AsciinemaRecorder) newRecorder(sess session.Session) (*asciinemaRecorde
 		}
 		header.Kadeessh = meta
 	}
+	// The input is only captured from terminals, which may report their echo.
+	captureInput := a.CaptureInput && hasPty
+	if captureInput {
+		if header.Kadeessh == nil {
+			header.Kadeessh = &asciinemaSSHMetadata{}
+		}
+		header.Kadeessh.InputCapture = true
+	}
 
 	rec := &asciinemaRecorder{
 		storage:       a.storage,
 		storagePath:   storagePath,
+		sealer:        a.sealer,
 		header:        header,
 		startTime:     now,
 		maxSize:       a.MaxSize,
 		maxDuration:   time.Duration(a.MaxDuration),
 		flushInterval: time.Duration(a.FlushInterval),
+		captureInput:  captureInput,
+		redactPrompts: a.redactPrompts,
 		logger:        a.logger,
 	}
 	if err := rec.openTempFile(a.TempDir); err != nil {
@@ -486,18 +577,23 @@ func (a *AsciinemaRecorder) recoverOne(ctx context.Context, tempPath string) err
 		return nil
 	}
 
+	// The temp files are never encrypted, so the recovered ones are sealed
+	// like the recordings of the finished sessions.
+	ext := a.sealer.extension()
 	storagePath := deriveRecoveredStoragePath(data, filepath.Base(tempPath))
+	storagePath = strings.TrimSuffix(storagePath, ".cast") + ext
 
 	probeCtx, cancel := context.WithTimeout(ctx, storeTimeout)
 	if a.storage.Exists(probeCtx, storagePath) {
-		base := strings.TrimSuffix(storagePath, ".cast")
-		storagePath = fmt.Sprintf("%s-%d.cast", base, time.Now().UnixNano())
+		base := strings.TrimSuffix(storagePath, ext)
+		storagePath = fmt.Sprintf("%s-%d%s", base, time.Now().UnixNano(), ext)
 	}
 	cancel()
 
 	storeCtx, cancel := context.WithTimeout(ctx, storeTimeout)
 	defer cancel()
-	if err := a.storage.Store(storeCtx, storagePath, data); err != nil {
+	size, err := a.sealer.store(storeCtx, a.storage, storagePath, data, true)
+	if err != nil {
 		return fmt.Errorf("store to %s: %w", storagePath, err)
 	}
 
@@ -505,7 +601,9 @@ func (a *AsciinemaRecorder) recoverOne(ctx context.Context, tempPath string) err
 		"recovered orphan recording",
 		zap.String("temp_path", tempPath),
 		zap.String("storage_path", storagePath),
-		zap.Int("size", len(data)),
+		zap.Int("size", size),
+		zap.Bool("encrypted", a.sealer.encrypts()),
+		zap.Bool("signed", a.sealer.signs()),
 	)
 	if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
 		a.logger.Warn(
@@ -567,6 +665,7 @@ type asciinemaSSHMetadata struct {
 	SessionID     string `json:"session_id,omitempty"`
 	ClientVersion string `json:"client_version,omitempty"`
 	PtyTerm       string `json:"pty_term,omitempty"`
+	InputCapture  bool   `json:"input_capture,omitempty"`
 }
 
 // asciinemaRecorder handles the actual recording logic. Events are streamed
@@ -575,6 +674,7 @@ type asciinemaSSHMetadata struct {
 type asciinemaRecorder struct {
 	storage       certmagic.Storage
 	storagePath   string
+	sealer        recordingSealer
 	tempPath      string
 	tempFile      *os.File
 	tempBuf       *bufio.Writer
@@ -583,6 +683,8 @@ type asciinemaRecorder struct {
 	maxSize       int64
 	maxDuration   time.Duration
 	flushInterval time.Duration
+	captureInput  bool
+	redactPrompts []*regexp.Regexp
 	logger        *zap.Logger
 
 	mu        sync.Mutex
@@ -590,6 +692,11 @@ type asciinemaRecorder struct {
 	closed    bool
 	truncated bool
 
+	// lastLine is the tail of the last line of the output, matched against the redacted prompts
+	lastLine    []byte
+	redacting   bool
+	echoUnknown bool
+
 	stopFlusher chan struct{}
 	flusherDone chan struct{}
 }
@@ -668,6 +775,7 @@ func (r *asciinemaRecorder) markTruncatedLocked(reason string) {
 	elapsed := time.Since(r.startTime).Seconds()
 	r.appendEventLocked([]interface{}{elapsed, "m", "kadeessh: recording truncated (" + reason + ")"})
 	r.truncated = true
+	metrics.RecordingsTruncated.WithLabelValues(reason).Inc()
 	r.logger.Warn(
 		"recording truncated",
 		zap.String("reason", reason),
@@ -691,22 +799,86 @@ func (r *asciinemaRecorder) Write(p []byte) (n int, err error) {
 	if r.closed {
 		return 0, fmt.Errorf("recorder is closed")
 	}
-	if r.truncated {
-		return len(p), nil
+	if r.captureInput {
+		r.trackPromptLocked(p)
 	}
+	r.recordLocked("o", p)
+	return len(p), nil
+}
 
+// recordLocked appends the data as an event of the code, unless the
+// recording is truncated or the data would exceed its limits, in which case
+// the recording is truncated. Caller must hold r.mu.
+func (r *asciinemaRecorder) recordLocked(code string, p []byte) {
+	if r.truncated {
+		return
+	}
 	if r.maxSize > 0 && r.totalSize+int64(len(p)) > r.maxSize {
 		r.markTruncatedLocked("max_size")
-		return len(p), nil
+		return
 	}
 	if r.maxDuration > 0 && time.Since(r.startTime) > r.maxDuration {
 		r.markTruncatedLocked("max_duration")
-		return len(p), nil
+		return
 	}
+	elapsed := time.Since(r.startTime).Seconds()
+	r.appendEventLocked([]interface{}{elapsed, code, string(p)})
+}
 
+// WriteInput records the input of the client in asciinema cast v2 "i"
+// events while the terminal echoes it, as reported by echo. The answer to a
+// prompt matching the redacted prompts is replaced by a marker event up to
+// the next line break.
+func (r *asciinemaRecorder) WriteInput(p []byte, echo func() bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.truncated || len(p) == 0 {
+		return
+	}
+	lineBreak := bytes.ContainsAny(p, "\r\n")
 	elapsed := time.Since(r.startTime).Seconds()
-	r.appendEventLocked([]interface{}{elapsed, "o", string(p)})
-	return len(p), nil
+	switch {
+	case r.redacting:
+		r.redacting = !lineBreak
+	case echo == nil:
+		// Without the echo, the input might as well be a password.
+		if !r.echoUnknown {
+			r.echoUnknown = true
+			r.appendEventLocked([]interface{}{elapsed, "m", "kadeessh: input not captured (terminal echo unknown)"})
+		}
+	case !echo():
+	case r.promptLocked():
+		r.redacting = !lineBreak
+		r.lastLine = r.lastLine[:0]
+		r.appendEventLocked([]interface{}{elapsed, "m", "kadeessh: input redacted"})
+	default:
+		r.recordLocked("i", p)
+	}
+}
+
+// trackPromptLocked keeps the tail of the last line of the output. Caller
+// must hold r.mu.
+func (r *asciinemaRecorder) trackPromptLocked(p []byte) {
+	if i := bytes.LastIndexByte(p, '\n'); i >= 0 {
+		r.lastLine = r.lastLine[:0]
+		p = p[i+1:]
+	}
+	r.lastLine = append(r.lastLine, p...)
+	if len(r.lastLine) > maxPromptLen {
+		r.lastLine = append(r.lastLine[:0], r.lastLine[len(r.lastLine)-maxPromptLen:]...)
+	}
+}
+
+// promptLocked reports whether the last line of the output is a prompt whose
+// answer is redacted. Caller must hold r.mu.
+func (r *asciinemaRecorder) promptLocked() bool {
+	line := ansiEscape.ReplaceAll(r.lastLine, nil)
+	for _, re := range r.redactPrompts {
+		if re.Match(line) {
+			return true
+		}
+	}
+	return false
 }
 
 // WriteResize records a PTY resize event in asciinema cast v2 "r" format.
@@ -762,14 +934,15 @@ func (r *asciinemaRecorder) Close() error {
 		r.logger.Warn("closing temp file", zap.String("temp_path", tempPath), zap.Error(closeErr))
 	}
 
-	payload, err := os.ReadFile(tempPath)
+	cast, err := os.ReadFile(tempPath)
 	if err != nil {
 		return fmt.Errorf("reading temp file %s: %w", tempPath, err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
 	defer cancel()
-	if err := r.storage.Store(ctx, r.storagePath, payload); err != nil {
+	size, err := r.sealer.store(ctx, r.storage, r.storagePath, cast, false)
+	if err != nil {
 		// Preserve the temp file so an operator can recover the recording.
 		r.logger.Error(
 			"recording upload failed; temp file preserved for manual recovery",
@@ -791,18 +964,81 @@ func (r *asciinemaRecorder) Close() error {
 	r.logger.Info(
 		"recording saved",
 		zap.String("path", r.storagePath),
-		zap.Int64("size", int64(len(payload))),
+		zap.Int64("size", int64(size)),
 		zap.Int64("event_bytes", totalSize),
 		zap.Duration("duration", time.Since(r.startTime)),
+		zap.Bool("encrypted", r.sealer.encrypts()),
+		zap.Bool("signed", r.sealer.signs()),
 	)
 	return nil
 }
 
-// recordingSession wraps a session to intercept Write calls for recording.
+// recordingSealer encrypts the recordings to the age recipients, if any, and
+// signs them with the Ed25519 key, if any, before they're stored.
+type recordingSealer struct {
+	recipients []age.Recipient
+	key        ed25519.PrivateKey
+}
+
+func (s recordingSealer) encrypts() bool { return len(s.recipients) > 0 }
+
+func (s recordingSealer) signs() bool { return s.key != nil }
+
+// extension returns the extension of the storage keys of the sealed recordings.
+func (s recordingSealer) extension() string {
+	if s.encrypts() {
+		return ".cast" + recording.EncryptedSuffix
+	}
+	return ".cast"
+}
+
+// store seals the cast and stores it at the key, returning the size of the
+// stored payload. The signature is stored first, so a stored recording is
+// never left unsigned.
+func (s recordingSealer) store(ctx context.Context, storage certmagic.Storage, key string, cast []byte, recovered bool) (int, error) {
+	payload, signature, err := recording.Seal(key, cast, s.recipients, s.key, recovered)
+	if err != nil {
+		return 0, err
+	}
+	if signature != nil {
+		if err := storage.Store(ctx, key+recording.SignatureSuffix, signature); err != nil {
+			return 0, fmt.Errorf("storing signature: %w", err)
+		}
+	}
+	if err := storage.Store(ctx, key, payload); err != nil {
+		return 0, err
+	}
+	return len(payload), nil
+}
+
+// loadSigningKey reads the Ed25519 private key from the file.
+func loadSigningKey(file string) (ed25519.PrivateKey, error) {
+	pemBytes, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("reading private key: %v", err)
+	}
+	key, err := gossh.ParseRawPrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing private key: %v", err)
+	}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		return k, nil
+	case *ed25519.PrivateKey:
+		return *k, nil
+	}
+	return nil, fmt.Errorf("private key is a %T, not an Ed25519 key", key)
+}
+
+// recordingSession wraps a session to intercept Write calls for recording,
+// and Read calls when the input is captured.
 type recordingSession struct {
 	session.Session
 	recorder *asciinemaRecorder
 
+	echoMu sync.Mutex
+	echo   func() bool
+
 	ptyOnce sync.Once
 	ptyReq  ssh.Pty
 	ptyCh   <-chan ssh.Window
@@ -815,6 +1051,29 @@ func (rs *recordingSession) Write(p []byte) (n int, err error) {
 	return rs.Session.Write(p)
 }
 
+// Read intercepts reads to capture the input when enabled.
+func (rs *recordingSession) Read(p []byte) (n int, err error) {
+	n, err = rs.Session.Read(p)
+	if n > 0 && rs.recorder.captureInput {
+		rs.echoMu.Lock()
+		echo := rs.echo
+		rs.echoMu.Unlock()
+		rs.recorder.WriteInput(p[:n], echo)
+	}
+	return n, err
+}
+
+// ReportEcho registers the echo of the terminal of the wrapped handler, so
+// the input is only captured while it's echoed.
+func (rs *recordingSession) ReportEcho(echo func() bool) {
+	rs.echoMu.Lock()
+	rs.echo = echo
+	rs.echoMu.Unlock()
+	if r, ok := rs.Session.(session.EchoReporter); ok {
+		r.ReportEcho(echo)
+	}
+}
+
 // Stderr wraps the stderr stream for recording.
 func (rs *recordingSession) Stderr() io.ReadWriter {
 	stderr := rs.Session.Stderr()
@@ -871,4 +1130,6 @@ var (
 	_ caddy.Module      = (*AsciinemaRecorder)(nil)
 	_ caddy.Provisioner = (*AsciinemaRecorder)(nil)
 	_ session.Handler   = (*AsciinemaRecorder)(nil)
+
+	_ session.EchoReporter = (*recordingSession)(nil)
 )
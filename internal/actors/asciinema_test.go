@@ -3,23 +3,33 @@ package actors
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"filippo.io/age"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/certmagic"
 	"github.com/kadeessh/kadeessh/internal/session"
 	"github.com/kadeessh/kadeessh/internal/ssh"
+	"github.com/kadeessh/kadeessh/recording"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 // mockSession implements session.Session for testing.
@@ -30,6 +40,8 @@ type mockSession struct {
 	ctx        context.Context
 	stderr     *mockReadWriter
 	written    []byte
+	// input holds the chunks returned by successive reads
+	input [][]byte
 
 	pty      ssh.Pty
 	winCh    <-chan ssh.Window
@@ -42,15 +54,21 @@ func (m *mockSession) RemoteAddr() net.Addr     { return m.remoteAddr }
 func (m *mockSession) LocalAddr() net.Addr      { return m.localAddr }
 func (m *mockSession) Context() context.Context { return m.ctx }
 func (m *mockSession) Read(data []byte) (int, error) {
-	return 0, io.EOF
+	if len(m.input) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(data, m.input[0])
+	m.input = m.input[1:]
+	return n, nil
 }
 
 func (m *mockSession) Write(data []byte) (int, error) {
 	m.written = append(m.written, data...)
 	return len(data), nil
 }
-func (m *mockSession) Close() error      { return nil }
-func (m *mockSession) CloseWrite() error { return nil }
+func (m *mockSession) Close() error            { return nil }
+func (m *mockSession) Closed() <-chan struct{} { return nil }
+func (m *mockSession) CloseWrite() error       { return nil }
 func (m *mockSession) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
 	return false, nil
 }
@@ -871,3 +889,260 @@ func TestDeriveRecoveredStoragePath(t *testing.T) {
 		t.Errorf("no kadeessh: got %q", got)
 	}
 }
+
+// inputEvents returns the data of the "i" events and the markers of the recording.
+func inputEvents(t *testing.T, storage *mockStorage) (asciinemaHeader, []string, []string) {
+	t.Helper()
+	if len(storage.data) != 1 {
+		t.Fatalf("expected 1 recording stored, got %d", len(storage.data))
+	}
+	var key string
+	for k := range storage.data {
+		key = k
+	}
+	header, events := splitCastLines(t, storage.data[key])
+	var inputs, markers []string
+	for _, ev := range events {
+		switch ev[1] {
+		case "i":
+			inputs = append(inputs, ev[2].(string))
+		case "m":
+			markers = append(markers, ev[2].(string))
+		}
+	}
+	return header, inputs, markers
+}
+
+func TestAsciinemaRecorder_InputCaptureRedactsPrompts(t *testing.T) {
+	storage := newMockStorage()
+	echo := true
+	handler := &mockHandler{
+		fn: func(sess session.Session) error {
+			sess.(session.EchoReporter).ReportEcho(func() bool { return echo })
+			buf := make([]byte, 64)
+			read := func() {
+				if _, err := sess.Read(buf); err != nil {
+					t.Fatalf("Read: %v", err)
+				}
+			}
+			_, _ = sess.Write([]byte("$ "))
+			read() // ls
+			_, _ = sess.Write([]byte("ls\r\nfile\r\n$ "))
+			read() // sudo -k
+			_, _ = sess.Write([]byte("sudo -k\r\n\x1b[1m[sudo] Password for alice:\x1b[0m "))
+			read() // hunter2, with the terminal echoing
+			read() // the end of the answer
+			_, _ = sess.Write([]byte("\r\n$ "))
+			echo = false
+			read() // secret, without the echo
+			echo = true
+			_, _ = sess.Write([]byte("\r\n$ "))
+			read() // exit
+			return nil
+		},
+	}
+	rec := newTestRecorderActor(t, handler, storage)
+	rec.CaptureInput = true
+	rec.redactPrompts = []*regexp.Regexp{regexp.MustCompile(defaultRedactPrompt)}
+	sess := newTestSession("alice", "sid-input")
+	sess.pty = ssh.Pty{Term: "xterm", Window: ssh.Window{Width: 80, Height: 24}}
+	sess.hasPty = true
+	sess.input = [][]byte{[]byte("ls\r"), []byte("sudo -k\r"), []byte("hunter2"), []byte("\r"), []byte("secret\r"), []byte("exit\r")}
+
+	if err := rec.Handle(sess); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	header, inputs, markers := inputEvents(t, storage)
+	if header.Kadeessh == nil || !header.Kadeessh.InputCapture {
+		t.Errorf("header.kadeessh = %+v, want input_capture", header.Kadeessh)
+	}
+	if want := []string{"ls\r", "sudo -k\r", "exit\r"}; strings.Join(inputs, "|") != strings.Join(want, "|") {
+		t.Errorf("input events = %q, want %q", inputs, want)
+	}
+	if len(markers) != 1 || markers[0] != "kadeessh: input redacted" {
+		t.Errorf("markers = %q, want the redaction marker", markers)
+	}
+}
+
+func TestAsciinemaRecorder_InputCaptureRequiresEcho(t *testing.T) {
+	for _, hasPty := range []bool{true, false} {
+		storage := newMockStorage()
+		handler := &mockHandler{
+			fn: func(sess session.Session) error {
+				_, err := io.ReadAll(sess)
+				return err
+			},
+		}
+		rec := newTestRecorderActor(t, handler, storage)
+		rec.CaptureInput = true
+		include := false
+		rec.IncludeMetadata = &include
+		sess := newTestSession("alice", "sid-no-echo")
+		sess.hasPty = hasPty
+		sess.input = [][]byte{[]byte("ls\r"), []byte("exit\r")}
+
+		if err := rec.Handle(sess); err != nil {
+			t.Fatalf("Handle: %v", err)
+		}
+		header, inputs, markers := inputEvents(t, storage)
+		if len(inputs) != 0 {
+			t.Errorf("pty %t: input events = %q, want none without the echo", hasPty, inputs)
+		}
+		if hasPty {
+			// the header records the capture even without the metadata
+			if header.Kadeessh == nil || !header.Kadeessh.InputCapture || header.Kadeessh.User != "" {
+				t.Errorf("header.kadeessh = %+v, want only input_capture", header.Kadeessh)
+			}
+			if len(markers) != 1 || !strings.Contains(markers[0], "terminal echo unknown") {
+				t.Errorf("markers = %q, want the unknown echo marker", markers)
+			}
+		} else if header.Kadeessh != nil || len(markers) != 0 {
+			t.Errorf("header.kadeessh = %+v, markers = %q; want no input capture without a pty", header.Kadeessh, markers)
+		}
+	}
+}
+
+// newTestSealer returns a sealer encrypting to a new age identity and signing with a new Ed25519 key
+func newTestSealer(t *testing.T) (recordingSealer, *age.X25519Identity) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recordingSealer{recipients: []age.Recipient{identity.Recipient()}, key: key}, identity
+}
+
+func TestAsciinemaRecorder_SealedRecording(t *testing.T) {
+	storage := newMockStorage()
+	rec := newTestRecorderActor(t, &mockHandler{}, storage)
+	sealer, identity := newTestSealer(t)
+	rec.sealer = sealer
+
+	if err := rec.Handle(newTestSession("alice", "sid1")); err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if len(storage.data) != 2 {
+		t.Fatalf("expected the recording and its signature, got %d keys", len(storage.data))
+	}
+	var key string
+	for k := range storage.data {
+		if !strings.HasSuffix(k, recording.SignatureSuffix) {
+			key = k
+		}
+	}
+	if !strings.HasSuffix(key, "alice-sid1.cast.age") {
+		t.Fatalf("encrypted recording key = %q", key)
+	}
+	payload, signature := storage.data[key], storage.data[key+recording.SignatureSuffix]
+	if bytes.Contains(payload, []byte("Hello from mock handler")) || !recording.IsEncrypted(payload) {
+		t.Fatal("recording was stored in plaintext")
+	}
+
+	trusted := []ed25519.PublicKey{sealer.key.Public().(ed25519.PublicKey)}
+	res, err := recording.Verify(key, payload, signature, trusted, identity)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !bytes.Contains(res.Cast, []byte("Hello from mock handler")) || res.Signature.Recovered {
+		t.Errorf("verified cast = %q, recovered %t", res.Cast, res.Signature.Recovered)
+	}
+
+	tampered := bytes.Clone(payload)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := recording.Verify(key, tampered, signature, trusted, identity); err == nil {
+		t.Error("tampered recording verified")
+	}
+}
+
+func TestRecoverOrphans_Sealed(t *testing.T) {
+	dir := t.TempDir()
+	storage := newMockStorage()
+	orphan := writeOrphanTempFile(t, dir, "99999", "alice", "sidX", nil)
+	sealer, identity := newTestSealer(t)
+
+	falseVal := false
+	rec := &AsciinemaRecorder{
+		storage:        storage,
+		logger:         caddy.Log(),
+		TempDir:        dir,
+		RecoverOrphans: &falseVal,
+		sealer:         sealer,
+	}
+	if err := rec.recoverOne(context.Background(), orphan); err != nil {
+		t.Fatalf("recoverOne: %v", err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphan temp file should have been removed after upload: %v", err)
+	}
+	var key string
+	for k := range storage.data {
+		if !strings.HasSuffix(k, recording.SignatureSuffix) {
+			key = k
+		}
+	}
+	if !strings.HasSuffix(key, "alice-sidX-recovered.cast.age") {
+		t.Fatalf("recovered key = %q", key)
+	}
+
+	res, err := recording.Verify(key, storage.data[key], storage.data[key+recording.SignatureSuffix],
+		[]ed25519.PublicKey{sealer.key.Public().(ed25519.PublicKey)}, identity)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if !res.Signature.Recovered || !bytes.Contains(res.Cast, []byte("recovered output")) {
+		t.Errorf("verified cast = %q, recovered %t", res.Cast, res.Signature.Recovered)
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	openssh, err := gossh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name    string
+		block   *pem.Block
+		wantErr bool
+	}{
+		{"pkcs8", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}, false},
+		{"openssh", openssh, false},
+		{"ecdsa", &pem.Block{Type: "PRIVATE KEY", Bytes: ecPKCS8}, true},
+	} {
+		file := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(file, pem.EncodeToMemory(tt.block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadSigningKey(file)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: loaded a non-Ed25519 key", tt.name)
+			}
+			continue
+		}
+		if err != nil || !key.Equal(got) {
+			t.Errorf("%s: loadSigningKey = %v; want the key", tt.name, err)
+		}
+	}
+}
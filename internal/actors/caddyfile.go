@@ -0,0 +1,380 @@
+package actors
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/kadeessh/kadeessh/internal/caddyfileutil"
+)
+
+var (
+	_ caddyfile.Unmarshaler = (*StaticResponse)(nil)
+	_ caddyfile.Unmarshaler = (*SCP)(nil)
+	_ caddyfile.Unmarshaler = (*AsciinemaRecorder)(nil)
+	_ caddyfile.Unmarshaler = (*Proxy)(nil)
+	_ caddyfile.Unmarshaler = (*Container)(nil)
+	_ caddyfile.Unmarshaler = (*Shadow)(nil)
+	_ caddyfile.Unmarshaler = (*ShadowWatch)(nil)
+)
+
+// UnmarshalCaddyfile sets up the actor from Caddyfile tokens. Syntax:
+//
+//	static_response <response>
+func (s *StaticResponse) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&s.Response) {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the actor from Caddyfile tokens. Syntax:
+//
+//	scp [<root>] {
+//		root <path>
+//		read_only
+//	}
+func (s *SCP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			s.Root = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "root":
+				if !d.AllArgs(&s.Root) {
+					return d.ArgErr()
+				}
+			case "read_only":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				s.ReadOnly = true
+			default:
+				return d.Errf("unrecognized scp option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the recorder from Caddyfile tokens. Syntax:
+//
+//	asciinema_recorder {
+//		handler            <actor> ...
+//		storage            <module> ...
+//		max_size           <bytes>
+//		max_duration       <duration>
+//		on_recording_error continue|reject
+//		include_metadata   [true|false]
+//		flush_interval     <duration>
+//		temp_dir           <path>
+//		recover_orphans    [true|false]
+//		capture_input
+//		redact_prompts     <regexp...>
+//		recipients         <age1...>
+//		signing_key_file   <path>
+//	}
+func (a *AsciinemaRecorder) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "handler":
+				a.HandlerRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.actors", "action")
+			case "storage":
+				a.StorageRaw, err = caddyfileutil.UnmarshalInlineModule(d, "caddy.storage", "module")
+			case "max_size":
+				var val string
+				if !d.AllArgs(&val) {
+					return d.ArgErr()
+				}
+				a.MaxSize, err = strconv.ParseInt(val, 10, 64)
+				if err != nil {
+					return d.Errf("parsing max_size: %v", err)
+				}
+			case "max_duration":
+				a.MaxDuration, err = parseDuration(d)
+			case "on_recording_error":
+				if !d.AllArgs(&a.OnRecordingError) {
+					return d.ArgErr()
+				}
+			case "include_metadata":
+				a.IncludeMetadata, err = parseOptionalBool(d)
+			case "flush_interval":
+				a.FlushInterval, err = parseDuration(d)
+			case "temp_dir":
+				if !d.AllArgs(&a.TempDir) {
+					return d.ArgErr()
+				}
+			case "recover_orphans":
+				a.RecoverOrphans, err = parseOptionalBool(d)
+			case "capture_input":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.CaptureInput = true
+			case "redact_prompts":
+				prompts := d.RemainingArgs()
+				if len(prompts) == 0 {
+					return d.ArgErr()
+				}
+				a.RedactPrompts = append(a.RedactPrompts, prompts...)
+			case "recipients":
+				recipients := d.RemainingArgs()
+				if len(recipients) == 0 {
+					return d.ArgErr()
+				}
+				a.Recipients = append(a.Recipients, recipients...)
+			case "signing_key_file":
+				if !d.AllArgs(&a.SigningKeyFile) {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unrecognized asciinema_recorder option '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(a.HandlerRaw) == 0 {
+		return d.Err("asciinema_recorder handler is required")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the actor from Caddyfile tokens. Syntax:
+//
+//	proxy [<upstream>] {
+//		upstream         <address>
+//		user             <user>
+//		private_key_file <path>
+//		forwarded_agent
+//		known_hosts      <paths...>
+//		dial_timeout     <duration>
+//	}
+func (p *Proxy) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			p.Upstream = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "upstream":
+				if !d.AllArgs(&p.Upstream) {
+					return d.ArgErr()
+				}
+			case "user":
+				if !d.AllArgs(&p.User) {
+					return d.ArgErr()
+				}
+			case "private_key_file":
+				if !d.AllArgs(&p.PrivateKeyFile) {
+					return d.ArgErr()
+				}
+			case "forwarded_agent":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				p.ForwardedAgent = true
+			case "known_hosts":
+				paths := d.RemainingArgs()
+				if len(paths) == 0 {
+					return d.ArgErr()
+				}
+				p.KnownHosts = append(p.KnownHosts, paths...)
+			case "dial_timeout":
+				p.DialTimeout, err = parseDuration(d)
+			default:
+				return d.Errf("unrecognized proxy option '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the actor from Caddyfile tokens. Syntax:
+//
+//	container [<image>] {
+//		image  <image>
+//		socket <path>
+//		name   <name>
+//		shell  <command> [<args...>]
+//		user   <user>
+//		env    <key> <value>
+//		binds  <source:destination[:options]...>
+//		remove
+//	}
+func (c *Container) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			c.Image = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "image":
+				if !d.AllArgs(&c.Image) {
+					return d.ArgErr()
+				}
+			case "socket":
+				if !d.AllArgs(&c.Socket) {
+					return d.ArgErr()
+				}
+			case "name":
+				if !d.AllArgs(&c.Name) {
+					return d.ArgErr()
+				}
+			case "shell":
+				c.Shell = d.RemainingArgs()
+				if len(c.Shell) == 0 {
+					return d.ArgErr()
+				}
+			case "user":
+				if !d.AllArgs(&c.User) {
+					return d.ArgErr()
+				}
+			case "env":
+				var key, val string
+				if !d.AllArgs(&key, &val) {
+					return d.ArgErr()
+				}
+				if c.Env == nil {
+					c.Env = make(map[string]string)
+				}
+				c.Env[key] = val
+			case "binds":
+				binds := d.RemainingArgs()
+				if len(binds) == 0 {
+					return d.ArgErr()
+				}
+				c.Binds = append(c.Binds, binds...)
+			case "remove":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.Remove = true
+			default:
+				return d.Errf("unrecognized container option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the actor from Caddyfile tokens. Syntax:
+//
+//	shadow {
+//		handler    <actor> ...
+//		assist
+//		banner     <text>
+//		end_banner <text>
+//	}
+func (s *Shadow) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "handler":
+				s.HandlerRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.actors", "action")
+			case "assist":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				s.Assist = true
+			case "banner":
+				if !d.AllArgs(&s.Banner) {
+					return d.ArgErr()
+				}
+			case "end_banner":
+				if !d.AllArgs(&s.EndBanner) {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unrecognized shadow option '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(s.HandlerRaw) == 0 {
+		return d.Err("shadow handler is required")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the actor from Caddyfile tokens. Syntax:
+//
+//	shadow_watch {
+//		assist
+//	}
+func (w *ShadowWatch) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "assist":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				w.Assist = true
+			default:
+				return d.Errf("unrecognized shadow_watch option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func parseDuration(d *caddyfile.Dispenser) (caddy.Duration, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return 0, d.Errf("parsing duration: %v", err)
+	}
+	if d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	return caddy.Duration(dur), nil
+}
+
+// parseOptionalBool parses the optional boolean argument of a flag, which is true when absent
+func parseOptionalBool(d *caddyfile.Dispenser) (*bool, error) {
+	val := true
+	if d.NextArg() {
+		var err error
+		if val, err = strconv.ParseBool(d.Val()); err != nil {
+			return nil, d.Errf("parsing boolean: %v", err)
+		}
+	}
+	if d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	return &val, nil
+}
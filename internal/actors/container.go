@@ -0,0 +1,467 @@
+package actors
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultContainerSocket = "/var/run/docker.sock"
+	defaultContainerName   = "kadeessh-{ssh.user}"
+
+	// containerCleanupTimeout bounds the calls to the engine cleaning up after the session, which outlive it
+	containerCleanupTimeout = 30 * time.Second
+)
+
+func init() {
+	caddy.RegisterModule(Container{})
+}
+
+var (
+	_ caddy.Provisioner = (*Container)(nil)
+	_ caddy.Validator   = (*Container)(nil)
+	_ session.Handler   = Container{}
+)
+
+// Container is an actor running the session inside a container of an engine serving the Docker Engine API over
+// a Unix socket, e.g. Docker or Podman. The container of the user is created from the image template by the first
+// session and reused by the later ones, each running as a process executed in the container. The command of the
+// session is run by the shell of the container, and the sessions without a command run the shell itself.
+//
+// With a PTY, the window changes resize the TTY of the process. Otherwise, the error output is sent apart as
+// extended data, and the input of the process is closed once the client sends EOF. The exit status of the process
+// is reported to the client. If the client goes away first, the process, which the engine keeps running, is
+// killed by its PID on the host, provided that the server runs on the host of the engine and may signal it.
+//
+// The sessions of users whose names can't be part of a path, e.g. `..`, are refused, as the session placeholders
+// may place them in the host paths of the binds.
+type Container struct {
+	// The path of the Unix socket of the engine. Defaults to `/var/run/docker.sock`.
+	Socket string `json:"socket,omitempty"`
+
+	// The image the containers are created from, which may use the session placeholders. Required.
+	Image string `json:"image,omitempty"`
+
+	// The name of the container, which may use the session placeholders. The sessions resolving to the
+	// same name share the container. Defaults to `kadeessh-{ssh.user}`.
+	Name string `json:"name,omitempty"`
+
+	// The shell of the container running the sessions, e.g. `["/bin/bash", "-l"]`. The command of the
+	// session is passed to the shell with `-c`. Defaults to `["/bin/sh"]`.
+	Shell []string `json:"shell,omitempty"`
+
+	// The user running the sessions in the container, which may use the session placeholders.
+	// Defaults to the user of the image.
+	User string `json:"user,omitempty"`
+
+	// environment variables to be set for the session
+	Env map[string]string `json:"env,omitempty"`
+
+	// The bind mounts of the container in the `source:destination[:options]` format, which may use
+	// the session placeholders, e.g. `/home/{ssh.user}:/home/{ssh.user}`
+	Binds []string `json:"binds,omitempty"`
+
+	// Remove the container once its last session ends. Otherwise, the container is kept running for the
+	// later sessions.
+	Remove bool `json:"remove,omitempty"`
+
+	containers *containerRefs
+	client     *http.Client
+	logger     *zap.Logger
+}
+
+// containerRefs holds the refs of the containers in use, keyed by the name
+type containerRefs struct {
+	mu   sync.Mutex
+	refs map[string]*containerRef
+}
+
+// containerRef serializes the preparation and the removal of a container, and counts the sessions running in it
+type containerRef struct {
+	mu       sync.Mutex
+	sessions int
+
+	// the sessions holding the ref, guarded by the mutex of containerRefs
+	holders int
+}
+
+// hold returns the ref of the container, which is kept until put back by every holder
+func (r *containerRefs) hold(name string) *containerRef {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ref, ok := r.refs[name]
+	if !ok {
+		ref = &containerRef{}
+		r.refs[name] = ref
+	}
+	ref.holders++
+	return ref
+}
+
+// put releases the hold on the ref of the container
+func (r *containerRefs) put(name string, ref *containerRef) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ref.holders--
+	if ref.holders == 0 {
+		delete(r.refs, name)
+	}
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (c Container) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "ssh.actors.container",
+		New: func() caddy.Module {
+			return new(Container)
+		},
+	}
+}
+
+// Provision sets up the defaults and the client of the engine
+func (c *Container) Provision(ctx caddy.Context) error {
+	c.logger = ctx.Logger(c)
+	if c.Socket == "" {
+		c.Socket = defaultContainerSocket
+	}
+	if c.Name == "" {
+		c.Name = defaultContainerName
+	}
+	if len(c.Shell) == 0 {
+		c.Shell = []string{"/bin/sh"}
+	}
+	c.containers = &containerRefs{refs: make(map[string]*containerRef)}
+	socket := c.Socket
+	c.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	return nil
+}
+
+// Validate ensures the image is defined
+func (c *Container) Validate() error {
+	if strings.TrimSpace(c.Image) == "" {
+		return errors.New("container: image is required")
+	}
+	return nil
+}
+
+// Handle runs the session in the container of the user and reports the exit status of the process
+func (c Container) Handle(sess session.Session) error {
+	sessionID, _ := sess.Context().Value(ssh.ContextKeySessionID).(string)
+	repl := session.NewReplacer(sess)
+	name := repl.ReplaceAll(c.Name, "")
+	logger := c.logger.With(
+		zap.String("session_id", sessionID),
+		zap.String("user", sess.User()),
+		zap.String("remote_ip", sess.RemoteAddr().String()),
+		zap.String("container", name),
+	)
+	ctx := sess.Context()
+
+	// the username is expanded into the host paths of the binds
+	if err := session.CheckPathSafeUser(sess.User()); err != nil {
+		logger.Error("preparing container", zap.Error(err))
+		fmt.Fprintln(sess.Stderr(), "container: preparing the container failed")
+		return err
+	}
+	ref, id, err := c.acquire(ctx, name, repl)
+	if err != nil {
+		logger.Error("preparing container", zap.Error(err))
+		fmt.Fprintln(sess.Stderr(), "container: preparing the container failed")
+		return err
+	}
+	defer c.release(name, ref, id, logger)
+
+	ptyReq, winCh, isPty := sess.Pty()
+	cmd := append([]string(nil), c.Shell...)
+	if sess.RawCommand() != "" {
+		cmd = append(cmd, "-c", sess.RawCommand())
+	}
+	env := make([]string, 0, len(c.Env)+1)
+	for k, v := range c.Env {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	if isPty {
+		env = append(env, fmt.Sprintf("TERM=%s", ptyReq.Term))
+	}
+	execConfig := map[string]any{
+		"AttachStdin":  true,
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          isPty,
+		"Cmd":          cmd,
+		"Env":          env,
+		"User":         repl.ReplaceAll(c.User, ""),
+	}
+	var created struct {
+		ID string `json:"Id"`
+	}
+	if _, err := c.call(ctx, http.MethodPost, "/containers/"+id+"/exec", execConfig, &created); err != nil {
+		logger.Error("creating exec", zap.Error(err))
+		return err
+	}
+
+	conn, output, err := c.hijack(ctx, "/exec/"+created.ID+"/start", map[string]any{"Detach": false, "Tty": isPty})
+	if err != nil {
+		logger.Error("starting exec", zap.Error(err))
+		return err
+	}
+	defer conn.Close()
+	// the connection is closed once the client goes away, which ends the copies below
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	logger.Info("running session in container", zap.String("container_id", id), zap.Strings("command", cmd))
+
+	go func() {
+		io.Copy(conn, sess) //nolint:errcheck
+		// forward the EOF of the channel
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite() //nolint:errcheck
+		}
+	}()
+	if isPty {
+		go func() {
+			for win := range winCh {
+				path := fmt.Sprintf("/exec/%s/resize?h=%d&w=%d", created.ID, win.Height, win.Width)
+				if _, err := c.call(ctx, http.MethodPost, path, nil, nil); err != nil {
+					logger.Debug("resizing exec", zap.Error(err))
+				}
+			}
+		}()
+		_, err = io.Copy(sess, output)
+	} else {
+		err = demux(sess, sess.Stderr(), output)
+	}
+	if err != nil {
+		logger.Debug("copying output", zap.Error(err))
+	}
+
+	// the session may be over, so the process is inspected apart from it
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), containerCleanupTimeout)
+	defer cancel()
+	var inspect struct {
+		ExitCode int
+		Running  bool
+		Pid      int
+	}
+	if _, err := c.call(cleanupCtx, http.MethodGet, "/exec/"+created.ID+"/json", nil, &inspect); err != nil {
+		logger.Error("inspecting exec", zap.Error(err))
+		return err
+	}
+	if inspect.Running && ctx.Err() != nil {
+		// the engine keeps the process running once its client goes away
+		if err := killExec(id, inspect.Pid); err != nil {
+			logger.Error("killing exec", zap.Error(err))
+		}
+		return ctx.Err()
+	}
+	if inspect.ExitCode != 0 {
+		return &session.ExitError{Status: uint32(inspect.ExitCode)} //nolint:gosec
+	}
+	return nil
+}
+
+// acquire ensures the container runs and counts the session in it. Only the sessions of the same
+// container wait on each other.
+func (c Container) acquire(ctx context.Context, name string, repl *caddy.Replacer) (*containerRef, string, error) {
+	ref := c.containers.hold(name)
+	ref.mu.Lock()
+	defer ref.mu.Unlock()
+	id, err := c.ensureContainer(ctx, name, repl)
+	if err != nil {
+		c.containers.put(name, ref)
+		return nil, "", err
+	}
+	ref.sessions++
+	return ref, id, nil
+}
+
+// release uncounts the session, and removes the container if it was the last session and `remove` is set
+func (c Container) release(name string, ref *containerRef, id string, logger *zap.Logger) {
+	defer c.containers.put(name, ref)
+	ref.mu.Lock()
+	defer ref.mu.Unlock()
+	ref.sessions--
+	if ref.sessions > 0 || !c.Remove {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), containerCleanupTimeout)
+	defer cancel()
+	if _, err := c.call(ctx, http.MethodDelete, "/containers/"+id+"?force=true", nil, nil); err != nil {
+		logger.Error("removing container", zap.Error(err))
+		return
+	}
+	logger.Info("removed container", zap.String("container_id", id))
+}
+
+// ensureContainer creates the container unless it exists, and starts it unless it runs
+func (c Container) ensureContainer(ctx context.Context, name string, repl *caddy.Replacer) (string, error) {
+	var inspect struct {
+		ID    string `json:"Id"`
+		State struct {
+			Running bool
+		}
+	}
+	status, err := c.call(ctx, http.MethodGet, "/containers/"+url.PathEscape(name)+"/json", nil, &inspect)
+	if status == http.StatusNotFound {
+		binds := make([]string, 0, len(c.Binds))
+		for _, b := range c.Binds {
+			binds = append(binds, repl.ReplaceAll(b, ""))
+		}
+		// the shell waiting on the open input keeps the container running
+		config := map[string]any{
+			"Image":     repl.ReplaceAll(c.Image, ""),
+			"Cmd":       c.Shell,
+			"Tty":       true,
+			"OpenStdin": true,
+			"Labels":    map[string]string{"kadeessh.user": repl.ReplaceAll("{ssh.user}", "")},
+			"HostConfig": map[string]any{
+				"Binds": binds,
+			},
+		}
+		var created struct {
+			ID string `json:"Id"`
+		}
+		if _, err := c.call(ctx, http.MethodPost, "/containers/create?name="+url.QueryEscape(name), config, &created); err != nil {
+			return "", err
+		}
+		inspect.ID = created.ID
+	} else if err != nil {
+		return "", err
+	}
+	if !inspect.State.Running {
+		if _, err := c.call(ctx, http.MethodPost, "/containers/"+inspect.ID+"/start", nil, nil); err != nil {
+			return "", err
+		}
+	}
+	return inspect.ID, nil
+}
+
+// call sends the request to the engine, and decodes the JSON response into out unless it's nil.
+// It returns the status code of the response, which is set along with an error for the error responses.
+func (c Container) call(ctx context.Context, method, path string, in, out any) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://engine"+path, body)
+	if err != nil {
+		return 0, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return resp.StatusCode, engineError(req, resp)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("decoding response of %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// hijack sends the request upgrading the connection to the raw stream of the process, and returns the
+// connection along with the reader of the output
+func (c Container) hijack(ctx context.Context, path string, in any) (net.Conn, io.Reader, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", c.Socket)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://engine"+path, bytes.NewReader(b))
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	// older engines respond with 200 rather than upgrading the connection
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		defer conn.Close()
+		return nil, nil, engineError(req, resp)
+	}
+	return conn, br, nil
+}
+
+// engineError returns the error of the engine's response
+func engineError(req *http.Request, resp *http.Response) error {
+	var e struct {
+		Message string `json:"message"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&e)
+	return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, e.Message)
+}
+
+// demux copies the output of a process without a TTY, which the engine multiplexes in frames
+// of a header, marking the stream and the size, and the data
+func demux(stdout, stderr io.Writer, r io.Reader) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		if _, err := io.CopyN(w, r, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package actors
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// killExec kills the process of the exec by its PID on the host. The process is only killed if it's in the
+// cgroup of the container, as the engine may run in another PID namespace than the server.
+func killExec(containerID string, pid int) error {
+	if pid <= 0 {
+		return fmt.Errorf("unknown PID %d", pid)
+	}
+	// the pidfd holds on to the process, so the PID can't be reused between the check and the signal
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		return fmt.Errorf("opening the process: %v", err)
+	}
+	defer unix.Close(fd)
+	cgroup, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return fmt.Errorf("reading the cgroup of the process: %v", err)
+	}
+	if !strings.Contains(string(cgroup), containerID) {
+		return fmt.Errorf("process %d isn't in the container", pid)
+	}
+	return unix.PidfdSendSignal(fd, unix.SIGKILL, nil, 0)
+}
@@ -0,0 +1,36 @@
+package actors
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestKillExec(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Skip("no sleep:", err)
+	}
+	defer cmd.Process.Kill() //nolint:errcheck
+	pid := cmd.Process.Pid
+
+	if err := killExec("0123456789abcdef", pid); err == nil {
+		t.Fatal("killed a process outside of the container")
+	}
+	// the cgroup of the process stands in for the one of the container
+	cgroup, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := killExec(strings.TrimSpace(string(cgroup)), pid); err != nil {
+		t.Fatalf("killExec() = %v", err)
+	}
+	if err := cmd.Wait(); err == nil || !strings.Contains(err.Error(), "killed") {
+		t.Errorf("Wait() = %v; want the process killed", err)
+	}
+	if err := killExec("0123456789abcdef", 0); err == nil {
+		t.Error("killed an unknown PID")
+	}
+}
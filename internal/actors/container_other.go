@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package actors
+
+import "errors"
+
+// killExec refuses to kill the process, as the cgroup of the process can't be checked
+func killExec(string, int) error {
+	return errors.New("killing the processes of containers is only supported on linux")
+}
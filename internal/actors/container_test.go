@@ -0,0 +1,345 @@
+package actors
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// testEngine stands in for a container engine, whose processes report the input, the command, and
+// the window size of their TTY. With hang set, the processes ignore their input and keep running silently
+// until the test ends.
+type testEngine struct {
+	hang      bool
+	inspected bool
+	done      chan struct{}
+	mu        sync.Mutex
+	exists    bool
+	running   bool
+	created   map[string]any
+	execs     []map[string]any
+	resizes   []string
+	removed   bool
+	resizeCh  chan string
+	exitCodes map[string]int
+}
+
+// serveTestEngine serves the engine on a Unix socket until the test ends, and returns the path of the socket
+func serveTestEngine(t *testing.T, e *testEngine) string {
+	t.Helper()
+	e.resizeCh = make(chan string, 8)
+	e.exitCodes = make(map[string]int)
+	e.done = make(chan struct{})
+	socket := filepath.Join(t.TempDir(), "engine.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /containers/{name}/json", func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if !e.exists || r.PathValue("name") != "kadeessh-alice" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "No such container"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"Id": "c1", "State": {"Running": %t}}`, e.running)
+	})
+	mux.HandleFunc("POST /containers/create", func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if err := json.NewDecoder(r.Body).Decode(&e.created); err != nil || r.URL.Query().Get("name") != "kadeessh-alice" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		e.exists = true
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"Id": "c1"}`)
+	})
+	mux.HandleFunc("POST /containers/c1/start", func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.running = true
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("DELETE /containers/c1", func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.exists, e.running, e.removed = false, false, r.URL.Query().Get("force") == "true"
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /containers/c1/exec", func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		var config map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil || !e.running {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		e.execs = append(e.execs, config)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id": "e%d"}`, len(e.execs))
+	})
+	mux.HandleFunc("POST /exec/{id}/resize", func(w http.ResponseWriter, r *http.Request) {
+		size := r.URL.Query().Get("w") + "x" + r.URL.Query().Get("h")
+		e.mu.Lock()
+		e.resizes = append(e.resizes, size)
+		e.mu.Unlock()
+		e.resizeCh <- size
+	})
+	mux.HandleFunc("GET /exec/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		code, exited := e.exitCodes[r.PathValue("id")]
+		e.inspected = true
+		fmt.Fprintf(w, `{"ExitCode": %d, "Running": %t}`, code, !exited)
+	})
+	mux.HandleFunc("POST /exec/{id}/start", e.startExec)
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		close(e.done)
+		srv.Close()
+	})
+	return socket
+}
+
+// startExec runs the process on the hijacked connection
+func (e *testEngine) startExec(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var start struct{ Tty bool }
+	if err := json.NewDecoder(r.Body).Decode(&start); err != nil || r.Header.Get("Upgrade") != "tcp" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprint(rw, "HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	rw.Flush()
+
+	e.mu.Lock()
+	cmd := e.execs[len(e.execs)-1]["Cmd"]
+	e.mu.Unlock()
+	if start.Tty {
+		// the process prompts once its TTY is sized, and ends once the client resizes the window
+		for size := range e.resizeCh {
+			if size == "132x50" {
+				fmt.Fprintf(conn, "%v resized to %s", cmd, size)
+				e.mu.Lock()
+				e.exitCodes[id] = 0
+				e.mu.Unlock()
+				return
+			}
+			fmt.Fprint(conn, "$ ")
+		}
+	}
+	if e.hang {
+		<-e.done
+		return
+	}
+	input, _ := io.ReadAll(rw)
+	frame := func(stream byte, data string) {
+		header := make([]byte, 8)
+		header[0] = stream
+		binary.BigEndian.PutUint32(header[4:], uint32(len(data))) //nolint:gosec
+		conn.Write(append(header, data...))                       //nolint:errcheck
+	}
+	frame(1, fmt.Sprintf("%v ", cmd))
+	frame(2, "warning")
+	frame(1, string(input))
+	e.mu.Lock()
+	e.exitCodes[id] = 3
+	e.mu.Unlock()
+}
+
+func newTestContainer(t *testing.T, socket string) *Container {
+	t.Helper()
+	c := &Container{
+		Socket: socket,
+		Image:  "alpine:{ssh.user}",
+		Binds:  []string{"/srv/{ssh.user}:/home/{ssh.user}"},
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := c.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestContainerRunsCommand(t *testing.T) {
+	e := &testEngine{}
+	c := newTestContainer(t, serveTestEngine(t, e))
+	c.Remove = true
+	sess, err := dialTestActor(t, c).NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	var stdout, stderr bytes.Buffer
+	sess.Stdout, sess.Stderr = &stdout, &stderr
+	sess.Stdin = strings.NewReader("input")
+	err = sess.Run("uname -a")
+	var exitErr *gossh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Fatalf("Run() error = %v; want the exit status 3", err)
+	}
+	if want := "[/bin/sh -c uname -a] input"; stdout.String() != want {
+		t.Errorf("stdout = %q; want %q", stdout.String(), want)
+	}
+	if want := "warning"; stderr.String() != want {
+		t.Errorf("stderr = %q; want %q", stderr.String(), want)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.created["Image"] != "alpine:alice" || !reflect.DeepEqual(e.created["HostConfig"], map[string]any{"Binds": []any{"/srv/alice:/home/alice"}}) {
+		t.Errorf("created container = %v", e.created)
+	}
+	if len(e.execs) != 1 || e.execs[0]["Tty"] != false {
+		t.Errorf("execs = %v; want one without a TTY", e.execs)
+	}
+	if !e.removed {
+		t.Error("the container wasn't removed after the last session")
+	}
+}
+
+func TestContainerResizesTTY(t *testing.T) {
+	e := &testEngine{exists: true}
+	c := newTestContainer(t, serveTestEngine(t, e))
+	sess, err := dialTestActor(t, c).NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.RequestPty("xterm", 40, 80, gossh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	prompt := make([]byte, 2)
+	if _, err := io.ReadFull(stdout, prompt); err != nil || string(prompt) != "$ " {
+		t.Fatalf("reading the prompt: %q, %v", prompt, err)
+	}
+	if err := sess.WindowChange(50, 132); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(stdout)
+	if err := sess.Wait(); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if want := "[/bin/sh] resized to 132x50"; string(out) != want {
+		t.Errorf("stdout = %q; want %q", out, want)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.created != nil || !e.running {
+		t.Errorf("the stopped container wasn't reused: created %v, running %t", e.created, e.running)
+	}
+	if want := []string{"80x40", "132x50"}; !reflect.DeepEqual(e.resizes, want) {
+		t.Errorf("resizes = %v; want %v", e.resizes, want)
+	}
+	if len(e.execs) != 1 || e.execs[0]["Tty"] != true || !reflect.DeepEqual(e.execs[0]["Env"], []any{"TERM=xterm"}) {
+		t.Errorf("execs = %v; want one with a TTY", e.execs)
+	}
+	if e.removed {
+		t.Error("the container was removed without remove set")
+	}
+}
+
+func TestContainerEndsWithClient(t *testing.T) {
+	e := &testEngine{hang: true}
+	c := newTestContainer(t, serveTestEngine(t, e))
+	c.Remove = true
+	client := dialTestActor(t, c)
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.StdinPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Start("sleep infinity"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			e.mu.Lock()
+			ok := cond()
+			e.mu.Unlock()
+			if ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("the exec", func() bool { return len(e.execs) == 1 })
+	client.Close()
+
+	// the process is inspected, and the container removed, although the session is gone
+	waitFor("the removal of the container", func() bool { return e.removed })
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.inspected {
+		t.Error("the exec wasn't inspected")
+	}
+	c.containers.mu.Lock()
+	defer c.containers.mu.Unlock()
+	if len(c.containers.refs) != 0 {
+		t.Errorf("refs = %v; want none once the session ended", c.containers.refs)
+	}
+}
+
+func TestContainerRefusesUnsafeUser(t *testing.T) {
+	e := &testEngine{}
+	c := newTestContainer(t, serveTestEngine(t, e))
+	for _, user := range []string{"..", "../etc", "alice/.."} {
+		sess, err := dialTestActorAs(t, c, user).NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exitErr *gossh.ExitError
+		if err := sess.Run("id"); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+			t.Errorf("Run() as %q error = %v; want the exit status 1", user, err)
+		}
+		sess.Close()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.created != nil || len(e.execs) != 0 {
+		t.Errorf("created container = %v, execs = %v; want none", e.created, e.execs)
+	}
+}
@@ -0,0 +1,273 @@
+package actors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const defaultProxyDialTimeout = 10 * time.Second
+
+func init() {
+	caddy.RegisterModule(Proxy{})
+}
+
+var (
+	_ caddy.Provisioner = (*Proxy)(nil)
+	_ caddy.Validator   = (*Proxy)(nil)
+	_ session.Handler   = Proxy{}
+)
+
+// Proxy is an actor terminating the session and re-originating it as a new SSH session to an upstream
+// server. It relays the PTY request, the window changes, the environment variables, the signals, the
+// command or subsystem, and the exit status or signal of the upstream session. Since the session is terminated by
+// the server, wrapping the actor with `asciinema_recorder` records the sessions to hosts not running kadeessh.
+//
+// The actor authenticates to the upstream with a private key held by the server, the agent forwarded by
+// the client, or both, and verifies the host key of the upstream against the `known_hosts` files.
+type Proxy struct {
+	// The address of the upstream, which may use the session placeholders, e.g. `{ssh.user}.internal:22`.
+	// The port defaults to 22. Required.
+	Upstream string `json:"upstream,omitempty"`
+
+	// The user on the upstream, which may use the session placeholders. Defaults to `{ssh.user}`.
+	User string `json:"user,omitempty"`
+
+	// The path of the private key used to authenticate to the upstream, which may use the session placeholders.
+	// The sessions of users whose names can't be part of a path, e.g. `..`, are refused.
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+
+	// Authenticate to the upstream with the keys of the agent forwarded by the client, if the client
+	// forwarded its agent and the `agent_forwarding` module of the server allowed it
+	ForwardedAgent bool `json:"forwarded_agent,omitempty"`
+
+	// The paths of the files, in the `known_hosts` format of OpenSSH, listing the host keys of the upstreams.
+	// Required.
+	KnownHosts []string `json:"known_hosts,omitempty"`
+
+	// The timeout of connecting to the upstream, including the handshake. Defaults to 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+
+	hostKeyCallback gossh.HostKeyCallback
+	logger          *zap.Logger
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (p Proxy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "ssh.actors.proxy",
+		New: func() caddy.Module {
+			return new(Proxy)
+		},
+	}
+}
+
+// Provision sets up the defaults and loads the known hosts
+func (p *Proxy) Provision(ctx caddy.Context) error {
+	p.logger = ctx.Logger(p)
+	if p.User == "" {
+		p.User = "{ssh.user}"
+	}
+	if p.DialTimeout == 0 {
+		p.DialTimeout = caddy.Duration(defaultProxyDialTimeout)
+	}
+	if len(p.KnownHosts) > 0 {
+		cb, err := knownhosts.New(p.KnownHosts...)
+		if err != nil {
+			return fmt.Errorf("loading known_hosts: %v", err)
+		}
+		p.hostKeyCallback = cb
+	}
+	return nil
+}
+
+// Validate ensures the upstream, the known hosts, and an authentication method are defined
+func (p *Proxy) Validate() error {
+	if strings.TrimSpace(p.Upstream) == "" {
+		return errors.New("proxy: upstream is required")
+	}
+	if len(p.KnownHosts) == 0 {
+		return errors.New("proxy: known_hosts is required")
+	}
+	if p.PrivateKeyFile == "" && !p.ForwardedAgent {
+		return errors.New("proxy: either private_key_file or forwarded_agent is required")
+	}
+	return nil
+}
+
+// Handle relays the session to the upstream and reports the exit status or signal of the upstream session
+func (p Proxy) Handle(sess session.Session) error {
+	sessionID, _ := sess.Context().Value(ssh.ContextKeySessionID).(string)
+	repl := session.NewReplacer(sess)
+	addr := repl.ReplaceAll(p.Upstream, "")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	user := repl.ReplaceAll(p.User, "")
+	logger := p.logger.With(
+		zap.String("session_id", sessionID),
+		zap.String("user", sess.User()),
+		zap.String("remote_ip", sess.RemoteAddr().String()),
+		zap.String("upstream", addr),
+		zap.String("upstream_user", user),
+	)
+
+	auth, cleanup, err := p.authMethods(sess, repl)
+	if err != nil {
+		logger.Error("preparing upstream authentication", zap.Error(err))
+		fmt.Fprintln(sess.Stderr(), "proxy: upstream authentication unavailable")
+		return err
+	}
+	defer cleanup()
+
+	client, err := p.dial(sess.Context(), addr, &gossh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: p.hostKeyCallback,
+		Timeout:         time.Duration(p.DialTimeout),
+	})
+	if err != nil {
+		logger.Error("connecting to upstream", zap.Error(err))
+		fmt.Fprintln(sess.Stderr(), "proxy: connecting to upstream failed")
+		return err
+	}
+	defer client.Close()
+
+	upstream, err := client.NewSession()
+	if err != nil {
+		logger.Error("opening upstream session", zap.Error(err))
+		return err
+	}
+	defer upstream.Close()
+
+	for _, env := range sess.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		// the upstream may refuse the variable, as OpenSSH does unless it's accepted by `AcceptEnv`
+		_ = upstream.Setenv(name, value)
+	}
+	if ptyReq, winCh, ok := sess.Pty(); ok {
+		if err := upstream.RequestPty(ptyReq.Term, ptyReq.Window.Height, ptyReq.Window.Width, gossh.TerminalModes{}); err != nil {
+			logger.Error("requesting upstream pty", zap.Error(err))
+			return err
+		}
+		go func() {
+			for win := range winCh {
+				_ = upstream.WindowChange(win.Height, win.Width)
+			}
+		}()
+	}
+	signals := make(chan ssh.Signal, 1)
+	sess.Signals(signals)
+	defer func() {
+		sess.Signals(nil)
+		close(signals)
+	}()
+	go func() {
+		for sig := range signals {
+			_ = upstream.Signal(gossh.Signal(sig))
+		}
+	}()
+
+	stdin, err := upstream.StdinPipe()
+	if err != nil {
+		return err
+	}
+	go func() {
+		_, _ = io.Copy(stdin, sess)
+		stdin.Close()
+	}()
+	upstream.Stdout = sess
+	upstream.Stderr = sess.Stderr()
+
+	switch {
+	case sess.Subsystem() != "":
+		err = upstream.RequestSubsystem(sess.Subsystem())
+	case sess.RawCommand() != "":
+		err = upstream.Start(sess.RawCommand())
+	default:
+		err = upstream.Shell()
+	}
+	if err != nil {
+		logger.Error("starting upstream session", zap.Error(err))
+		return err
+	}
+	logger.Info("proxying session")
+
+	err = upstream.Wait()
+	var exitErr *gossh.ExitError
+	if errors.As(err, &exitErr) {
+		return &session.ExitError{
+			Status:  uint32(exitErr.ExitStatus()), //nolint:gosec
+			Signal:  ssh.Signal(exitErr.Signal()),
+			Message: exitErr.Msg(),
+		}
+	}
+	return err
+}
+
+// authMethods returns the methods authenticating to the upstream, and the function releasing their resources
+func (p Proxy) authMethods(sess session.Session, repl *caddy.Replacer) ([]gossh.AuthMethod, func(), error) {
+	var methods []gossh.AuthMethod
+	cleanup := func() {}
+	if p.PrivateKeyFile != "" {
+		// the username may be expanded into the path of the key
+		if err := session.CheckPathSafeUser(sess.User()); err != nil {
+			return nil, cleanup, err
+		}
+		pemBytes, err := os.ReadFile(repl.ReplaceAll(p.PrivateKeyFile, ""))
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("reading private key: %v", err)
+		}
+		signer, err := gossh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("parsing private key: %v", err)
+		}
+		methods = append(methods, gossh.PublicKeys(signer))
+	}
+	if p.ForwardedAgent && ssh.AgentRequestedContext(sess.Context()) {
+		conn, err := ssh.DialAgentContext(sess.Context())
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("connecting to the forwarded agent: %v", err)
+		}
+		cleanup = func() { conn.Close() }
+		methods = append(methods, gossh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	if len(methods) == 0 {
+		return nil, cleanup, errors.New("no authentication method available for the upstream")
+	}
+	return methods, cleanup, nil
+}
+
+// dial connects to the upstream, giving up when the session ends
+func (p Proxy) dial(ctx context.Context, addr string, config *gossh.ClientConfig) (*gossh.Client, error) {
+	dialer := net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// the client config timeout only covers the TCP connection
+	_ = conn.SetDeadline(time.Now().Add(config.Timeout))
+	c, chans, reqs, err := gossh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return gossh.NewClient(c, chans, reqs), nil
+}
@@ -0,0 +1,228 @@
+package actors
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestSigner(t *testing.T) (gossh.Signer, ed25519.PrivateKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, key
+}
+
+// serveTestSSH serves the handler on a loopback listener until the test ends
+func serveTestSSH(t *testing.T, srv *ssh.Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// newTestProxy starts an upstream running the handler, and returns a proxy to it authenticating with
+// a key held by the server, and verifying the upstream against a known_hosts file of the given host key
+func newTestProxy(t *testing.T, handler ssh.Handler, knownHostKey func(upstream gossh.Signer) gossh.PublicKey) Proxy {
+	t.Helper()
+	dir := t.TempDir()
+	hostSigner, _ := newTestSigner(t)
+	clientSigner, clientKey := newTestSigner(t)
+
+	upstream := &ssh.Server{
+		Handler: handler,
+		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
+			return ctx.User() == "upstream-alice" && ssh.KeysEqual(key, clientSigner.PublicKey())
+		},
+	}
+	upstream.AddHostKey(hostSigner)
+	addr := serveTestSSH(t, upstream)
+
+	block, err := gossh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "alice_key"), pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, knownHostKey(hostSigner))
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Proxy{
+		Upstream:        addr,
+		User:            "upstream-{ssh.user}",
+		PrivateKeyFile:  filepath.Join(dir, "{ssh.user}_key"),
+		KnownHosts:      []string{knownHosts},
+		DialTimeout:     caddy.Duration(5 * time.Second),
+		hostKeyCallback: hostKeyCallback,
+		logger:          zap.NewNop(),
+	}
+}
+
+// dialTestActor dials a server acting with the handler as alice, and reports the exit errors of the handler
+func dialTestActor(t *testing.T, h session.Handler) *gossh.Client {
+	t.Helper()
+	return dialTestActorAs(t, h, "alice")
+}
+
+// dialTestActorAs connects as the user to a server acting with the handler
+func dialTestActorAs(t *testing.T, h session.Handler, user string) *gossh.Client {
+	t.Helper()
+	hostSigner, _ := newTestSigner(t)
+	front := &ssh.Server{
+		Handler: func(sess ssh.Session) {
+			err := h.Handle(sess)
+			var exitErr *session.ExitError
+			switch {
+			case errors.As(err, &exitErr) && exitErr.Signal != "":
+				sess.ExitSignal(exitErr.Signal, exitErr.CoreDumped, exitErr.Message)
+			case errors.As(err, &exitErr):
+				sess.Exit(int(exitErr.Status))
+			case err != nil:
+				sess.Exit(1)
+			default:
+				sess.Exit(0)
+			}
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool { return true },
+	}
+	front.AddHostKey(hostSigner)
+	addr := serveTestSSH(t, front)
+
+	client, err := gossh.Dial("tcp", addr, &gossh.ClientConfig{
+		User:            user,
+		Auth:            []gossh.AuthMethod{gossh.Password("secret")},
+		HostKeyCallback: gossh.FixedHostKey(hostSigner.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// runThroughProxy runs the command through a server acting with the proxy, and returns the output and the exit error
+func runThroughProxy(t *testing.T, p Proxy, cmd string) (string, string, error) {
+	t.Helper()
+	client := dialTestActor(t, p)
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.Setenv("GREETING", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	sess.Stdout, sess.Stderr = &stdout, &stderr
+	sess.Stdin = strings.NewReader("input")
+	err = sess.Run(cmd)
+	return stdout.String(), stderr.String(), err
+}
+
+func TestProxyRelaysSession(t *testing.T) {
+	p := newTestProxy(t, func(s ssh.Session) {
+		input, _ := io.ReadAll(s)
+		fmt.Fprintf(s, "%s %s %s", s.User(), s.RawCommand(), input)
+		fmt.Fprint(s.Stderr(), strings.Join(s.Environ(), ","))
+		s.Exit(3)
+	}, gossh.Signer.PublicKey)
+
+	stdout, stderr, err := runThroughProxy(t, p, "uname -a")
+	var exitErr *gossh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+		t.Fatalf("Run() error = %v; want the exit status 3", err)
+	}
+	if want := "upstream-alice uname -a input"; stdout != want {
+		t.Errorf("stdout = %q; want %q", stdout, want)
+	}
+	if want := "GREETING=hello"; stderr != want {
+		t.Errorf("stderr = %q; want %q", stderr, want)
+	}
+}
+
+func TestProxyRelaysExitSignal(t *testing.T) {
+	p := newTestProxy(t, func(s ssh.Session) {
+		s.ExitSignal(ssh.SIGTERM, false, "terminated")
+	}, gossh.Signer.PublicKey)
+
+	_, _, err := runThroughProxy(t, p, "sleep 60")
+	var exitErr *gossh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Signal() != string(ssh.SIGTERM) || exitErr.Msg() != "terminated" {
+		t.Fatalf("Run() error = %v; want the exit signal TERM", err)
+	}
+}
+
+func TestProxyRejectsUnknownHostKey(t *testing.T) {
+	other, _ := newTestSigner(t)
+	p := newTestProxy(t, func(s ssh.Session) {
+		t.Error("the session reached an upstream with an unknown host key")
+	}, func(gossh.Signer) gossh.PublicKey { return other.PublicKey() })
+
+	_, stderr, err := runThroughProxy(t, p, "id")
+	var exitErr *gossh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Fatalf("Run() error = %v; want the exit status 1", err)
+	}
+	if !strings.Contains(stderr, "connecting to upstream failed") {
+		t.Errorf("stderr = %q; want the connection failure", stderr)
+	}
+}
+
+func TestProxyRefusesUnsafeUser(t *testing.T) {
+	p := newTestProxy(t, func(s ssh.Session) {
+		t.Error("the session reached the upstream with the key of another user")
+	}, gossh.Signer.PublicKey)
+	p.User = "upstream-alice"
+	// the path of the key of the user resolves to the one of alice
+	if err := os.Mkdir(filepath.Join(filepath.Dir(p.PrivateKeyFile), "mallory"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := dialTestActorAs(t, p, "mallory/../alice").NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	var stderr bytes.Buffer
+	sess.Stderr = &stderr
+	var exitErr *gossh.ExitError
+	if err := sess.Run("id"); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 1 {
+		t.Fatalf("Run() error = %v; want the exit status 1", err)
+	}
+	if !strings.Contains(stderr.String(), "upstream authentication unavailable") {
+		t.Errorf("stderr = %q; want the authentication failure", stderr.String())
+	}
+}
@@ -0,0 +1,562 @@
+package actors
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/pty/passwd"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(SCP{})
+}
+
+var (
+	_ caddy.Provisioner = (*SCP)(nil)
+	_ caddy.Validator   = (*SCP)(nil)
+	_ session.Handler   = SCP{}
+)
+
+// SCP is an actor speaking the SCP protocol natively, without spawning a shell. It serves
+// `scp -t` (sink, i.e. upload) and `scp -f` (source, i.e. download) requests, including the recursive `-r`
+// and the time-preserving `-p` flags, against a root directory. The paths requested by the client are
+// resolved inside the root; `..` components and symbolic links never escape it. Any other command is rejected.
+// Combined with the matchers, e.g. `extension` or `critical_option`, it allows granting file-copy-only
+// access. Note that OpenSSH 9.0+ clients use SFTP by default, and the legacy SCP protocol is requested with `scp -O`.
+type SCP struct {
+	// The root directory of the session. The value may contain the session placeholders,
+	// e.g. `/srv/scp/{ssh.user}`. Required.
+	Root string `json:"root,omitempty"`
+
+	// Reject the uploads
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	logger *zap.Logger
+	pass   passwd.Passwd
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (s SCP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "ssh.actors.scp",
+		New: func() caddy.Module {
+			return new(SCP)
+		},
+	}
+}
+
+// Provision sets up the SCP actor
+func (s *SCP) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger(s)
+	s.pass = passwd.New()
+	return nil
+}
+
+// Validate ensures the root is defined
+func (s *SCP) Validate() error {
+	if strings.TrimSpace(s.Root) == "" {
+		return errors.New("scp: root is required")
+	}
+	return nil
+}
+
+// Handle serves the scp command of the session
+func (s SCP) Handle(sess session.Session) error {
+	sessionID, _ := sess.Context().Value(ssh.ContextKeySessionID).(string)
+	logger := s.logger.With(
+		zap.String("session_id", sessionID),
+		zap.String("user", sess.User()),
+		zap.String("remote_ip", sess.RemoteAddr().String()),
+	)
+
+	opts, err := parseSCPCommand(sess.Command())
+	if err != nil {
+		fmt.Fprintf(sess.Stderr(), "%s\n", err)
+		return err
+	}
+	if opts.sink && s.ReadOnly {
+		err := errors.New("scp: uploads are not permitted")
+		writeSCPError(sess, err)
+		return err
+	}
+	if err := session.CheckPathSafeUser(sess.User()); err != nil {
+		err = fmt.Errorf("scp: %v", err)
+		writeSCPError(sess, err)
+		return err
+	}
+	root, err := os.OpenRoot(filepath.Clean(session.NewReplacer(sess).ReplaceAll(s.Root, "")))
+	if err != nil {
+		writeSCPError(sess, errors.New("scp: root directory unavailable"))
+		return err
+	}
+	defer root.Close()
+
+	c := &scpConn{
+		root:   root,
+		opts:   opts,
+		r:      bufio.NewReader(sess),
+		w:      sess,
+		logger: logger,
+	}
+	if entry := s.pass.Get(sess.User()); entry != nil && runtime.GOOS != "windows" && os.Getuid() != int(entry.UID) { //nolint:gosec
+		c.chown = func(name string) {
+			if err := root.Lchown(name, int(entry.UID), int(entry.GID)); err != nil { //nolint:gosec
+				logger.Warn("changing file ownership", zap.String("path", name), zap.Error(err))
+			}
+		}
+	}
+
+	logger.Info("handling scp session",
+		zap.Bool("sink", opts.sink),
+		zap.Bool("recursive", opts.recursive),
+		zap.Bool("preserve", opts.preserve),
+		zap.Strings("paths", opts.paths),
+	)
+	if opts.sink {
+		err = c.sink()
+	} else {
+		err = c.source()
+	}
+	if err != nil {
+		logger.Error("scp session failed", zap.Error(err))
+	}
+	return err
+}
+
+type scpOptions struct {
+	sink, recursive, preserve, targetIsDir bool
+	paths                                  []string
+}
+
+// parseSCPCommand parses the arguments of the scp command invoked by the client on the remote end
+func parseSCPCommand(args []string) (scpOptions, error) {
+	opts := scpOptions{}
+	if len(args) == 0 || path.Base(args[0]) != "scp" {
+		return opts, errors.New("scp: only scp commands are permitted")
+	}
+	var source bool
+	args = args[1:]
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && args[0] != "-" {
+		arg := args[0]
+		args = args[1:]
+		if arg == "--" {
+			break
+		}
+		for _, f := range arg[1:] {
+			switch f {
+			case 't':
+				opts.sink = true
+			case 'f':
+				source = true
+			case 'r':
+				opts.recursive = true
+			case 'p':
+				opts.preserve = true
+			case 'd':
+				opts.targetIsDir = true
+			case 'v', 'q', 'E':
+				// verbosity and extended attributes are ignored
+			default:
+				return opts, fmt.Errorf("scp: unsupported flag: -%c", f)
+			}
+		}
+	}
+	if opts.sink == source {
+		return opts, errors.New("scp: exactly one of -t or -f is required")
+	}
+	if len(args) == 0 {
+		return opts, errors.New("scp: missing path")
+	}
+	if opts.sink && len(args) > 1 {
+		return opts, errors.New("scp: ambiguous target")
+	}
+	opts.paths = args
+	return opts, nil
+}
+
+// scpConn is one SCP exchange confined to the root
+type scpConn struct {
+	root   *os.Root
+	opts   scpOptions
+	r      *bufio.Reader
+	w      io.Writer
+	chown  func(name string)
+	logger *zap.Logger
+}
+
+// scpRelative resolves the path requested by the client into a path relative to the root
+func scpRelative(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// writeSCPError sends a fatal error to the client
+func writeSCPError(w io.Writer, err error) {
+	fmt.Fprintf(w, "\x02%s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+}
+
+// writeSCPWarning sends a non-fatal error to the client
+func writeSCPWarning(w io.Writer, err error) {
+	fmt.Fprintf(w, "\x01%s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+}
+
+func (c *scpConn) ack() error {
+	_, err := c.w.Write([]byte{0})
+	return err
+}
+
+// readAck reads the response of the client to the last message
+func (c *scpConn) readAck() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch b {
+	case 0:
+		return nil
+	case 1, 2:
+		msg, _ := c.r.ReadString('\n')
+		return fmt.Errorf("scp: client error: %s", strings.TrimSpace(msg))
+	}
+	return fmt.Errorf("scp: unexpected response: %q", b)
+}
+
+// sink receives the files from the client
+func (c *scpConn) sink() error {
+	target := scpRelative(c.opts.paths[0])
+	info, err := c.root.Stat(target)
+	targetIsDir := err == nil && info.IsDir()
+	if c.opts.targetIsDir && !targetIsDir {
+		err := fmt.Errorf("scp: %s: not a directory", c.opts.paths[0])
+		writeSCPError(c.w, err)
+		return err
+	}
+	if err := c.ack(); err != nil {
+		return err
+	}
+
+	type dirEntry struct {
+		name         string
+		atime, mtime time.Time
+		hasTimes     bool
+	}
+	var (
+		dirs                 []dirEntry
+		atime, mtime         time.Time
+		hasTimes, firstEntry = false, true
+	)
+	for {
+		line, err := c.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			if len(dirs) > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case 1:
+			c.logger.Warn("scp client warning", zap.String("message", line[1:]))
+			continue
+		case 2:
+			return fmt.Errorf("scp: client error: %s", line[1:])
+		case 'T':
+			var mt, ma int64
+			var mu, au int64
+			if _, err := fmt.Sscanf(line[1:], "%d %d %d %d", &mt, &mu, &ma, &au); err != nil {
+				writeSCPError(c.w, errors.New("scp: protocol error: invalid times"))
+				return err
+			}
+			mtime, atime, hasTimes = time.Unix(mt, 0), time.Unix(ma, 0), true
+			if err := c.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'E':
+			if len(dirs) == 0 {
+				err := errors.New("scp: protocol error: unexpected end of directory")
+				writeSCPError(c.w, err)
+				return err
+			}
+			d := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if d.hasTimes && c.opts.preserve {
+				if err := c.root.Chtimes(d.name, d.atime, d.mtime); err != nil {
+					c.logger.Warn("setting directory times", zap.String("path", d.name), zap.Error(err))
+				}
+			}
+			if err := c.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			err := fmt.Errorf("scp: protocol error: unexpected message %q", line[0])
+			writeSCPError(c.w, err)
+			return err
+		}
+
+		mode, size, name, err := parseSCPEntry(line[1:])
+		if err != nil {
+			writeSCPError(c.w, err)
+			return err
+		}
+		var dest string
+		switch {
+		case len(dirs) > 0:
+			dest = path.Join(dirs[len(dirs)-1].name, name)
+		case targetIsDir:
+			dest = path.Join(target, name)
+		case firstEntry:
+			// a single file or a directory copied onto a non-existent target takes the target's name
+			dest = target
+		default:
+			err := fmt.Errorf("scp: %s: not a directory", c.opts.paths[0])
+			writeSCPError(c.w, err)
+			return err
+		}
+		firstEntry = false
+
+		if line[0] == 'D' {
+			if !c.opts.recursive {
+				err := errors.New("scp: received directory without -r")
+				writeSCPError(c.w, err)
+				return err
+			}
+			if info, err := c.root.Stat(dest); err == nil && !info.IsDir() {
+				err := fmt.Errorf("scp: %s: not a directory", dest)
+				writeSCPError(c.w, err)
+				return err
+			} else if err != nil {
+				if err := c.root.Mkdir(dest, mode|0o700); err != nil {
+					writeSCPError(c.w, fmt.Errorf("scp: %s: %v", dest, errors.Unwrap(err)))
+					return err
+				}
+				if c.chown != nil {
+					c.chown(dest)
+				}
+			}
+			if c.opts.preserve {
+				_ = c.root.Chmod(dest, mode)
+			}
+			dirs = append(dirs, dirEntry{name: dest, atime: atime, mtime: mtime, hasTimes: hasTimes})
+			hasTimes = false
+			if err := c.ack(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := c.receiveFile(dest, mode, size); err != nil {
+			return err
+		}
+		if hasTimes && c.opts.preserve {
+			if err := c.root.Chtimes(dest, atime, mtime); err != nil {
+				c.logger.Warn("setting file times", zap.String("path", dest), zap.Error(err))
+			}
+		}
+		hasTimes = false
+	}
+}
+
+func (c *scpConn) receiveFile(dest string, mode fs.FileMode, size int64) error {
+	_, statErr := c.root.Lstat(dest)
+	f, err := c.root.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		// the content still has to be consumed to keep the stream in sync
+		if err := c.ack(); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, c.r, size); err != nil {
+			return err
+		}
+		if err := c.readAck(); err != nil {
+			return err
+		}
+		writeSCPWarning(c.w, fmt.Errorf("scp: %s: %v", dest, errors.Unwrap(err)))
+		return nil
+	}
+	defer f.Close()
+	if errors.Is(statErr, fs.ErrNotExist) && c.chown != nil {
+		c.chown(dest)
+	}
+	if err := c.ack(); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, c.r, size); err != nil {
+		return err
+	}
+	if err := c.readAck(); err != nil {
+		return err
+	}
+	if c.opts.preserve {
+		_ = f.Chmod(mode)
+	}
+	if err := f.Close(); err != nil {
+		writeSCPWarning(c.w, fmt.Errorf("scp: %s: %v", dest, err))
+		return nil
+	}
+	return c.ack()
+}
+
+// parseSCPEntry parses the `<mode> <size> <name>` of the C and D messages
+func parseSCPEntry(s string) (fs.FileMode, int64, string, error) {
+	parts := strings.SplitN(s, " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", errors.New("scp: protocol error: invalid entry")
+	}
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errors.New("scp: protocol error: invalid mode")
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", errors.New("scp: protocol error: invalid size")
+	}
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return 0, 0, "", fmt.Errorf("scp: protocol error: invalid name %q", name)
+	}
+	return fs.FileMode(mode) & fs.ModePerm, size, name, nil
+}
+
+// source sends the requested files to the client
+func (c *scpConn) source() error {
+	if err := c.readAck(); err != nil {
+		return err
+	}
+	var failed bool
+	for _, p := range c.opts.paths {
+		rel := scpRelative(p)
+		matches := []string{rel}
+		if strings.ContainsAny(rel, `*?[`) {
+			var err error
+			matches, err = fs.Glob(c.root.FS(), rel)
+			if err != nil || len(matches) == 0 {
+				failed = true
+				writeSCPWarning(c.w, fmt.Errorf("scp: %s: No such file or directory", p))
+				continue
+			}
+		}
+		for _, m := range matches {
+			if err := c.send(m); err != nil {
+				var warn scpWarning
+				if errors.As(err, &warn) {
+					failed = true
+					writeSCPWarning(c.w, err)
+					continue
+				}
+				return err
+			}
+		}
+	}
+	if failed {
+		return errors.New("scp: some files could not be sent")
+	}
+	return nil
+}
+
+// scpWarning is an error about a single file, which doesn't abort the exchange
+type scpWarning struct {
+	error
+}
+
+func (c *scpConn) send(name string) error {
+	info, err := c.root.Stat(name)
+	if err != nil {
+		return scpWarning{fmt.Errorf("scp: %s: No such file or directory", name)}
+	}
+	if info.IsDir() && !c.opts.recursive {
+		return scpWarning{fmt.Errorf("scp: %s: not a regular file", name)}
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return scpWarning{fmt.Errorf("scp: %s: not a regular file", name)}
+	}
+	if c.opts.preserve {
+		if _, err := fmt.Fprintf(c.w, "T%d 0 %d 0\n", info.ModTime().Unix(), info.ModTime().Unix()); err != nil {
+			return err
+		}
+		if err := c.readAck(); err != nil {
+			return err
+		}
+	}
+	base := path.Base(name)
+	if name == "." {
+		base = "."
+		if abs, err := filepath.Abs(c.root.Name()); err == nil {
+			base = filepath.Base(abs)
+		}
+	}
+
+	if info.IsDir() {
+		if _, err := fmt.Fprintf(c.w, "D%04o 0 %s\n", info.Mode().Perm(), base); err != nil {
+			return err
+		}
+		if err := c.readAck(); err != nil {
+			return err
+		}
+		entries, err := fs.ReadDir(c.root.FS(), name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := c.send(path.Join(name, e.Name())); err != nil {
+				var warn scpWarning
+				if errors.As(err, &warn) {
+					writeSCPWarning(c.w, err)
+					continue
+				}
+				return err
+			}
+		}
+		if _, err := fmt.Fprint(c.w, "E\n"); err != nil {
+			return err
+		}
+		return c.readAck()
+	}
+
+	f, err := c.root.Open(name)
+	if err != nil {
+		return scpWarning{fmt.Errorf("scp: %s: %v", name, errors.Unwrap(err))}
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(c.w, "C%04o %d %s\n", info.Mode().Perm(), info.Size(), base); err != nil {
+		return err
+	}
+	if err := c.readAck(); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(c.w, f, info.Size()); err != nil {
+		return err
+	}
+	if err := c.ack(); err != nil {
+		return err
+	}
+	return c.readAck()
+}
@@ -0,0 +1,154 @@
+package actors
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newTestSCPConn(t *testing.T, dir string, opts scpOptions, input string) (*scpConn, *bytes.Buffer) {
+	t.Helper()
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+	out := &bytes.Buffer{}
+	return &scpConn{
+		root:   root,
+		opts:   opts,
+		r:      bufio.NewReader(strings.NewReader(input)),
+		w:      out,
+		logger: zap.NewNop(),
+	}, out
+}
+
+func TestParseSCPCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    scpOptions
+		wantErr bool
+	}{
+		{
+			name: "sink",
+			args: []string{"scp", "-t", "uploads"},
+			want: scpOptions{sink: true, paths: []string{"uploads"}},
+		},
+		{
+			name: "recursive source preserving times",
+			args: []string{"/usr/bin/scp", "-rpf", "--", "-dir"},
+			want: scpOptions{recursive: true, preserve: true, paths: []string{"-dir"}},
+		},
+		{
+			name:    "other commands are rejected",
+			args:    []string{"bash", "-c", "id"},
+			wantErr: true,
+		},
+		{
+			name:    "both directions",
+			args:    []string{"scp", "-t", "-f", "file"},
+			wantErr: true,
+		},
+		{
+			name:    "missing path",
+			args:    []string{"scp", "-f"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSCPCommand(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSCPCommand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSCPCommand() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSCPSink(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	input := "D0755 0 docs\n" +
+		"T" + strconv.FormatInt(mtime.Unix(), 10) + " 0 " + strconv.FormatInt(mtime.Unix(), 10) + " 0\n" +
+		"C0644 5 a.txt\nhello\x00" +
+		"E\n" +
+		"C0600 3 b.txt\nabc\x00"
+	c, out := newTestSCPConn(t, dir, scpOptions{sink: true, recursive: true, preserve: true, paths: []string{"/../.."}}, input)
+	if err := c.sink(); err != nil {
+		t.Fatalf("sink() error = %v", err)
+	}
+	// ready, D, T, C header, C content, E, C header, C content
+	if got := out.String(); got != strings.Repeat("\x00", 8) {
+		t.Errorf("unexpected acks: %q", got)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "docs", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("content = %q, want %q", got, "hello")
+	}
+	info, err := os.Stat(filepath.Join(dir, "docs", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Errorf("mtime = %v, want %v", info.ModTime(), mtime)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, "b.txt")); err != nil || string(got) != "abc" {
+		t.Errorf("content = %q, %v, want %q", got, err, "abc")
+	}
+}
+
+func TestSCPSink_RejectsTraversingNames(t *testing.T) {
+	dir := t.TempDir()
+	c, out := newTestSCPConn(t, dir, scpOptions{sink: true, paths: []string{"."}}, "C0644 5 ../a.txt\nhello\x00")
+	if err := c.sink(); err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.HasPrefix(out.String(), "\x00\x02") {
+		t.Errorf("expected a fatal error to the client, got %q", out.String())
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "a.txt")); err == nil {
+		t.Error("file written outside the root")
+	}
+}
+
+func TestSCPSource(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "docs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docs", "a.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c, out := newTestSCPConn(t, dir, scpOptions{recursive: true, paths: []string{"docs"}}, strings.Repeat("\x00", 10))
+	if err := c.source(); err != nil {
+		t.Fatalf("source() error = %v", err)
+	}
+	want := "D0755 0 docs\nC0644 5 a.txt\nhello\x00E\n"
+	if got := out.String(); got != want {
+		t.Errorf("source() sent %q, want %q", got, want)
+	}
+
+	c, out = newTestSCPConn(t, dir, scpOptions{paths: []string{"docs"}}, strings.Repeat("\x00", 10))
+	if err := c.source(); err == nil {
+		t.Error("expected an error sending a directory without -r")
+	}
+	if !strings.HasPrefix(out.String(), "\x01") {
+		t.Errorf("expected a warning to the client, got %q", out.String())
+	}
+}
@@ -0,0 +1,564 @@
+package actors
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultShadowBanner    = "*** {ssh.shadow.observer} is watching this session ({ssh.shadow.mode}) ***"
+	defaultShadowEndBanner = "*** {ssh.shadow.observer} stopped watching this session ***"
+
+	// shadowObserverQueue is the number of output chunks queued for an observer before it's
+	// detached for falling behind, so a slow observer never stalls the shadowed session
+	shadowObserverQueue = 256
+
+	// shadowDetachKey is Ctrl-], which detaches the observers attached with the `shadow_watch` actor
+	shadowDetachKey = 0x1d
+)
+
+var (
+	// ErrShadowEnded is reported by the observers of a shadowed session which ended
+	ErrShadowEnded = errors.New("the shadowed session ended")
+
+	// ErrShadowTooSlow is reported by the observers detached for not keeping up with the output of the session
+	ErrShadowTooSlow = errors.New("the observer fell behind the output of the session")
+)
+
+func init() {
+	caddy.RegisterModule(Shadow{})
+	caddy.RegisterModule(ShadowWatch{})
+}
+
+var (
+	_ caddy.Provisioner = (*Shadow)(nil)
+	_ session.Handler   = Shadow{}
+	_ caddy.Provisioner = (*ShadowWatch)(nil)
+	_ session.Handler   = ShadowWatch{}
+
+	_ session.EchoReporter = (*shadowingSession)(nil)
+)
+
+// shadowedSessions are the live shadowed sessions, shared by the shadow actors of all the configurations
+// so the observers find them across config reloads
+var shadowedSessions = struct {
+	sync.Mutex
+	m map[string]*shadowedSession
+}{m: make(map[string]*shadowedSession)}
+
+// Shadow is an actor wrapping another handler to multicast the live output of the PTY sessions to the
+// observers attached with the `shadow_watch` actor, e.g. `ssh admin@host watch <id>`, or with the websocket
+// of the admin API at `/ssh/shadow/<id>`. A shadowed session is identified by the session ID of its connection,
+// as found in the logs and the admin API, suffixed with `.2`, `.3`, etc. for the further PTY sessions of the
+// connection. The shadowed user is notified with a banner whenever an observer attaches or detaches.
+// Sessions without a PTY are handled by the wrapped handler without being shadowed.
+//
+// In the assist mode, permitted by `assist`, the input of the observer is injected into the session along
+// with the input of the client, e.g. for pairing.
+type Shadow struct {
+	// The wrapped handler that will handle the actual session
+	HandlerRaw json.RawMessage `json:"handler,omitempty" caddy:"namespace=ssh.actors inline_key=action"`
+
+	// Permit the observers to attach in the assist mode, injecting their input into the session
+	Assist bool `json:"assist,omitempty"`
+
+	// The notice written to the shadowed user when an observer attaches, which may use the session placeholders
+	// along with `{ssh.shadow.observer}` and `{ssh.shadow.mode}`, either `watch` or `assist`.
+	// Defaults to `*** {ssh.shadow.observer} is watching this session ({ssh.shadow.mode}) ***`.
+	Banner string `json:"banner,omitempty"`
+
+	// The notice written to the shadowed user when an observer detaches, which may use the same placeholders
+	// as the banner. Defaults to `*** {ssh.shadow.observer} stopped watching this session ***`.
+	EndBanner string `json:"end_banner,omitempty"`
+
+	handler session.Handler
+	logger  *zap.Logger
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (s Shadow) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "ssh.actors.shadow",
+		New: func() caddy.Module {
+			return new(Shadow)
+		},
+	}
+}
+
+// Provision loads the wrapped handler and sets up the default banners
+func (s *Shadow) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger(s)
+	if len(s.HandlerRaw) == 0 {
+		return fmt.Errorf("handler is required for shadow")
+	}
+	val, err := ctx.LoadModule(s, "HandlerRaw")
+	if err != nil {
+		return fmt.Errorf("loading handler module: %v", err)
+	}
+	s.handler = val.(session.Handler)
+	if s.Banner == "" {
+		s.Banner = defaultShadowBanner
+	}
+	if s.EndBanner == "" {
+		s.EndBanner = defaultShadowEndBanner
+	}
+	return nil
+}
+
+// Handle shadows the PTY session while the wrapped handler handles it
+func (s Shadow) Handle(sess session.Session) error {
+	if _, _, isPty := sess.Pty(); !isPty {
+		return s.handler.Handle(sess)
+	}
+	shadowed := &shadowedSession{
+		sess:      sess,
+		user:      sess.User(),
+		start:     time.Now(),
+		assist:    s.Assist,
+		banner:    s.Banner,
+		endBanner: s.EndBanner,
+		observers: make(map[*ShadowObserver]struct{}),
+	}
+	wrapped := &shadowingSession{Session: sess, shadowed: shadowed}
+	if s.Assist {
+		// the input of the client and the injected input of the observers are merged into the pipe
+		var pw *io.PipeWriter
+		wrapped.input, pw = io.Pipe()
+		shadowed.input = pw
+		go func() {
+			_, err := io.Copy(pw, sess)
+			_ = pw.CloseWithError(err)
+		}()
+	}
+	shadowed.register(getSessionID(sess.Context()))
+	defer shadowed.end()
+
+	s.logger.Info("session shadowed",
+		zap.String("user", sess.User()),
+		zap.String("remote_ip", sess.RemoteAddr().String()),
+		zap.String("session_id", getSessionID(sess.Context())),
+		zap.String("shadow_id", shadowed.id),
+		zap.Bool("assist", s.Assist),
+	)
+	return s.handler.Handle(wrapped)
+}
+
+// ShadowedSessionInfo describes a live shadowed session
+type ShadowedSessionInfo struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Start     time.Time `json:"start"`
+	Assist    bool      `json:"assist"`
+	Observers []string  `json:"observers"`
+}
+
+// ShadowedSessions lists the live shadowed sessions ordered by their start
+func ShadowedSessions() []ShadowedSessionInfo {
+	shadowedSessions.Lock()
+	all := make([]*shadowedSession, 0, len(shadowedSessions.m))
+	for _, s := range shadowedSessions.m {
+		all = append(all, s)
+	}
+	shadowedSessions.Unlock()
+
+	infos := make([]ShadowedSessionInfo, 0, len(all))
+	for _, s := range all {
+		infos = append(infos, s.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+	return infos
+}
+
+// LookupShadowedSession describes the live shadowed session of the ID
+func LookupShadowedSession(id string) (ShadowedSessionInfo, bool) {
+	shadowedSessions.Lock()
+	s, ok := shadowedSessions.m[id]
+	shadowedSessions.Unlock()
+	if !ok {
+		return ShadowedSessionInfo{}, false
+	}
+	return s.info(), true
+}
+
+// AttachShadow attaches the observer of the name to the shadowed session of the ID, writing the output of the
+// session to w until either the session ends or the observer detaches. The observer may inject its input into
+// the session if it attaches in the assist mode, which the session must permit.
+func AttachShadow(id, name string, assist bool, w io.Writer) (*ShadowObserver, error) {
+	shadowedSessions.Lock()
+	s, ok := shadowedSessions.m[id]
+	shadowedSessions.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no shadowed session %q", id)
+	}
+	if assist && !s.assist {
+		return nil, fmt.Errorf("shadowed session %q does not permit the assist mode", id)
+	}
+	o := &ShadowObserver{
+		name:     name,
+		assist:   assist,
+		shadowed: s,
+		output:   make(chan []byte, shadowObserverQueue),
+		done:     make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("no shadowed session %q", id)
+	}
+	s.observers[o] = struct{}{}
+	s.mu.Unlock()
+
+	s.notify(s.banner, o)
+	go o.forward(w)
+	return o, nil
+}
+
+// ShadowObserver is an observer attached to a shadowed session
+type ShadowObserver struct {
+	name     string
+	assist   bool
+	shadowed *shadowedSession
+	output   chan []byte
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+// Input injects the input of the observer into the shadowed session in the assist mode
+func (o *ShadowObserver) Input(p []byte) error {
+	if !o.assist {
+		return fmt.Errorf("the observer is not attached in the assist mode")
+	}
+	select {
+	case <-o.done:
+		return o.err
+	default:
+	}
+	_, err := o.shadowed.input.Write(p)
+	return err
+}
+
+// Done is closed once the observer is detached
+func (o *ShadowObserver) Done() <-chan struct{} {
+	return o.done
+}
+
+// Err reports why the observer was detached, which is nil if it detached itself
+func (o *ShadowObserver) Err() error {
+	<-o.done
+	return o.err
+}
+
+// Detach detaches the observer from the shadowed session
+func (o *ShadowObserver) Detach() {
+	o.detach(nil)
+}
+
+func (o *ShadowObserver) detach(err error) {
+	o.once.Do(func() {
+		o.err = err
+		close(o.done)
+
+		s := o.shadowed
+		s.mu.Lock()
+		delete(s.observers, o)
+		ended := s.ended
+		s.mu.Unlock()
+		if !ended {
+			s.notify(s.endBanner, o)
+		}
+	})
+}
+
+// forward writes the output of the session queued for the observer to w
+func (o *ShadowObserver) forward(w io.Writer) {
+	for {
+		select {
+		case <-o.done:
+			return
+		case p := <-o.output:
+			if _, err := w.Write(p); err != nil {
+				o.detach(err)
+				return
+			}
+		}
+	}
+}
+
+// shadowedSession multicasts the output of the session to its observers
+type shadowedSession struct {
+	id        string
+	sess      session.Session
+	user      string
+	start     time.Time
+	assist    bool
+	banner    string
+	endBanner string
+
+	// the writer of the merged input in the assist mode
+	input *io.PipeWriter
+
+	mu        sync.Mutex
+	observers map[*ShadowObserver]struct{}
+	ended     bool
+}
+
+// register makes the session available to the observers under the ID of the connection, suffixed by a
+// counter if the connection has other shadowed sessions
+func (s *shadowedSession) register(sessionID string) {
+	shadowedSessions.Lock()
+	defer shadowedSessions.Unlock()
+	s.id = sessionID
+	for n := 2; ; n++ {
+		if _, taken := shadowedSessions.m[s.id]; !taken {
+			break
+		}
+		s.id = sessionID + "." + strconv.Itoa(n)
+	}
+	shadowedSessions.m[s.id] = s
+}
+
+// end unregisters the session and detaches its observers
+func (s *shadowedSession) end() {
+	shadowedSessions.Lock()
+	delete(shadowedSessions.m, s.id)
+	shadowedSessions.Unlock()
+
+	s.mu.Lock()
+	s.ended = true
+	observers := make([]*ShadowObserver, 0, len(s.observers))
+	for o := range s.observers {
+		observers = append(observers, o)
+	}
+	s.mu.Unlock()
+	for _, o := range observers {
+		o.detach(ErrShadowEnded)
+	}
+	if s.input != nil {
+		_ = s.input.Close()
+	}
+}
+
+// broadcast queues a copy of the output for each observer, detaching those falling behind
+func (s *shadowedSession) broadcast(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	var slow []*ShadowObserver
+	s.mu.Lock()
+	if len(s.observers) > 0 {
+		chunk := append([]byte(nil), p...)
+		for o := range s.observers {
+			select {
+			case o.output <- chunk:
+			default:
+				slow = append(slow, o)
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, o := range slow {
+		o.detach(ErrShadowTooSlow)
+	}
+}
+
+// notify writes the banner about the observer to the shadowed user
+func (s *shadowedSession) notify(banner string, o *ShadowObserver) {
+	mode := "watch"
+	if o.assist {
+		mode = "assist"
+	}
+	repl := session.NewReplacer(s.sess)
+	repl.Set("ssh.shadow.observer", o.name)
+	repl.Set("ssh.shadow.mode", mode)
+	_, _ = io.WriteString(s.sess.Stderr(), "\r\n"+repl.ReplaceAll(banner, "")+"\r\n")
+}
+
+func (s *shadowedSession) info() ShadowedSessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	observers := make([]string, 0, len(s.observers))
+	for o := range s.observers {
+		observers = append(observers, o.name)
+	}
+	sort.Strings(observers)
+	return ShadowedSessionInfo{ID: s.id, User: s.user, Start: s.start, Assist: s.assist, Observers: observers}
+}
+
+// shadowingSession wraps a session to multicast its output and, in the assist mode, to merge the input
+// injected by the observers
+type shadowingSession struct {
+	session.Session
+	shadowed *shadowedSession
+	input    *io.PipeReader
+}
+
+// Read reads the input of the client, merged with the input of the observers in the assist mode
+func (ss *shadowingSession) Read(p []byte) (int, error) {
+	if ss.input != nil {
+		return ss.input.Read(p)
+	}
+	return ss.Session.Read(p)
+}
+
+// Write intercepts writes to multicast the output
+func (ss *shadowingSession) Write(p []byte) (int, error) {
+	n, err := ss.Session.Write(p)
+	ss.shadowed.broadcast(p[:n])
+	return n, err
+}
+
+// ReportEcho forwards the echo of the terminal of the wrapped handler to the shadowed session
+func (ss *shadowingSession) ReportEcho(echo func() bool) {
+	if r, ok := ss.Session.(session.EchoReporter); ok {
+		r.ReportEcho(echo)
+	}
+}
+
+// Stderr wraps the stderr stream to multicast the output
+func (ss *shadowingSession) Stderr() io.ReadWriter {
+	return &shadowingReadWriter{ReadWriter: ss.Session.Stderr(), shadowed: ss.shadowed}
+}
+
+// shadowingReadWriter wraps a ReadWriter to multicast writes
+type shadowingReadWriter struct {
+	io.ReadWriter
+	shadowed *shadowedSession
+}
+
+// Write intercepts writes to stderr to multicast the output
+func (rw *shadowingReadWriter) Write(p []byte) (int, error) {
+	n, err := rw.ReadWriter.Write(p)
+	rw.shadowed.broadcast(p[:n])
+	return n, err
+}
+
+// ShadowWatch is an actor attaching the session, as an observer, to a session shadowed by the `shadow` actor.
+// The command of the session selects the shadowed session:
+//
+//	watch          lists the shadowed sessions
+//	watch <id>     attaches to the session to watch it
+//	assist <id>    attaches to the session in the assist mode, injecting the input into the session
+//
+// The observer detaches with Ctrl-] or by closing the session. The actor should only be matched for the users
+// permitted to observe the sessions, e.g. with the `user` or `group` matchers.
+type ShadowWatch struct {
+	// Permit the observers to attach in the assist mode to the sessions permitting it
+	Assist bool `json:"assist,omitempty"`
+
+	logger *zap.Logger
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (w ShadowWatch) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "ssh.actors.shadow_watch",
+		New: func() caddy.Module {
+			return new(ShadowWatch)
+		},
+	}
+}
+
+// Provision sets up the logger
+func (w *ShadowWatch) Provision(ctx caddy.Context) error {
+	w.logger = ctx.Logger(w)
+	return nil
+}
+
+// Handle lists the shadowed sessions, or attaches the session to the shadowed session selected by the command
+func (w ShadowWatch) Handle(sess session.Session) error {
+	args := sess.Command()
+	if len(args) == 1 && args[0] == "watch" {
+		for _, info := range ShadowedSessions() {
+			fmt.Fprintf(sess, "%s\t%s\t%s\tassist=%t\tobservers=%d\n",
+				info.ID, info.User, info.Start.Format(time.RFC3339), info.Assist, len(info.Observers))
+		}
+		return nil
+	}
+	if len(args) != 2 || (args[0] != "watch" && args[0] != "assist") {
+		fmt.Fprintln(sess.Stderr(), "usage: watch [<id>] | assist <id>")
+		return &session.ExitError{Status: 2}
+	}
+	id, assist := args[1], args[0] == "assist"
+	if assist && !w.Assist {
+		fmt.Fprintln(sess.Stderr(), "shadow: the assist mode is not permitted")
+		return &session.ExitError{Status: 1}
+	}
+	if sessionID := getSessionID(sess.Context()); id == sessionID || (len(id) > len(sessionID) && id[:len(sessionID)+1] == sessionID+".") {
+		fmt.Fprintln(sess.Stderr(), "shadow: a connection cannot watch its own sessions")
+		return &session.ExitError{Status: 1}
+	}
+	eol := "\n"
+	if _, _, isPty := sess.Pty(); isPty {
+		eol = "\r\n"
+	}
+
+	o, err := AttachShadow(id, sess.User(), assist, sess)
+	if err != nil {
+		fmt.Fprintf(sess.Stderr(), "shadow: %v\n", err)
+		return &session.ExitError{Status: 1}
+	}
+	defer o.Detach()
+	logger := w.logger.With(
+		zap.String("observer", sess.User()),
+		zap.String("remote_ip", sess.RemoteAddr().String()),
+		zap.String("session_id", getSessionID(sess.Context())),
+		zap.String("shadow_id", id),
+		zap.Bool("assist", assist),
+	)
+	logger.Info("observer attached")
+	fmt.Fprintf(sess.Stderr(), "[attached to %s, press Ctrl-] to detach]%s", id, eol)
+
+	// the end of the input doesn't detach the observer, so the output may be watched with the input closed
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := sess.Read(buf)
+			if i := bytes.IndexByte(buf[:n], shadowDetachKey); i >= 0 {
+				if assist && i > 0 {
+					_ = o.Input(buf[:i])
+				}
+				o.Detach()
+				return
+			}
+			if assist && n > 0 && o.Input(buf[:n]) != nil {
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-o.Done():
+	case <-sess.Context().Done():
+		o.Detach()
+	}
+	if err := o.Err(); err != nil {
+		fmt.Fprintf(sess.Stderr(), "%s[detached: %v]%s", eol, err, eol)
+	} else {
+		fmt.Fprintf(sess.Stderr(), "%s[detached]%s", eol, eol)
+	}
+	logger.Info("observer detached", zap.Error(o.Err()))
+	return nil
+}
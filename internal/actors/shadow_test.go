@@ -0,0 +1,206 @@
+package actors
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kadeessh/kadeessh/internal/session"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// echoHandler echoes the input of the session
+type echoHandler struct{}
+
+func (echoHandler) Handle(sess session.Session) error {
+	_, err := io.Copy(sess, sess)
+	return err
+}
+
+// readUntil reads r until the read output contains want
+func readUntil(t *testing.T, r io.Reader, want string) {
+	t.Helper()
+	var got []byte
+	buf := make([]byte, 256)
+	for !bytes.Contains(got, []byte(want)) {
+		n, err := r.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil {
+			t.Fatalf("read %q, %v; want %q", got, err, want)
+		}
+	}
+}
+
+// waitShadowObservers waits until the shadowed session of the ID has the number of observers
+func waitShadowObservers(t *testing.T, id string, observers int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		info, ok := LookupShadowedSession(id)
+		if ok && len(info.Observers) == observers {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("shadowed session %s = %+v, %t; want %d observers", id, info, ok, observers)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startWatch starts the command of the shadow_watch actor, returning its input and output
+func startWatch(t *testing.T, client *gossh.Client, cmd string) (*gossh.Session, io.WriteCloser, io.Reader, *bytes.Buffer) {
+	t.Helper()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := new(bytes.Buffer)
+	sess.Stderr = stderr
+	if err := sess.Start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	return sess, stdin, stdout, stderr
+}
+
+func TestShadow(t *testing.T) {
+	user := dialTestActor(t, Shadow{
+		handler:   echoHandler{},
+		Assist:    true,
+		Banner:    "{ssh.shadow.observer} joined in {ssh.shadow.mode} mode",
+		EndBanner: "{ssh.shadow.observer} left",
+		logger:    zap.NewNop(),
+	})
+	watcher := dialTestActor(t, ShadowWatch{Assist: true, logger: zap.NewNop()})
+
+	shell, err := user.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := shell.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := shell.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := shell.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := shell.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := shell.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	id := hex.EncodeToString(user.SessionID())
+	waitShadowObservers(t, id, 0)
+
+	list, err := watcher.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := list.Output("watch")
+	if err != nil || !strings.HasPrefix(string(out), id+"\talice\t") || !strings.Contains(string(out), "assist=true") {
+		t.Errorf("watch = %q, %v; want the shadowed session", out, err)
+	}
+
+	// the assisting observer sees the output and injects its input
+	assist, assistIn, assistOut, assistErr := startWatch(t, watcher, "assist "+id)
+	readUntil(t, stderr, "\r\nalice joined in assist mode\r\n")
+	if _, err := io.WriteString(stdin, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, stdout, "hello\r\n")
+	readUntil(t, assistOut, "hello\n")
+	if _, err := io.WriteString(assistIn, "ls\n"); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, stdout, "ls\r\n")
+	readUntil(t, assistOut, "ls\n")
+	if _, err := io.WriteString(assistIn, "\x1d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := assist.Wait(); err != nil {
+		t.Errorf("assist exited with %v; want success", err)
+	}
+	if !strings.Contains(assistErr.String(), "[detached]") {
+		t.Errorf("assist stderr = %q; want the detach notice", assistErr.String())
+	}
+	readUntil(t, stderr, "\r\nalice left\r\n")
+
+	// the watching observer is detached once the shadowed session ends
+	watch, _, watchOut, watchErr := startWatch(t, watcher, "watch "+id)
+	readUntil(t, stderr, "\r\nalice joined in watch mode\r\n")
+	if _, err := io.WriteString(stdin, "bye\n"); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, watchOut, "bye\n")
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := watch.Wait(); err != nil {
+		t.Errorf("watch exited with %v; want success", err)
+	}
+	if !strings.Contains(watchErr.String(), "[detached: "+ErrShadowEnded.Error()+"]") {
+		t.Errorf("watch stderr = %q; want the end of the session", watchErr.String())
+	}
+	if err := shell.Wait(); err != nil {
+		t.Errorf("shadowed session exited with %v; want success", err)
+	}
+	if _, ok := LookupShadowedSession(id); ok {
+		t.Errorf("shadowed session %s is still registered", id)
+	}
+}
+
+func TestShadowWatchRefuses(t *testing.T) {
+	user := dialTestActor(t, Shadow{handler: echoHandler{}, Banner: defaultShadowBanner, EndBanner: defaultShadowEndBanner, logger: zap.NewNop()})
+	shell, err := user.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shell.Close()
+	if err := shell.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := shell.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	id := hex.EncodeToString(user.SessionID())
+	waitShadowObservers(t, id, 0)
+
+	for _, tt := range []struct {
+		watch  ShadowWatch
+		cmd    string
+		status int
+	}{
+		{ShadowWatch{}, "assist " + id, 1},
+		{ShadowWatch{Assist: true}, "assist " + id, 1},
+		{ShadowWatch{}, "watch 00ff", 1},
+		{ShadowWatch{}, "top", 2},
+	} {
+		tt.watch.logger = zap.NewNop()
+		sess, err := dialTestActor(t, tt.watch).NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exitErr *gossh.ExitError
+		if err := sess.Run(tt.cmd); !errors.As(err, &exitErr) || exitErr.ExitStatus() != tt.status {
+			t.Errorf("%s with assist %t exited with %v; want the status %d", tt.cmd, tt.watch.Assist, err, tt.status)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package internalcaddyssh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/actors"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+const adminSSHEndpointBase = "/ssh/"
+
+// adminMessageTimeout bounds the wait on the message of the operator, which blocks while the client doesn't read
+const adminMessageTimeout = 2 * time.Second
+
+func init() {
+	caddy.RegisterModule(adminAPI{})
+}
+
+// adminAPI is a module serving the endpoints of the live connections of the SSH servers, e.g. for
+// incident response:
+//
+//	GET    /ssh/servers/{name}/sessions                      lists the connections with their sessions and forwardings
+//	DELETE /ssh/servers/{name}/sessions?user={user}          closes all the connections of the user
+//	DELETE /ssh/servers/{name}/sessions/{session_id}         closes the connection
+//	DELETE /ssh/servers/{name}/sessions/{session_id}/{id}    closes a session of the connection
+//	GET    /ssh/shadow                                       lists the sessions shadowed by the `shadow` actor
+//	GET    /ssh/shadow/{id}[?assist=true&observer={name}]    attaches to the shadowed session over a websocket
+//
+// The `session_id` is the ID of the connection found in the logs. The body of the DELETE requests may
+// be a JSON object with a `message`, which is written to the sessions before closing them.
+//
+// The websocket of a shadowed session carries its output in binary messages, and the input of the observer
+// to inject into the session in the assist mode. The observer is named `admin` in the banner shown to the
+// shadowed user unless named by the query.
+type adminAPI struct {
+	ctx caddy.Context
+	log *zap.Logger
+	app *SSH
+}
+
+// connInfo describes a live connection along with its sessions and forwardings
+type connInfo struct {
+	SessionID     string        `json:"session_id"`
+	User          string        `json:"user"`
+	RemoteAddr    string        `json:"remote_addr"`
+	ClientVersion string        `json:"client_version"`
+	Start         time.Time     `json:"start"`
+	Sessions      []sessionInfo `json:"sessions"`
+	Forwards      []forwardInfo `json:"forwards"`
+}
+
+// sessionInfo describes a session, i.e. a `session` channel, of a connection
+type sessionInfo struct {
+	ID        uint64    `json:"id"`
+	Start     time.Time `json:"start"`
+	Actor     string    `json:"actor,omitempty"`
+	Command   string    `json:"command,omitempty"`
+	Subsystem string    `json:"subsystem,omitempty"`
+	Pty       *ptyInfo  `json:"pty,omitempty"`
+}
+
+type ptyInfo struct {
+	Term   string `json:"term"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// forwardInfo describes an open forwarding of a connection by its type, one of `local`, `reverse`,
+// `local_streamlocal`, and `reverse_streamlocal`, and the forwarded address
+type forwardInfo struct {
+	Type    string    `json:"type"`
+	Address string    `json:"address"`
+	Start   time.Time `json:"start"`
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (adminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.ssh",
+		New: func() caddy.Module { return new(adminAPI) },
+	}
+}
+
+// Provision sets up the adminAPI module
+func (a *adminAPI) Provision(ctx caddy.Context) error {
+	a.ctx = ctx
+	a.log = ctx.Logger(a)
+
+	// the endpoints report no servers unless the ssh app is configured
+	app, err := ctx.AppIfConfigured("ssh")
+	if err == nil {
+		a.app = app.(*SSH)
+	}
+	return nil
+}
+
+// Routes returns the admin routes of the SSH app
+func (a *adminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: adminSSHEndpointBase,
+			Handler: caddy.AdminHandlerFunc(a.handleAPIEndpoints),
+		},
+	}
+}
+
+// handleAPIEndpoints routes the requests within adminSSHEndpointBase
+func (a *adminAPI) handleAPIEndpoints(w http.ResponseWriter, r *http.Request) error {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminSSHEndpointBase), "/")
+	if parts[0] == "shadow" && len(parts) <= 2 {
+		return a.handleShadow(w, r, parts[1:])
+	}
+	if len(parts) < 3 || len(parts) > 5 || parts[0] != "servers" || parts[2] != "sessions" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("resource not found: %v", r.URL.Path),
+		}
+	}
+	srv, conns, ok := a.app.lookupServer(parts[1])
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown server: %s", parts[1]),
+		}
+	}
+	switch {
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		return a.handleList(w, srv, conns)
+	case r.Method == http.MethodDelete:
+		return a.handleClose(w, r, srv, conns, parts[3:])
+	}
+	return caddy.APIError{
+		HTTPStatus: http.StatusMethodNotAllowed,
+		Err:        fmt.Errorf("method not allowed: %v", r.Method),
+	}
+}
+
+// handleList responds with the live connections of the server
+func (a *adminAPI) handleList(w http.ResponseWriter, srv *Server, conns []ssh.ConnInfo) error {
+	infos := make([]connInfo, 0, len(conns))
+	for _, c := range conns {
+		info := connInfo{
+			SessionID:     c.SessionID,
+			User:          c.User,
+			ClientVersion: c.ClientVersion,
+			Start:         c.Start,
+		}
+		if c.RemoteAddr != nil {
+			info.RemoteAddr = c.RemoteAddr.String()
+		}
+		info.Sessions, info.Forwards = srv.sessions.describe(c.SessionID)
+		infos = append(infos, info)
+	}
+	return writeJSON(w, infos)
+}
+
+// handleClose closes the connections or the session selected by the path following `sessions`, or by
+// the user of the query
+func (a *adminAPI) handleClose(w http.ResponseWriter, r *http.Request, srv *Server, conns []ssh.ConnInfo, path []string) error {
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("decoding request body: %v", err),
+		}
+	}
+	user := r.URL.Query().Get("user")
+	if len(path) == 0 && user == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("either a session ID or a user is required"),
+		}
+	}
+
+	var id uint64
+	if len(path) == 2 {
+		var err error
+		if id, err = strconv.ParseUint(path[1], 10, 64); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid session: %v", err),
+			}
+		}
+	}
+
+	var closed int
+	for _, c := range conns {
+		if (len(path) > 0 && c.SessionID != path[0]) || (len(path) == 0 && c.User != user) {
+			continue
+		}
+		if len(path) == 2 {
+			for _, s := range srv.sessions.sessions(c.SessionID) {
+				if s.id == id {
+					closeSession(s, body.Message)
+					closed++
+				}
+			}
+			continue
+		}
+		writeMessage(body.Message, srv.sessions.sessions(c.SessionID)...)
+		c.Conn.Close()
+		closed++
+	}
+	if closed == 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no matching sessions: %v", r.URL.Path),
+		}
+	}
+	a.log.Info("closed sessions through the admin API",
+		zap.String("server", srv.name),
+		zap.Strings("path", path),
+		zap.String("user", user),
+		zap.Int("closed", closed),
+	)
+	return writeJSON(w, map[string]int{"closed": closed})
+}
+
+// handleShadow lists the shadowed sessions, or attaches the websocket to the shadowed session of the path
+func (a *adminAPI) handleShadow(w http.ResponseWriter, r *http.Request, path []string) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %v", r.Method),
+		}
+	}
+	if len(path) == 0 || path[0] == "" {
+		return writeJSON(w, actors.ShadowedSessions())
+	}
+	id := path[0]
+	info, ok := actors.LookupShadowedSession(id)
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no shadowed session: %s", id),
+		}
+	}
+	assist, _ := strconv.ParseBool(r.URL.Query().Get("assist"))
+	if assist && !info.Assist {
+		return caddy.APIError{
+			HTTPStatus: http.StatusForbidden,
+			Err:        fmt.Errorf("shadowed session does not permit the assist mode: %s", id),
+		}
+	}
+	observer := r.URL.Query().Get("observer")
+	if observer == "" {
+		observer = "admin"
+	}
+
+	websocket.Server{
+		// the origin of the request is enforced by the admin endpoint
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			// the deadlines of the admin endpoint don't apply to the websocket
+			_ = ws.SetDeadline(time.Time{})
+			ws.PayloadType = websocket.BinaryFrame
+
+			o, err := actors.AttachShadow(id, observer, assist, ws)
+			if err != nil {
+				a.log.Error("attaching to shadowed session", zap.String("shadow_id", id), zap.Error(err))
+				return
+			}
+			defer o.Detach()
+			logger := a.log.With(
+				zap.String("observer", observer),
+				zap.String("remote_addr", r.RemoteAddr),
+				zap.String("shadow_id", id),
+				zap.Bool("assist", assist),
+			)
+			logger.Info("observer attached through the admin API")
+
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := ws.Read(buf)
+					if assist && n > 0 && o.Input(buf[:n]) != nil {
+						break
+					}
+					if err != nil {
+						break
+					}
+				}
+				// the websocket is gone once it can't be read
+				o.Detach()
+			}()
+			<-o.Done()
+			logger.Info("observer detached", zap.Error(o.Err()))
+		},
+	}.ServeHTTP(w, r)
+	return nil
+}
+
+// writeMessage writes the message of the operator to the clients on the error output of the sessions.
+// It waits on the writes for adminMessageTimeout at most, as the sessions are closed afterwards anyway,
+// which ends the writes left blocked.
+func writeMessage(message string, sessions ...*liveSession) {
+	if message == "" {
+		return
+	}
+	done := make(chan struct{}, len(sessions))
+	for _, s := range sessions {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			msg := message + "\n"
+			if _, _, isPty := s.sess.Pty(); isPty {
+				msg = "\r\n" + message + "\r\n"
+			}
+			_, _ = io.WriteString(s.sess.Stderr(), msg)
+		}()
+	}
+	timeout := time.NewTimer(adminMessageTimeout)
+	defer timeout.Stop()
+	for range sessions {
+		select {
+		case <-done:
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+// closeSession writes the message to the session and closes it
+func closeSession(s *liveSession, message string) {
+	writeMessage(message, s)
+	_ = s.sess.Close()
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        err,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(encoded)
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner = (*adminAPI)(nil)
+	_ caddy.AdminRouter = (*adminAPI)(nil)
+)
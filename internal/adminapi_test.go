@@ -0,0 +1,233 @@
+package internalcaddyssh
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// newTestAdminAPI serves a server named srv0, whose sessions are tracked until the client closes them,
+// and returns the admin API of the app along with the dialer of the server
+func newTestAdminAPI(t *testing.T) (*adminAPI, func(user string) *gossh.Client) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{name: "srv0", sessions: newLiveSessions()}
+	sshsrv := &ssh.Server{
+		Handler: func(s ssh.Session) {
+			live, untrack := srv.sessions.add(s)
+			defer untrack()
+			srv.sessions.act(live, "shell")
+			<-s.Closed()
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool { return true },
+	}
+	sshsrv.AddHostKey(hostSigner)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sshsrv.Serve(l)
+	t.Cleanup(func() { sshsrv.Close() })
+
+	app := &SSH{
+		Servers:       map[string]*Server{"srv0": srv},
+		servers:       []*sshServer{{sshsrv}},
+		serverIndexer: map[string][]int{"srv0": {0}},
+	}
+	dial := func(user string) *gossh.Client {
+		client, err := gossh.Dial("tcp", l.Addr().String(), &gossh.ClientConfig{
+			User:            user,
+			Auth:            []gossh.AuthMethod{gossh.Password("secret")},
+			HostKeyCallback: gossh.FixedHostKey(hostSigner.PublicKey()),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+	return &adminAPI{app: app, log: zap.NewNop()}, dial
+}
+
+func doAdminRequest(a *adminAPI, method, target, body string) (*httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	err := a.handleAPIEndpoints(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w, err
+}
+
+// listConns lists the connections once the sessions are all tracked
+func listConns(t *testing.T, a *adminAPI, sessions int) map[string]connInfo {
+	t.Helper()
+	for i := 0; ; i++ {
+		w, err := doAdminRequest(a, http.MethodGet, "/ssh/servers/srv0/sessions", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var conns []connInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &conns); err != nil {
+			t.Fatal(err)
+		}
+		byUser, n := make(map[string]connInfo), 0
+		for _, c := range conns {
+			byUser[c.User] = c
+			n += len(c.Sessions)
+		}
+		if n == sessions {
+			return byUser
+		}
+		if i == 100 {
+			t.Fatalf("listed %d sessions; want %d", n, sessions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminAPISessions(t *testing.T) {
+	a, dial := newTestAdminAPI(t)
+	alice, bob := dial("alice"), dial("bob")
+
+	shell, err := alice.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	shell.Stderr = &stderr
+	if err := shell.RequestPty("xterm", 24, 80, gossh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := shell.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	exec, err := alice.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Start("sleep 60"); err != nil {
+		t.Fatal(err)
+	}
+	bobShell, err := bob.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bobShell.Shell(); err != nil {
+		t.Fatal(err)
+	}
+
+	conns := listConns(t, a, 3)
+	aliceConn := conns["alice"]
+	if len(conns) != 2 || len(aliceConn.Sessions) != 2 || aliceConn.SessionID == "" || aliceConn.RemoteAddr == "" || !strings.HasPrefix(aliceConn.ClientVersion, "SSH-2.0-") {
+		t.Fatalf("listed connections = %+v", conns)
+	}
+	var ptySession sessionInfo
+	for _, s := range aliceConn.Sessions {
+		if s.Actor != "shell" {
+			t.Errorf("session %d actor = %q; want shell", s.ID, s.Actor)
+		}
+		switch {
+		case s.Pty != nil:
+			ptySession = s
+		case s.Command != "sleep 60":
+			t.Errorf("session %d command = %q; want sleep 60", s.ID, s.Command)
+		}
+	}
+	if ptySession.Pty == nil || *ptySession.Pty != (ptyInfo{Term: "xterm", Width: 80, Height: 24}) {
+		t.Fatalf("sessions of alice = %+v; want one with the PTY", aliceConn.Sessions)
+	}
+
+	target := "/ssh/servers/srv0/sessions/" + aliceConn.SessionID + "/" + strconv.FormatUint(ptySession.ID, 10)
+	if _, err := doAdminRequest(a, http.MethodDelete, target, `{"message": "maintenance"}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := shell.Wait(); err == nil {
+		t.Error("the closed session exited successfully")
+	}
+	if want := "\r\nmaintenance\r\n"; stderr.String() != want {
+		t.Errorf("stderr of the closed session = %q; want %q", stderr.String(), want)
+	}
+	listConns(t, a, 2)
+
+	if _, err := doAdminRequest(a, http.MethodDelete, "/ssh/servers/srv0/sessions?user=bob", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Wait(); err == nil {
+		t.Error("the connection of bob wasn't closed")
+	}
+	if conns := listConns(t, a, 1); len(conns) != 1 {
+		t.Errorf("listed connections after closing bob = %+v", conns)
+	}
+
+	if w, err := doAdminRequest(a, http.MethodGet, "/ssh/shadow", ""); err != nil || w.Body.String() != "[]" {
+		t.Errorf("listed shadowed sessions = %q, %v; want none", w.Body.String(), err)
+	}
+
+	for _, tt := range []struct {
+		method, target string
+		status         int
+	}{
+		{http.MethodDelete, "/ssh/servers/srv0/sessions?user=mallory", http.StatusNotFound},
+		{http.MethodDelete, "/ssh/servers/srv0/sessions", http.StatusBadRequest},
+		{http.MethodDelete, "/ssh/servers/srv0/sessions/" + aliceConn.SessionID + "/x", http.StatusBadRequest},
+		{http.MethodGet, "/ssh/servers/srv1/sessions", http.StatusNotFound},
+		{http.MethodPost, "/ssh/servers/srv0/sessions", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/ssh/shadow/00ff", http.StatusNotFound},
+		{http.MethodPost, "/ssh/shadow", http.StatusMethodNotAllowed},
+	} {
+		_, err := doAdminRequest(a, tt.method, tt.target, "")
+		var apiErr caddy.APIError
+		if !errors.As(err, &apiErr) || apiErr.HTTPStatus != tt.status {
+			t.Errorf("%s %s error = %v; want the status %d", tt.method, tt.target, err, tt.status)
+		}
+	}
+}
+
+func TestAdminAPIMessageToStalledClient(t *testing.T) {
+	a, dial := newTestAdminAPI(t)
+	sess, err := dial("alice").NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the error output is never read, so the message is blocked once it exceeds the window of the channel
+	if _, err := sess.StderrPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	conns := listConns(t, a, 1)
+	message, err := json.Marshal(map[string]string{"message": strings.Repeat("x", 8<<20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := "/ssh/servers/srv0/sessions/" + conns["alice"].SessionID + "/" + strconv.FormatUint(conns["alice"].Sessions[0].ID, 10)
+	start := time.Now()
+	if _, err := doAdminRequest(a, http.MethodDelete, target, string(message)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*adminMessageTimeout {
+		t.Errorf("closing the session took %v", elapsed)
+	}
+	if err := sess.Wait(); err == nil {
+		t.Error("the closed session exited successfully")
+	}
+}
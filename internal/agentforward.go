@@ -0,0 +1,18 @@
+package internalcaddyssh
+
+import (
+	"github.com/kadeessh/kadeessh/internal/agentforward"
+	"github.com/kadeessh/kadeessh/internal/authentication"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+// allowAgentForwarding returns the callback permitting agent forwarding if the key of the user permits it
+// and the asker permits it
+func allowAgentForwarding(asker agentforward.AgentForwardingAsker) ssh.AgentForwardingCallback {
+	return func(ctx ssh.Context) bool {
+		if perms := ctx.Permissions(); perms != nil && !authentication.AgentForwardingPermitted(perms.Permissions) {
+			return false
+		}
+		return asker.Allow(ctx)
+	}
+}
@@ -0,0 +1,11 @@
+package agentforward
+
+import (
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+// AgentForwardingAsker is the interface necessary to ask whether a session is
+// permitted to have agent-forwarding
+type AgentForwardingAsker interface {
+	Allow(ctx ssh.Context) bool
+}
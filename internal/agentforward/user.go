@@ -0,0 +1,60 @@
+package agentforward
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(User{})
+}
+
+// User is AgentForwardingAsker module which allows the agent forwarding
+// only for the listed users
+type User struct {
+	// The usernames permitted to forward their agent
+	Users []string `json:"users,omitempty"`
+
+	users  map[string]bool
+	logger *zap.Logger
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (User) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ssh.ask.agent_forwarding.user",
+		New: func() caddy.Module { return new(User) },
+	}
+}
+
+// Provision sets up the User module
+func (m *User) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+	m.users = make(map[string]bool, len(m.Users))
+	for _, u := range m.Users {
+		m.users[u] = true
+	}
+	return nil
+}
+
+// Allow returns true if the user of the session is listed
+func (m User) Allow(ctx ssh.Context) bool {
+	allowed := m.users[ctx.User()]
+	m.logger.Info(
+		"asking for permission",
+		zap.String("session_id", ctx.SessionID()),
+		zap.String("remote_address", ctx.RemoteAddr().String()),
+		zap.String("user", ctx.User()),
+		zap.Bool("allowed", allowed),
+	)
+	return allowed
+}
+
+var (
+	_ caddy.Provisioner    = (*User)(nil)
+	_ AgentForwardingAsker = User{}
+)
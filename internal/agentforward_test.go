@@ -0,0 +1,30 @@
+package internalcaddyssh
+
+import (
+	"testing"
+
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+type allowAgent struct{}
+
+func (allowAgent) Allow(ssh.Context) bool { return true }
+
+func TestAgentForwardingKeyOptions(t *testing.T) {
+	allow := allowAgentForwarding(allowAgent{})
+	for _, tt := range []struct {
+		name       string
+		extensions map[string]string
+		want       bool
+	}{
+		{"no options", nil, true},
+		{"no-agent-forwarding", map[string]string{"no-agent-forwarding": ""}, false},
+		{"restrict", map[string]string{"restrict": ""}, false},
+		{"restrict and agent-forwarding", map[string]string{"restrict": "", "agent-forwarding": ""}, true},
+		{"no-port-forwarding", map[string]string{"no-port-forwarding": ""}, true},
+	} {
+		if got := allow(permissionsContext{extensions: tt.extensions}); got != tt.want {
+			t.Errorf("%s: allowed = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
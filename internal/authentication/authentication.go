@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net"
 
+	"github.com/kadeessh/kadeessh/internal/metrics"
 	"github.com/kadeessh/kadeessh/internal/session"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -64,9 +65,11 @@ type UserPublicKeyAuthenticator interface {
 	AuthenticateUser(ctx session.ConnMetadata, key gossh.PublicKey) (User, bool, error)
 }
 
-// TODO: TBD -- the implementation should take into consideration: https://pkg.go.dev/golang.org/x/crypto/ssh#CertChecker
+// UserCertificateAuthenticator is the interface authentication providers should implement
+// to be used in ssh.authentication.flows.certificate. The providers are only presented with
+// OpenSSH user certificates, never plain public keys.
 type UserCertificateAuthenticator interface {
-	AuthenticateUser(ctx session.ConnMetadata, key gossh.PublicKey) (User, bool, error)
+	AuthenticateUser(ctx session.ConnMetadata, cert *gossh.Certificate) (User, bool, error)
 }
 
 // UserInteractiveAuthenticator is the interface authentication providers should implement
@@ -75,8 +78,10 @@ type UserInteractiveAuthenticator interface {
 	AuthenticateUser(conn session.ConnMetadata, client gossh.KeyboardInteractiveChallenge) (User, bool, error)
 }
 
+// authenticatorLogger logs the authentication attempts of the flow and counts them in the metrics
 type authenticatorLogger struct {
 	logger *zap.Logger
+	flow   string
 }
 
 func (a authenticatorLogger) authStart(ctx session.ConnMetadata, providerCount int, remoteAddr net.Addr, fields ...zapcore.Field) {
@@ -96,6 +101,7 @@ func (a authenticatorLogger) authFailed(ctx session.ConnMetadata, providerName s
 		zap.String("provider", providerName),
 		zap.String("username", ctx.User()),
 	}, fields...)
+	metrics.AuthAttempts.WithLabelValues(a.flow, providerName, "failure").Inc()
 	a.logger.Info(
 		"authentication failed",
 		fields...,
@@ -108,6 +114,7 @@ func (a authenticatorLogger) authSuccessful(_ session.ConnMetadata, providerName
 		zap.String("user_id", user.Uid()),
 		zap.String("username", user.Username()),
 	}, fields...)
+	metrics.AuthAttempts.WithLabelValues(a.flow, providerName, "success").Inc()
 	a.logger.Info(
 		"authentication successful",
 		fields...,
@@ -118,6 +125,7 @@ func (a authenticatorLogger) invalidCredentials(ctx session.ConnMetadata, fields
 	fields = append([]zapcore.Field{
 		zap.String("username", ctx.User()),
 	}, fields...)
+	metrics.AuthAttempts.WithLabelValues(a.flow, "", "invalid").Inc()
 	a.logger.Warn(
 		"invalid credentials",
 		fields...,
@@ -130,6 +138,7 @@ func (a authenticatorLogger) authError(ctx session.ConnMetadata, providerName st
 		zap.String("provider", providerName),
 		zap.String("usernames", ctx.User()),
 	}, fields...)
+	metrics.AuthAttempts.WithLabelValues(a.flow, providerName, "error").Inc()
 	a.logger.Error(
 		"authentication error",
 		fields...,
@@ -0,0 +1,188 @@
+package authentication
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ caddyfile.Unmarshaler = (*Config)(nil)
+	_ caddyfile.Unmarshaler = (*PasswordAuthFlow)(nil)
+	_ caddyfile.Unmarshaler = (*PublicKeyFlow)(nil)
+	_ caddyfile.Unmarshaler = (*InteractiveFlow)(nil)
+	_ caddyfile.Unmarshaler = (*CertificateFlow)(nil)
+)
+
+// UnmarshalCaddyfile sets up the authentication config from Caddyfile tokens. Syntax:
+//
+//	authentication {
+//		allow_users       <users...>
+//		deny_users        <users...>
+//		allow_groups      <groups...>
+//		deny_groups       <groups...>
+//		username_password [<provider> ...] {
+//			permit_empty_passwords
+//			provider <module> ...
+//		}
+//		public_key        [<provider> ...] {
+//			provider <module> ...
+//		}
+//		interactive       [<provider> ...] {
+//			provider <module> ...
+//		}
+//		certificate       [<provider> ...] {
+//			provider <module> ...
+//		}
+//	}
+//
+// A flow is enabled by its presence, and it may name a single provider inline instead of the block.
+func (c *Config) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "allow_users":
+				c.AllowUsers, err = appendArgs(d, c.AllowUsers)
+			case "deny_users":
+				c.DenyUsers, err = appendArgs(d, c.DenyUsers)
+			case "allow_groups":
+				c.AllowGroups, err = appendArgs(d, c.AllowGroups)
+			case "deny_groups":
+				c.DenyGroups, err = appendArgs(d, c.DenyGroups)
+			case "username_password":
+				c.UsernamePassword = new(PasswordAuthFlow)
+				err = c.UsernamePassword.UnmarshalCaddyfile(d.NewFromNextSegment())
+			case "public_key":
+				c.PublicKey = new(PublicKeyFlow)
+				err = c.PublicKey.UnmarshalCaddyfile(d.NewFromNextSegment())
+			case "interactive":
+				c.Interactive = new(InteractiveFlow)
+				err = c.Interactive.UnmarshalCaddyfile(d.NewFromNextSegment())
+			case "certificate":
+				c.Certificate = new(CertificateFlow)
+				err = c.Certificate.UnmarshalCaddyfile(d.NewFromNextSegment())
+			default:
+				return d.Errf("unrecognized authentication option '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the password flow from Caddyfile tokens. Syntax:
+//
+//	username_password [<provider> ...] {
+//		permit_empty_passwords
+//		provider <module> ...
+//	}
+func (paf *PasswordAuthFlow) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	const namespace = "ssh.authentication.providers.password"
+	paf.ProvidersRaw = make(caddy.ModuleMap)
+	for d.Next() {
+		if d.CountRemainingArgs() > 0 {
+			if err := unmarshalProvider(d, namespace, paf.ProvidersRaw); err != nil {
+				return err
+			}
+			continue
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "permit_empty_passwords":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				paf.PermitEmptyPasswords = true
+			case "provider":
+				if err := unmarshalProvider(d, namespace, paf.ProvidersRaw); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unrecognized username_password option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the public key flow from Caddyfile tokens. Syntax:
+//
+//	public_key [<provider> ...] {
+//		provider <module> ...
+//	}
+func (pk *PublicKeyFlow) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	pk.ProvidersRaw = make(caddy.ModuleMap)
+	return unmarshalProviders(d, "ssh.authentication.providers.public_key", pk.ProvidersRaw)
+}
+
+// UnmarshalCaddyfile sets up the interactive flow from Caddyfile tokens. Syntax:
+//
+//	interactive [<provider> ...] {
+//		provider <module> ...
+//	}
+func (upf *InteractiveFlow) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	upf.ProvidersRaw = make(caddy.ModuleMap)
+	return unmarshalProviders(d, "ssh.providers.interactive", upf.ProvidersRaw)
+}
+
+// UnmarshalCaddyfile sets up the certificate flow from Caddyfile tokens. Syntax:
+//
+//	certificate [<provider> ...] {
+//		provider <module> ...
+//	}
+func (cf *CertificateFlow) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	cf.ProvidersRaw = make(caddy.ModuleMap)
+	return unmarshalProviders(d, "ssh.authentication.providers.certificate", cf.ProvidersRaw)
+}
+
+// unmarshalProviders loads the providers of a flow which has no options of its own
+func unmarshalProviders(d *caddyfile.Dispenser, namespace string, providers caddy.ModuleMap) error {
+	for d.Next() {
+		if d.CountRemainingArgs() > 0 {
+			if err := unmarshalProvider(d, namespace, providers); err != nil {
+				return err
+			}
+			continue
+		}
+		for d.NextBlock(0) {
+			if d.Val() != "provider" {
+				return d.Errf("unrecognized authentication flow option '%s'", d.Val())
+			}
+			if err := unmarshalProvider(d, namespace, providers); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalProvider loads the provider module named by the next argument into the providers map
+func unmarshalProvider(d *caddyfile.Dispenser, namespace string, providers caddy.ModuleMap) error {
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	name := d.Val()
+	if _, ok := providers[name]; ok {
+		return d.Errf("provider '%s' is already defined", name)
+	}
+	unm, err := caddyfile.UnmarshalModule(d, namespace+"."+name)
+	if err != nil {
+		return err
+	}
+	providers[name] = caddyconfig.JSON(unm, nil)
+	return nil
+}
+
+func appendArgs(d *caddyfile.Dispenser, list []string) ([]string, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return nil, d.ArgErr()
+	}
+	return append(list, args...), nil
+}
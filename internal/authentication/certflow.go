@@ -0,0 +1,91 @@
+package authentication
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var _ caddy.Provisioner = (*CertificateFlow)(nil)
+
+func init() {
+	caddy.RegisterModule(CertificateFlow{})
+}
+
+// CertificateFlow holds the OpenSSH user-certificate authentication providers
+type CertificateFlow struct {
+	authenticatorLogger
+	// A set of authentication providers implementing the UserCertificateAuthenticator interface. If none are specified,
+	// all requests will always be unauthenticated.
+	ProvidersRaw caddy.ModuleMap                         `json:"providers,omitempty" caddy:"namespace=ssh.authentication.providers.certificate"`
+	providers    map[string]UserCertificateAuthenticator `json:"-"`
+
+	logger *zap.Logger
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (CertificateFlow) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ssh.authentication.flows.certificate",
+		New: func() caddy.Module { return new(CertificateFlow) },
+	}
+}
+
+// Provision sets up and loads the providers of conforming to UserCertificateAuthenticator interface
+func (cf *CertificateFlow) Provision(ctx caddy.Context) error {
+	cf.logger = ctx.Logger(cf)
+	cf.authenticatorLogger = authenticatorLogger{cf.logger, "certificate"}
+
+	cf.providers = make(map[string]UserCertificateAuthenticator)
+	mods, err := ctx.LoadModule(cf, "ProvidersRaw")
+	if err != nil {
+		return fmt.Errorf("loading authentication providers: %v", err)
+	}
+
+	for modName, modIface := range mods.(map[string]interface{}) {
+		if ca, ok := modIface.(UserCertificateAuthenticator); ok {
+			cf.providers[modName] = ca
+			continue
+		}
+		return fmt.Errorf("%+v is not type UserCertificateAuthenticator", modIface)
+	}
+	return nil
+}
+
+func (cf CertificateFlow) callback(ctx session.Context) func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+	return func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
+		cert, ok := key.(*gossh.Certificate)
+		if !ok {
+			cf.invalidCredentials(conn, zap.String("key_type", key.Type()))
+			return nil, invalidCredentials
+		}
+		fields := []zap.Field{
+			zap.String("key_type", cert.Key.Type()),
+			zap.String("key_id", cert.KeyId),
+			zap.Uint64("serial", cert.Serial),
+		}
+		cf.authStart(conn, len(cf.providers), ctx.RemoteAddr(), fields...)
+		for name, provider := range cf.providers { //nolint:golint,misspell
+			user, authed, err := provider.AuthenticateUser(conn, cert)
+			if err != nil {
+				cf.authError(conn, name, err, fields...)
+				continue
+			}
+			if !authed {
+				cf.authFailed(conn, name, fields...)
+				continue
+			}
+			cf.authSuccessful(conn, name, user, fields...)
+			ctx.SetValue(UserCtxKey, user)
+			return certificatePermissions(user.Permissions()), nil
+		}
+		cf.invalidCredentials(conn, fields...)
+		return nil, invalidCredentials
+	}
+}
@@ -0,0 +1,86 @@
+package certificate
+
+import (
+	"runtime"
+	"strings"
+
+	"github.com/kadeessh/kadeessh/internal/authentication"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// account is the user authenticated by a certificate. The certificate authority vouches for
+// the identity, so there's no user record beyond what's carried in the certificate.
+type account struct {
+	username    string
+	permissions *gossh.Permissions
+	metadata    map[string]any
+}
+
+func newAccount(username, principal string, cert *gossh.Certificate) account {
+	perms := &gossh.Permissions{
+		CriticalOptions: make(map[string]string, len(cert.CriticalOptions)),
+		Extensions:      make(map[string]string, len(cert.Extensions)),
+	}
+	for k, v := range cert.CriticalOptions {
+		perms.CriticalOptions[k] = v
+	}
+	for k, v := range cert.Extensions {
+		perms.Extensions[k] = v
+	}
+	return account{
+		username:    username,
+		permissions: perms,
+		metadata: map[string]any{
+			"principal":      principal,
+			"key_id":         cert.KeyId,
+			"serial":         cert.Serial,
+			"principals":     strings.Join(cert.ValidPrincipals, ","),
+			"ca_fingerprint": gossh.FingerprintSHA256(cert.SignatureKey),
+			"fingerprint":    gossh.FingerprintSHA256(cert.Key),
+		},
+	}
+}
+
+// returns the username, as certificates carry no user IDs
+func (a account) Uid() string {
+	return a.username
+}
+
+// returns the username, as certificates carry no group IDs
+func (a account) Gid() string {
+	return a.username
+}
+
+func (a account) Username() string {
+	return a.username
+}
+
+func (a account) Name() string {
+	return a.username
+}
+
+// HomeDir defaults to `C:\Users\Public` on Windows and `/var/empty` on *nix
+func (a account) HomeDir() string {
+	if runtime.GOOS == "windows" {
+		return `C:\Users\Public`
+	}
+	return "/var/empty"
+}
+
+func (a account) GroupIDs() ([]string, error) {
+	return []string{}, nil
+}
+
+func (a account) Groups() []authentication.Group {
+	return []authentication.Group{}
+}
+
+// returns the certificate details, i.e. key ID, serial, principals, and the fingerprints of the key and the authority
+func (a account) Metadata() map[string]any {
+	return a.metadata
+}
+
+// returns the critical options and extensions of the certificate
+func (a account) Permissions() *gossh.Permissions {
+	return a.permissions
+}
@@ -0,0 +1,86 @@
+package certificate
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var _ caddyfile.Unmarshaler = (*TrustedCA)(nil)
+
+// UnmarshalCaddyfile sets up the trusted CA provider from Caddyfile tokens. Syntax:
+//
+//	trusted_ca {
+//		authority                  <public_key>
+//		authority_source           <urls...>
+//		authorized_principals      <username> <principals...>
+//		supported_critical_options <options...>
+//		revoked_key                <public_key|fingerprint>
+//		revoked_keys_file          <path>
+//		revoked_serials            <serials...>
+//	}
+//
+// The public keys are in the authorized_keys format, so they must be quoted.
+func (tc *TrustedCA) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "authority":
+				var key string
+				if !d.AllArgs(&key) {
+					return d.ArgErr()
+				}
+				tc.Authorities = append(tc.Authorities, key)
+			case "authority_source":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				tc.AuthoritySources = append(tc.AuthoritySources, args...)
+			case "authorized_principals":
+				args := d.RemainingArgs()
+				if len(args) < 2 {
+					return d.ArgErr()
+				}
+				if tc.AuthorizedPrincipals == nil {
+					tc.AuthorizedPrincipals = make(map[string][]string)
+				}
+				tc.AuthorizedPrincipals[args[0]] = append(tc.AuthorizedPrincipals[args[0]], args[1:]...)
+			case "supported_critical_options":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				tc.SupportedCriticalOptions = append(tc.SupportedCriticalOptions, args...)
+			case "revoked_key":
+				var key string
+				if !d.AllArgs(&key) {
+					return d.ArgErr()
+				}
+				tc.RevokedKeys = append(tc.RevokedKeys, key)
+			case "revoked_keys_file":
+				if !d.AllArgs(&tc.RevokedKeysFile) {
+					return d.ArgErr()
+				}
+			case "revoked_serials":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				for _, arg := range args {
+					serial, err := strconv.ParseUint(arg, 10, 64)
+					if err != nil {
+						return d.Errf("parsing revoked serial: %v", err)
+					}
+					tc.RevokedSerials = append(tc.RevokedSerials, serial)
+				}
+			default:
+				return d.Errf("unrecognized trusted_ca option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
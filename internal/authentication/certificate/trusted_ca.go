@@ -0,0 +1,305 @@
+package certificate
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/authentication"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func init() {
+	caddy.RegisterModule(TrustedCA{})
+}
+
+var (
+	_ authentication.UserCertificateAuthenticator = (*TrustedCA)(nil)
+	_ caddy.Provisioner                           = (*TrustedCA)(nil)
+)
+
+// The critical options understood by the server. The `source-address` option is enforced
+// by golang.org/x/crypto/ssh itself, and `force-command` is honored by the `shell` actor.
+var defaultSupportedCriticalOptions = []string{"force-command"}
+
+// TrustedCA authenticates users presenting OpenSSH user certificates signed by one of the trusted
+// certificate authorities. It follows the semantics of the OpenSSH `TrustedUserCAKeys`,
+// `AuthorizedPrincipalsFile`, and `RevokedKeys` options. The critical options and extensions of the
+// certificate are carried into the session permissions.
+type TrustedCA struct {
+	// The public keys of the trusted certificate authorities in the authorized_keys format,
+	// e.g. `ssh-ed25519 AAAA... user-ca`
+	Authorities []string `json:"authorities,omitempty"`
+
+	// URLs to the location of files holding the public keys of the trusted certificate authorities
+	// in the authorized_keys format, e.g. file:///etc/ssh/user_ca.pub or https://example.com/user_ca.pub
+	AuthoritySources []string `json:"authority_sources,omitempty"`
+
+	// The principals accepted for a user keyed by the username. The certificate must list at least one
+	// of the accepted principals. If the user is absent, the username is the only accepted principal.
+	AuthorizedPrincipals map[string][]string `json:"authorized_principals,omitempty"`
+
+	// Additional critical options the server is willing to accept. Certificates carrying critical
+	// options unknown to the server are rejected. `force-command` and `source-address` are always supported.
+	SupportedCriticalOptions []string `json:"supported_critical_options,omitempty"`
+
+	// The revoked keys in the authorized_keys format or as SHA256 fingerprints, e.g. `SHA256:...`.
+	// Revoking a certificate authority key revokes all the certificates signed by it.
+	RevokedKeys []string `json:"revoked_keys,omitempty"`
+
+	// Path to a file listing revoked keys, one per line, in the same format as `revoked_keys`. Blank
+	// lines and lines starting with `#` are ignored. The file is re-read when its modification time changes,
+	// so revocations take effect without reloading the config.
+	RevokedKeysFile string `json:"revoked_keys_file,omitempty"`
+
+	// The serial numbers of revoked certificates
+	RevokedSerials []uint64 `json:"revoked_serials,omitempty"`
+
+	authorities    map[string]gossh.PublicKey
+	revokedSerials map[uint64]bool
+	revoked        *revocationList
+	checker        *gossh.CertChecker
+	logger         *zap.Logger
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (TrustedCA) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ssh.authentication.providers.certificate.trusted_ca",
+		New: func() caddy.Module { return new(TrustedCA) },
+	}
+}
+
+// Provision loads the trusted authorities from the inline values and named sources, and prepares the revocation list
+func (tc *TrustedCA) Provision(ctx caddy.Context) error {
+	tc.logger = ctx.Logger(tc)
+	tc.authorities = make(map[string]gossh.PublicKey)
+	repl := caddy.NewReplacer()
+
+	for i, v := range tc.Authorities {
+		if err := tc.addAuthorities([]byte(v)); err != nil {
+			return fmt.Errorf("authority %d: %v", i, err)
+		}
+	}
+
+	t := &http.Transport{}
+	// The path is set by the server administrator, not by arbitrary user.
+	// nolint:gosec
+	t.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	c := &http.Client{Transport: t}
+	for _, src := range tc.AuthoritySources {
+		u, err := url.Parse(repl.ReplaceKnown(src, ""))
+		if err != nil {
+			return err
+		}
+		switch u.Scheme {
+		case "http", "https", "file":
+		default:
+			return fmt.Errorf("unsupported authority source: %s", u.Scheme)
+		}
+		res, err := c.Get(u.String())
+		if err != nil {
+			return err
+		}
+		keysBytes, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		if err := tc.addAuthorities(keysBytes); err != nil {
+			return fmt.Errorf("authority source %s: %v", src, err)
+		}
+	}
+	if len(tc.authorities) == 0 {
+		return errors.New("at least one trusted certificate authority is required")
+	}
+
+	tc.revokedSerials = make(map[uint64]bool)
+	for _, v := range tc.RevokedSerials {
+		tc.revokedSerials[v] = true
+	}
+	tc.revoked = &revocationList{
+		static: make(map[string]bool),
+		path:   repl.ReplaceKnown(tc.RevokedKeysFile, ""),
+	}
+	for _, v := range tc.RevokedKeys {
+		fp, err := parseRevokedEntry(v)
+		if err != nil {
+			return fmt.Errorf("parsing revoked key: %v", err)
+		}
+		tc.revoked.static[fp] = true
+	}
+	if tc.revoked.path != "" {
+		if err := tc.revoked.reload(); err != nil {
+			return fmt.Errorf("loading revoked keys file: %v", err)
+		}
+	}
+
+	tc.checker = &gossh.CertChecker{
+		IsUserAuthority: func(auth gossh.PublicKey) bool {
+			_, ok := tc.authorities[gossh.FingerprintSHA256(auth)]
+			return ok
+		},
+		IsRevoked:                tc.isRevoked,
+		SupportedCriticalOptions: append(append([]string{}, defaultSupportedCriticalOptions...), tc.SupportedCriticalOptions...),
+	}
+	return nil
+}
+
+func (tc *TrustedCA) addAuthorities(in []byte) error {
+	for len(bytes.TrimSpace(in)) > 0 {
+		k, _, _, rest, err := ssh.ParseAuthorizedKey(in)
+		if err != nil {
+			return err
+		}
+		tc.authorities[gossh.FingerprintSHA256(k)] = k
+		in = rest
+	}
+	return nil
+}
+
+// isRevoked reports whether the certificate, its key, or the signing authority has been revoked
+func (tc *TrustedCA) isRevoked(cert *gossh.Certificate) bool {
+	if tc.revokedSerials[cert.Serial] {
+		return true
+	}
+	for _, k := range []gossh.PublicKey{cert, cert.Key, cert.SignatureKey} {
+		if tc.revoked.contains(gossh.FingerprintSHA256(k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthenticateUser verifies the certificate is a user certificate signed by a trusted authority, that it's
+// within its validity window, not revoked, and lists one of the principals accepted for the user. On success,
+// the critical options and extensions of the certificate are returned in the Permissions of the user.
+func (tc *TrustedCA) AuthenticateUser(ctx session.ConnMetadata, cert *gossh.Certificate) (authentication.User, bool, error) {
+	username := ctx.User()
+	if username == "" || cert == nil {
+		return account{}, false, nil
+	}
+	if cert.CertType != gossh.UserCert {
+		return account{}, false, nil
+	}
+	if !tc.checker.IsUserAuthority(cert.SignatureKey) {
+		return account{}, false, nil
+	}
+	// OpenSSH refuses certificates without principals for user authentication
+	if len(cert.ValidPrincipals) == 0 {
+		return account{}, false, nil
+	}
+
+	principals, ok := tc.AuthorizedPrincipals[username]
+	if !ok {
+		principals = []string{username}
+	}
+	var checkErr error
+	for _, principal := range principals {
+		if checkErr = tc.checker.CheckCert(principal, cert); checkErr == nil {
+			return newAccount(username, principal, cert), true, nil
+		}
+	}
+	tc.logger.Debug("certificate rejected",
+		zap.String("username", username),
+		zap.String("key_id", cert.KeyId),
+		zap.Uint64("serial", cert.Serial),
+		zap.Error(checkErr),
+	)
+	return account{}, false, nil
+}
+
+// revocationList holds the fingerprints of revoked keys from the config and the
+// optional revocation file, which is reloaded when modified.
+type revocationList struct {
+	static map[string]bool
+
+	path     string
+	mu       sync.RWMutex
+	modTime  time.Time
+	fromFile map[string]bool
+}
+
+func (rl *revocationList) contains(fp string) bool {
+	if rl.static[fp] {
+		return true
+	}
+	if rl.path == "" {
+		return false
+	}
+	if info, err := os.Stat(rl.path); err == nil {
+		rl.mu.RLock()
+		stale := !info.ModTime().Equal(rl.modTime)
+		rl.mu.RUnlock()
+		if stale {
+			// keep the previous list on failure rather than failing open
+			_ = rl.reload()
+		}
+	}
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return rl.fromFile[fp]
+}
+
+func (rl *revocationList) reload() error {
+	f, err := os.Open(rl.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fps := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fp, err := parseRevokedEntry(line)
+		if err != nil {
+			return err
+		}
+		fps[fp] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	rl.mu.Lock()
+	rl.fromFile = fps
+	rl.modTime = info.ModTime()
+	rl.mu.Unlock()
+	return nil
+}
+
+// parseRevokedEntry returns the SHA256 fingerprint of an entry which is either
+// a fingerprint or a public key in the authorized_keys format
+func parseRevokedEntry(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "SHA256:") {
+		return v, nil
+	}
+	k, _, _, _, err := ssh.ParseAuthorizedKey([]byte(v))
+	if err != nil {
+		return "", err
+	}
+	return gossh.FingerprintSHA256(k), nil
+}
@@ -0,0 +1,229 @@
+package certificate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type fakeConnMetadata struct {
+	user string
+}
+
+func (f fakeConnMetadata) User() string          { return f.user }
+func (f fakeConnMetadata) SessionID() []byte     { return nil }
+func (f fakeConnMetadata) ClientVersion() []byte { return nil }
+func (f fakeConnMetadata) ServerVersion() []byte { return nil }
+func (f fakeConnMetadata) RemoteAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (f fakeConnMetadata) LocalAddr() net.Addr   { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+
+func newSigner(t *testing.T) gossh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newCert(t *testing.T, ca gossh.Signer, mutate func(*gossh.Certificate)) *gossh.Certificate {
+	t.Helper()
+	cert := &gossh.Certificate{
+		Key:             newSigner(t).PublicKey(),
+		Serial:          42,
+		CertType:        gossh.UserCert,
+		KeyId:           "alice@example",
+		ValidPrincipals: []string{"alice"},
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		Permissions: gossh.Permissions{
+			CriticalOptions: map[string]string{},
+			Extensions:      map[string]string{"permit-pty": ""},
+		},
+	}
+	if mutate != nil {
+		mutate(cert)
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func provision(t *testing.T, tc *TrustedCA) {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	if err := tc.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrustedCA_AuthenticateUser(t *testing.T) {
+	ca := newSigner(t)
+	otherCA := newSigner(t)
+	caLine := string(gossh.MarshalAuthorizedKey(ca.PublicKey()))
+
+	tests := []struct {
+		name   string
+		tc     TrustedCA
+		user   string
+		cert   func(t *testing.T) *gossh.Certificate
+		authed bool
+	}{
+		{
+			name:   "valid certificate for the username",
+			tc:     TrustedCA{Authorities: []string{caLine}},
+			user:   "alice",
+			cert:   func(t *testing.T) *gossh.Certificate { return newCert(t, ca, nil) },
+			authed: true,
+		},
+		{
+			name:   "principal does not match the username",
+			tc:     TrustedCA{Authorities: []string{caLine}},
+			user:   "bob",
+			cert:   func(t *testing.T) *gossh.Certificate { return newCert(t, ca, nil) },
+			authed: false,
+		},
+		{
+			name:   "authorized principals mapping",
+			tc:     TrustedCA{Authorities: []string{caLine}, AuthorizedPrincipals: map[string][]string{"root": {"admins", "alice"}}},
+			user:   "root",
+			cert:   func(t *testing.T) *gossh.Certificate { return newCert(t, ca, nil) },
+			authed: true,
+		},
+		{
+			name:   "untrusted authority",
+			tc:     TrustedCA{Authorities: []string{caLine}},
+			user:   "alice",
+			cert:   func(t *testing.T) *gossh.Certificate { return newCert(t, otherCA, nil) },
+			authed: false,
+		},
+		{
+			name: "host certificate",
+			tc:   TrustedCA{Authorities: []string{caLine}},
+			user: "alice",
+			cert: func(t *testing.T) *gossh.Certificate {
+				return newCert(t, ca, func(c *gossh.Certificate) { c.CertType = gossh.HostCert })
+			},
+			authed: false,
+		},
+		{
+			name: "expired certificate",
+			tc:   TrustedCA{Authorities: []string{caLine}},
+			user: "alice",
+			cert: func(t *testing.T) *gossh.Certificate {
+				return newCert(t, ca, func(c *gossh.Certificate) {
+					c.ValidBefore = uint64(time.Now().Add(-time.Minute).Unix())
+				})
+			},
+			authed: false,
+		},
+		{
+			name: "certificate without principals",
+			tc:   TrustedCA{Authorities: []string{caLine}},
+			user: "alice",
+			cert: func(t *testing.T) *gossh.Certificate {
+				return newCert(t, ca, func(c *gossh.Certificate) { c.ValidPrincipals = nil })
+			},
+			authed: false,
+		},
+		{
+			name: "unsupported critical option",
+			tc:   TrustedCA{Authorities: []string{caLine}},
+			user: "alice",
+			cert: func(t *testing.T) *gossh.Certificate {
+				return newCert(t, ca, func(c *gossh.Certificate) { c.CriticalOptions["verify-required"] = "" })
+			},
+			authed: false,
+		},
+		{
+			name: "additionally supported critical option",
+			tc:   TrustedCA{Authorities: []string{caLine}, SupportedCriticalOptions: []string{"verify-required"}},
+			user: "alice",
+			cert: func(t *testing.T) *gossh.Certificate {
+				return newCert(t, ca, func(c *gossh.Certificate) { c.CriticalOptions["verify-required"] = "" })
+			},
+			authed: true,
+		},
+		{
+			name:   "revoked serial",
+			tc:     TrustedCA{Authorities: []string{caLine}, RevokedSerials: []uint64{42}},
+			user:   "alice",
+			cert:   func(t *testing.T) *gossh.Certificate { return newCert(t, ca, nil) },
+			authed: false,
+		},
+		{
+			name:   "revoked authority",
+			tc:     TrustedCA{Authorities: []string{caLine}, RevokedKeys: []string{gossh.FingerprintSHA256(ca.PublicKey())}},
+			user:   "alice",
+			cert:   func(t *testing.T) *gossh.Certificate { return newCert(t, ca, nil) },
+			authed: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := tt.tc
+			provision(t, &tc)
+			cert := tt.cert(t)
+			user, authed, err := tc.AuthenticateUser(fakeConnMetadata{user: tt.user}, cert)
+			if err != nil {
+				t.Fatalf("AuthenticateUser() error = %v", err)
+			}
+			if authed != tt.authed {
+				t.Fatalf("AuthenticateUser() authed = %v, want %v", authed, tt.authed)
+			}
+			if !authed {
+				return
+			}
+			if user.Username() != tt.user {
+				t.Errorf("Username() = %s, want %s", user.Username(), tt.user)
+			}
+			if _, ok := user.Permissions().Extensions["permit-pty"]; !ok {
+				t.Errorf("certificate extensions are not carried into the permissions: %+v", user.Permissions())
+			}
+		})
+	}
+}
+
+func TestTrustedCA_RevokedKeysFileReload(t *testing.T) {
+	ca := newSigner(t)
+	revokedFile := filepath.Join(t.TempDir(), "revoked_keys")
+	if err := os.WriteFile(revokedFile, []byte("# empty\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tc := TrustedCA{
+		Authorities:     []string{string(gossh.MarshalAuthorizedKey(ca.PublicKey()))},
+		RevokedKeysFile: revokedFile,
+	}
+	provision(t, &tc)
+
+	cert := newCert(t, ca, nil)
+	if _, authed, _ := tc.AuthenticateUser(fakeConnMetadata{user: "alice"}, cert); !authed {
+		t.Fatal("expected the certificate to be accepted before revocation")
+	}
+
+	if err := os.WriteFile(revokedFile, gossh.MarshalAuthorizedKey(cert.Key), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// ensure the modification time differs on filesystems with coarse timestamps
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(revokedFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if _, authed, _ := tc.AuthenticateUser(fakeConnMetadata{user: "alice"}, cert); authed {
+		t.Fatal("expected the certificate to be rejected after revocation")
+	}
+}
@@ -29,6 +29,10 @@ type Config struct {
 	// Interactive holds the configuration of the interactive-based
 	// authentication flow. nil value disables the authentication flow.
 	Interactive *InteractiveFlow `json:"interactive,omitempty"`
+
+	// Certificate holds the configuration of the OpenSSH user-certificate
+	// authentication flow. nil value disables the authentication flow.
+	Certificate *CertificateFlow `json:"certificate,omitempty"`
 }
 
 // Provision sets up the allowed/denied users/groups and provisions the non-nil authentication flows
@@ -68,6 +72,11 @@ func (c *Config) Provision(ctx caddy.Context) error {
 			return err
 		}
 	}
+	if c.Certificate != nil {
+		if err := c.Certificate.Provision(ctx); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -96,15 +105,26 @@ func (c Config) PasswordCallback(ctx session.Context) func(conn gossh.ConnMetada
 }
 
 // PublicKeyCallback returns an authentiction callback conforming to the public key authentication callback func needed
-// by ServerConfig of golang.org/x/crypto/ssh. The method returns nil if the field PublicKey
-// is nil to disable public key authentication.
+// by ServerConfig of golang.org/x/crypto/ssh. User certificates are dispatched to the Certificate flow if it's configured,
+// otherwise all keys are handed to the PublicKey flow. The method returns nil if both fields PublicKey and Certificate
+// are nil to disable public key authentication.
 func (c Config) PublicKeyCallback(ctx session.Context) func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
-	if c.PublicKey == nil {
+	if c.PublicKey == nil && c.Certificate == nil {
 		return nil
 	}
 	return func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error) {
 		if subjectAllowedNotDenied(conn.User(), c.allowUsers, c.denyUsers) {
-			perms, err := c.PublicKey.callback(ctx)(conn, key)
+			var cb func(conn gossh.ConnMetadata, key gossh.PublicKey) (*gossh.Permissions, error)
+			_, isCert := key.(*gossh.Certificate)
+			switch {
+			case isCert && c.Certificate != nil:
+				cb = c.Certificate.callback(ctx)
+			case c.PublicKey != nil:
+				cb = c.PublicKey.callback(ctx)
+			default:
+				return nil, invalidCredentials
+			}
+			perms, err := cb(conn, key)
 			if err != nil {
 				return perms, err
 			}
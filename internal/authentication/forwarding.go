@@ -0,0 +1,76 @@
+package authentication
+
+import (
+	"strings"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// certificateKey marks the permissions granted by a certificate in their ExtraData
+type certificateKey struct{}
+
+// certificatePermissions returns a copy of the permissions of the certificate user, marked as granted by
+// a certificate, as the certificate options are read differently from the ones of an authorized key
+func certificatePermissions(perms *gossh.Permissions) *gossh.Permissions {
+	marked := &gossh.Permissions{ExtraData: map[any]any{certificateKey{}: true}}
+	if perms == nil {
+		return marked
+	}
+	marked.CriticalOptions, marked.Extensions = perms.CriticalOptions, perms.Extensions
+	for k, v := range perms.ExtraData {
+		marked.ExtraData[k] = v
+	}
+	return marked
+}
+
+// PortForwardingPermitted returns true if the options of the authorized key or the certificate permit port
+// forwarding, as OpenSSH reads them. A certificate must carry the `permit-port-forwarding` extension, while an
+// authorized key permits it unless it has the `no-port-forwarding` option, or the `restrict` option without
+// `port-forwarding`. The permissions of other authentication methods carry no options and permit it.
+func PortForwardingPermitted(perms *gossh.Permissions) bool {
+	return forwardingPermitted(perms, "port-forwarding")
+}
+
+// AgentForwardingPermitted returns true if the options of the authorized key or the certificate permit agent
+// forwarding, read as the ones of port forwarding by PortForwardingPermitted: a certificate must carry the
+// `permit-agent-forwarding` extension, while an authorized key permits it unless it has the `no-agent-forwarding`
+// option, or the `restrict` option without `agent-forwarding`.
+func AgentForwardingPermitted(perms *gossh.Permissions) bool {
+	return forwardingPermitted(perms, "agent-forwarding")
+}
+
+// X11ForwardingPermitted returns true if the options of the authorized key or the certificate permit X11
+// forwarding, read as the ones of port forwarding by PortForwardingPermitted: a certificate must carry the
+// `permit-X11-forwarding` extension, while an authorized key permits it unless it has the `no-X11-forwarding`
+// option, or the `restrict` option without `X11-forwarding`.
+func X11ForwardingPermitted(perms *gossh.Permissions) bool {
+	return forwardingPermitted(perms, "X11-forwarding")
+}
+
+// forwardingPermitted reads the options of the forwarding of the kind. The options of authorized keys are
+// matched regardless of case, as OpenSSH does, while the extensions of certificates are matched exactly.
+func forwardingPermitted(perms *gossh.Permissions, kind string) bool {
+	if perms == nil {
+		return true
+	}
+	if cert, _ := perms.ExtraData[certificateKey{}].(bool); cert {
+		_, ok := perms.Extensions["permit-"+kind]
+		return ok
+	}
+	if hasOption(perms.Extensions, "no-"+kind) {
+		return false
+	}
+	if hasOption(perms.Extensions, "restrict") {
+		return hasOption(perms.Extensions, kind)
+	}
+	return true
+}
+
+func hasOption(opts map[string]string, name string) bool {
+	for k := range opts {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
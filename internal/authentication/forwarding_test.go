@@ -0,0 +1,151 @@
+package authentication
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/kadeessh/kadeessh/internal/session"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type fakeConnMetadata struct {
+	gossh.ConnMetadata
+}
+
+func (fakeConnMetadata) User() string { return "alice" }
+
+type fakeSessionContext struct {
+	session.Context
+	values map[any]any
+}
+
+func (c *fakeSessionContext) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+}
+func (c *fakeSessionContext) SetValue(key, value any) { c.values[key] = value }
+
+type certUser struct {
+	User
+	perms *gossh.Permissions
+}
+
+func (u certUser) Uid() string                     { return "alice" }
+func (u certUser) Username() string                { return "alice" }
+func (u certUser) Groups() []Group                 { return nil }
+func (u certUser) Permissions() *gossh.Permissions { return u.perms }
+
+// certProvider authenticates any certificate, granting its options as they are
+type certProvider struct{}
+
+func (certProvider) AuthenticateUser(_ session.ConnMetadata, cert *gossh.Certificate) (User, bool, error) {
+	return certUser{perms: &gossh.Permissions{
+		CriticalOptions: cert.CriticalOptions,
+		Extensions:      cert.Extensions,
+	}}, true, nil
+}
+
+func TestPortForwardingPermittedByCertificate(t *testing.T) {
+	flow := CertificateFlow{
+		providers: map[string]UserCertificateAuthenticator{"fake": certProvider{}},
+		logger:    zap.NewNop(),
+	}
+	flow.authenticatorLogger = authenticatorLogger{flow.logger, "certificate"}
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name       string
+		extensions map[string]string
+		want       bool
+	}{
+		{"permit-port-forwarding", map[string]string{"permit-port-forwarding": "", "permit-pty": ""}, true},
+		{"without permit-port-forwarding", map[string]string{"permit-pty": ""}, false},
+		{"without extensions", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &fakeSessionContext{values: map[any]any{}}
+			cert := &gossh.Certificate{Key: key, CertType: gossh.UserCert, Permissions: gossh.Permissions{Extensions: tt.extensions}}
+			perms, err := flow.callback(ctx)(fakeConnMetadata{}, cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := PortForwardingPermitted(perms); got != tt.want {
+				t.Errorf("PortForwardingPermitted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAgentForwardingPermitted(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		perms *gossh.Permissions
+		want  bool
+	}{
+		{"certificate with permit-agent-forwarding", certificatePermissions(&gossh.Permissions{Extensions: map[string]string{"permit-agent-forwarding": ""}}), true},
+		{"certificate without permit-agent-forwarding", certificatePermissions(&gossh.Permissions{Extensions: map[string]string{"permit-port-forwarding": ""}}), false},
+		{"key without options", &gossh.Permissions{}, true},
+		{"no-agent-forwarding", &gossh.Permissions{Extensions: map[string]string{"no-agent-forwarding": ""}}, false},
+		{"no-agent-forwarding in capitals", &gossh.Permissions{Extensions: map[string]string{"NO-AGENT-FORWARDING": ""}}, false},
+		{"restrict", &gossh.Permissions{Extensions: map[string]string{"restrict": ""}}, false},
+		{"restrict and agent-forwarding", &gossh.Permissions{Extensions: map[string]string{"restrict": "", "agent-forwarding": ""}}, true},
+		{"restrict and port-forwarding", &gossh.Permissions{Extensions: map[string]string{"restrict": "", "port-forwarding": ""}}, false},
+	} {
+		if got := AgentForwardingPermitted(tt.perms); got != tt.want {
+			t.Errorf("%s: AgentForwardingPermitted() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPortForwardingPermittedByAuthorizedKey(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []string
+		want bool
+	}{
+		{"no options", nil, true},
+		{"no-port-forwarding", []string{"no-port-forwarding"}, false},
+		{"restrict", []string{"restrict"}, false},
+		{"restrict and port-forwarding", []string{"restrict", "port-forwarding"}, true},
+		{"permitopen", []string{`permitopen="localhost:80"`}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			criticalOptions, extensions := ParseAuthorizedKeyOptions(tt.opts)
+			perms := &gossh.Permissions{CriticalOptions: criticalOptions, Extensions: extensions}
+			if got := PortForwardingPermitted(perms); got != tt.want {
+				t.Errorf("PortForwardingPermitted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if !PortForwardingPermitted(nil) {
+		t.Error("PortForwardingPermitted(nil) = false, want true")
+	}
+}
+
+func TestX11ForwardingPermitted(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		perms *gossh.Permissions
+		want  bool
+	}{
+		{"certificate with permit-X11-forwarding", certificatePermissions(&gossh.Permissions{Extensions: map[string]string{"permit-X11-forwarding": ""}}), true},
+		{"certificate without permit-X11-forwarding", certificatePermissions(&gossh.Permissions{Extensions: map[string]string{"permit-agent-forwarding": ""}}), false},
+		{"key without options", &gossh.Permissions{}, true},
+		{"no-X11-forwarding", &gossh.Permissions{Extensions: map[string]string{"no-X11-forwarding": ""}}, false},
+		{"no-x11-forwarding in lowercase", &gossh.Permissions{Extensions: map[string]string{"no-x11-forwarding": ""}}, false},
+		{"restrict", &gossh.Permissions{Extensions: map[string]string{"restrict": ""}}, false},
+		{"restrict and X11-forwarding", &gossh.Permissions{Extensions: map[string]string{"restrict": "", "X11-forwarding": ""}}, true},
+	} {
+		if got := X11ForwardingPermitted(tt.perms); got != tt.want {
+			t.Errorf("%s: X11ForwardingPermitted() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
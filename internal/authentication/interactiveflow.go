@@ -39,7 +39,7 @@ func (upf InteractiveFlow) CaddyModule() caddy.ModuleInfo {
 // Provision sets up and loads the providers of conforming to UserInteractiveAuthenticator interface
 func (upf *InteractiveFlow) Provision(ctx caddy.Context) error {
 	upf.logger = ctx.Logger(upf)
-	upf.authenticatorLogger = authenticatorLogger{upf.logger}
+	upf.authenticatorLogger = authenticatorLogger{upf.logger, "interactive"}
 
 	upf.providers = make(map[string]UserInteractiveAuthenticator)
 	mods, err := ctx.LoadModule(upf, "ProvidersRaw")
@@ -40,7 +40,7 @@ func (PublicKeyFlow) CaddyModule() caddy.ModuleInfo {
 // Provision sets up and loads the providers of conforming to UserPublicKeyAuthenticator interface
 func (pk *PublicKeyFlow) Provision(ctx caddy.Context) error {
 	pk.logger = ctx.Logger(pk)
-	pk.authenticatorLogger = authenticatorLogger{pk.logger}
+	pk.authenticatorLogger = authenticatorLogger{pk.logger, "public_key"}
 
 	pk.providers = make(map[string]UserPublicKeyAuthenticator)
 	mods, err := ctx.LoadModule(pk, "ProvidersRaw")
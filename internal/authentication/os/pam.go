@@ -8,6 +8,7 @@ import (
 	user "github.com/tweekmonster/luser"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/kadeessh/kadeessh/internal/authentication"
 	"github.com/kadeessh/kadeessh/internal/session"
 	pam "github.com/msteinert/pam/v2"
@@ -40,6 +41,18 @@ func (pm *OS) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. The module takes no options. Syntax:
+//
+//	os
+func (pm *OS) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
 // AuthenticateUser uses PAM to authenticate users
 func (pm OS) AuthenticateUser(sshctx session.ConnMetadata, password []byte) (authentication.User, bool, error) {
 	pm.logger.Info("auth begin", zap.String("username", sshctx.User()))
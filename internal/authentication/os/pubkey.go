@@ -7,6 +7,7 @@ import (
 	user "github.com/tweekmonster/luser"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/kadeessh/kadeessh/internal/authentication"
 	"github.com/kadeessh/kadeessh/internal/session"
 	"github.com/kadeessh/kadeessh/internal/ssh"
@@ -17,6 +18,7 @@ import (
 var (
 	_ authentication.UserPublicKeyAuthenticator = (*PublicKey)(nil)
 	_ caddy.Provisioner                         = (*PublicKey)(nil)
+	_ caddyfile.Unmarshaler                     = (*PublicKey)(nil)
 )
 
 func init() {
@@ -46,6 +48,18 @@ func (o *PublicKey) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. The module takes no options. Syntax:
+//
+//	os
+func (o *PublicKey) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
 // AuthenticateUser loads the $HOME`/.ssh/authorized_keys` of the user to look for a matching key. The user is denied
 // if none of the list of keys in `authorized_keys` match the submitted keys.
 func (o *PublicKey) AuthenticateUser(ctx session.ConnMetadata, pubkey gossh.PublicKey) (authentication.User, bool, error) {
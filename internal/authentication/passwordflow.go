@@ -44,7 +44,7 @@ func (paf PasswordAuthFlow) CaddyModule() caddy.ModuleInfo {
 // Provision sets up and loads the providers of conforming to UserPasswordAuthenticator interface
 func (paf *PasswordAuthFlow) Provision(ctx caddy.Context) error {
 	paf.logger = ctx.Logger(paf)
-	paf.authenticatorLogger = authenticatorLogger{paf.logger}
+	paf.authenticatorLogger = authenticatorLogger{paf.logger, "password_auth"}
 
 	paf.providers = make(map[string]UserPasswordAuthenticator)
 	mods, err := ctx.LoadModule(paf, "ProvidersRaw")
@@ -0,0 +1,95 @@
+package static
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ caddyfile.Unmarshaler = (*Static)(nil)
+	_ caddyfile.Unmarshaler = (*StaticPublicKeyProvider)(nil)
+)
+
+// UnmarshalCaddyfile sets up the static password provider from Caddyfile tokens. Syntax:
+//
+//	static {
+//		hash    <algorithm>
+//		account <username> <hashed_password_base64> [<salt_base64>] {
+//			id   <id>
+//			home <path>
+//		}
+//	}
+func (up *Static) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "hash":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				up.HashRaw = caddyconfig.JSONModuleObject(struct{}{}, "algorithm", d.Val(), nil)
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "account":
+				var acc Account
+				args := d.RemainingArgs()
+				switch len(args) {
+				case 3:
+					acc.Salt = args[2]
+					fallthrough
+				case 2:
+					acc.Uname, acc.Password = args[0], args[1]
+				default:
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "id":
+						if !d.AllArgs(&acc.ID) {
+							return d.ArgErr()
+						}
+					case "home":
+						if !d.AllArgs(&acc.Home) {
+							return d.ArgErr()
+						}
+					default:
+						return d.Errf("unrecognized account option '%s'", d.Val())
+					}
+				}
+				up.Accounts = append(up.Accounts, acc)
+			default:
+				return d.Errf("unrecognized static provider option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the static public key provider from Caddyfile tokens. The key
+// sources are URLs, e.g. file:///path/to/file or https://github.com/username.keys. Syntax:
+//
+//	static {
+//		user <username> <key_sources...>
+//	}
+func (pk *StaticPublicKeyProvider) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			if d.Val() != "user" {
+				return d.Errf("unrecognized static provider option '%s'", d.Val())
+			}
+			args := d.RemainingArgs()
+			if len(args) < 2 {
+				return d.ArgErr()
+			}
+			pk.Users = append(pk.Users, User{Username: args[0], Keys: args[1:]})
+		}
+	}
+	return nil
+}
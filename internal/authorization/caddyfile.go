@@ -0,0 +1,82 @@
+package authorization
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ caddyfile.Unmarshaler = (*Public)(nil)
+	_ caddyfile.Unmarshaler = (*Reject)(nil)
+	_ caddyfile.Unmarshaler = (*MaxSession)(nil)
+	_ caddyfile.Unmarshaler = (*Chained)(nil)
+)
+
+// UnmarshalCaddyfile sets up the authorizer from Caddyfile tokens. The module takes no options. Syntax:
+//
+//	public
+func (ms *Public) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return noOptions(d)
+}
+
+// UnmarshalCaddyfile sets up the authorizer from Caddyfile tokens. The module takes no options. Syntax:
+//
+//	reject
+func (ms *Reject) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return noOptions(d)
+}
+
+// UnmarshalCaddyfile sets up the authorizer from Caddyfile tokens. Syntax:
+//
+//	max_session <max_sessions>
+func (ms *MaxSession) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		var val string
+		if !d.AllArgs(&val) {
+			return d.ArgErr()
+		}
+		n, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return d.Errf("parsing max_sessions: %v", err)
+		}
+		ms.MaxSessions = n
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the chain from Caddyfile tokens. The authorizers are
+// consulted in the order of the block. Syntax:
+//
+//	chained {
+//		<authorizer> ...
+//	}
+func (c *Chained) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			name := d.Val()
+			unm, err := caddyfile.UnmarshalModule(d, "ssh.session.authorizers."+name)
+			if err != nil {
+				return err
+			}
+			c.AuthorizersRaw = append(c.AuthorizersRaw, caddyconfig.JSONModuleObject(unm, "authorizer", name, nil))
+		}
+	}
+	if len(c.AuthorizersRaw) == 0 {
+		return d.Err("chained authorizer requires at least one authorizer")
+	}
+	return nil
+}
+
+func noOptions(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
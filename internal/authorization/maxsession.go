@@ -5,6 +5,7 @@ import (
 	"sync/atomic"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/metrics"
 	"github.com/kadeessh/kadeessh/internal/session"
 	"github.com/kadeessh/kadeessh/internal/ssh"
 	"go.uber.org/zap"
@@ -48,6 +49,7 @@ func (ms *MaxSession) Authorize(sess session.Session) (DeauthorizeFunc, bool, er
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 	if (ms.currentSessionCount + 1) > ms.MaxSessions {
+		metrics.MaxSessionsRejected.Inc()
 		ms.logger.Info("session count exceeds max",
 			zap.Uint64("max_session_count", ms.MaxSessions),
 			zap.Uint64("current_session_count", ms.currentSessionCount),
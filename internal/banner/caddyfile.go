@@ -0,0 +1,35 @@
+package banner
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var _ caddyfile.Unmarshaler = (*Template)(nil)
+
+// UnmarshalCaddyfile sets up the template from Caddyfile tokens. The body may be given
+// inline or in the block, where heredocs are convenient for multi-line banners. Syntax:
+//
+//	template [<body>] {
+//		body <body>
+//	}
+func (t *Template) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			t.Body = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "body":
+				if !d.AllArgs(&t.Body) {
+					return d.ArgErr()
+				}
+			default:
+				return d.Errf("unrecognized template option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,578 @@
+package internalcaddyssh
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/kadeessh/kadeessh/internal/authentication"
+	"github.com/kadeessh/kadeessh/internal/caddyfileutil"
+	"github.com/kadeessh/kadeessh/internal/tunnel"
+)
+
+func init() {
+	httpcaddyfile.RegisterGlobalOption("ssh", parseApp)
+}
+
+var (
+	_ caddyfile.Unmarshaler = (*SSH)(nil)
+	_ caddyfile.Unmarshaler = (*Server)(nil)
+	_ caddyfile.Unmarshaler = (*Configurator)(nil)
+	_ caddyfile.Unmarshaler = (*Actor)(nil)
+	_ caddyfile.Unmarshaler = (*ProvidedConfig)(nil)
+	_ caddyfile.Unmarshaler = (*MatchRemoteIP)(nil)
+	_ caddyfile.Unmarshaler = (*MatchNot)(nil)
+	_ caddyfile.Unmarshaler = (*MatchUser)(nil)
+	_ caddyfile.Unmarshaler = (*MatchGroup)(nil)
+	_ caddyfile.Unmarshaler = (*MatchExtension)(nil)
+	_ caddyfile.Unmarshaler = (*MatchCriticalOption)(nil)
+	_ caddyfile.Unmarshaler = (*MatchConfigRemoteIP)(nil)
+	_ caddyfile.Unmarshaler = (*MatchConfigLocalIP)(nil)
+	_ caddyfile.Unmarshaler = (*MatchConfigNot)(nil)
+)
+
+// parseApp parses the `ssh` global option into the SSH app. The option may be
+// repeated, in which case the servers of the blocks are merged.
+func parseApp(d *caddyfile.Dispenser, existingVal any) (any, error) {
+	app := new(SSH)
+	if existing, ok := existingVal.(httpcaddyfile.App); ok {
+		if err := json.Unmarshal(existing.Value, app); err != nil {
+			return nil, d.Errf("loading the previous ssh option: %v", err)
+		}
+	}
+	if err := app.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+	return httpcaddyfile.App{
+		Name:  "ssh",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+// UnmarshalCaddyfile sets up the SSH app from Caddyfile tokens. Syntax:
+//
+//	ssh {
+//		grace_period <duration>
+//		server <name> [<address>] {
+//			...
+//		}
+//	}
+func (app *SSH) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "grace_period":
+				dur, err := parseDuration(d)
+				if err != nil {
+					return err
+				}
+				app.GracePeriod = dur
+			case "server":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				if _, ok := app.Servers[name]; ok {
+					return d.Errf("server '%s' is already defined", name)
+				}
+				srv := new(Server)
+				if err := srv.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+					return err
+				}
+				if app.Servers == nil {
+					app.Servers = make(map[string]*Server)
+				}
+				app.Servers[name] = srv
+			default:
+				return d.Errf("unrecognized ssh option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the server from Caddyfile tokens. The first token is
+// the name of the server. Syntax:
+//
+//	<name> [<address>] {
+//		address                    <address>
+//		localforward               <module> ...
+//		reverseforward             <module> ...
+//		localforward_streamlocal   <module> ...
+//		reverseforward_streamlocal <module> ...
+//		reverse_tunnels {
+//			name  <template>
+//			hosts <patterns...>
+//		}
+//		pty                        <module> ...
+//		agent_forwarding           <module> ...
+//		x11_forwarding             <module> ...
+//		authorize                  <module> ...
+//		idle_timeout               <duration>
+//		max_timeout                <duration>
+//		subsystem                  <module> ...
+//		config {
+//			match <matcher> ...
+//			loader <module> ...
+//		}
+//		actor {
+//			match <matcher> ...
+//			act <module> ...
+//			final
+//		}
+//	}
+//
+// The `config` and `actor` directives may be repeated, and they're consulted in order.
+func (s *Server) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			s.Address = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "address":
+				if !d.AllArgs(&s.Address) {
+					return d.ArgErr()
+				}
+			case "localforward":
+				s.LocalForwardRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.ask.localforward", "forward")
+			case "reverseforward":
+				s.ReverseForwardRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.ask.reverseforward", "forward")
+			case "localforward_streamlocal":
+				s.LocalStreamLocalRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.ask.streamlocal", "forward")
+			case "reverseforward_streamlocal":
+				s.ReverseStreamLocalRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.ask.streamlocal", "forward")
+			case "reverse_tunnels":
+				s.ReverseTunnels = new(tunnel.Config)
+				err = s.ReverseTunnels.UnmarshalCaddyfile(d.NewFromNextSegment())
+			case "pty":
+				s.PtyAskRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.ask.pty", "pty")
+			case "agent_forwarding":
+				s.AgentForwardRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.ask.agent_forwarding", "forward")
+			case "x11_forwarding":
+				s.X11ForwardRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.ask.x11", "forward")
+			case "authorize":
+				s.AuthorizeRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.session.authorizers", "authorizer")
+			case "idle_timeout":
+				s.IdleTimeout, err = parseDuration(d)
+			case "max_timeout":
+				s.MaxTimeout, err = parseDuration(d)
+			case "subsystem":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				name := d.Val()
+				if _, ok := s.SubsystemRaw[name]; ok {
+					return d.Errf("subsystem '%s' is already defined", name)
+				}
+				unm, err := caddyfile.UnmarshalModule(d, "ssh.subsystem."+name)
+				if err != nil {
+					return err
+				}
+				if s.SubsystemRaw == nil {
+					s.SubsystemRaw = make(caddy.ModuleMap)
+				}
+				s.SubsystemRaw[name] = caddyconfig.JSON(unm, nil)
+			case "config":
+				var cfg Configurator
+				if err := cfg.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+					return err
+				}
+				s.Config = append(s.Config, cfg)
+			case "actor":
+				var actor Actor
+				if err := actor.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+					return err
+				}
+				s.Actors = append(s.Actors, actor)
+			default:
+				return d.Errf("unrecognized server option '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.Address == "" {
+		return d.Err("server address is required")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the configurator from Caddyfile tokens. Syntax:
+//
+//	config {
+//		match <matcher> ...
+//		match {
+//			<matcher> ...
+//		}
+//		loader <module> ...
+//	}
+//
+// Each `match` directive adds a matcher set, and the loader applies if any of the sets matches.
+func (c *Configurator) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "match":
+				set, err := unmarshalMatcherSet(d, "ssh.config_matchers")
+				if err != nil {
+					return err
+				}
+				c.MatcherSetsRaw = append(c.MatcherSetsRaw, set)
+			case "loader":
+				raw, err := caddyfileutil.UnmarshalInlineModule(d, "ssh.config.loaders", "loader")
+				if err != nil {
+					return err
+				}
+				c.ConfiguratorRaw = raw
+			default:
+				return d.Errf("unrecognized config option '%s'", d.Val())
+			}
+		}
+	}
+	if len(c.ConfiguratorRaw) == 0 {
+		return d.Err("config loader is required")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the actor from Caddyfile tokens. Syntax:
+//
+//	actor {
+//		match <matcher> ...
+//		match {
+//			<matcher> ...
+//		}
+//		act <module> ...
+//		final
+//	}
+//
+// Each `match` directive adds a matcher set, and the actor acts if any of the sets matches.
+func (a *Actor) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "match":
+				set, err := unmarshalMatcherSet(d, "ssh.actor_matchers")
+				if err != nil {
+					return err
+				}
+				a.MatcherSetsRaw = append(a.MatcherSetsRaw, set)
+			case "act":
+				raw, err := caddyfileutil.UnmarshalInlineModule(d, "ssh.actors", "action")
+				if err != nil {
+					return err
+				}
+				a.ActorRaw = raw
+			case "final":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				a.Final = true
+			default:
+				return d.Errf("unrecognized actor option '%s'", d.Val())
+			}
+		}
+	}
+	if len(a.ActorRaw) == 0 {
+		return d.Err("actor act is required")
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the provided config from Caddyfile tokens. Syntax:
+//
+//	provided {
+//		signer         <module> ...
+//		key_exchanges  <algorithms...>
+//		ciphers        <algorithms...>
+//		macs           <algorithms...>
+//		no_client_auth
+//		max_auth_tries <n>
+//		server_version <version>
+//		banner         <engine> ...
+//		authentication {
+//			...
+//		}
+//	}
+func (c *ProvidedConfig) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "signer":
+				c.SignerRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.signers", "module")
+			case "key_exchanges":
+				c.KeyExchanges, err = remainingArgs(d)
+			case "ciphers":
+				c.Ciphers, err = remainingArgs(d)
+			case "macs":
+				c.MACs, err = remainingArgs(d)
+			case "no_client_auth":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				c.NoClientAuth = true
+			case "max_auth_tries":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				c.MaxAuthTries, err = strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("parsing max_auth_tries: %v", err)
+				}
+			case "server_version":
+				if !d.AllArgs(&c.ServerVersion) {
+					return d.ArgErr()
+				}
+			case "banner":
+				c.BannerRaw, err = caddyfileutil.UnmarshalInlineModule(d, "ssh.banner", "engine")
+			case "authentication":
+				c.Authentication = new(authentication.Config)
+				err = c.Authentication.UnmarshalCaddyfile(d.NewFromNextSegment())
+			default:
+				return d.Errf("unrecognized provided config option '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	remote_ip <ranges...>
+func (m *MatchRemoteIP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Ranges = append(m.Ranges, d.RemainingArgs()...)
+		if d.NextBlock(0) {
+			return d.Err("malformed remote_ip matcher: blocks are not supported")
+		}
+	}
+	if len(m.Ranges) == 0 {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. The matchers of
+// the set are negated together. Syntax:
+//
+//	not <matcher> ...
+//	not {
+//		<matcher> ...
+//	}
+func (m *MatchNot) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		set, err := unmarshalMatcherSet(d, "ssh.actor_matchers")
+		if err != nil {
+			return err
+		}
+		m.MatcherSetsRaw = append(m.MatcherSetsRaw, set)
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	user <users...>
+func (m *MatchUser) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Users = append(m.Users, d.RemainingArgs()...)
+		if d.NextBlock(0) {
+			return d.Err("malformed user matcher: blocks are not supported")
+		}
+	}
+	if len(m.Users) == 0 {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	group <groups...>
+func (m *MatchGroup) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Groups = append(m.Groups, d.RemainingArgs()...)
+		if d.NextBlock(0) {
+			return d.Err("malformed group matcher: blocks are not supported")
+		}
+	}
+	if len(m.Groups) == 0 {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	extension <name> [<values...>]
+//	extension {
+//		<name> [<values...>]
+//	}
+func (m *MatchExtension) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if *m == nil {
+		*m = make(MatchExtension)
+	}
+	return unmarshalKeyValues(d, *m)
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	critical_option <name> [<values...>]
+//	critical_option {
+//		<name> [<values...>]
+//	}
+func (m *MatchCriticalOption) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	if *m == nil {
+		*m = make(MatchCriticalOption)
+	}
+	return unmarshalKeyValues(d, *m)
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	remote_ip <ranges...>
+func (m *MatchConfigRemoteIP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Ranges = append(m.Ranges, d.RemainingArgs()...)
+		if d.NextBlock(0) {
+			return d.Err("malformed remote_ip matcher: blocks are not supported")
+		}
+	}
+	if len(m.Ranges) == 0 {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. Syntax:
+//
+//	local_ip <ranges...>
+func (m *MatchConfigLocalIP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Ranges = append(m.Ranges, d.RemainingArgs()...)
+		if d.NextBlock(0) {
+			return d.Err("malformed local_ip matcher: blocks are not supported")
+		}
+	}
+	if len(m.Ranges) == 0 {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the matcher from Caddyfile tokens. The matchers of
+// the set are negated together. Syntax:
+//
+//	not <matcher> ...
+//	not {
+//		<matcher> ...
+//	}
+func (m *MatchConfigNot) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		set, err := unmarshalMatcherSet(d, "ssh.config_matchers")
+		if err != nil {
+			return err
+		}
+		m.MatcherSetsRaw = append(m.MatcherSetsRaw, set)
+	}
+	return nil
+}
+
+// unmarshalMatcherSet loads the matcher set following the current token, which is either
+// a single matcher on the same line or a block of matchers
+func unmarshalMatcherSet(d *caddyfile.Dispenser, namespace string) (caddy.ModuleMap, error) {
+	set := make(caddy.ModuleMap)
+	add := func() error {
+		name := d.Val()
+		if _, ok := set[name]; ok {
+			return d.Errf("matcher '%s' is already defined in the set", name)
+		}
+		unm, err := caddyfile.UnmarshalModule(d, namespace+"."+name)
+		if err != nil {
+			return err
+		}
+		set[name] = caddyconfig.JSON(unm, nil)
+		return nil
+	}
+	if d.NextArg() {
+		return set, add()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		if err := add(); err != nil {
+			return nil, err
+		}
+	}
+	if len(set) == 0 {
+		return nil, d.Err("empty matcher set")
+	}
+	return set, nil
+}
+
+// unmarshalKeyValues collects the `<key> [<values...>]` lines, either on the line of
+// the current token or in its block, into the map
+func unmarshalKeyValues(d *caddyfile.Dispenser, m map[string][]string) error {
+	add := func() {
+		key := d.Val()
+		m[key] = append(m[key], d.RemainingArgs()...)
+	}
+	for d.Next() {
+		if d.NextArg() {
+			add()
+			continue
+		}
+		for d.NextBlock(0) {
+			add()
+		}
+	}
+	if len(m) == 0 {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func parseDuration(d *caddyfile.Dispenser) (caddy.Duration, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return 0, d.Errf("parsing duration: %v", err)
+	}
+	if d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	return caddy.Duration(dur), nil
+}
+
+func remainingArgs(d *caddyfile.Dispenser) ([]string, error) {
+	args := d.RemainingArgs()
+	if len(args) == 0 {
+		return nil, d.ArgErr()
+	}
+	return args, nil
+}
@@ -0,0 +1,709 @@
+package internalcaddyssh_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	_ "github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	_ "github.com/kadeessh/kadeessh/internal/actors"
+	_ "github.com/kadeessh/kadeessh/internal/authentication"
+	_ "github.com/kadeessh/kadeessh/internal/authentication/certificate"
+	_ "github.com/kadeessh/kadeessh/internal/authentication/os"
+	_ "github.com/kadeessh/kadeessh/internal/authentication/static"
+	_ "github.com/kadeessh/kadeessh/internal/authorization"
+	_ "github.com/kadeessh/kadeessh/internal/banner"
+	_ "github.com/kadeessh/kadeessh/internal/signer"
+	_ "github.com/kadeessh/kadeessh/internal/subsystem"
+)
+
+func TestCaddyfileAdapter(t *testing.T) {
+	tests := []struct {
+		name      string
+		caddyfile string
+		want      string
+		wantErr   string
+	}{
+		{
+			name: "shell with static password",
+			caddyfile: `{
+	ssh {
+		grace_period 2s
+		server srv0 tcp/0.0.0.0:2000-2012 {
+			pty allow
+			config {
+				loader provided {
+					authentication {
+						username_password static {
+							account user1 JDJhJDE0JDcxOENoL2du
+						}
+					}
+				}
+			}
+			actor {
+				match user user1
+				act shell
+			}
+		}
+	}
+}`,
+			want: `{
+	"apps": {
+		"ssh": {
+			"grace_period": 2000000000,
+			"servers": {
+				"srv0": {
+					"address": "tcp/0.0.0.0:2000-2012",
+					"pty": {"pty": "allow"},
+					"configs": [{
+						"config": {
+							"loader": "provided",
+							"authentication": {
+								"username_password": {
+									"providers": {
+										"static": {
+											"accounts": [{"name": "user1", "password": "JDJhJDE0JDcxOENoL2du"}]
+										}
+									}
+								}
+							}
+						}
+					}],
+					"actors": [{
+						"match": [{"user": {"users": ["user1"]}}],
+						"act": {"action": "shell", "force_command": ""}
+					}]
+				}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "matchers, authorizers, forwarding, and subsystems",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			localforward remote_ip 10.0.0.0/8
+			reverseforward deny
+			agent_forwarding user alice bob
+			x11_forwarding allow
+			localforward_streamlocal path /var/run/docker.sock /run/user/{ssh.user}/*.sock
+			reverseforward_streamlocal allow
+			authorize chained {
+				max_session 2
+				public
+			}
+			idle_timeout 5m
+			subsystem sftp /srv/sftp/{ssh.user} {
+				read_only
+			}
+			config {
+				match {
+					remote_ip 192.168.0.0/16
+					local_ip 192.168.1.1
+				}
+				match not remote_ip 10.0.0.0/8
+				loader provided {
+					no_client_auth
+					max_auth_tries 3
+					signer file /etc/ssh/ssh_host_ed25519_key {
+						key /etc/ssh/ssh_host_rsa_key secret
+					}
+					banner template "Hello, {{ .User }}"
+				}
+			}
+			config {
+				loader provided {
+					authentication {
+						deny_users root
+						public_key {
+							provider os
+						}
+					}
+				}
+			}
+			actor {
+				match {
+					group wheel
+					extension permit-pty
+				}
+				match critical_option force-command
+				act static_response "go away"
+				final
+			}
+			actor {
+				match not {
+					user root
+				}
+				act asciinema_recorder {
+					handler shell {
+						env TERM xterm
+						force_pty
+						kill_grace_period 10s
+						accept_env LANG LC_*
+						environment_file /etc/environment
+						permit_user_environment
+						jail {
+							chroot_directory /srv/jail
+							namespaces user network
+							rlimit nofile 1024
+							rlimit nproc 64
+							cgroup /sys/fs/cgroup/ssh/{ssh.user}
+							no_new_privs
+						}
+					}
+					max_size 1024
+					include_metadata false
+				}
+			}
+		}
+	}
+}`,
+			want: `{
+	"apps": {
+		"ssh": {
+			"servers": {
+				"srv0": {
+					"address": ":2000",
+					"localforward": {"forward": "remote_ip", "ranges": ["10.0.0.0/8"]},
+					"reverseforward": {"forward": "deny"},
+					"agent_forwarding": {"forward": "user", "users": ["alice", "bob"]},
+					"x11_forwarding": {"forward": "allow"},
+					"localforward_streamlocal": {"forward": "path", "paths": ["/var/run/docker.sock", "/run/user/{ssh.user}/*.sock"]},
+					"reverseforward_streamlocal": {"forward": "allow"},
+					"authorize": {
+						"authorizer": "chained",
+						"authorize": [
+							{"authorizer": "max_session", "max_sessions": 2},
+							{"authorizer": "public"}
+						]
+					},
+					"idle_timeout": 300000000000,
+					"subsystems": {
+						"sftp": {"root": "/srv/sftp/{ssh.user}", "read_only": true}
+					},
+					"configs": [
+						{
+							"match": [
+								{
+									"remote_ip": {"ranges": ["192.168.0.0/16"]},
+									"local_ip": {"ranges": ["192.168.1.1"]}
+								},
+								{
+									"not": [{"remote_ip": {"ranges": ["10.0.0.0/8"]}}]
+								}
+							],
+							"config": {
+								"loader": "provided",
+								"no_client_auth": true,
+								"max_auth_tries": 3,
+								"signer": {
+									"module": "file",
+									"keys": [
+										{"source": "/etc/ssh/ssh_host_ed25519_key"},
+										{"source": "/etc/ssh/ssh_host_rsa_key", "passphrase": "secret"}
+									]
+								},
+								"banner": {"engine": "template", "body": "Hello, {{ .User }}"}
+							}
+						},
+						{
+							"config": {
+								"loader": "provided",
+								"authentication": {
+									"deny_users": ["root"],
+									"public_key": {"providers": {"os": {}}}
+								}
+							}
+						}
+					],
+					"actors": [
+						{
+							"match": [
+								{
+									"group": {"groups": ["wheel"]},
+									"extension": {"permit-pty": null}
+								},
+								{
+									"critical_option": {"force-command": null}
+								}
+							],
+							"act": {"action": "static_response", "response": "go away"},
+							"final": true
+						},
+						{
+							"match": [{"not": [{"user": {"users": ["root"]}}]}],
+							"act": {
+								"action": "asciinema_recorder",
+								"handler": {
+									"action": "shell",
+									"force_command": "",
+									"env": {"TERM": "xterm"},
+									"force_pty": true,
+									"kill_grace_period": 10000000000,
+									"accept_env": ["LANG", "LC_*"],
+									"environment_file": "/etc/environment",
+									"permit_user_environment": true,
+									"jail": {
+										"chroot_directory": "/srv/jail",
+										"namespaces": ["user", "network"],
+										"rlimits": {"nofile": 1024, "nproc": 64},
+										"cgroup": "/sys/fs/cgroup/ssh/{ssh.user}",
+										"no_new_privs": true
+									}
+								},
+								"max_size": 1024,
+								"include_metadata": false
+							}
+						}
+					]
+				}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "repeated ssh option merges the servers",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000
+	}
+	ssh {
+		grace_period 1s
+		server srv1 :2001
+	}
+}`,
+			want: `{
+	"apps": {
+		"ssh": {
+			"grace_period": 1000000000,
+			"servers": {
+				"srv0": {"address": ":2000"},
+				"srv1": {"address": ":2001"}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "forwarding policies",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			localforward policy {
+				deny {
+					hosts 10.0.0.0/8
+				}
+				allow {
+					groups dba
+					hosts *.db.internal
+					ports 5432 6000-6010
+				}
+			}
+			reverseforward policy {
+				gateway_ports clientspecified
+				max_listeners 4
+				ignore_key_options
+				allow {
+					users alice
+					ports 8000-8100
+				}
+			}
+		}
+	}
+}`,
+			want: `{
+	"apps": {
+		"ssh": {
+			"servers": {
+				"srv0": {
+					"address": ":2000",
+					"localforward": {
+						"forward": "policy",
+						"rules": [
+							{"action": "deny", "hosts": ["10.0.0.0/8"]},
+							{"action": "allow", "groups": ["dba"], "hosts": ["*.db.internal"], "ports": ["5432", "6000-6010"]}
+						]
+					},
+					"reverseforward": {
+						"forward": "policy",
+						"gateway_ports": "clientspecified",
+						"max_listeners": 4,
+						"ignore_key_options": true,
+						"rules": [{"action": "allow", "users": ["alice"], "ports": ["8000-8100"]}]
+					}
+				}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "recorded proxy",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			actor {
+				act asciinema_recorder {
+					handler proxy {ssh.user}.internal {
+						user deploy
+						private_key_file /etc/kadeessh/upstream_key
+						forwarded_agent
+						known_hosts /etc/kadeessh/known_hosts
+						dial_timeout 5s
+					}
+				}
+			}
+		}
+	}
+}`,
+			want: `{
+	"apps": {
+		"ssh": {
+			"servers": {
+				"srv0": {
+					"address": ":2000",
+					"actors": [
+						{
+							"act": {
+								"action": "asciinema_recorder",
+								"handler": {
+									"action": "proxy",
+									"upstream": "{ssh.user}.internal",
+									"user": "deploy",
+									"private_key_file": "/etc/kadeessh/upstream_key",
+									"forwarded_agent": true,
+									"known_hosts": ["/etc/kadeessh/known_hosts"],
+									"dial_timeout": 5000000000
+								}
+							}
+						}
+					]
+				}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "recorded input",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			actor {
+				match user ops
+				act asciinema_recorder {
+					handler shell
+					capture_input
+					redact_prompts "(?i)token:\s*$" "^PIN:"
+				}
+			}
+		}
+	}
+}`,
+			want: `{
+	"apps": {
+		"ssh": {
+			"servers": {
+				"srv0": {
+					"address": ":2000",
+					"actors": [
+						{
+							"match": [{"user": {"users": ["ops"]}}],
+							"act": {
+								"action": "asciinema_recorder",
+								"handler": {"action": "shell", "force_command": ""},
+								"capture_input": true,
+								"redact_prompts": ["(?i)token:\\s*$", "^PIN:"]
+							}
+						}
+					]
+				}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "sealed recordings",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			actor {
+				act asciinema_recorder {
+					handler shell
+					recipients age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p age1lggyhqrw2nlhcxprm67z43rta597azn8gknawjehu9d9dl0jq3yqqvfafg
+					signing_key_file /etc/kadeessh/recording_ed25519
+				}
+			}
+		}
+	}
+}`,
+			want: `{
+	"apps": {
+		"ssh": {
+			"servers": {
+				"srv0": {
+					"address": ":2000",
+					"actors": [
+						{
+							"act": {
+								"action": "asciinema_recorder",
+								"handler": {"action": "shell", "force_command": ""},
+								"recipients": ["age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p", "age1lggyhqrw2nlhcxprm67z43rta597azn8gknawjehu9d9dl0jq3yqqvfafg"],
+								"signing_key_file": "/etc/kadeessh/recording_ed25519"
+							}
+						}
+					]
+				}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "container",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			actor {
+				act container ubuntu:24.04 {
+					socket /run/podman/podman.sock
+					name sandbox-{ssh.user}
+					shell /bin/bash -l
+					user {ssh.user}
+					env LANG C.UTF-8
+					binds /srv/home/{ssh.user}:/home/{ssh.user} /srv/shared:/shared:ro
+					remove
+				}
+			}
+		}
+	}
+}`,
+			want: `{
+	"apps": {
+		"ssh": {
+			"servers": {
+				"srv0": {
+					"address": ":2000",
+					"actors": [
+						{
+							"act": {
+								"action": "container",
+								"socket": "/run/podman/podman.sock",
+								"image": "ubuntu:24.04",
+								"name": "sandbox-{ssh.user}",
+								"shell": ["/bin/bash", "-l"],
+								"user": "{ssh.user}",
+								"env": {"LANG": "C.UTF-8"},
+								"binds": ["/srv/home/{ssh.user}:/home/{ssh.user}", "/srv/shared:/shared:ro"],
+								"remove": true
+							}
+						}
+					]
+				}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "shadow",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			actor {
+				match user support
+				act shadow_watch {
+					assist
+				}
+				final
+			}
+			actor {
+				act shadow {
+					handler shell
+					assist
+					banner "{ssh.shadow.observer} joined"
+					end_banner "{ssh.shadow.observer} left"
+				}
+			}
+		}
+	}
+}`,
+			want: `{
+	"apps": {
+		"ssh": {
+			"servers": {
+				"srv0": {
+					"address": ":2000",
+					"actors": [
+						{
+							"match": [{"user": {"users": ["support"]}}],
+							"act": {
+								"action": "shadow_watch",
+								"assist": true
+							},
+							"final": true
+						},
+						{
+							"act": {
+								"action": "shadow",
+								"handler": {"action": "shell", "force_command": ""},
+								"assist": true,
+								"banner": "{ssh.shadow.observer} joined",
+								"end_banner": "{ssh.shadow.observer} left"
+							}
+						}
+					]
+				}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "jump host",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			localforward jump {
+				group ops *.internal 10.0.0.0/24
+				group dba pg.db.internal:5432
+				group ops [fd00::/8]:2222
+			}
+		}
+	}
+}`,
+			want: `{
+	"apps": {
+		"ssh": {
+			"servers": {
+				"srv0": {
+					"address": ":2000",
+					"localforward": {
+						"forward": "jump",
+						"groups": {
+							"dba": ["pg.db.internal:5432"],
+							"ops": ["*.internal", "10.0.0.0/24", "[fd00::/8]:2222"]
+						}
+					}
+				}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "reverse tunnels",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			reverseforward allow
+			reverse_tunnels {
+				name {ssh.user}-{ssh.bind_host}
+				hosts *.dev
+			}
+		}
+	}
+}`,
+			want: `{
+	"apps": {
+		"ssh": {
+			"servers": {
+				"srv0": {
+					"address": ":2000",
+					"reverseforward": {"forward": "allow"},
+					"reverse_tunnels": {"name": "{ssh.user}-{ssh.bind_host}", "hosts": ["*.dev"]}
+				}
+			}
+		}
+	}
+}`,
+		},
+		{
+			name: "missing server address",
+			caddyfile: `{
+	ssh {
+		server srv0 {
+			pty allow
+		}
+	}
+}`,
+			wantErr: "server address is required",
+		},
+		{
+			name: "duplicate server",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000
+		server srv0 :2001
+	}
+}`,
+			wantErr: "server 'srv0' is already defined",
+		},
+		{
+			name: "unknown server option",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			listen :2001
+		}
+	}
+}`,
+			wantErr: "unrecognized server option 'listen'",
+		},
+		{
+			name: "unknown module",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			pty sometimes
+		}
+	}
+}`,
+			wantErr: "ssh.ask.pty.sometimes",
+		},
+		{
+			name: "actor without act",
+			caddyfile: `{
+	ssh {
+		server srv0 :2000 {
+			actor {
+				final
+			}
+		}
+	}
+}`,
+			wantErr: "actor act is required",
+		},
+	}
+	adapter := caddyconfig.GetAdapter("caddyfile")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := adapter.Adapt([]byte(tt.caddyfile), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Adapt() error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Adapt() unexpected error = %v", err)
+			}
+			var gotVal, wantVal any
+			if err := json.Unmarshal(got, &gotVal); err != nil {
+				t.Fatalf("unmarshaling adapted config: %v", err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantVal); err != nil {
+				t.Fatalf("unmarshaling expected config: %v", err)
+			}
+			if !reflect.DeepEqual(gotVal, wantVal) {
+				t.Errorf("Adapt() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+// Package caddyfileutil holds the helpers shared by the Caddyfile unmarshalers of the modules
+package caddyfileutil
+
+import (
+	"encoding/json"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// UnmarshalInlineModule loads the module named by the next argument from the namespace
+// and returns its JSON with the name set at the inline key
+func UnmarshalInlineModule(d *caddyfile.Dispenser, namespace, inlineKey string) (json.RawMessage, error) {
+	if !d.NextArg() {
+		return nil, d.ArgErr()
+	}
+	name := d.Val()
+	unm, err := caddyfile.UnmarshalModule(d, namespace+"."+name)
+	if err != nil {
+		return nil, err
+	}
+	return caddyconfig.JSONModuleObject(unm, inlineKey, name, nil), nil
+}
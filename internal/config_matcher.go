@@ -168,7 +168,7 @@ type MatchConfigLocalIP struct {
 func (MatchConfigLocalIP) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "ssh.config_matchers.local_ip",
-		New: func() caddy.Module { return new(MatchConfigRemoteIP) },
+		New: func() caddy.Module { return new(MatchConfigLocalIP) },
 	}
 }
 
@@ -0,0 +1,33 @@
+package internalcaddyssh
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+)
+
+// auditLocalForward returns the callback logging each local forwarding, e.g. a jump through
+// the server, once it's done
+func auditLocalForward(logger *zap.Logger) ssh.LocalPortForwardingDoneCallback {
+	return func(ctx ssh.Context, stats ssh.LocalPortForwardingStats) {
+		fields := []zap.Field{
+			zap.String("session_id", ctx.SessionID()),
+			zap.String("remote_address", ctx.RemoteAddr().String()),
+			zap.String("client_version", ctx.ClientVersion()),
+			zap.String("user", ctx.User()),
+			zap.String("destination", net.JoinHostPort(stats.DestinationHost, strconv.FormatUint(uint64(stats.DestinationPort), 10))),
+			zap.String("origin", net.JoinHostPort(stats.OriginHost, strconv.FormatUint(uint64(stats.OriginPort), 10))),
+			zap.Time("start", stats.Start),
+			zap.Duration("duration", stats.Duration),
+			zap.Int64("bytes_in", stats.BytesIn),
+			zap.Int64("bytes_out", stats.BytesOut),
+		}
+		if stats.Err != nil {
+			logger.Warn("local forwarding failed", append(fields, zap.Error(stats.Err))...)
+			return
+		}
+		logger.Info("local forwarding closed", fields...)
+	}
+}
@@ -0,0 +1,110 @@
+package localforward
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Jump{})
+}
+
+// Jump is PortForwardingAsker module for bastion hosts, which allows the local forwarding, e.g. of
+// `ssh -J bastion target`, only to the targets listed for any of the groups of the authenticated user.
+// The forwarding is denied to anyone else and to any other destination.
+//
+// The targets are matched as the hosts of the `policy` module, i.e. the hostnames are resolved for the
+// IP addresses and CIDR ranges, and the options of the key are honored unless `ignore_key_options` is set.
+type Jump struct {
+	// The targets permitted to the members of each group, keyed by the group name. A target is a
+	// hostname glob in the syntax of `path.Match`, an IP address, or a CIDR range, optionally followed
+	// by `:<port>`, where the port defaults to 22 and IPv6 addresses and ranges must be bracketed,
+	// e.g. `{"ops": ["*.internal", "[fd00::/8]:2222"]}`.
+	Groups map[string][]string `json:"groups,omitempty"`
+
+	// Skip honoring the port forwarding options of the key or certificate
+	IgnoreKeyOptions bool `json:"ignore_key_options,omitempty"`
+
+	policy Policy
+	logger *zap.Logger
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (Jump) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ssh.ask.localforward.jump",
+		New: func() caddy.Module { return new(Jump) },
+	}
+}
+
+// Provision turns the targets into the allow rules of the underlying policy
+func (j *Jump) Provision(ctx caddy.Context) error {
+	j.logger = ctx.Logger(j)
+	rules, err := jumpRules(j.Groups)
+	if err != nil {
+		return err
+	}
+	j.policy = Policy{
+		Rules:            rules,
+		IgnoreKeyOptions: j.IgnoreKeyOptions,
+		resolver:         net.DefaultResolver,
+	}
+	return nil
+}
+
+// jumpRules returns an allow rule for each target of each group, sorted by the group name
+func jumpRules(groups map[string][]string) ([]PolicyRule, error) {
+	names := make([]string, 0, len(groups))
+	for g := range groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+	var rules []PolicyRule
+	for _, g := range names {
+		for _, target := range groups[g] {
+			host, port, err := net.SplitHostPort(target)
+			if err != nil {
+				host, port = target, "22"
+			}
+			rule := PolicyRule{Action: "allow", Groups: []string{g}, Hosts: []string{host}, Ports: []string{port}}
+			if err := rule.provision(); err != nil {
+				return nil, fmt.Errorf("group '%s': target '%s': %v", g, target, err)
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// Allow returns true if the key options permit the destination and it's a target of any of the groups of the user
+func (j Jump) Allow(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
+	allowed, addrs, reason := j.policy.decide(ctx, destinationHost, destinationPort)
+	if allowed {
+		ssh.SetDialAddresses(ctx, destinationHost, destinationPort, addrs)
+	}
+	j.logger.Info(
+		"asking for permission",
+		zap.String("session_id", ctx.SessionID()),
+		zap.String("remote_address", ctx.RemoteAddr().String()),
+		zap.String("client_version", ctx.ClientVersion()),
+		zap.String("user", ctx.User()),
+		zap.String("destination_host", destinationHost),
+		zap.Uint32("destination_port", destinationPort),
+		zap.Bool("allowed", allowed),
+		zap.String("reason", reason),
+	)
+	return allowed
+}
+
+var (
+	_ caddy.Provisioner   = (*Jump)(nil)
+	_ PortForwardingAsker = Jump{}
+)
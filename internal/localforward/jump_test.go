@@ -0,0 +1,69 @@
+package localforward
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestJumpAllow(t *testing.T) {
+	rules, err := jumpRules(map[string][]string{
+		"ops": {"*.internal", "10.0.0.0/24", "[fd00::/8]:2222"},
+		"dba": {"pg.db.internal:5432"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jump := Jump{
+		policy: Policy{
+			Rules: rules,
+			resolver: fakeResolver{
+				"web.internal":   {"172.16.0.5"},
+				"pg.db.internal": {"172.16.0.6"},
+				"lab.example":    {"10.0.0.7"},
+			},
+		},
+		logger: zap.NewNop(),
+	}
+
+	tests := []struct {
+		name            string
+		user            string
+		groups          []string
+		criticalOptions map[string]string
+		host            string
+		port            uint32
+		want            bool
+	}{
+		{name: "glob target on the default port", user: "alice", groups: []string{"ops"}, host: "web.internal", port: 22, want: true},
+		{name: "glob target on another port", user: "alice", groups: []string{"ops"}, host: "web.internal", port: 80, want: false},
+		{name: "range target", user: "alice", groups: []string{"ops"}, host: "10.0.0.9", port: 22, want: true},
+		{name: "name resolving into the range target", user: "alice", groups: []string{"ops"}, host: "lab.example", port: 22, want: true},
+		{name: "bracketed range target with port", user: "alice", groups: []string{"ops"}, host: "fd00::1", port: 2222, want: true},
+		{name: "target of another group", user: "alice", groups: []string{"ops"}, host: "pg.db.internal", port: 5432, want: false},
+		{name: "target with port", user: "bob", groups: []string{"dba"}, host: "pg.db.internal", port: 5432, want: true},
+		{name: "target of the group on the default port", user: "bob", groups: []string{"dba"}, host: "pg.db.internal", port: 22, want: false},
+		{name: "user without groups", user: "carol", host: "web.internal", port: 22, want: false},
+		{name: "permitopen", user: "alice", groups: []string{"ops"}, criticalOptions: map[string]string{"permitopen": "db.internal:22"}, host: "web.internal", port: 22, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newFakeContext(tt.user, tt.groups, tt.criticalOptions, nil)
+			if got := jump.Allow(ctx, tt.host, tt.port); got != tt.want {
+				t.Errorf("Allow(%s, %d) = %v, want %v", tt.host, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJumpRulesErrors(t *testing.T) {
+	for _, targets := range [][]string{
+		{"db.internal:ssh"},
+		{"10.0.0.0/33"},
+		{"[a-"},
+	} {
+		if _, err := jumpRules(map[string][]string{"ops": targets}); err == nil {
+			t.Errorf("jumpRules(%v) = nil error, want error", targets)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package localforward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/authentication"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Policy{})
+}
+
+// resolver is the subset of net.Resolver used to resolve the destination hostnames
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Policy is PortForwardingAsker module which decides on the local forwarding by the destination
+// and the user. The rules are evaluated in order, and the first rule matching the session and the
+// destination decides. The forwarding is denied if no rule matches.
+//
+// Unless `ignore_key_options` is set, the options of the authorized key (or the critical options and
+// extensions of the certificate) are honored on top of the rules, as OpenSSH does: a certificate must
+// carry the `permit-port-forwarding` extension, `no-port-forwarding` (or `restrict` without `port-forwarding`)
+// denies any forwarding, and `permitopen="host:port"` restricts the forwarding to the listed destinations,
+// where either part may be `*`.
+//
+// The destination hostnames are resolved for the rules listing IP addresses or CIDR ranges, so a DNS name
+// pointing into a range is treated as the range. An `allow` rule matches only if all the resolved addresses
+// are in its ranges, while a `deny` rule matches if any of them is, or if the name fails to resolve.
+// The allowed connection is dialed to the resolved addresses rather than by name, so the DNS records can't
+// change between the check and the connection.
+type Policy struct {
+	// The rules evaluated in order
+	Rules []PolicyRule `json:"rules,omitempty"`
+
+	// Skip honoring the port forwarding options of the key or certificate
+	IgnoreKeyOptions bool `json:"ignore_key_options,omitempty"`
+
+	resolver resolver
+	logger   *zap.Logger
+}
+
+// PolicyRule is a rule of the local forwarding policy. The empty lists match anything.
+type PolicyRule struct {
+	// The action taken when the rule matches, either `allow` or `deny`
+	Action string `json:"action"`
+
+	// The users to whom the rule applies. The rule applies to the session if either its user
+	// or any of its groups is listed.
+	Users []string `json:"users,omitempty"`
+
+	// The groups to whom the rule applies
+	Groups []string `json:"groups,omitempty"`
+
+	// The destination hosts, as hostname globs in the syntax of `path.Match` (e.g. `*.internal`),
+	// IP addresses, or CIDR ranges.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// The destination ports, as single ports (e.g. `443`) or inclusive ranges (e.g. `8000-8100`)
+	Ports []string `json:"ports,omitempty"`
+
+	users  map[string]bool
+	groups map[string]bool
+	globs  []string
+	cidrs  []*net.IPNet
+	ports  []portRange
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (Policy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ssh.ask.localforward.policy",
+		New: func() caddy.Module { return new(Policy) },
+	}
+}
+
+// Provision parses the rules
+func (p *Policy) Provision(ctx caddy.Context) error {
+	p.logger = ctx.Logger(p)
+	p.resolver = net.DefaultResolver
+	for i := range p.Rules {
+		if err := p.Rules[i].provision(); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (r *PolicyRule) provision() error {
+	if r.Action != "allow" && r.Action != "deny" {
+		return fmt.Errorf("unknown action '%s'", r.Action)
+	}
+	r.users, r.groups = make(map[string]bool), make(map[string]bool)
+	for _, u := range r.Users {
+		r.users[u] = true
+	}
+	for _, g := range r.Groups {
+		r.groups[g] = true
+	}
+	for _, h := range r.Hosts {
+		switch {
+		case strings.Contains(h, "/"):
+			_, ipNet, err := net.ParseCIDR(h)
+			if err != nil {
+				return fmt.Errorf("parsing CIDR expression: %v", err)
+			}
+			r.cidrs = append(r.cidrs, ipNet)
+		case net.ParseIP(h) != nil:
+			ip := net.ParseIP(h)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			mask := len(ip) * 8
+			r.cidrs = append(r.cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(mask, mask)})
+		default:
+			if _, err := path.Match(h, ""); err != nil {
+				return fmt.Errorf("invalid host pattern '%s': %v", h, err)
+			}
+			r.globs = append(r.globs, strings.ToLower(h))
+		}
+	}
+	for _, pr := range r.Ports {
+		rng, err := parsePortRange(pr)
+		if err != nil {
+			return err
+		}
+		r.ports = append(r.ports, rng)
+	}
+	return nil
+}
+
+// Allow returns true if the key options permit the destination and the first matching rule allows it
+func (p Policy) Allow(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
+	allowed, addrs, reason := p.decide(ctx, destinationHost, destinationPort)
+	if allowed {
+		ssh.SetDialAddresses(ctx, destinationHost, destinationPort, addrs)
+	}
+	p.logger.Info(
+		"asking for permission",
+		zap.String("session_id", ctx.SessionID()),
+		zap.String("remote_address", ctx.RemoteAddr().String()),
+		zap.String("user", ctx.User()),
+		zap.String("destination_host", destinationHost),
+		zap.Uint32("destination_port", destinationPort),
+		zap.Bool("allowed", allowed),
+		zap.String("reason", reason),
+	)
+	return allowed
+}
+
+// decide returns whether the forwarding is allowed, and if so, the addresses of the destination it was
+// checked for, which the forwarding is to connect to
+func (p Policy) decide(ctx ssh.Context, host string, port uint32) (bool, []net.IP, string) {
+	if !p.IgnoreKeyOptions && ctx.Permissions() != nil && ctx.Permissions().Permissions != nil {
+		perms := ctx.Permissions()
+		if !authentication.PortForwardingPermitted(perms.Permissions) {
+			return false, nil, "port forwarding not permitted by the key"
+		}
+		if permitopen, ok := perms.CriticalOptions["permitopen"]; ok && !permitOpen(permitopen, host, port) {
+			return false, nil, "permitopen"
+		}
+	}
+
+	var groups []string
+	if u, ok := ctx.Value(authentication.UserCtxKey).(authentication.User); ok && u != nil {
+		for _, g := range u.Groups() {
+			groups = append(groups, g.Name())
+		}
+	}
+	// resolve lazily, and only once, for the rules listing ranges
+	var addrs []net.IP
+	var resolveErr error
+	resolved := false
+	resolve := func() ([]net.IP, error) {
+		if !resolved {
+			resolved = true
+			addrs, resolveErr = p.resolve(ctx, host)
+		}
+		return addrs, resolveErr
+	}
+	for i, r := range p.Rules {
+		if !r.appliesTo(ctx.User(), groups) || !r.matchesPort(port) || !r.matchesHost(host, r.Action == "deny", resolve) {
+			continue
+		}
+		if r.Action != "allow" {
+			return false, nil, fmt.Sprintf("rule %d", i)
+		}
+		// the addresses are resolved for the connection if the rule didn't need them
+		ips, err := resolve()
+		if err != nil {
+			return false, nil, fmt.Sprintf("rule %d: resolving the destination: %v", i, err)
+		}
+		return true, ips, fmt.Sprintf("rule %d", i)
+	}
+	return false, nil, "no matching rule"
+}
+
+// resolve returns the IP addresses of the host, which may be an IP literal
+func (p Policy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ipAddrs, err := p.resolver.LookupIPAddr(ctx, strings.ToLower(host))
+	if err != nil {
+		return nil, err
+	}
+	if len(ipAddrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	ips := make([]net.IP, 0, len(ipAddrs))
+	for _, a := range ipAddrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+func (r PolicyRule) appliesTo(user string, groups []string) bool {
+	if len(r.users) == 0 && len(r.groups) == 0 {
+		return true
+	}
+	if r.users[user] {
+		return true
+	}
+	for _, g := range groups {
+		if r.groups[g] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PolicyRule) matchesPort(port uint32) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, rng := range r.ports {
+		if rng.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesHost matches the host against the globs by name, and against the ranges by its addresses.
+// A deny rule fails closed, i.e. it matches when the host can't be resolved or any address is in range,
+// while an allow rule requires all the addresses to be in range.
+func (r PolicyRule) matchesHost(host string, deny bool, resolve func() ([]net.IP, error)) bool {
+	if len(r.globs) == 0 && len(r.cidrs) == 0 {
+		return true
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, g := range r.globs {
+		if ok, _ := path.Match(g, name); ok {
+			return true
+		}
+	}
+	if len(r.cidrs) == 0 {
+		return false
+	}
+	ips, err := resolve()
+	if err != nil {
+		return deny
+	}
+	for _, ip := range ips {
+		in := r.containsIP(ip)
+		if deny && in {
+			return true
+		}
+		if !deny && !in {
+			return false
+		}
+	}
+	return !deny
+}
+
+func (r PolicyRule) containsIP(ip net.IP) bool {
+	for _, c := range r.cidrs {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permitOpen returns true if the destination is listed in the comma-separated `permitopen` value
+func permitOpen(permitopen, host string, port uint32) bool {
+	for _, entry := range strings.Split(permitopen, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "none" {
+			return false
+		}
+		h, p, err := net.SplitHostPort(entry)
+		if err != nil {
+			continue
+		}
+		if h != "*" && !strings.EqualFold(h, host) {
+			continue
+		}
+		if p == "*" || p == strconv.FormatUint(uint64(port), 10) {
+			return true
+		}
+	}
+	return false
+}
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	start, end uint32
+}
+
+func (r portRange) contains(port uint32) bool {
+	return port >= r.start && port <= r.end
+}
+
+func parsePortRange(s string) (portRange, error) {
+	start, end, isRange := strings.Cut(s, "-")
+	if !isRange {
+		end = start
+	}
+	startPort, err := strconv.ParseUint(start, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port '%s': %v", s, err)
+	}
+	endPort, err := strconv.ParseUint(end, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port '%s': %v", s, err)
+	}
+	if startPort > endPort {
+		return portRange{}, fmt.Errorf("invalid port range '%s': start is greater than end", s)
+	}
+	return portRange{uint32(startPort), uint32(endPort)}, nil
+}
+
+var (
+	_ caddy.Provisioner   = (*Policy)(nil)
+	_ PortForwardingAsker = Policy{}
+)
@@ -0,0 +1,221 @@
+package localforward
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kadeessh/kadeessh/internal/authentication"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type fakeContext struct {
+	context.Context
+	sync.Mutex
+	user  string
+	perms *ssh.Permissions
+}
+
+func (c *fakeContext) User() string          { return c.user }
+func (c *fakeContext) SessionID() string     { return "session" }
+func (c *fakeContext) ClientVersion() string { return "SSH-2.0-test" }
+func (c *fakeContext) ServerVersion() string { return "SSH-2.0-kadeessh" }
+func (c *fakeContext) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+}
+func (c *fakeContext) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 22}
+}
+func (c *fakeContext) Permissions() *ssh.Permissions { return c.perms }
+func (c *fakeContext) SetValue(key, value any) {
+	c.Context = context.WithValue(c.Context, key, value)
+}
+
+type fakeGroup string
+
+func (g fakeGroup) Gid() string  { return string(g) }
+func (g fakeGroup) Name() string { return string(g) }
+
+type fakeUser struct {
+	authentication.User
+	groups []authentication.Group
+}
+
+func (u fakeUser) Groups() []authentication.Group { return u.groups }
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func newFakeContext(user string, groups []string, criticalOptions, extensions map[string]string) *fakeContext {
+	ctx := &fakeContext{
+		Context: context.Background(),
+		user:    user,
+		perms: &ssh.Permissions{Permissions: &gossh.Permissions{
+			CriticalOptions: criticalOptions,
+			Extensions:      extensions,
+		}},
+	}
+	var gs []authentication.Group
+	for _, g := range groups {
+		gs = append(gs, fakeGroup(g))
+	}
+	ctx.SetValue(authentication.UserCtxKey, fakeUser{groups: gs})
+	return ctx
+}
+
+func TestPolicyAllow(t *testing.T) {
+	policy := Policy{
+		Rules: []PolicyRule{
+			{Action: "deny", Hosts: []string{"10.0.0.0/8", "169.254.169.254"}},
+			{Action: "allow", Groups: []string{"dba"}, Hosts: []string{"*.db.internal"}, Ports: []string{"5432", "6000-6010"}},
+			{Action: "allow", Users: []string{"alice"}, Hosts: []string{"192.168.0.0/16"}},
+			{Action: "allow", Hosts: []string{"example.com"}, Ports: []string{"443"}},
+		},
+		resolver: fakeResolver{
+			"pg.db.internal":     {"172.16.0.5"},
+			"sneaky.example.net": {"10.1.2.3"},
+			"mixed.example.net":  {"192.168.1.1", "10.1.2.3"},
+			"home.example.net":   {"192.168.1.1", "192.168.1.2"},
+			"example.com":        {"93.184.215.14"},
+		},
+		logger: zap.NewNop(),
+	}
+	for i := range policy.Rules {
+		if err := policy.Rules[i].provision(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name            string
+		user            string
+		groups          []string
+		criticalOptions map[string]string
+		extensions      map[string]string
+		host            string
+		port            uint32
+		want            bool
+	}{
+		{name: "denied range", user: "alice", host: "10.0.0.1", port: 22, want: false},
+		{name: "denied single address", user: "alice", host: "169.254.169.254", port: 80, want: false},
+		{name: "name resolving into the denied range", user: "alice", host: "sneaky.example.net", port: 22, want: false},
+		{name: "name partly resolving into the denied range", user: "alice", host: "mixed.example.net", port: 22, want: false},
+		{name: "unresolvable name fails the denied range closed", user: "alice", host: "nowhere.invalid", port: 22, want: false},
+		{name: "group and glob and port", user: "bob", groups: []string{"dba"}, host: "pg.db.internal", port: 5432, want: true},
+		{name: "group and glob and port range", user: "bob", groups: []string{"dba"}, host: "PG.db.internal", port: 6005, want: true},
+		{name: "group and glob but wrong port", user: "bob", groups: []string{"dba"}, host: "pg.db.internal", port: 22, want: false},
+		{name: "glob and port but wrong group", user: "bob", groups: []string{"dev"}, host: "pg.db.internal", port: 5432, want: false},
+		{name: "user and allowed range", user: "alice", host: "192.168.5.5", port: 22, want: true},
+		{name: "user and name resolving into allowed range", user: "alice", host: "home.example.net", port: 22, want: true},
+		{name: "allowed range but wrong user", user: "bob", host: "192.168.5.5", port: 22, want: false},
+		{name: "any user", user: "carol", host: "example.com", port: 443, want: true},
+		{name: "no matching rule", user: "carol", host: "example.org", port: 443, want: false},
+		{name: "no-port-forwarding", user: "carol", extensions: map[string]string{"no-port-forwarding": ""}, host: "example.com", port: 443, want: false},
+		{name: "restrict", user: "carol", extensions: map[string]string{"restrict": ""}, host: "example.com", port: 443, want: false},
+		{name: "restrict and port-forwarding", user: "carol", extensions: map[string]string{"restrict": "", "port-forwarding": ""}, host: "example.com", port: 443, want: true},
+		{name: "permitopen listed", user: "carol", criticalOptions: map[string]string{"permitopen": "example.com:443,localhost:80"}, host: "example.com", port: 443, want: true},
+		{name: "permitopen wildcard port", user: "carol", criticalOptions: map[string]string{"permitopen": "example.com:*"}, host: "example.com", port: 443, want: true},
+		{name: "permitopen not listed", user: "carol", criticalOptions: map[string]string{"permitopen": "localhost:80"}, host: "example.com", port: 443, want: false},
+		{name: "permitopen none", user: "carol", criticalOptions: map[string]string{"permitopen": "none"}, host: "example.com", port: 443, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newFakeContext(tt.user, tt.groups, tt.criticalOptions, tt.extensions)
+			if got := policy.Allow(ctx, tt.host, tt.port); got != tt.want {
+				t.Errorf("Allow(%s, %d) = %v, want %v", tt.host, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyDialAddresses(t *testing.T) {
+	policy := Policy{
+		Rules: []PolicyRule{
+			{Action: "deny", Hosts: []string{"10.0.0.0/8"}},
+			{Action: "allow", Hosts: []string{"*.example.net", "192.168.0.0/16"}},
+		},
+		resolver: fakeResolver{
+			"web.example.net":  {"172.16.0.5", "172.16.0.6"},
+			"home.example.net": {"192.168.1.1"},
+		},
+		logger: zap.NewNop(),
+	}
+	for i := range policy.Rules {
+		if err := policy.Rules[i].provision(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		host  string
+		want  bool
+		addrs []string
+	}{
+		// the addresses checked against the ranges are the ones connected to
+		{host: "home.example.net", want: true, addrs: []string{"192.168.1.1"}},
+		// the addresses are resolved for the connection although the glob matched by name
+		{host: "web.example.net", want: true, addrs: []string{"172.16.0.5", "172.16.0.6"}},
+		{host: "192.168.1.2", want: true, addrs: []string{"192.168.1.2"}},
+		{host: "gone.example.net", want: false},
+	}
+	for _, tt := range tests {
+		allowed, addrs, _ := policy.decide(newFakeContext("alice", nil, nil, nil), tt.host, 80)
+		if allowed != tt.want {
+			t.Errorf("decide(%s) = %v, want %v", tt.host, allowed, tt.want)
+			continue
+		}
+		var got []string
+		for _, ip := range addrs {
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.addrs, ",") {
+			t.Errorf("decide(%s) addresses = %v, want %v", tt.host, got, tt.addrs)
+		}
+	}
+}
+
+func TestPolicyIgnoreKeyOptions(t *testing.T) {
+	policy := Policy{
+		Rules:            []PolicyRule{{Action: "allow"}},
+		IgnoreKeyOptions: true,
+		resolver:         fakeResolver{"example.com": {"93.184.215.14"}},
+		logger:           zap.NewNop(),
+	}
+	if err := policy.Rules[0].provision(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := newFakeContext("alice", nil, map[string]string{"permitopen": "none"}, map[string]string{"no-port-forwarding": ""})
+	if !policy.Allow(ctx, "example.com", 443) {
+		t.Error("Allow() = false, want true when the key options are ignored")
+	}
+}
+
+func TestPolicyRuleProvisionErrors(t *testing.T) {
+	for _, rule := range []PolicyRule{
+		{Action: "maybe"},
+		{Action: "allow", Hosts: []string{"10.0.0.0/33"}},
+		{Action: "allow", Hosts: []string{"[a-"}},
+		{Action: "allow", Ports: []string{"http"}},
+		{Action: "allow", Ports: []string{"90-80"}},
+		{Action: "allow", Ports: []string{"70000"}},
+	} {
+		if err := rule.provision(); err == nil {
+			t.Errorf("provision(%+v) = nil, want error", rule)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package internalcaddyssh
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/kadeessh/kadeessh/internal/metrics"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// observeConnections counts the connections accepted by the server and those failing the handshake
+func observeConnections(sshsrv *ssh.Server, server string) {
+	accepted, rejected := metrics.ConnectionsAccepted.WithLabelValues(server), metrics.ConnectionsRejected.WithLabelValues(server)
+	sshsrv.ConnCallback = func(_ ssh.Context, conn net.Conn) net.Conn {
+		accepted.Inc()
+		return conn
+	}
+	sshsrv.ConnectionFailedCallback = func(net.Conn, error) {
+		rejected.Inc()
+	}
+}
+
+// observeForward counts the forwarding of the type as opened or denied, and returns whether it's permitted
+func observeForward(server, forwardType string, allowed bool) bool {
+	if allowed {
+		metrics.ForwardsOpened.WithLabelValues(server, forwardType).Inc()
+	} else {
+		metrics.ForwardsDenied.WithLabelValues(server, forwardType).Inc()
+	}
+	return allowed
+}
+
+// observeForwardErr counts the forwarding of the type as opened if the callback succeeded,
+// or denied if the callback rejected it
+func observeForwardErr(server, forwardType string, err error) {
+	switch {
+	case err == nil:
+		observeForward(server, forwardType, true)
+	case errors.Is(err, ssh.ErrRejected):
+		observeForward(server, forwardType, false)
+	}
+}
+
+// observeActor acts on the session with the actor, observing the session in the metrics of the actor
+func observeActor(server string, actor Actor, sess session.Session) error {
+	metrics.SessionsTotal.WithLabelValues(server, actor.name).Inc()
+	active := metrics.SessionsActive.WithLabelValues(server, actor.name)
+	active.Inc()
+	defer active.Dec()
+	start := time.Now()
+	defer func() {
+		metrics.SessionDuration.WithLabelValues(server, actor.name).Observe(time.Since(start).Seconds())
+	}()
+	return actor.handler.Handle(sess)
+}
+
+// countChannelBytes wraps the handler of the channel type to count the bytes transferred on the channels
+func countChannelBytes(server, channelType string, handler ssh.ChannelHandler) ssh.ChannelHandler {
+	in := metrics.ChannelBytes.WithLabelValues(server, channelType, "in")
+	out := metrics.ChannelBytes.WithLabelValues(server, channelType, "out")
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		handler(srv, conn, countedNewChannel{NewChannel: newChan, in: in, out: out}, ctx)
+	}
+}
+
+type countedNewChannel struct {
+	gossh.NewChannel
+	in, out prometheus.Counter
+}
+
+func (c countedNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	return countedChannel{Channel: ch, in: c.in, out: c.out}, reqs, nil
+}
+
+type countedChannel struct {
+	gossh.Channel
+	in, out prometheus.Counter
+}
+
+func (c countedChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.in.Add(float64(n))
+	return n, err
+}
+
+func (c countedChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	c.out.Add(float64(n))
+	return n, err
+}
+
+func (c countedChannel) Stderr() io.ReadWriter {
+	return countedReadWriter{ReadWriter: c.Channel.Stderr(), in: c.in, out: c.out}
+}
+
+type countedReadWriter struct {
+	io.ReadWriter
+	in, out prometheus.Counter
+}
+
+func (c countedReadWriter) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	c.in.Add(float64(n))
+	return n, err
+}
+
+func (c countedReadWriter) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.out.Add(float64(n))
+	return n, err
+}
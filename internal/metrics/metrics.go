@@ -0,0 +1,135 @@
+// Package metrics holds the Prometheus metrics of the SSH app. They're registered into the metrics registry of
+// Caddy by the app, hence exposed on the `/metrics` endpoint of the admin API along with the metrics of Caddy.
+// The metrics are shared by the modules of the app, and they outlive the config reloads, as the metrics of
+// Caddy's reverse proxy do.
+package metrics
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const ns, sub = "caddy", "ssh"
+
+var (
+	// ConnectionsAccepted counts the connections accepted by the listeners of a server
+	ConnectionsAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "connections_accepted_total",
+		Help:      "Number of connections accepted by the listeners of the server.",
+	}, []string{"server"})
+
+	// ConnectionsRejected counts the connections of a server failing the handshake, e.g. for failing the authentication
+	ConnectionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "connections_rejected_total",
+		Help:      "Number of connections failing the SSH handshake, including the authentication.",
+	}, []string{"server"})
+
+	// AuthAttempts counts the authentication attempts by the flow, the provider, and the result. The result is one of
+	// `success`, `failure`, and `error` of the provider, or `invalid` without a provider when all the providers rejected
+	// the credentials.
+	AuthAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "auth_attempts_total",
+		Help:      "Number of authentication attempts by flow, provider, and result.",
+	}, []string{"flow", "provider", "result"})
+
+	// SessionsActive is the number of sessions an actor is acting on
+	SessionsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "sessions_active",
+		Help:      "Number of sessions currently handled by the actor.",
+	}, []string{"server", "actor"})
+
+	// SessionsTotal counts the sessions an actor acted on
+	SessionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "sessions_total",
+		Help:      "Number of sessions handled by the actor.",
+	}, []string{"server", "actor"})
+
+	// SessionDuration observes the time an actor took acting on a session
+	SessionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "session_duration_seconds",
+		Help:      "Histogram of the durations of the sessions handled by the actor.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 4, 10),
+	}, []string{"server", "actor"})
+
+	// ChannelBytes counts the bytes received from (`in`) and sent to (`out`) the clients on the channels they open
+	ChannelBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "channel_bytes_total",
+		Help:      "Number of bytes transferred on the channels opened by the clients, by channel type and direction.",
+	}, []string{"server", "channel_type", "direction"})
+
+	// ForwardsOpened counts the forwardings permitted by the type, one of `local`, `reverse`,
+	// `local_streamlocal`, and `reverse_streamlocal`
+	ForwardsOpened = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "forwards_opened_total",
+		Help:      "Number of forwardings permitted, by server and type.",
+	}, []string{"server", "type"})
+
+	// ForwardsDenied counts the forwardings denied by the type, as ForwardsOpened
+	ForwardsDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "forwards_denied_total",
+		Help:      "Number of forwardings denied, by server and type.",
+	}, []string{"server", "type"})
+
+	// MaxSessionsRejected counts the sessions rejected by the `max_session` authorizer for reaching the maximum
+	MaxSessionsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "max_sessions_rejected_total",
+		Help:      "Number of sessions rejected for the saturation of the maximum of sessions.",
+	})
+
+	// RecordingsTruncated counts the recordings truncated by the reason, either `max_size` or `max_duration`
+	RecordingsTruncated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "recordings_truncated_total",
+		Help:      "Number of session recordings truncated, by reason.",
+	}, []string{"reason"})
+)
+
+var collectors = []prometheus.Collector{
+	ConnectionsAccepted,
+	ConnectionsRejected,
+	AuthAttempts,
+	SessionsActive,
+	SessionsTotal,
+	SessionDuration,
+	ChannelBytes,
+	ForwardsOpened,
+	ForwardsDenied,
+	MaxSessionsRejected,
+	RecordingsTruncated,
+}
+
+// Register registers the metrics into the registry, unless they're registered already
+func Register(registry *prometheus.Registry) error {
+	for _, c := range collectors {
+		if err := registry.Register(c); err != nil {
+			var are prometheus.AlreadyRegisteredError
+			if errors.As(err, &are) && are.ExistingCollector == c {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package internalcaddyssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kadeessh/kadeessh/internal/metrics"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// echoActor echoes the input of the session
+type echoActor struct{}
+
+func (echoActor) Handle(sess session.Session) error {
+	_, err := io.Copy(sess, sess)
+	return err
+}
+
+func TestMetrics(t *testing.T) {
+	const server = "metrics-test"
+	registry := prometheus.NewPedanticRegistry()
+	for i := 0; i < 2; i++ {
+		if err := metrics.Register(registry); err != nil {
+			t.Fatalf("Register() #%d error = %v", i, err)
+		}
+	}
+
+	// the metrics outlive the test, so their increase is observed
+	observed := map[string]*struct {
+		c            prometheus.Collector
+		before, want float64
+	}{
+		"connections accepted": {c: metrics.ConnectionsAccepted.WithLabelValues(server), want: 2},
+		"connections rejected": {c: metrics.ConnectionsRejected.WithLabelValues(server), want: 1},
+		"sessions total":       {c: metrics.SessionsTotal.WithLabelValues(server, "echo"), want: 1},
+		"sessions active":      {c: metrics.SessionsActive.WithLabelValues(server, "echo"), want: 0},
+		"bytes in":             {c: metrics.ChannelBytes.WithLabelValues(server, "session", "in"), want: 5},
+		"bytes out":            {c: metrics.ChannelBytes.WithLabelValues(server, "session", "out"), want: 5},
+	}
+	for _, tt := range observed {
+		tt.before = testutil.ToFloat64(tt.c)
+	}
+	rejected := observed["connections rejected"]
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor := Actor{handler: echoActor{}, name: "echo"}
+	srv := &ssh.Server{
+		Handler: func(sess ssh.Session) {
+			observeActor(server, actor, sess) //nolint:errcheck
+			sess.Exit(0)                      //nolint:errcheck
+		},
+		PasswordHandler: func(ctx ssh.Context, password string) bool { return password == "secret" },
+		ChannelHandlers: map[string]ssh.ChannelHandler{
+			"session": countChannelBytes(server, "session", ssh.DefaultSessionHandler),
+		},
+	}
+	srv.AddHostKey(hostSigner)
+	observeConnections(srv, server)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	dial := func(password string) (*gossh.Client, error) {
+		return gossh.Dial("tcp", l.Addr().String(), &gossh.ClientConfig{
+			User:            "alice",
+			Auth:            []gossh.AuthMethod{gossh.Password(password)},
+			HostKeyCallback: gossh.FixedHostKey(hostSigner.PublicKey()),
+		})
+	}
+	if _, err := dial("wrong"); err == nil {
+		t.Fatal("dialing with a wrong password succeeded")
+	}
+	client, err := dial("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Stdin = strings.NewReader("hello")
+	out, err := sess.Output("")
+	if err != nil || string(out) != "hello" {
+		t.Fatalf("Output() = %q, %v; want the echo", out, err)
+	}
+
+	// the rejected connection is counted once the server notices the client hung up
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(rejected.c)-rejected.before != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for name, tt := range observed {
+		if got := testutil.ToFloat64(tt.c) - tt.before; got != tt.want {
+			t.Errorf("%s = %v; want %v", name, got, tt.want)
+		}
+	}
+	if n, err := testutil.GatherAndCount(registry, "caddy_ssh_session_duration_seconds"); err != nil || n != 1 {
+		t.Errorf("session duration series = %d, %v; want 1", n, err)
+	}
+}
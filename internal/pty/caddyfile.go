@@ -0,0 +1,176 @@
+package pty
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ caddyfile.Unmarshaler = (*Allow)(nil)
+	_ caddyfile.Unmarshaler = (*Deny)(nil)
+	_ caddyfile.Unmarshaler = (*Shell)(nil)
+	_ caddyfile.Unmarshaler = (*Jail)(nil)
+)
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. The module takes no options. Syntax:
+//
+//	allow
+func (e *Allow) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return noOptions(d)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. The module takes no options. Syntax:
+//
+//	deny
+func (e *Deny) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return noOptions(d)
+}
+
+// UnmarshalCaddyfile sets up the shell from Caddyfile tokens. Syntax:
+//
+//	shell [<force_command>] {
+//		force_command <command>
+//		env           <key> <value>
+//		force_pty
+//		kill_grace_period <duration>
+//		accept_env        <patterns...>
+//		environment_file  <path>
+//		permit_user_environment
+//		jail {
+//			...
+//		}
+//	}
+func (s *Shell) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			s.ForceCommand = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "force_command":
+				if !d.AllArgs(&s.ForceCommand) {
+					return d.ArgErr()
+				}
+			case "env":
+				var key, val string
+				if !d.AllArgs(&key, &val) {
+					return d.ArgErr()
+				}
+				if s.Env == nil {
+					s.Env = make(map[string]string)
+				}
+				s.Env[key] = val
+			case "force_pty":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				s.ForcePTY = true
+			case "kill_grace_period":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("parsing kill_grace_period: %v", err)
+				}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				s.KillGracePeriod = caddy.Duration(dur)
+			case "accept_env":
+				patterns := d.RemainingArgs()
+				if len(patterns) == 0 {
+					return d.ArgErr()
+				}
+				s.AcceptEnv = append(s.AcceptEnv, patterns...)
+			case "environment_file":
+				if !d.AllArgs(&s.EnvironmentFile) {
+					return d.ArgErr()
+				}
+			case "permit_user_environment":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				s.PermitUserEnvironment = true
+			case "jail":
+				s.Jail = new(Jail)
+				if err := s.Jail.UnmarshalCaddyfile(d.NewFromNextSegment()); err != nil {
+					return err
+				}
+			default:
+				return d.Errf("unrecognized shell option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the jail from Caddyfile tokens. The `rlimit` option may be repeated. Syntax:
+//
+//	jail {
+//		chroot_directory <path>
+//		namespaces       <user|mount|pid|network...>
+//		rlimit           <name> <value>
+//		cgroup           <path>
+//		no_new_privs
+//	}
+func (j *Jail) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "chroot_directory":
+				if !d.AllArgs(&j.ChrootDirectory) {
+					return d.ArgErr()
+				}
+			case "namespaces":
+				namespaces := d.RemainingArgs()
+				if len(namespaces) == 0 {
+					return d.ArgErr()
+				}
+				j.Namespaces = append(j.Namespaces, namespaces...)
+			case "rlimit":
+				var name, value string
+				if !d.AllArgs(&name, &value) {
+					return d.ArgErr()
+				}
+				limit, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					return d.Errf("parsing rlimit %s: %v", name, err)
+				}
+				if j.Rlimits == nil {
+					j.Rlimits = make(map[string]uint64)
+				}
+				j.Rlimits[name] = limit
+			case "cgroup":
+				if !d.AllArgs(&j.Cgroup) {
+					return d.ArgErr()
+				}
+			case "no_new_privs":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				j.NoNewPrivs = true
+			default:
+				return d.Errf("unrecognized jail option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func noOptions(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
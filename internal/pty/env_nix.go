@@ -0,0 +1,142 @@
+//go:build !windows
+// +build !windows
+
+package pty
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/kadeessh/kadeessh/internal/pty/passwd"
+	"github.com/kadeessh/kadeessh/internal/session"
+)
+
+// The PATH of the login sessions, as set by sshd
+const (
+	defaultPath     = "/usr/local/bin:/usr/bin:/bin"
+	defaultRootPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// loginEnv returns the standard variables of a login session of the user
+func loginEnv(user *passwd.Entry) []string {
+	p := defaultPath
+	if user.UID == 0 {
+		p = defaultRootPath
+	}
+	return []string{
+		"USER=" + user.Username,
+		"LOGNAME=" + user.Username,
+		"HOME=" + user.HomeDir,
+		"SHELL=" + user.Shell,
+		"PATH=" + p,
+	}
+}
+
+// connectionEnv returns the SSH_CLIENT and SSH_CONNECTION variables describing the connection of the session
+func connectionEnv(sess session.Session) []string {
+	clientHost, clientPort, _ := net.SplitHostPort(sess.RemoteAddr().String())
+	serverHost, serverPort, _ := net.SplitHostPort(sess.LocalAddr().String())
+	return []string{
+		fmt.Sprintf("SSH_CLIENT=%s %s %s", clientHost, clientPort, serverPort),
+		fmt.Sprintf("SSH_CONNECTION=%s %s %s %s", clientHost, clientPort, serverHost, serverPort),
+	}
+}
+
+// acceptEnv returns the variables whose names match any of the patterns, and the names of the rejected ones
+func acceptEnv(patterns []string, environ []string) (accepted []string, rejected []string) {
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		if matchesAny(patterns, name) {
+			accepted = append(accepted, kv)
+		} else {
+			rejected = append(rejected, name)
+		}
+	}
+	return accepted, rejected
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		// the patterns are validated on provisioning
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readEnvironmentFile reads the `NAME=value` lines of the file, skipping the blank lines and the comments.
+// The value may be enclosed in quotes, as is common in `/etc/environment`.
+func readEnvironmentFile(f *os.File) ([]string, error) {
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			continue
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, name+"="+value)
+	}
+	return env, scanner.Err()
+}
+
+// systemEnvironment reads the system-wide environment file, e.g. `/etc/environment`
+func systemEnvironment(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readEnvironmentFile(f)
+}
+
+// userEnvironment reads `~/.ssh/environment` of the user. The file is opened with the permissions of the user
+// on the file system, where the platform permits taking them on, so the server reads no more than the user can.
+// It's refused if it's a symlink, has other links, or is owned by another user. A missing file is not an error.
+func userEnvironment(user *passwd.Entry) ([]string, error) {
+	var f *os.File
+	open := func() error {
+		var err error
+		f, err = os.OpenFile(filepath.Join(user.HomeDir, ".ssh", "environment"), os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		return err
+	}
+	var err error
+	if os.Getuid() == 0 && user.UID != 0 {
+		err = passwd.AsUser(user, open)
+		if errors.Is(err, errors.ErrUnsupported) {
+			err = open()
+		}
+	} else {
+		err = open()
+	}
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !fi.Mode().IsRegular() || !ok || uint(st.Uid) != user.UID || st.Nlink != 1 {
+		return nil, fmt.Errorf("refusing %s: not a regular file owned by the user without other links", f.Name())
+	}
+	return readEnvironmentFile(f)
+}
@@ -0,0 +1,167 @@
+//go:build !windows
+// +build !windows
+
+package pty
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/kadeessh/kadeessh/internal/pty/passwd"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+func TestAcceptEnv(t *testing.T) {
+	accepted, rejected := acceptEnv(
+		[]string{"LANG", "LC_*"},
+		[]string{"LANG=C.UTF-8", "LC_ALL=C", "LD_PRELOAD=/tmp/evil.so", "LANGUAGE=en"},
+	)
+	if want := []string{"LANG=C.UTF-8", "LC_ALL=C"}; !reflect.DeepEqual(accepted, want) {
+		t.Errorf("accepted = %v, want %v", accepted, want)
+	}
+	if want := []string{"LD_PRELOAD", "LANGUAGE"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejected = %v, want %v", rejected, want)
+	}
+}
+
+func TestSystemEnvironment(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "environment")
+	content := "# comment\n\nPATH=\"/usr/local/bin:/usr/bin\"\nLANG='C.UTF-8'\n  EDITOR=vi  \ninvalid line\n=empty\n"
+	if err := os.WriteFile(name, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env, err := systemEnvironment(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"PATH=/usr/local/bin:/usr/bin", "LANG=C.UTF-8", "EDITOR=vi"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("systemEnvironment() = %v, want %v", env, want)
+	}
+}
+
+func TestUserEnvironment(t *testing.T) {
+	home := t.TempDir()
+	user := &passwd.Entry{Username: "alice", UID: uint(os.Getuid()), HomeDir: home} //nolint:gosec
+	if env, err := userEnvironment(user); err != nil || env != nil {
+		t.Fatalf("userEnvironment() without the file = %v, %v; want nothing", env, err)
+	}
+
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("SECRET=1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(home, ".ssh", "environment")
+	if err := os.Symlink(secret, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userEnvironment(user); err == nil {
+		t.Fatal("userEnvironment() followed a symlink")
+	}
+
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(secret, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userEnvironment(user); err == nil {
+		t.Fatal("userEnvironment() read a file with other links")
+	}
+
+	if err := os.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte("GREETING=hello\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env, err := userEnvironment(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"GREETING=hello"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("userEnvironment() = %v, want %v", env, want)
+	}
+}
+
+func TestUserEnvironmentAsUser(t *testing.T) {
+	if os.Getuid() != 0 || runtime.GOOS != "linux" {
+		t.Skip("taking on the permissions of another user requires root on linux")
+	}
+	nobody := passwd.New().Get("nobody")
+	if nobody == nil {
+		t.Skip("no nobody user")
+	}
+	home := t.TempDir()
+	// the parent of the temp directories is private to root
+	if err := os.Chmod(filepath.Dir(home), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	sshDir := filepath.Join(home, ".ssh")
+	if err := os.Mkdir(sshDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// the file of the user is unreadable by the user, although it's readable by root
+	name := filepath.Join(sshDir, "environment")
+	if err := os.WriteFile(name, []byte("SECRET=1\n"), 0o000); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(name, int(nobody.UID), int(nobody.GID)); err != nil { //nolint:gosec
+		t.Fatal(err)
+	}
+	user := *nobody
+	user.HomeDir = home
+	if env, err := userEnvironment(&user); err == nil {
+		t.Fatalf("userEnvironment() = %v; want the file unreadable by the user", env)
+	}
+
+	if err := os.Chmod(name, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env, err := userEnvironment(&user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"SECRET=1"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("userEnvironment() = %v, want %v", env, want)
+	}
+}
+
+func TestShellLoginEnvironment(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("running the shell of root requires root")
+	}
+	s := newTestShell()
+	s.pass = passwd.New()
+	s.AcceptEnv = []string{"LC_*"}
+	s.Env = map[string]string{"EDITOR": "vi"}
+	sess := newTestSession(t, func(sess ssh.Session) {
+		exitSession(sess, s.Handle(sess))
+	})
+	for name, value := range map[string]string{"LC_ALL": "C", "LD_PRELOAD": "/tmp/evil.so", "HOME": "/tmp"} {
+		if err := sess.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stdout bytes.Buffer
+	sess.Stdout = &stdout
+	if err := sess.Run("env"); err != nil {
+		t.Fatal(err)
+	}
+	out := stdout.String()
+	for _, want := range []string{"\nUSER=root\n", "\nLOGNAME=root\n", "\nHOME=" + s.pass.Get("root").HomeDir + "\n", "\nLC_ALL=C\n", "\nEDITOR=vi\n", "\nSSH_CONNECTION=127.0.0.1 "} {
+		if !strings.Contains("\n"+out, want) {
+			t.Errorf("environment lacks %q:\n%s", strings.TrimSpace(want), out)
+		}
+	}
+	if strings.Contains(out, "LD_PRELOAD") {
+		t.Errorf("environment has a variable not accepted:\n%s", out)
+	}
+}
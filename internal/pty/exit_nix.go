@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package pty
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/kadeessh/kadeessh/internal/session"
+)
+
+// exitError returns the exit of the process as reported to the client, or nil if it succeeded
+func exitError(state *os.ProcessState) error {
+	ws, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		if state.Success() {
+			return nil
+		}
+		return &session.ExitError{Status: uint32(state.ExitCode())} //nolint:gosec
+	}
+	if ws.Signaled() {
+		name, ok := signalNames[ws.Signal()]
+		if !ok {
+			// the name OpenSSH reports for the signals not listed in RFC 4254
+			name = "SIG@openssh.com"
+		}
+		return &session.ExitError{Signal: name, CoreDumped: ws.CoreDump()}
+	}
+	if ws.ExitStatus() == 0 {
+		return nil
+	}
+	return &session.ExitError{Status: uint32(ws.ExitStatus())} //nolint:gosec
+}
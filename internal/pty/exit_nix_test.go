@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package pty
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+func TestExitError(t *testing.T) {
+	tests := []struct {
+		script string
+		want   *session.ExitError
+	}{
+		{script: "exit 0", want: nil},
+		{script: "exit 3", want: &session.ExitError{Status: 3}},
+		{script: "kill -TERM $$", want: &session.ExitError{Signal: ssh.SIGTERM}},
+		{script: "kill -WINCH $$; kill -KILL $$", want: &session.ExitError{Signal: ssh.SIGKILL}},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command("/bin/sh", "-c", tt.script)
+		_ = cmd.Run()
+		err := exitError(cmd.ProcessState)
+		var got *session.ExitError
+		errors.As(err, &got)
+		switch {
+		case tt.want == nil && err != nil:
+			t.Errorf("exitError() of %q = %v, want nil", tt.script, err)
+		case tt.want != nil && (got == nil || *got != *tt.want):
+			t.Errorf("exitError() of %q = %#v, want %#v", tt.script, got, tt.want)
+		}
+	}
+}
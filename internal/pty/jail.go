@@ -0,0 +1,32 @@
+package pty
+
+// Jail confines the processes of the shell sessions on Linux, giving untrusted users a restricted shell without
+// a container runtime. The paths may use the session placeholders, e.g. `/srv/jail/{ssh.user}`.
+//
+// The confinement is applied by a helper, which is the server binary executed anew, before it executes the shell
+// of the user. Hence the process stays confined across the executions of setuid binaries when `no_new_privs` is set.
+type Jail struct {
+	// The directory the process is confined to, following the semantics of the
+	// [`ChrootDirectory`](https://man.openbsd.org/sshd_config#ChrootDirectory) of OpenSSH: all the components
+	// of the path must be directories owned by root and not writable by any other user or group. The shell of
+	// the user must exist within the directory. The working directory is the home directory of the user within
+	// the chroot, if present, or `/` otherwise. The sockets forwarding the agent and X11 are outside the directory.
+	ChrootDirectory string `json:"chroot_directory,omitempty"`
+
+	// The Linux namespaces the process is run in, any of `user`, `mount`, `pid`, and `network`. In the `user`
+	// namespace, only root, the user, and their groups are mapped to themselves. In the `pid` namespace, the
+	// process is PID 1, so it ignores the signals it has no handler for, except for SIGKILL. The `/proc`
+	// filesystem isn't remounted.
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// The resource limits of the process by their name without the `RLIMIT_` prefix in lower case, e.g.
+	// `nofile` or `nproc`. Both the soft and hard limits are set to the value.
+	Rlimits map[string]uint64 `json:"rlimits,omitempty"`
+
+	// The path of the cgroup v2 directory the process is placed in, e.g. `/sys/fs/cgroup/ssh/{ssh.user}`.
+	// The directory is created if missing, while setting its limits is left to the administrator.
+	Cgroup string `json:"cgroup,omitempty"`
+
+	// Set `no_new_privs`, so neither the process nor its children may gain privileges, e.g. through setuid binaries
+	NoNewPrivs bool `json:"no_new_privs,omitempty"`
+}
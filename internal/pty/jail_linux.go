@@ -0,0 +1,246 @@
+//go:build linux
+// +build linux
+
+package pty
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/sys/unix"
+)
+
+// jailEnv is the environment variable passing the jailSpec to the helper
+const jailEnv = "KADEESSH_JAIL"
+
+// jailConfigHome is the configuration directory of the helper, which it never uses
+const jailConfigHome = "/nonexistent"
+
+var namespaceFlags = map[string]uintptr{
+	"user":    syscall.CLONE_NEWUSER,
+	"mount":   syscall.CLONE_NEWNS,
+	"pid":     syscall.CLONE_NEWPID,
+	"network": syscall.CLONE_NEWNET,
+}
+
+var rlimitResources = map[string]int{
+	"as":         unix.RLIMIT_AS,
+	"core":       unix.RLIMIT_CORE,
+	"cpu":        unix.RLIMIT_CPU,
+	"data":       unix.RLIMIT_DATA,
+	"fsize":      unix.RLIMIT_FSIZE,
+	"locks":      unix.RLIMIT_LOCKS,
+	"memlock":    unix.RLIMIT_MEMLOCK,
+	"msgqueue":   unix.RLIMIT_MSGQUEUE,
+	"nice":       unix.RLIMIT_NICE,
+	"nofile":     unix.RLIMIT_NOFILE,
+	"nproc":      unix.RLIMIT_NPROC,
+	"rss":        unix.RLIMIT_RSS,
+	"rtprio":     unix.RLIMIT_RTPRIO,
+	"sigpending": unix.RLIMIT_SIGPENDING,
+	"stack":      unix.RLIMIT_STACK,
+}
+
+// jailSpec is the confinement applied by the helper before it executes the shell. The environment of the
+// session is carried by the spec and only given to the shell, since the helper runs privileged.
+type jailSpec struct {
+	Path       string            `json:"path"`
+	Dir        string            `json:"dir"`
+	Env        []string          `json:"env"`
+	Chroot     string            `json:"chroot,omitempty"`
+	UID        uint32            `json:"uid"`
+	GID        uint32            `json:"gid"`
+	SetGroups  bool              `json:"set_groups,omitempty"`
+	Groups     []uint32          `json:"groups,omitempty"`
+	Rlimits    map[string]uint64 `json:"rlimits,omitempty"`
+	NoNewPrivs bool              `json:"no_new_privs,omitempty"`
+}
+
+func init() {
+	// the server binary executed as the helper confines itself and executes the shell, never returning
+	if spec, ok := os.LookupEnv(jailEnv); ok {
+		runJailed(spec)
+	}
+}
+
+func (j *Jail) validate() error {
+	for _, ns := range j.Namespaces {
+		if _, ok := namespaceFlags[ns]; !ok {
+			return fmt.Errorf("unknown namespace '%s'", ns)
+		}
+	}
+	for name := range j.Rlimits {
+		if _, ok := rlimitResources[name]; !ok {
+			return fmt.Errorf("unknown rlimit '%s'", name)
+		}
+	}
+	return nil
+}
+
+// apply prepares the command to be run by the helper, which takes over the credential of the attributes.
+// It returns the function releasing the resources of the jail once the command is started.
+func (j *Jail) apply(cmd *exec.Cmd, attrs *syscall.SysProcAttr, repl *caddy.Replacer) (func(), error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("locating the helper: %v", err)
+	}
+	cred := attrs.Credential
+	spec := jailSpec{
+		Path:       cmd.Path,
+		Dir:        cmd.Dir,
+		Env:        cmd.Env,
+		UID:        cred.Uid,
+		GID:        cred.Gid,
+		SetGroups:  !cred.NoSetGroups,
+		Groups:     cred.Groups,
+		Rlimits:    j.Rlimits,
+		NoNewPrivs: j.NoNewPrivs,
+	}
+	if j.ChrootDirectory != "" {
+		spec.Chroot = repl.ReplaceAll(j.ChrootDirectory, "")
+		if err := checkChrootDirectory(spec.Chroot); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, ns := range j.Namespaces {
+		attrs.Cloneflags |= namespaceFlags[ns]
+	}
+	if attrs.Cloneflags&syscall.CLONE_NEWUSER != 0 {
+		uids, gids := []uint32{cred.Uid}, append([]uint32{cred.Gid}, cred.Groups...)
+		if os.Getuid() == 0 {
+			// root is mapped for the helper to keep its capabilities across the execution, and it's
+			// dropped by the helper before executing the shell
+			uids, gids = append(uids, 0), append(gids, 0)
+		}
+		attrs.UidMappings, attrs.GidMappings = idMappings(uids), idMappings(gids)
+		attrs.GidMappingsEnableSetgroups = spec.SetGroups
+	}
+
+	release := func() {}
+	if j.Cgroup != "" {
+		dir := repl.ReplaceAll(j.Cgroup, "")
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating cgroup: %v", err)
+		}
+		f, err := os.OpenFile(dir, os.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			return nil, fmt.Errorf("opening cgroup: %v", err)
+		}
+		attrs.UseCgroupFD = true
+		attrs.CgroupFD = int(f.Fd())
+		release = func() { f.Close() }
+	}
+
+	b, err := json.Marshal(spec)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	cmd.Path = exe
+	// the helper changes to the working directory once confined
+	cmd.Dir = "/"
+	// the helper is started with a fixed environment, as the variables of the client, e.g. LD_PRELOAD,
+	// would otherwise apply to it before it drops its privileges. The configuration directory keeps the
+	// initialization of caddy from warning about the missing HOME on the output of the session.
+	cmd.Env = []string{jailEnv + "=" + string(b), "XDG_CONFIG_HOME=" + jailConfigHome}
+	attrs.Credential = nil
+	return release, nil
+}
+
+// idMappings maps the IDs to themselves within the user namespace
+func idMappings(ids []uint32) []syscall.SysProcIDMap {
+	var mappings []syscall.SysProcIDMap
+	seen := make(map[uint32]bool)
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			mappings = append(mappings, syscall.SysProcIDMap{ContainerID: int(id), HostID: int(id), Size: 1})
+		}
+	}
+	return mappings
+}
+
+// checkChrootDirectory ensures all the components of the path are directories owned by root and not writable
+// by the group or others, as sshd does
+func checkChrootDirectory(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("chroot directory '%s' is not an absolute path", dir)
+	}
+	p := "/"
+	components := strings.Split(strings.Trim(filepath.Clean(dir), "/"), "/")
+	for i := 0; ; i++ {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("chroot directory component: %v", err)
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !fi.IsDir() || !ok || st.Uid != 0 || fi.Mode().Perm()&0o022 != 0 {
+			return fmt.Errorf("bad ownership or modes for chroot directory component '%s'", p)
+		}
+		if i == len(components) || components[i] == "" {
+			return nil
+		}
+		p = filepath.Join(p, components[i])
+	}
+}
+
+// runJailed confines the helper by the spec and executes the shell in its place, or exits if it fails
+func runJailed(raw string) {
+	// no_new_privs is set on the thread executing the shell
+	runtime.LockOSThread()
+	err := execJailed(raw)
+	fmt.Fprintf(os.Stderr, "kadeessh: confining the session: %v\n", err)
+	os.Exit(126)
+}
+
+func execJailed(raw string) error {
+	var spec jailSpec
+	if err := json.Unmarshal([]byte(raw), &spec); err != nil {
+		return err
+	}
+	for name, limit := range spec.Rlimits {
+		if err := unix.Setrlimit(rlimitResources[name], &unix.Rlimit{Cur: limit, Max: limit}); err != nil {
+			return fmt.Errorf("setting rlimit %s: %v", name, err)
+		}
+	}
+	if spec.Chroot != "" {
+		if err := unix.Chroot(spec.Chroot); err != nil {
+			return fmt.Errorf("chroot: %v", err)
+		}
+	}
+	if spec.SetGroups {
+		groups := make([]int, 0, len(spec.Groups))
+		for _, gid := range spec.Groups {
+			groups = append(groups, int(gid))
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("setting groups: %v", err)
+		}
+	}
+	if err := syscall.Setresgid(int(spec.GID), int(spec.GID), int(spec.GID)); err != nil {
+		return fmt.Errorf("setting gid: %v", err)
+	}
+	if err := syscall.Setresuid(int(spec.UID), int(spec.UID), int(spec.UID)); err != nil {
+		return fmt.Errorf("setting uid: %v", err)
+	}
+	// changing the directory as the user, as sshd does
+	if err := unix.Chdir(spec.Dir); err != nil {
+		if err := unix.Chdir("/"); err != nil {
+			return fmt.Errorf("changing directory: %v", err)
+		}
+	}
+	if spec.NoNewPrivs {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("setting no_new_privs: %v", err)
+		}
+	}
+	return syscall.Exec(spec.Path, os.Args, spec.Env)
+}
@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package pty
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestCheckChrootDirectory(t *testing.T) {
+	writable := filepath.Join(t.TempDir(), "writable")
+	if err := os.Mkdir(writable, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(writable, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dir     string
+		wantErr bool
+	}{
+		{dir: "/", wantErr: false},
+		{dir: "relative/path", wantErr: true},
+		{dir: "/nonexistent-chroot", wantErr: true},
+		{dir: writable, wantErr: true},
+		{dir: "/etc/passwd", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := checkChrootDirectory(tt.dir); (err != nil) != tt.wantErr {
+			t.Errorf("checkChrootDirectory(%q) = %v, wantErr %v", tt.dir, err, tt.wantErr)
+		}
+	}
+}
+
+func TestJail(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("switching to another user requires root")
+	}
+	j := &Jail{
+		Namespaces: []string{"user", "mount", "pid", "network"},
+		Rlimits:    map[string]uint64{"nofile": 64},
+		NoNewPrivs: true,
+	}
+	if err := j.validate(); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("/bin/sh", "-c", "ulimit -n; grep NoNewPrivs /proc/self/status; id -u; pwd; readlink /proc/self/ns/net; echo $HOME")
+	// the directory isn't accessible to the user, so the helper falls back to /
+	cmd.Dir = t.TempDir()
+	cmd.Env = []string{"HOME=/"}
+	attrs := &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534, Groups: []uint32{65534}}}
+	release, err := j.apply(cmd, attrs, caddy.NewReplacer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	cmd.SysProcAttr = attrs
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("running the jailed command: %v: %s", err, out)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	netns, _ := os.Readlink("/proc/self/ns/net")
+	if len(lines) != 6 || lines[0] != "64" || lines[1] != "NoNewPrivs:\t1" || lines[2] != "65534" || lines[3] != "/" || lines[4] == netns || lines[5] != "/" {
+		t.Errorf("the jailed command reported:\n%s", out)
+	}
+}
+
+func TestJailApplyEnv(t *testing.T) {
+	cmd := exec.Command("/bin/sh")
+	cmd.Env = []string{"HOME=/home/alice", "LD_PRELOAD=/tmp/evil.so"}
+	attrs := &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+	release, err := (&Jail{}).apply(cmd, attrs, caddy.NewReplacer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	// the privileged helper only gets the spec, which carries the environment of the shell
+	if len(cmd.Env) != 2 || !strings.HasPrefix(cmd.Env[0], jailEnv+"=") || cmd.Env[1] != "XDG_CONFIG_HOME="+jailConfigHome {
+		t.Fatalf("environment of the helper = %q; want only the fixed variables", cmd.Env)
+	}
+	var spec jailSpec
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(cmd.Env[0], jailEnv+"=")), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(spec.Env, []string{"HOME=/home/alice", "LD_PRELOAD=/tmp/evil.so"}) || spec.Path != "/bin/sh" {
+		t.Errorf("spec = %+v; want the command and its environment", spec)
+	}
+}
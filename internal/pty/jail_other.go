@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package pty
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+var errJailUnsupported = errors.New("jail is only supported on Linux")
+
+func (j *Jail) validate() error {
+	return errJailUnsupported
+}
+
+func (j *Jail) apply(_ *exec.Cmd, _ *syscall.SysProcAttr, _ *caddy.Replacer) (func(), error) {
+	return nil, errJailUnsupported
+}
@@ -0,0 +1,45 @@
+package passwd
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// AsUser runs fn on a thread whose file system credentials are the ones of the user, so the paths it
+// accesses are checked against the permissions of the user, and the files it creates are owned by the user.
+// The credentials are set on the thread alone, which is discarded afterwards.
+func AsUser(user *Entry, fn func() error) error {
+	groups, err := user.Groups()
+	if err != nil {
+		return fmt.Errorf("looking up the groups of the user: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		// the thread is left locked, so it's terminated with the goroutine rather than reused
+		runtime.LockOSThread()
+		errc <- func() error {
+			gids := make([]int, 0, len(groups))
+			for _, gid := range groups {
+				gids = append(gids, int(gid))
+			}
+			// unlike the ones of package syscall, these apply to the calling thread only
+			if err := unix.Setgroups(gids); err != nil {
+				return fmt.Errorf("setting groups: %v", err)
+			}
+			if err := unix.Setfsgid(int(user.GID)); err != nil { //nolint:gosec
+				return fmt.Errorf("setting fsgid: %v", err)
+			}
+			if err := unix.Setfsuid(int(user.UID)); err != nil { //nolint:gosec
+				return fmt.Errorf("setting fsuid: %v", err)
+			}
+			// setfsuid reports no failure, so the credential is read back by an invalid change
+			if uid, _ := unix.SetfsuidRetUid(-1); uid != int(user.UID) { //nolint:gosec
+				return fmt.Errorf("setting fsuid: uid is %d", uid)
+			}
+			return fn()
+		}()
+	}()
+	return <-errc
+}
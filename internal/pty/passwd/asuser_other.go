@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package passwd
+
+import (
+	"errors"
+	"fmt"
+)
+
+// AsUser refuses to run fn, as the credentials of the file system can't be taken on by a single thread
+func AsUser(*Entry, func() error) error {
+	return fmt.Errorf("taking on the credentials of another user is only supported on linux: %w", errors.ErrUnsupported)
+}
@@ -1,6 +1,8 @@
 package passwd
 
 import (
+	osuser "os/user"
+	"strconv"
 	"sync"
 
 	"go.uber.org/zap/zapcore"
@@ -29,6 +31,27 @@ func (e Entry) MarshalLogObject(enc zapcore.ObjectEncoder) error {
 	return nil
 }
 
+// Groups returns the IDs of the groups the user is a member of
+func (e Entry) Groups() ([]uint32, error) {
+	u, err := osuser.Lookup(e.Username)
+	if err != nil {
+		return nil, err
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	var groups []uint32
+	for _, gid := range gids {
+		id, err := strconv.ParseUint(gid, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, uint32(id))
+	}
+	return groups, nil
+}
+
 type Passwd interface {
 	Get(username string) *Entry
 }
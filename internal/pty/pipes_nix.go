@@ -0,0 +1,94 @@
+//go:build !windows
+// +build !windows
+
+package pty
+
+import (
+	"io"
+	"os/exec"
+	"sync"
+
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+// caddyPipes runs the command of a session without a PTY, connecting the standard streams of the
+// command to the channel of the session through pipes
+type caddyPipes struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+	sess   session.Session
+
+	// cleanup releases the per-session resources, e.g. the agent socket and the X11 display
+	cleanup func()
+}
+
+// startPipes starts the command with its standard streams connected to pipes
+func startPipes(cmd *exec.Cmd, sess session.Session, cleanup func()) (*caddyPipes, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &caddyPipes{cmd, stdin, stdout, stderr, sess, cleanup}, nil
+}
+
+// Communicate copies the input of the peer to the command, closing the input of the command once
+// the peer sends EOF, and copies the output and error output of the command to the peer, the latter
+// as extended data, until the command closes them
+func (p *caddyPipes) Communicate(peer io.ReadWriter) {
+	go func() {
+		io.Copy(p.stdin, peer) //nolint:errcheck
+		p.stdin.Close()
+	}()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(p.sess.Stderr(), p.stderr) //nolint:errcheck
+	}()
+	io.Copy(peer, p.stdout) //nolint:errcheck
+	wg.Wait()
+}
+
+// SetWindowsSize is a no-op as there is no terminal
+func (p *caddyPipes) SetWindowsSize(h, w int) {}
+
+// Close releases the resources of the session
+func (p *caddyPipes) Close() error {
+	p.cleanup()
+	return nil
+}
+
+// WaitExited waits for the process to exit without reaping it, where supported
+func (p *caddyPipes) WaitExited() {
+	waitExited(p.cmd)
+}
+
+// Wait waits for the process to exit, and returns its exit as *session.ExitError, or nil if it succeeded
+func (p *caddyPipes) Wait() error {
+	err := p.cmd.Wait()
+	if p.cmd.ProcessState == nil {
+		return err
+	}
+	return exitError(p.cmd.ProcessState)
+}
+
+// Signal sends the signal to the process group of the command
+func (p *caddyPipes) Signal(sig ssh.Signal) error {
+	return signalGroup(p.cmd, sig)
+}
+
+var _ sshPty = (*caddyPipes)(nil)
@@ -8,21 +8,26 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"syscall"
 
 	"github.com/creack/pty"
 	"github.com/kadeessh/kadeessh/internal/session"
 	"github.com/kadeessh/kadeessh/internal/ssh"
 	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 )
 
 type caddyPty struct {
 	pty       *os.File
+	cmd       *exec.Cmd
 	sess      session.Session
-	wantTTY   bool
 	sessionId string
 
 	logger *zap.Logger
+
+	// cleanup releases the per-session resources, e.g. the agent socket and the X11 display
+	cleanup func()
 }
 
 func (s Shell) openPty(sess session.Session) (sshPty, error) {
@@ -32,14 +37,18 @@ func (s Shell) openPty(sess session.Session) (sshPty, error) {
 	}
 	sessionId := sess.Context().Value(ssh.ContextKeySessionID).(string)
 
-	// Honor a per-key command="..." critical option from authorized_keys, but
-	// let a server-side ForceCommand take precedence.
+	// Honor a per-key command="..." critical option from authorized_keys, or the
+	// force-command critical option of a user certificate, but let a server-side
+	// ForceCommand take precedence.
 	forcedCommand := s.ForceCommand != "" && s.ForceCommand != "none"
 	if !forcedCommand {
 		if opts := sess.Permissions().CriticalOptions; opts != nil {
-			if cmd, ok := opts["command"]; ok && cmd != "" {
-				s.ForceCommand = cmd
-				forcedCommand = true
+			for _, opt := range []string{"command", "force-command"} {
+				if cmd, ok := opts[opt]; ok && cmd != "" {
+					s.ForceCommand = cmd
+					forcedCommand = true
+					break
+				}
 			}
 		}
 	}
@@ -83,44 +92,140 @@ func (s Shell) openPty(sess session.Session) (sshPty, error) {
 	shell := user.Shell
 	execCmd := exec.Command(shell, args...)
 	execCmd.Dir = user.HomeDir
+	if len(args) == 0 {
+		// a login shell, as started by login(1) and sshd
+		execCmd.Args[0] = "-" + filepath.Base(shell)
+	}
 
-	env := make([]string, len(s.Env))
+	// the later variables override the earlier ones
+	execCmd.Env = loginEnv(user)
+	if s.EnvironmentFile != "" {
+		env, err := systemEnvironment(s.EnvironmentFile)
+		if err != nil {
+			s.logger.Warn("reading environment file", zap.String("session_id", sessionId), zap.Error(err))
+		}
+		execCmd.Env = append(execCmd.Env, env...)
+	}
+	accepted, rejected := acceptEnv(s.AcceptEnv, sess.Environ())
+	if len(rejected) > 0 {
+		s.logger.Debug("ignoring environment variables", zap.String("session_id", sessionId), zap.Strings("names", rejected))
+	}
+	execCmd.Env = append(execCmd.Env, accepted...)
+	if s.PermitUserEnvironment {
+		env, err := userEnvironment(user)
+		if err != nil {
+			s.logger.Warn("reading user environment", zap.String("session_id", sessionId), zap.Error(err))
+		}
+		execCmd.Env = append(execCmd.Env, env...)
+	}
 	for k, v := range s.Env {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
+		execCmd.Env = append(execCmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	execCmd.Env = append(execCmd.Env, connectionEnv(sess)...)
+	if isPty {
+		execCmd.Env = append(execCmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
 	}
-	execCmd.Env = append(execCmd.Env, sess.Environ()...)
-	execCmd.Env = append(execCmd.Env, env...)
-	execCmd.Env = append(execCmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
 	if forcedCommand && wantTTY {
 		execCmd.Env = append(execCmd.Env, fmt.Sprintf("SSH_ORIGINAL_COMMAND=%s", sess.RawCommand()))
 	}
 
-	// hook std{in,out} to the session if the user is not requesting a shell, which is implied
-	// by the absence of a command. Setting stderr by using sess.Stderr() causes the output of the commands
-	// to disappear completely.
-	// TODO: investigate whether the observation of setting stderr is a bug with `sess.Stderr()` or an expected behavior
-	if wantTTY && !forcedCommand {
-		execCmd.Stdin = sess
-		execCmd.Stdout = sess
+	cleanup := func() {}
+	if ssh.AgentRequestedContext(sess.Context()) {
+		sock, closeAgent, err := forwardAgent(sess, int(user.UID), int(user.GID)) //nolint:gosec
+		if err != nil {
+			return nil, fmt.Errorf("forwarding agent: %v", err)
+		}
+		s.logger.Info("forwarding agent", zap.String("session_id", sessionId), zap.String("socket", sock))
+		execCmd.Env = append(execCmd.Env, fmt.Sprintf("SSH_AUTH_SOCK=%s", sock))
+		cleanup = closeAgent
+	}
+	if x11, ok := ssh.X11RequestedContext(sess.Context()); ok {
+		display, closeX11, err := forwardX11(sess, x11, user)
+		if err != nil {
+			// the session proceeds without X11 as OpenSSH does
+			s.logger.Warn("forwarding x11", zap.String("session_id", sessionId), zap.Error(err))
+		} else {
+			s.logger.Info("forwarding x11", zap.String("session_id", sessionId), zap.String("display", display))
+			execCmd.Env = append(execCmd.Env, fmt.Sprintf("DISPLAY=%s", display))
+			closePrevious := cleanup
+			cleanup = func() {
+				closePrevious()
+				closeX11()
+			}
+		}
 	}
 
 	// thanks @mholt!
-	// jailCommand(execCmd, u)
 	// run as unprivileged user
-	f, err := pty.StartWithAttrs(execCmd, &pty.Winsize{}, &syscall.SysProcAttr{
+	attrs := &syscall.SysProcAttr{
 		Setsid: true,
 		Credential: &syscall.Credential{
 			//nolint:gosec
-			Uid:         uint32(user.UID), // <-- other user's ID
-			Gid:         uint32(user.GID), //nolint:gosec
-			NoSetGroups: true,
+			Uid: uint32(user.UID), // <-- other user's ID
+			Gid: uint32(user.GID), //nolint:gosec
+			// setting the groups requires privileges, which the server lacks when it runs as the user
+			NoSetGroups: os.Getuid() != 0,
 		},
-	})
+	}
+	if !attrs.Credential.NoSetGroups {
+		groups, err := user.Groups()
+		if err != nil {
+			// the process is left with its primary group rather than inheriting the groups of the server
+			s.logger.Warn("looking up supplementary groups", zap.String("session_id", sessionId), zap.Error(err))
+		}
+		attrs.Credential.Groups = groups
+	}
+
+	var f, tty *os.File
+	if isPty {
+		var err error
+		if f, tty, err = pty.Open(); err != nil {
+			cleanup()
+			return nil, err
+		}
+		execCmd.Env = append(execCmd.Env, fmt.Sprintf("SSH_TTY=%s", tty.Name()))
+	}
+	// the environment of the session is complete before the jail takes it over
+	if s.Jail != nil {
+		release, err := s.Jail.apply(execCmd, attrs, session.NewReplacer(sess))
+		if err != nil {
+			if isPty {
+				f.Close()
+				tty.Close()
+			}
+			cleanup()
+			return nil, fmt.Errorf("jailing session: %v", err)
+		}
+		defer release()
+	}
+
+	// without a PTY the standard streams are connected to the session through pipes
+	if !isPty {
+		execCmd.SysProcAttr = attrs
+		pipes, err := startPipes(execCmd, sess, cleanup)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		return pipes, nil
+	}
+
+	execCmd.Stdin, execCmd.Stdout, execCmd.Stderr = tty, tty, tty
+	attrs.Setctty = true
+	execCmd.SysProcAttr = attrs
+	err := execCmd.Start()
+	// the process holds the tty on its own
+	tty.Close()
 	if err != nil {
+		f.Close()
+		cleanup()
 		return nil, err
 	}
 
-	spty := &caddyPty{f, sess, wantTTY, sessionId, s.logger}
+	spty := &caddyPty{f, execCmd, sess, sessionId, s.logger, cleanup}
+	if r, ok := sess.(session.EchoReporter); ok {
+		r.ReportEcho(spty.echoes)
+	}
 	go func() {
 		for win := range winCh {
 			spty.SetWindowsSize(win.Height, win.Width)
@@ -131,14 +236,27 @@ func (s Shell) openPty(sess session.Session) (sshPty, error) {
 
 // Communicate copies the IO across the PTY and the peer
 func (p *caddyPty) Communicate(peer io.ReadWriter) {
-	if !p.wantTTY {
-		go func() {
-			io.Copy(p.pty, peer) // stdin
-		}()
-	}
+	go func() {
+		io.Copy(p.pty, peer) // stdin
+	}()
 	io.Copy(peer, p.pty) // stdout
 }
 
+// echoes reports whether the terminal of the PTY echoes the input, e.g. it doesn't while a password is read
+func (p *caddyPty) echoes() bool {
+	// the descriptor is used through the raw connection to keep the PTY in non-blocking mode
+	conn, err := p.pty.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var echo bool
+	_ = conn.Control(func(fd uintptr) {
+		t, err := unix.IoctlGetTermios(int(fd), ioctlReadTermios)
+		echo = err == nil && t.Lflag&unix.ECHO != 0
+	})
+	return echo
+}
+
 // SetWindowsSize updates the window size fo the PTY session
 func (p *caddyPty) SetWindowsSize(h, w int) {
 	pty.Setsize(p.pty, &pty.Winsize{Rows: uint16(h), Cols: uint16(w)}) //nolint
@@ -150,12 +268,59 @@ func (p *caddyPty) SetWindowsSize(h, w int) {
 	)
 }
 
-// Close closes the PTY session
+// Close closes the PTY session and releases its resources
 func (p *caddyPty) Close() error {
+	p.cleanup()
 	if err := p.pty.Close(); err != nil && err != io.EOF {
 		return err
 	}
 	return nil
 }
 
+// WaitExited waits for the process to exit without reaping it, where supported
+func (p *caddyPty) WaitExited() {
+	waitExited(p.cmd)
+}
+
+// Wait waits for the process to exit, and returns its exit as *session.ExitError, or nil if it succeeded
+func (p *caddyPty) Wait() error {
+	err := p.cmd.Wait()
+	if p.cmd.ProcessState == nil {
+		return err
+	}
+	return exitError(p.cmd.ProcessState)
+}
+
+// Signal sends the signal to the process group of the command
+func (p *caddyPty) Signal(sig ssh.Signal) error {
+	return signalGroup(p.cmd, sig)
+}
+
 var _ sshPty = (*caddyPty)(nil)
+
+// forwardAgent listens on a per-session unix socket, owned by the user, and forwards its
+// connections to the agent of the client. It returns the socket path and the function
+// closing the listener and removing the socket.
+func forwardAgent(sess session.Session, uid, gid int) (string, func(), error) {
+	l, err := ssh.NewAgentListener()
+	if err != nil {
+		return "", nil, err
+	}
+	sock := l.Addr().String()
+	dir := filepath.Dir(sock)
+	cleanup := func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+	// chown is skipped when the server runs as the user, e.g. when it's not running as root
+	if os.Getuid() != uid {
+		for _, p := range []string{dir, sock} {
+			if err := os.Chown(p, uid, gid); err != nil {
+				cleanup()
+				return "", nil, err
+			}
+		}
+	}
+	go ssh.ForwardAgentConnectionsContext(l, sess.Context())
+	return sock, cleanup, nil
+}
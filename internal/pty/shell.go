@@ -1,14 +1,22 @@
 package pty
 
 import (
+	"fmt"
 	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/kadeessh/kadeessh/internal/pty/passwd"
 	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
 	"go.uber.org/zap"
 )
 
+const defaultKillGracePeriod = 5 * time.Second
+
 func init() {
 	caddy.RegisterModule(Shell{})
 }
@@ -17,6 +25,9 @@ type sshPty interface {
 	Communicate(io.ReadWriter)
 	SetWindowsSize(w, h int)
 	Close() error
+	WaitExited()
+	Wait() error
+	Signal(sig ssh.Signal) error
 }
 
 // Shell is an `ssh.actors` module providing "shell" to a session. The module spawns a process
@@ -24,6 +35,21 @@ type sshPty interface {
 // for the details and caches the result for future logins. On macOS, the module calls `dscl . -read` for the necessary
 // user details and caches them for future logins. On Windows, the module uses the
 // [`os/user` package](https://pkg.go.dev/os/user?GOOS=windows) from the Go standard library.
+//
+// The process is attached to a PTY only if the client requested one. Otherwise, its standard streams are
+// connected to the session through pipes, so the output is binary-safe, the error output is sent apart as
+// extended data, and the input is closed once the client sends EOF, as needed by e.g. rsync and git.
+//
+// The signals sent by the client are forwarded to the process group of the command. If the client closes
+// the session while the command runs, the process group is sent SIGHUP, then SIGKILL once the grace period
+// elapses, so no orphaned processes are left behind.
+//
+// The process runs in a login environment on par with sshd: it's a member of the supplementary groups of
+// the user, the shell started without a command is a login shell, and the environment has the `USER`,
+// `LOGNAME`, `HOME`, `SHELL`, `PATH`, `SSH_CLIENT`, `SSH_CONNECTION`, and, with a PTY, `SSH_TTY` variables.
+// The variables are set in the following order, where the later ones override the earlier ones: the standard
+// variables, the `environment_file`, the variables sent by the client and accepted by `accept_env`,
+// `~/.ssh/environment` if `permit_user_environment` is set, `env`, and the variables describing the session.
 type Shell struct {
 	// Executes the designated command using the user's default shell, regardless of
 	// the supplied command. It follows the OpenSSH semantics specified for
@@ -37,6 +63,27 @@ type Shell struct {
 	// whether the server should check for explicit pty request
 	ForcePTY bool `json:"force_pty,omitempty"`
 
+	// The patterns of the names of the environment variables sent by the client which are accepted, as the
+	// [`AcceptEnv`](https://man.openbsd.org/sshd_config#AcceptEnv) of OpenSSH, e.g. `LANG` and `LC_*`.
+	// The other variables are ignored. No variable is accepted by default.
+	AcceptEnv []string `json:"accept_env,omitempty"`
+
+	// The path of a file of `NAME=value` lines setting the environment of the sessions, e.g. `/etc/environment`
+	EnvironmentFile string `json:"environment_file,omitempty"`
+
+	// Read the environment of the session from `~/.ssh/environment` of the user, as the
+	// [`PermitUserEnvironment`](https://man.openbsd.org/sshd_config#PermitUserEnvironment) of OpenSSH.
+	// As with OpenSSH, users may bypass access restrictions, e.g. with `LD_PRELOAD`, when it's enabled.
+	// The file is read with the permissions of the user, and must be owned by the user.
+	PermitUserEnvironment bool `json:"permit_user_environment,omitempty"`
+
+	// Confine the process with chroot, namespaces, resource limits, a cgroup, and `no_new_privs` on Linux
+	Jail *Jail `json:"jail,omitempty"`
+
+	// The time the process group is given to exit after the SIGHUP sent when the client closes the session,
+	// before it's killed with SIGKILL. Defaults to 5s.
+	KillGracePeriod caddy.Duration `json:"kill_grace_period,omitempty"`
+
 	logger *zap.Logger
 	pass   passwd.Passwd
 }
@@ -58,10 +105,23 @@ func (s Shell) CaddyModule() caddy.ModuleInfo {
 func (s *Shell) Provision(ctx caddy.Context) error {
 	s.logger = ctx.Logger(s)
 	s.pass = passwd.New()
+	if s.KillGracePeriod == 0 {
+		s.KillGracePeriod = caddy.Duration(defaultKillGracePeriod)
+	}
+	for _, p := range s.AcceptEnv {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid accept_env pattern '%s': %v", p, err)
+		}
+	}
+	if s.Jail != nil {
+		if err := s.Jail.validate(); err != nil {
+			return fmt.Errorf("jail: %v", err)
+		}
+	}
 	return nil
 }
 
-// Handle opens a PTY to run the command
+// Handle opens a PTY to run the command, and reports the exit status or signal of the command
 func (s Shell) Handle(sess session.Session) error {
 	spty, err := s.openPty(sess)
 	if err != nil {
@@ -69,8 +129,90 @@ func (s Shell) Handle(sess session.Session) error {
 		sess.Close()
 		return err
 	}
+	wait := s.forwardSignals(sess, spty)
+
 	spty.Communicate(sess)
-	return spty.Close()
+	if err := spty.Close(); err != nil {
+		return err
+	}
+	return wait()
+}
+
+// forwardSignals relays the signals of the client to the process group until the process exits, and hangs
+// up the group if the client closes the session before then. The group is signaled by the PID of its leader,
+// the process, so the returned function waiting on the process doesn't reap it while the group is signaled.
+func (s Shell) forwardSignals(sess session.Session, spty sshPty) (wait func() error) {
+	sessionId, _ := sess.Context().Value(ssh.ContextKeySessionID).(string)
+	var mu sync.Mutex
+	reaped := false
+	exited := make(chan struct{})
+	signal := func(sig ssh.Signal) error {
+		if reaped {
+			return os.ErrProcessDone
+		}
+		return spty.Signal(sig)
+	}
+
+	signals := make(chan ssh.Signal, 1)
+	sess.Signals(signals)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				mu.Lock()
+				err := signal(sig)
+				mu.Unlock()
+				if err != nil {
+					s.logger.Warn("forwarding signal", zap.String("session_id", sessionId), zap.String("signal", string(sig)), zap.Error(err))
+				}
+			case <-sess.Closed():
+				select {
+				case <-exited:
+					// the session is closed after the process exits
+					return
+				default:
+				}
+				s.logger.Info("session closed, hanging up the process", zap.String("session_id", sessionId))
+				// the process is left unreaped until the group is killed, so its PID isn't reused meanwhile
+				mu.Lock()
+				defer mu.Unlock()
+				_ = signal(ssh.SIGHUP)
+				// the group is killed even if its leader exits in time, as the rest of it would be orphaned
+				time.Sleep(time.Duration(s.KillGracePeriod))
+				_ = signal(ssh.SIGKILL)
+				return
+			case <-exited:
+				unregisterSignals(sess, signals)
+				return
+			}
+		}
+	}()
+
+	return func() error {
+		spty.WaitExited()
+		close(exited)
+		mu.Lock()
+		reaped = true
+		mu.Unlock()
+		return spty.Wait()
+	}
+}
+
+// unregisterSignals unregisters the channel of the signals, draining it meanwhile as the session
+// blocks on delivering a signal while holding the lock needed to unregister
+func unregisterSignals(sess session.Session, signals <-chan ssh.Signal) {
+	done := make(chan struct{})
+	go func() {
+		sess.Signals(nil)
+		close(done)
+	}()
+	for {
+		select {
+		case <-signals:
+		case <-done:
+			return
+		}
+	}
 }
 
 var _ session.Handler = Shell{}
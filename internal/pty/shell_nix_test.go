@@ -0,0 +1,235 @@
+//go:build !windows
+// +build !windows
+
+package pty
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/creack/pty"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// newTestSession serves the sessions with the handler, and returns a client session to the server
+func newTestSession(t *testing.T, handler ssh.Handler) *gossh.Session {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := gossh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &ssh.Server{
+		Handler:         handler,
+		PasswordHandler: func(ctx ssh.Context, password string) bool { return true },
+	}
+	srv.AddHostKey(hostSigner)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	client, err := gossh.Dial("tcp", l.Addr().String(), &gossh.ClientConfig{
+		User:            "root",
+		Auth:            []gossh.AuthMethod{gossh.Password("secret")},
+		HostKeyCallback: gossh.FixedHostKey(hostSigner.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sess.Close() })
+	return sess
+}
+
+// exitSession reports the exit of the command to the client, as the app does
+func exitSession(sess ssh.Session, err error) {
+	var exitErr *session.ExitError
+	switch {
+	case errors.As(err, &exitErr) && exitErr.Signal != "":
+		sess.ExitSignal(exitErr.Signal, exitErr.CoreDumped, "")
+	case errors.As(err, &exitErr):
+		sess.Exit(int(exitErr.Status))
+	case err != nil:
+		sess.Exit(1)
+	default:
+		sess.Exit(0)
+	}
+}
+
+// newTestShellSession serves sessions running their command through pipes, as the shell does for the
+// sessions without a PTY, and returns a client session to the server. The exit of the commands is
+// sent on the returned channel.
+func newTestShellSession(t *testing.T, s Shell) (*gossh.Session, <-chan error) {
+	t.Helper()
+	exits := make(chan error, 1)
+	sess := newTestSession(t, func(sess ssh.Session) {
+		cmd := exec.Command("/bin/sh", "-c", sess.RawCommand())
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		p, err := startPipes(cmd, sess, func() {})
+		if err != nil {
+			t.Error(err)
+			sess.Exit(1)
+			return
+		}
+		wait := s.forwardSignals(sess, p)
+		p.Communicate(sess)
+		p.Close()
+		err = wait()
+		exits <- err
+		exitSession(sess, err)
+	})
+	return sess, exits
+}
+
+func newTestShell() Shell {
+	return Shell{KillGracePeriod: caddy.Duration(100 * time.Millisecond), logger: zap.NewNop()}
+}
+
+func TestPipes(t *testing.T) {
+	sess, _ := newTestShellSession(t, newTestShell())
+
+	input := []byte("binary\x00\xff\r\nlines\n")
+	var stdout, stderr bytes.Buffer
+	sess.Stdin, sess.Stdout, sess.Stderr = bytes.NewReader(input), &stdout, &stderr
+	// cat only exits once the input is closed
+	err := sess.Run("cat; echo oops >&2; exit 4")
+	var exitErr *gossh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 4 {
+		t.Fatalf("Run() error = %v; want the exit status 4", err)
+	}
+	if !bytes.Equal(stdout.Bytes(), input) {
+		t.Errorf("stdout = %q; want %q", stdout.Bytes(), input)
+	}
+	if want := "oops\n"; stderr.String() != want {
+		t.Errorf("stderr = %q; want %q", stderr.String(), want)
+	}
+}
+
+func TestShellForwardsSignals(t *testing.T) {
+	sess, _ := newTestShellSession(t, newTestShell())
+
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Start("trap 'echo interrupted; exit 7' INT; echo ready; while :; do sleep 0.1; done"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("ready\n"))
+	if _, err := stdout.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Signal(gossh.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	err = sess.Wait()
+	var exitErr *gossh.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitStatus() != 7 {
+		t.Fatalf("Wait() error = %v; want the exit status 7", err)
+	}
+}
+
+func TestShellHangsUpOnClose(t *testing.T) {
+	sess, exits := newTestShellSession(t, newTestShell())
+
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the process ignores SIGHUP, so only SIGKILL terminates it
+	if err := sess.Start("trap '' HUP; echo ready; while :; do sleep 0.1; done"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("ready\n"))
+	if _, err := stdout.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	sess.Close()
+
+	select {
+	case err := <-exits:
+		var exitErr *session.ExitError
+		if !errors.As(err, &exitErr) || exitErr.Signal != ssh.SIGKILL {
+			t.Fatalf("exit = %v; want the signal KILL", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the process outlived the session")
+	}
+}
+
+func TestShellKillsGroupBeforeReaping(t *testing.T) {
+	s := newTestShell()
+	sess, exits := newTestShellSession(t, s)
+
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the leader exits on SIGHUP, while the rest of the group ignores it
+	if err := sess.Start("(trap '' HUP; while :; do sleep 0.1; done) >/dev/null 2>&1 & echo ready; wait"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("ready\n"))
+	if _, err := stdout.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	closed := time.Now()
+	sess.Close()
+
+	select {
+	case err := <-exits:
+		var exitErr *session.ExitError
+		if !errors.As(err, &exitErr) || exitErr.Signal != ssh.SIGHUP {
+			t.Fatalf("exit = %v; want the signal HUP", err)
+		}
+		// the leader is only reaped once the group is killed, so the PGID isn't reused meanwhile
+		if elapsed := time.Since(closed); elapsed < time.Duration(s.KillGracePeriod) {
+			t.Errorf("the leader was reaped %v after the hang up; want after the grace period", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the process outlived the session")
+	}
+}
+
+func TestPtyEchoes(t *testing.T) {
+	f, tty, err := pty.Open()
+	if err != nil {
+		t.Skipf("opening a pty: %v", err)
+	}
+	defer f.Close()
+	defer tty.Close()
+
+	p := &caddyPty{pty: f}
+	if !p.echoes() {
+		t.Error("echoes() = false; want the echo of a new terminal")
+	}
+	stty := exec.Command("stty", "-echo")
+	stty.Stdin = tty
+	if out, err := stty.CombinedOutput(); err != nil {
+		t.Fatalf("stty -echo: %v: %s", err, out)
+	}
+	if p.echoes() {
+		t.Error("echoes() = true; want no echo once disabled")
+	}
+}
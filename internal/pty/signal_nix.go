@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package pty
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+// signalNames maps the signals to their names in RFC 4254
+var signalNames = map[syscall.Signal]ssh.Signal{
+	syscall.SIGABRT: ssh.SIGABRT,
+	syscall.SIGALRM: ssh.SIGALRM,
+	syscall.SIGFPE:  ssh.SIGFPE,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGILL:  ssh.SIGILL,
+	syscall.SIGINT:  ssh.SIGINT,
+	syscall.SIGKILL: ssh.SIGKILL,
+	syscall.SIGPIPE: ssh.SIGPIPE,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+	syscall.SIGSEGV: ssh.SIGSEGV,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGUSR1: ssh.SIGUSR1,
+	syscall.SIGUSR2: ssh.SIGUSR2,
+}
+
+// signalsByName maps the names in RFC 4254 to the signals
+var signalsByName = func() map[ssh.Signal]syscall.Signal {
+	m := make(map[ssh.Signal]syscall.Signal, len(signalNames))
+	for sig, name := range signalNames {
+		m[name] = sig
+	}
+	return m
+}()
+
+// signalGroup sends the signal to the process group of the command, which is led by the command
+// as it's started in a new session
+func signalGroup(cmd *exec.Cmd, name ssh.Signal) error {
+	sig, ok := signalsByName[name]
+	if !ok {
+		return fmt.Errorf("unknown signal '%s'", name)
+	}
+	if cmd.Process == nil {
+		return fmt.Errorf("process not started")
+	}
+	return syscall.Kill(-cmd.Process.Pid, sig)
+}
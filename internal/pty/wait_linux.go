@@ -0,0 +1,23 @@
+package pty
+
+import (
+	"errors"
+	"os/exec"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitExited blocks until the command exits, and leaves it unreaped, so the ID of the process group
+// led by the command isn't reused until the command is waited on
+func waitExited(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	var info unix.Siginfo
+	for {
+		err := unix.Waitid(unix.P_PID, cmd.Process.Pid, &info, unix.WEXITED|unix.WNOWAIT, nil)
+		if !errors.Is(err, unix.EINTR) {
+			return
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package pty
+
+import "os/exec"
+
+// waitExited returns right away, as the exit of the command can't be waited on without reaping it.
+// The process group is thus no longer signaled once the command is being waited on.
+func waitExited(*exec.Cmd) {}
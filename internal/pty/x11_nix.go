@@ -0,0 +1,87 @@
+//go:build !windows
+// +build !windows
+
+package pty
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/kadeessh/kadeessh/internal/pty/passwd"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+const (
+	// x11DisplayOffset is the first display number tried for forwarding, which
+	// is the default `X11DisplayOffset` of OpenSSH to avoid clashing with real X servers
+	x11DisplayOffset = 10
+
+	// x11MaxDisplays is the number of display numbers tried before giving up
+	x11MaxDisplays = 1000
+
+	// x11BasePort is the TCP port of the display number 0
+	x11BasePort = 6000
+)
+
+// forwardX11 listens on the localhost TCP port of the first free display number, writes the
+// cookie of the client into the xauth file of the user, and forwards the connections to the
+// client over x11 channels. It returns the DISPLAY value and the function closing the listener
+// and removing the cookie.
+func forwardX11(sess session.Session, x11 ssh.X11, user *passwd.Entry) (string, func(), error) {
+	// the protocol and the cookie of the client are written into the commands of xauth
+	if !x11.ValidAuth() {
+		return "", nil, fmt.Errorf("malformed x11 authentication protocol or cookie")
+	}
+
+	var l net.Listener
+	var display int
+	for display = x11DisplayOffset; display < x11DisplayOffset+x11MaxDisplays; display++ {
+		var err error
+		if l, err = net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(x11BasePort+display))); err == nil {
+			break
+		}
+	}
+	if l == nil {
+		return "", nil, fmt.Errorf("no free display number in the range [%d, %d)", x11DisplayOffset, x11DisplayOffset+x11MaxDisplays)
+	}
+
+	// the cookie is registered for the unix display, which is what xlib looks up for localhost displays
+	authDisplay := fmt.Sprintf("unix:%d.%d", display, x11.ScreenNumber)
+	if err := runXauth(user, fmt.Sprintf("remove %s\nadd %s %s %s\n", authDisplay, authDisplay, x11.AuthProtocol, x11.AuthCookie)); err != nil {
+		l.Close()
+		return "", nil, fmt.Errorf("adding xauth cookie: %v", err)
+	}
+	cleanup := func() {
+		l.Close()
+		runXauth(user, fmt.Sprintf("remove %s\n", authDisplay)) //nolint:errcheck
+	}
+	go ssh.ForwardX11ConnectionsContext(l, sess.Context())
+	return fmt.Sprintf("localhost:%d.%d", display, x11.ScreenNumber), cleanup, nil
+}
+
+// runXauth runs `xauth` as the user feeding it the commands on stdin
+func runXauth(user *passwd.Entry, commands string) error {
+	cmd := exec.Command("xauth", "-q", "-")
+	cmd.Dir = user.HomeDir
+	cmd.Env = []string{fmt.Sprintf("HOME=%s", user.HomeDir)}
+	cmd.Stdin = strings.NewReader(commands)
+	if os.Getuid() != int(user.UID) { //nolint:gosec
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{
+				Uid:         uint32(user.UID), //nolint:gosec
+				Gid:         uint32(user.GID), //nolint:gosec
+				NoSetGroups: true,
+			},
+		}
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -9,3 +9,16 @@ import (
 type PortForwardingAsker interface {
 	Allow(ctx ssh.Context, destinationHost string, destinationPort uint32) bool
 }
+
+// BindAddressRewriter is implemented by the askers choosing the host the allowed
+// reverse port-forwarding binds to, e.g. to apply the OpenSSH `GatewayPorts` semantics
+type BindAddressRewriter interface {
+	BindAddress(ctx ssh.Context, bindHost string) string
+}
+
+// ListenerReleaser is implemented by the askers tracking the allowed listeners. Release
+// is called with the requested address once the listener allowed by the asker stops,
+// or fails to start.
+type ListenerReleaser interface {
+	Release(ctx ssh.Context, bindHost string, bindPort uint32)
+}
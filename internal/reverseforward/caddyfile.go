@@ -0,0 +1,133 @@
+package reverseforward
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ caddyfile.Unmarshaler = (*Allow)(nil)
+	_ caddyfile.Unmarshaler = (*Deny)(nil)
+	_ caddyfile.Unmarshaler = (*RemoteIP)(nil)
+	_ caddyfile.Unmarshaler = (*Policy)(nil)
+)
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. The module takes no options. Syntax:
+//
+//	allow
+func (e *Allow) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return noOptions(d)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. The module takes no options. Syntax:
+//
+//	deny
+func (e *Deny) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return noOptions(d)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	remote_ip <ranges...>
+func (m *RemoteIP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Ranges = append(m.Ranges, d.RemainingArgs()...)
+		if d.NextBlock(0) {
+			return d.Err("malformed remote_ip: blocks are not supported")
+		}
+	}
+	if len(m.Ranges) == 0 {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	policy {
+//		gateway_ports no|yes|clientspecified
+//		max_listeners <n>
+//		ignore_key_options
+//		allow|deny {
+//			users  <users...>
+//			groups <groups...>
+//			hosts  <hosts...>
+//			ports  <ports...>
+//		}
+//	}
+//
+// The `allow` and `deny` rules are evaluated in order. A rule without a block matches anything.
+func (p *Policy) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "gateway_ports":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				p.GatewayPorts = d.Val()
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "max_listeners":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				val, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("parsing max_listeners: %v", err)
+				}
+				p.MaxListeners = val
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+			case "ignore_key_options":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				p.IgnoreKeyOptions = true
+			case "allow", "deny":
+				rule := PolicyRule{Action: d.Val()}
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					field := d.Val()
+					args := d.RemainingArgs()
+					if len(args) == 0 {
+						return d.ArgErr()
+					}
+					switch field {
+					case "users":
+						rule.Users = append(rule.Users, args...)
+					case "groups":
+						rule.Groups = append(rule.Groups, args...)
+					case "hosts":
+						rule.Hosts = append(rule.Hosts, args...)
+					case "ports":
+						rule.Ports = append(rule.Ports, args...)
+					default:
+						return d.Errf("unrecognized policy rule option '%s'", field)
+					}
+				}
+				p.Rules = append(p.Rules, rule)
+			default:
+				return d.Errf("unrecognized policy option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+func noOptions(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+package reverseforward
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/authentication"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Policy{})
+}
+
+// The `GatewayPorts` modes of the Policy, as defined by OpenSSH
+const (
+	gatewayPortsNo              = "no"
+	gatewayPortsYes             = "yes"
+	gatewayPortsClientSpecified = "clientspecified"
+)
+
+// Policy is PortForwardingAsker module which decides on the reverse forwarding by the bind address
+// and the user. The rules are evaluated in order, and the first rule matching the session and the
+// bind address decides. The forwarding is denied if no rule matches.
+//
+// The host the listener binds to follows the [`GatewayPorts`](https://man.openbsd.org/sshd_config#GatewayPorts)
+// semantics of OpenSSH, and the rules match the resulting host rather than the requested one:
+//
+//   - `no`, the default, binds to the loopback address, unless the client asked for a loopback address.
+//   - `yes` binds to the wildcard address regardless of the request.
+//   - `clientspecified` binds to the requested address, where an empty address or `*` means the wildcard
+//     address and `localhost` means the loopback address.
+//
+// Unless `ignore_key_options` is set, the options of the authorized key (or the critical options and
+// extensions of the certificate) are honored on top of the rules, as OpenSSH does: a certificate must
+// carry the `permit-port-forwarding` extension, `no-port-forwarding` (or `restrict` without `port-forwarding`)
+// denies any forwarding, and `permitlisten="[host:]port"` restricts the forwarding to the listed requests,
+// where either part may be `*` and a bare port permits the loopback and default hosts.
+type Policy struct {
+	// The rules evaluated in order
+	Rules []PolicyRule `json:"rules,omitempty"`
+
+	// The `GatewayPorts` mode, one of `no`, `yes`, or `clientspecified`. Defaults to `no`.
+	GatewayPorts string `json:"gateway_ports,omitempty"`
+
+	// The maximum number of concurrent listeners per connection. Unlimited if 0.
+	MaxListeners int `json:"max_listeners,omitempty"`
+
+	// Skip honoring the port forwarding options of the key or certificate
+	IgnoreKeyOptions bool `json:"ignore_key_options,omitempty"`
+
+	listeners *listenerCounter
+	logger    *zap.Logger
+}
+
+// PolicyRule is a rule of the reverse forwarding policy. The empty lists match anything.
+type PolicyRule struct {
+	// The action taken when the rule matches, either `allow` or `deny`
+	Action string `json:"action"`
+
+	// The users to whom the rule applies. The rule applies to the session if either its user
+	// or any of its groups is listed.
+	Users []string `json:"users,omitempty"`
+
+	// The groups to whom the rule applies
+	Groups []string `json:"groups,omitempty"`
+
+	// The bind addresses, as IP addresses or CIDR ranges, after applying the `GatewayPorts` mode
+	Hosts []string `json:"hosts,omitempty"`
+
+	// The bind ports, as single ports (e.g. `8080`) or inclusive ranges (e.g. `8000-8100`).
+	// The port `0` stands for the dynamically allocated port.
+	Ports []string `json:"ports,omitempty"`
+
+	users  map[string]bool
+	groups map[string]bool
+	cidrs  []*net.IPNet
+	ports  []portRange
+}
+
+// listenerCounter counts the allowed listeners by connection
+type listenerCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (Policy) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ssh.ask.reverseforward.policy",
+		New: func() caddy.Module { return new(Policy) },
+	}
+}
+
+// Provision parses the rules
+func (p *Policy) Provision(ctx caddy.Context) error {
+	p.logger = ctx.Logger(p)
+	p.listeners = &listenerCounter{counts: make(map[string]int)}
+	switch p.GatewayPorts {
+	case "":
+		p.GatewayPorts = gatewayPortsNo
+	case gatewayPortsNo, gatewayPortsYes, gatewayPortsClientSpecified:
+	default:
+		return fmt.Errorf("unknown gateway_ports mode '%s'", p.GatewayPorts)
+	}
+	if p.MaxListeners < 0 {
+		return fmt.Errorf("max_listeners must not be negative")
+	}
+	for i := range p.Rules {
+		if err := p.Rules[i].provision(); err != nil {
+			return fmt.Errorf("rule %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (r *PolicyRule) provision() error {
+	if r.Action != "allow" && r.Action != "deny" {
+		return fmt.Errorf("unknown action '%s'", r.Action)
+	}
+	r.users, r.groups = make(map[string]bool), make(map[string]bool)
+	for _, u := range r.Users {
+		r.users[u] = true
+	}
+	for _, g := range r.Groups {
+		r.groups[g] = true
+	}
+	for _, h := range r.Hosts {
+		if strings.Contains(h, "/") {
+			_, ipNet, err := net.ParseCIDR(h)
+			if err != nil {
+				return fmt.Errorf("parsing CIDR expression: %v", err)
+			}
+			r.cidrs = append(r.cidrs, ipNet)
+			continue
+		}
+		ip := net.ParseIP(h)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address: %s", h)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		mask := len(ip) * 8
+		r.cidrs = append(r.cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(mask, mask)})
+	}
+	for _, pr := range r.Ports {
+		rng, err := parsePortRange(pr)
+		if err != nil {
+			return err
+		}
+		r.ports = append(r.ports, rng)
+	}
+	return nil
+}
+
+// Allow returns true if the key options permit the request, the first matching rule allows
+// the bind address, and the connection is below the maximum number of listeners
+func (p Policy) Allow(ctx ssh.Context, bindHost string, bindPort uint32) bool {
+	allowed, reason := p.decide(ctx, bindHost, bindPort)
+	if allowed && p.MaxListeners > 0 {
+		p.listeners.mu.Lock()
+		if p.listeners.counts[ctx.SessionID()] >= p.MaxListeners {
+			allowed, reason = false, "max_listeners"
+		} else {
+			p.listeners.counts[ctx.SessionID()]++
+		}
+		p.listeners.mu.Unlock()
+	}
+	p.logger.Info(
+		"asking for permission",
+		zap.String("session_id", ctx.SessionID()),
+		zap.String("remote_address", ctx.RemoteAddr().String()),
+		zap.String("user", ctx.User()),
+		zap.String("bind_host", bindHost),
+		zap.String("effective_bind_host", p.BindAddress(ctx, bindHost)),
+		zap.Uint32("bind_port", bindPort),
+		zap.Bool("allowed", allowed),
+		zap.String("reason", reason),
+	)
+	return allowed
+}
+
+// BindAddress applies the `GatewayPorts` mode to the requested host
+func (p Policy) BindAddress(_ ssh.Context, bindHost string) string {
+	switch p.GatewayPorts {
+	case gatewayPortsYes:
+		return "0.0.0.0"
+	case gatewayPortsClientSpecified:
+		switch bindHost {
+		case "", "*":
+			return "0.0.0.0"
+		case "localhost":
+			return "127.0.0.1"
+		}
+		return bindHost
+	default:
+		if ip := net.ParseIP(bindHost); ip != nil && ip.IsLoopback() {
+			return bindHost
+		}
+		return "127.0.0.1"
+	}
+}
+
+// Release frees the slot of the listener of the connection
+func (p Policy) Release(ctx ssh.Context, _ string, _ uint32) {
+	if p.MaxListeners <= 0 {
+		return
+	}
+	p.listeners.mu.Lock()
+	defer p.listeners.mu.Unlock()
+	if p.listeners.counts[ctx.SessionID()] <= 1 {
+		delete(p.listeners.counts, ctx.SessionID())
+		return
+	}
+	p.listeners.counts[ctx.SessionID()]--
+}
+
+func (p Policy) decide(ctx ssh.Context, bindHost string, bindPort uint32) (bool, string) {
+	if !p.IgnoreKeyOptions && ctx.Permissions() != nil && ctx.Permissions().Permissions != nil {
+		perms := ctx.Permissions()
+		if !authentication.PortForwardingPermitted(perms.Permissions) {
+			return false, "port forwarding not permitted by the key"
+		}
+		if permitlisten, ok := perms.CriticalOptions["permitlisten"]; ok && !permitListen(permitlisten, bindHost, bindPort) {
+			return false, "permitlisten"
+		}
+	}
+
+	var groups []string
+	if u, ok := ctx.Value(authentication.UserCtxKey).(authentication.User); ok && u != nil {
+		for _, g := range u.Groups() {
+			groups = append(groups, g.Name())
+		}
+	}
+	effectiveHost := net.ParseIP(p.BindAddress(ctx, bindHost))
+	for i, r := range p.Rules {
+		if !r.appliesTo(ctx.User(), groups) || !r.matchesPort(bindPort) || !r.matchesHost(effectiveHost) {
+			continue
+		}
+		return r.Action == "allow", fmt.Sprintf("rule %d", i)
+	}
+	return false, "no matching rule"
+}
+
+func (r PolicyRule) appliesTo(user string, groups []string) bool {
+	if len(r.users) == 0 && len(r.groups) == 0 {
+		return true
+	}
+	if r.users[user] {
+		return true
+	}
+	for _, g := range groups {
+		if r.groups[g] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PolicyRule) matchesPort(port uint32) bool {
+	if len(r.ports) == 0 {
+		return true
+	}
+	for _, rng := range r.ports {
+		if rng.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesHost returns true if the bind IP is in any of the ranges. A bind address which
+// isn't an IP address, i.e. a hostname, only matches the rules without hosts.
+func (r PolicyRule) matchesHost(ip net.IP) bool {
+	if len(r.cidrs) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, c := range r.cidrs {
+		if c.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permitListen returns true if the request is listed in the comma-separated `permitlisten` value
+func permitListen(permitlisten, bindHost string, bindPort uint32) bool {
+	for _, entry := range strings.Split(permitlisten, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "none" {
+			return false
+		}
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			// a bare port permits the default host
+			host, port = "", entry
+		}
+		if port != "*" && port != strconv.FormatUint(uint64(bindPort), 10) {
+			continue
+		}
+		switch host {
+		case "*":
+			return true
+		case "", "localhost":
+			if bindHost == "" || bindHost == "localhost" {
+				return true
+			}
+			if ip := net.ParseIP(bindHost); ip != nil && ip.IsLoopback() {
+				return true
+			}
+		default:
+			if strings.EqualFold(host, bindHost) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// portRange is an inclusive range of ports
+type portRange struct {
+	start, end uint32
+}
+
+func (r portRange) contains(port uint32) bool {
+	return port >= r.start && port <= r.end
+}
+
+func parsePortRange(s string) (portRange, error) {
+	start, end, isRange := strings.Cut(s, "-")
+	if !isRange {
+		end = start
+	}
+	startPort, err := strconv.ParseUint(start, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port '%s': %v", s, err)
+	}
+	endPort, err := strconv.ParseUint(end, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port '%s': %v", s, err)
+	}
+	if startPort > endPort {
+		return portRange{}, fmt.Errorf("invalid port range '%s': start is greater than end", s)
+	}
+	return portRange{uint32(startPort), uint32(endPort)}, nil
+}
+
+var (
+	_ caddy.Provisioner   = (*Policy)(nil)
+	_ PortForwardingAsker = Policy{}
+	_ BindAddressRewriter = Policy{}
+	_ ListenerReleaser    = Policy{}
+)
@@ -0,0 +1,190 @@
+package reverseforward
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/kadeessh/kadeessh/internal/authentication"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type fakeContext struct {
+	context.Context
+	sync.Mutex
+	user      string
+	sessionID string
+	perms     *ssh.Permissions
+}
+
+func (c *fakeContext) User() string          { return c.user }
+func (c *fakeContext) SessionID() string     { return c.sessionID }
+func (c *fakeContext) ClientVersion() string { return "SSH-2.0-test" }
+func (c *fakeContext) ServerVersion() string { return "SSH-2.0-kadeessh" }
+func (c *fakeContext) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+}
+func (c *fakeContext) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 22}
+}
+func (c *fakeContext) Permissions() *ssh.Permissions { return c.perms }
+func (c *fakeContext) SetValue(key, value any) {
+	c.Context = context.WithValue(c.Context, key, value)
+}
+
+type fakeGroup string
+
+func (g fakeGroup) Gid() string  { return string(g) }
+func (g fakeGroup) Name() string { return string(g) }
+
+type fakeUser struct {
+	authentication.User
+	groups []authentication.Group
+}
+
+func (u fakeUser) Groups() []authentication.Group { return u.groups }
+
+func newFakeContext(user string, groups []string, criticalOptions, extensions map[string]string) *fakeContext {
+	ctx := &fakeContext{
+		Context:   context.Background(),
+		user:      user,
+		sessionID: "session-" + user,
+		perms: &ssh.Permissions{Permissions: &gossh.Permissions{
+			CriticalOptions: criticalOptions,
+			Extensions:      extensions,
+		}},
+	}
+	var gs []authentication.Group
+	for _, g := range groups {
+		gs = append(gs, fakeGroup(g))
+	}
+	ctx.SetValue(authentication.UserCtxKey, fakeUser{groups: gs})
+	return ctx
+}
+
+func newTestPolicy(t *testing.T, p Policy) Policy {
+	t.Helper()
+	p.logger = zap.NewNop()
+	p.listeners = &listenerCounter{counts: make(map[string]int)}
+	if p.GatewayPorts == "" {
+		p.GatewayPorts = gatewayPortsNo
+	}
+	for i := range p.Rules {
+		if err := p.Rules[i].provision(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func TestPolicyBindAddress(t *testing.T) {
+	tests := []struct {
+		mode, requested, want string
+	}{
+		{gatewayPortsNo, "", "127.0.0.1"},
+		{gatewayPortsNo, "0.0.0.0", "127.0.0.1"},
+		{gatewayPortsNo, "192.0.2.2", "127.0.0.1"},
+		{gatewayPortsNo, "::1", "::1"},
+		{gatewayPortsNo, "127.0.0.2", "127.0.0.2"},
+		{gatewayPortsYes, "127.0.0.1", "0.0.0.0"},
+		{gatewayPortsYes, "", "0.0.0.0"},
+		{gatewayPortsClientSpecified, "", "0.0.0.0"},
+		{gatewayPortsClientSpecified, "*", "0.0.0.0"},
+		{gatewayPortsClientSpecified, "localhost", "127.0.0.1"},
+		{gatewayPortsClientSpecified, "192.0.2.2", "192.0.2.2"},
+	}
+	for _, tt := range tests {
+		p := newTestPolicy(t, Policy{GatewayPorts: tt.mode})
+		if got := p.BindAddress(nil, tt.requested); got != tt.want {
+			t.Errorf("BindAddress(%q) with %s = %q, want %q", tt.requested, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyAllow(t *testing.T) {
+	rules := []PolicyRule{
+		{Action: "deny", Ports: []string{"0-1023"}},
+		{Action: "allow", Groups: []string{"web"}, Hosts: []string{"0.0.0.0"}, Ports: []string{"8000-8100"}},
+		{Action: "allow", Users: []string{"alice"}, Hosts: []string{"127.0.0.0/8"}},
+	}
+	tests := []struct {
+		name            string
+		gatewayPorts    string
+		user            string
+		groups          []string
+		criticalOptions map[string]string
+		extensions      map[string]string
+		host            string
+		port            uint32
+		want            bool
+	}{
+		{name: "privileged port", user: "alice", host: "localhost", port: 80, want: false},
+		{name: "loopback for the user", user: "alice", host: "", port: 9000, want: true},
+		{name: "wildcard rewritten to loopback", user: "alice", host: "0.0.0.0", port: 9000, want: true},
+		{name: "wildcard for the group without gateway ports", user: "bob", groups: []string{"web"}, host: "0.0.0.0", port: 8080, want: false},
+		{name: "wildcard for the group with gateway ports", gatewayPorts: gatewayPortsClientSpecified, user: "bob", groups: []string{"web"}, host: "0.0.0.0", port: 8080, want: true},
+		{name: "wildcard for the group out of the port range", gatewayPorts: gatewayPortsYes, user: "bob", groups: []string{"web"}, host: "", port: 9000, want: false},
+		{name: "specific address not in rules", gatewayPorts: gatewayPortsClientSpecified, user: "alice", host: "192.0.2.2", port: 9000, want: false},
+		{name: "no matching rule", user: "carol", host: "", port: 9000, want: false},
+		{name: "no-port-forwarding", user: "alice", extensions: map[string]string{"no-port-forwarding": ""}, host: "", port: 9000, want: false},
+		{name: "restrict", user: "alice", extensions: map[string]string{"restrict": ""}, host: "", port: 9000, want: false},
+		{name: "restrict and port-forwarding", user: "alice", extensions: map[string]string{"restrict": "", "port-forwarding": ""}, host: "", port: 9000, want: true},
+		{name: "permitlisten bare port", user: "alice", criticalOptions: map[string]string{"permitlisten": "9000"}, host: "localhost", port: 9000, want: true},
+		{name: "permitlisten bare port with other host", gatewayPorts: gatewayPortsClientSpecified, user: "bob", groups: []string{"web"}, criticalOptions: map[string]string{"permitlisten": "8080"}, host: "0.0.0.0", port: 8080, want: false},
+		{name: "permitlisten wildcard host", gatewayPorts: gatewayPortsClientSpecified, user: "bob", groups: []string{"web"}, criticalOptions: map[string]string{"permitlisten": "*:8080"}, host: "0.0.0.0", port: 8080, want: true},
+		{name: "permitlisten other port", user: "alice", criticalOptions: map[string]string{"permitlisten": "localhost:9001"}, host: "localhost", port: 9000, want: false},
+		{name: "permitlisten none", user: "alice", criticalOptions: map[string]string{"permitlisten": "none"}, host: "localhost", port: 9000, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPolicy(t, Policy{Rules: append([]PolicyRule(nil), rules...), GatewayPorts: tt.gatewayPorts})
+			ctx := newFakeContext(tt.user, tt.groups, tt.criticalOptions, tt.extensions)
+			if got := p.Allow(ctx, tt.host, tt.port); got != tt.want {
+				t.Errorf("Allow(%q, %d) = %v, want %v", tt.host, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyMaxListeners(t *testing.T) {
+	p := newTestPolicy(t, Policy{Rules: []PolicyRule{{Action: "allow"}}, MaxListeners: 2})
+	alice := newFakeContext("alice", nil, nil, nil)
+	bob := newFakeContext("bob", nil, nil, nil)
+
+	for i := 0; i < 2; i++ {
+		if !p.Allow(alice, "", uint32(9000+i)) {
+			t.Fatalf("listener %d was denied", i)
+		}
+	}
+	if p.Allow(alice, "", 9002) {
+		t.Fatal("listener above the maximum was allowed")
+	}
+	if !p.Allow(bob, "", 9000) {
+		t.Fatal("listener of another connection was denied")
+	}
+	p.Release(alice, "", 9000)
+	if !p.Allow(alice, "", 9002) {
+		t.Fatal("listener after a release was denied")
+	}
+	p.Release(alice, "", 9001)
+	p.Release(alice, "", 9002)
+	if _, ok := p.listeners.counts[alice.SessionID()]; ok {
+		t.Fatal("the counter of the connection wasn't cleaned up")
+	}
+}
+
+func TestPolicyRuleProvisionErrors(t *testing.T) {
+	for _, rule := range []PolicyRule{
+		{Action: "maybe"},
+		{Action: "allow", Hosts: []string{"10.0.0.0/33"}},
+		{Action: "allow", Hosts: []string{"example.com"}},
+		{Action: "allow", Ports: []string{"90-80"}},
+	} {
+		if err := rule.provision(); err == nil {
+			t.Errorf("provision(%+v) = nil, want error", rule)
+		}
+	}
+}
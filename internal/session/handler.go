@@ -1,6 +1,36 @@
 package session
 
+import (
+	"fmt"
+
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
 // Handler is an interface for an Actor to implement
 type Handler interface {
 	Handle(Session) error
 }
+
+// ExitError is returned by a Handler to report how the session exited to the client, e.g. the exit
+// status of the command it ran on behalf of the client, or the signal which terminated the command.
+// Any other error is reported as the exit status 1.
+type ExitError struct {
+	// The exit status, which is ignored if the signal is set
+	Status uint32
+
+	// The signal which terminated the command, without the `SIG` prefix as listed in RFC 4254, if any
+	Signal ssh.Signal
+
+	// Whether the command terminated by the signal dumped core
+	CoreDumped bool
+
+	// The optional message describing the signal to the client
+	Message string
+}
+
+func (e *ExitError) Error() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("terminated by signal %s", e.Signal)
+	}
+	return fmt.Sprintf("exit status %d", e.Status)
+}
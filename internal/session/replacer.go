@@ -0,0 +1,58 @@
+package session
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+// NewReplacer returns a caddy.Replacer populated with the global placeholders in addition to the
+// session placeholders:
+//
+//	{ssh.user}         the username used when establishing the connection
+//	{ssh.session_id}   the session ID
+//	{ssh.remote_addr}  the address of the client side of the connection
+//	{ssh.remote_ip}    the IP address of the client
+//	{ssh.local_addr}   the address of the server side of the connection
+//	{ssh.subsystem}    the subsystem requested by the user, if any
+//	{ssh.command}      the raw command provided by the user, if any
+func NewReplacer(sess ActorMatchingContext) *caddy.Replacer {
+	repl := caddy.NewReplacer()
+	repl.Map(func(key string) (any, bool) {
+		switch key {
+		case "ssh.user":
+			return sess.User(), true
+		case "ssh.session_id":
+			id, _ := sess.Context().Value(ssh.ContextKeySessionID).(string)
+			return id, true
+		case "ssh.remote_addr":
+			return sess.RemoteAddr().String(), true
+		case "ssh.remote_ip":
+			host, _, err := net.SplitHostPort(sess.RemoteAddr().String())
+			if err != nil {
+				return sess.RemoteAddr().String(), true
+			}
+			return host, true
+		case "ssh.local_addr":
+			return sess.LocalAddr().String(), true
+		case "ssh.subsystem":
+			return sess.Subsystem(), true
+		case "ssh.command":
+			return sess.RawCommand(), true
+		}
+		return nil, false
+	})
+	return repl
+}
+
+// CheckPathSafeUser ensures the username, which may be part of a path through the `{ssh.user}` placeholder,
+// doesn't traverse the tree
+func CheckPathSafeUser(user string) error {
+	if user == "" || user == "." || user == ".." || strings.ContainsAny(user, `/\`) || strings.ContainsRune(user, 0) {
+		return fmt.Errorf("invalid username for path: %q", user)
+	}
+	return nil
+}
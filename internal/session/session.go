@@ -54,4 +54,15 @@ type Session interface {
 	// the request handling loop. Registering nil will unregister the channel.
 	// During the time that no channel is registered, breaks are ignored.
 	Break(c chan<- bool)
+
+	// Closed returns a channel which is closed once the channel of the session is
+	// closed by either side, e.g. when the client hangs up.
+	Closed() <-chan struct{}
+}
+
+// EchoReporter is implemented by the sessions observing whether the terminal of their handler echoes the
+// input, e.g. to record the input only while it's echoed. The handler owning the terminal reports it.
+type EchoReporter interface {
+	// ReportEcho registers the function reporting whether the terminal currently echoes the input
+	ReportEcho(echo func() bool)
 }
@@ -0,0 +1,241 @@
+package internalcaddyssh
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// liveSessions tracks the sessions and the forwardings of the connections of a server for the admin API
+type liveSessions struct {
+	mu    sync.Mutex
+	conns map[string]*liveConn // keyed by the session ID of the connection
+}
+
+type liveConn struct {
+	nextID   uint64
+	sessions map[uint64]*liveSession
+	forwards map[uint64]forwardInfo
+}
+
+type liveSession struct {
+	id    uint64
+	sess  ssh.Session
+	start time.Time
+	actor string
+}
+
+func newLiveSessions() *liveSessions {
+	return &liveSessions{conns: make(map[string]*liveConn)}
+}
+
+// connLocked returns the tracked state of the connection of the context, which is dropped once the
+// connection closes. Caller must hold ls.mu.
+func (ls *liveSessions) connLocked(ctx ssh.Context) *liveConn {
+	id := ctx.SessionID()
+	if c, ok := ls.conns[id]; ok {
+		return c
+	}
+	c := &liveConn{sessions: make(map[uint64]*liveSession), forwards: make(map[uint64]forwardInfo)}
+	ls.conns[id] = c
+	context.AfterFunc(ctx, func() {
+		ls.mu.Lock()
+		defer ls.mu.Unlock()
+		delete(ls.conns, id)
+	})
+	return c
+}
+
+// add tracks the session until the returned function is called
+func (ls *liveSessions) add(sess ssh.Session) (*liveSession, func()) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	c := ls.connLocked(sess.Context().(ssh.Context))
+	c.nextID++
+	s := &liveSession{id: c.nextID, sess: sess, start: time.Now()}
+	c.sessions[s.id] = s
+	return s, func() {
+		ls.mu.Lock()
+		defer ls.mu.Unlock()
+		delete(c.sessions, s.id)
+	}
+}
+
+// act records the actor acting on the session
+func (ls *liveSessions) act(s *liveSession, actor string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	s.actor = actor
+}
+
+// addForward tracks the forwarding until the returned function is called
+func (ls *liveSessions) addForward(ctx ssh.Context, forwardType, address string) func() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	c := ls.connLocked(ctx)
+	c.nextID++
+	id := c.nextID
+	c.forwards[id] = forwardInfo{Type: forwardType, Address: address, Start: time.Now()}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ls.mu.Lock()
+			defer ls.mu.Unlock()
+			delete(c.forwards, id)
+		})
+	}
+}
+
+// removeForward stops tracking the forwarding of the type and address, e.g. once the client cancels it
+func (ls *liveSessions) removeForward(ctx ssh.Context, forwardType, address string) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	c := ls.connLocked(ctx)
+	for id, f := range c.forwards {
+		if f.Type == forwardType && f.Address == address {
+			delete(c.forwards, id)
+			return
+		}
+	}
+}
+
+// describe returns the sessions and the forwardings of the connection
+func (ls *liveSessions) describe(sessionID string) ([]sessionInfo, []forwardInfo) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	c, ok := ls.conns[sessionID]
+	if !ok {
+		return []sessionInfo{}, []forwardInfo{}
+	}
+	sessions := make([]sessionInfo, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		info := sessionInfo{
+			ID:        s.id,
+			Start:     s.start,
+			Actor:     s.actor,
+			Command:   s.sess.RawCommand(),
+			Subsystem: s.sess.Subsystem(),
+		}
+		if pty, _, ok := s.sess.Pty(); ok {
+			info.Pty = &ptyInfo{Term: pty.Term, Width: pty.Window.Width, Height: pty.Window.Height}
+		}
+		sessions = append(sessions, info)
+	}
+	forwards := make([]forwardInfo, 0, len(c.forwards))
+	for _, f := range c.forwards {
+		forwards = append(forwards, f)
+	}
+	return sessions, forwards
+}
+
+// sessions returns the sessions of the connection
+func (ls *liveSessions) sessions(sessionID string) []*liveSession {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	c, ok := ls.conns[sessionID]
+	if !ok {
+		return nil
+	}
+	sessions := make([]*liveSession, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// trackLocalForward wraps the handler of the channels of local forwardings to track them while the channel is open
+func trackLocalForward(ls *liveSessions, forwardType string, handler ssh.ChannelHandler) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		var address string
+		if forwardType == "local" {
+			var d struct {
+				DestAddr   string
+				DestPort   uint32
+				OriginAddr string
+				OriginPort uint32
+			}
+			if err := gossh.Unmarshal(newChan.ExtraData(), &d); err == nil {
+				address = net.JoinHostPort(d.DestAddr, strconv.FormatUint(uint64(d.DestPort), 10))
+			}
+		} else {
+			var d struct {
+				SocketPath string
+				Reserved0  string
+				Reserved1  uint32
+			}
+			if err := gossh.Unmarshal(newChan.ExtraData(), &d); err == nil {
+				address = d.SocketPath
+			}
+		}
+		handler(srv, conn, trackedNewChannel{NewChannel: newChan, track: func() func() {
+			return ls.addForward(ctx, forwardType, address)
+		}}, ctx)
+	}
+}
+
+type trackedNewChannel struct {
+	gossh.NewChannel
+	track func() func()
+}
+
+func (c trackedNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	ch, reqs, err := c.NewChannel.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	return trackedChannel{Channel: ch, untrack: c.track()}, reqs, nil
+}
+
+type trackedChannel struct {
+	gossh.Channel
+	untrack func()
+}
+
+func (c trackedChannel) Close() error {
+	c.untrack()
+	return c.Channel.Close()
+}
+
+// trackReverseForward wraps the handler of the requests of reverse forwardings, e.g. `tcpip-forward`, to track them
+// from the request until its cancellation
+func trackReverseForward(ls *liveSessions, forwardType string, cancel bool, handler ssh.RequestHandler) ssh.RequestHandler {
+	return func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+		ok, payload := handler(ctx, srv, req)
+		if !ok {
+			return ok, payload
+		}
+		var address string
+		if forwardType == "reverse" {
+			var d struct {
+				BindAddr string
+				BindPort uint32
+			}
+			if err := gossh.Unmarshal(req.Payload, &d); err != nil {
+				return ok, payload
+			}
+			// the port allocated by the server is in the reply
+			var allocated struct{ BindPort uint32 }
+			if d.BindPort == 0 && gossh.Unmarshal(payload, &allocated) == nil {
+				d.BindPort = allocated.BindPort
+			}
+			address = net.JoinHostPort(d.BindAddr, strconv.FormatUint(uint64(d.BindPort), 10))
+		} else {
+			var d struct{ SocketPath string }
+			if err := gossh.Unmarshal(req.Payload, &d); err != nil {
+				return ok, payload
+			}
+			address = d.SocketPath
+		}
+		if cancel {
+			ls.removeForward(ctx, forwardType, address)
+		} else {
+			ls.addForward(ctx, forwardType, address)
+		}
+		return ok, payload
+	}
+}
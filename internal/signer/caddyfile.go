@@ -0,0 +1,165 @@
+package signer
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/kadeessh/kadeessh/internal/caddyfileutil"
+)
+
+var (
+	_ caddyfile.Unmarshaler = (*Fallback)(nil)
+	_ caddyfile.Unmarshaler = (*File)(nil)
+	_ caddyfile.Unmarshaler = (*Certificate)(nil)
+)
+
+// UnmarshalCaddyfile sets up the fallback signer from Caddyfile tokens. Syntax:
+//
+//	fallback {
+//		storage <module> ...
+//	}
+func (f *Fallback) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "storage":
+				raw, err := caddyfileutil.UnmarshalInlineModule(d, "caddy.storage", "module")
+				if err != nil {
+					return err
+				}
+				f.StorageRaw = raw
+			default:
+				return d.Errf("unrecognized fallback option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the file signer from Caddyfile tokens. Syntax:
+//
+//	file [<key_paths...>] {
+//		key         <path> [<passphrase>]
+//		file_system <backend> ...
+//	}
+func (s *File) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for d.NextArg() {
+			s.Keys = append(s.Keys, Key{Source: d.Val()})
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "key":
+				key, err := parseKey(d)
+				if err != nil {
+					return err
+				}
+				s.Keys = append(s.Keys, key)
+			case "file_system":
+				raw, err := caddyfileutil.UnmarshalInlineModule(d, "caddy.fs", "backend")
+				if err != nil {
+					return err
+				}
+				s.FileSystemRaw = raw
+			default:
+				return d.Errf("unrecognized file signer option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the certificate signer from Caddyfile tokens. Syntax:
+//
+//	certificate {
+//		storage              <module> ...
+//		file_system          <backend> ...
+//		key                  <source> [<passphrase>]
+//		authority            <source> [<passphrase>]
+//		principals           <principals...>
+//		validity             <duration>
+//		renewal_window_ratio <ratio>
+//		check_interval       <duration>
+//	}
+func (c *Certificate) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "storage":
+				c.StorageRaw, err = caddyfileutil.UnmarshalInlineModule(d, "caddy.storage", "module")
+			case "file_system":
+				c.FileSystemRaw, err = caddyfileutil.UnmarshalInlineModule(d, "caddy.fs", "backend")
+			case "key":
+				var key Key
+				key, err = parseKey(d)
+				c.Keys = append(c.Keys, key)
+			case "authority":
+				var key Key
+				key, err = parseKey(d)
+				c.Authority = &key
+			case "principals":
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				c.Principals = append(c.Principals, args...)
+			case "validity":
+				c.Validity, err = parseDuration(d)
+			case "renewal_window_ratio":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				c.RenewalWindowRatio, err = strconv.ParseFloat(d.Val(), 64)
+				if err != nil {
+					return d.Errf("parsing renewal_window_ratio: %v", err)
+				}
+			case "check_interval":
+				c.CheckInterval, err = parseDuration(d)
+			default:
+				return d.Errf("unrecognized certificate signer option '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseKey parses the `<source> [<passphrase>]` arguments of the current directive
+func parseKey(d *caddyfile.Dispenser) (Key, error) {
+	var key Key
+	args := d.RemainingArgs()
+	switch len(args) {
+	case 2:
+		key.Passphrase = args[1]
+		fallthrough
+	case 1:
+		key.Source = args[0]
+	default:
+		return key, d.ArgErr()
+	}
+	return key, nil
+}
+
+func parseDuration(d *caddyfile.Dispenser) (caddy.Duration, error) {
+	if !d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	dur, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return 0, d.Errf("parsing duration: %v", err)
+	}
+	if d.NextArg() {
+		return 0, d.ArgErr()
+	}
+	return caddy.Duration(dur), nil
+}
@@ -0,0 +1,448 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	internalcaddyssh "github.com/kadeessh/kadeessh/internal"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"go.step.sm/crypto/pemutil"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var (
+	_ internalcaddyssh.SignerConfigurator = (*Certificate)(nil)
+	_ caddy.Provisioner                   = (*Certificate)(nil)
+)
+
+const (
+	// the name of the host certificate authority key in storage when none is specified
+	host_ca_key = "ssh_host_ca_key"
+
+	// OpenSSH convention of naming the certificate of the key `<key>` as `<key>-cert.pub`
+	certSuffix = "-cert.pub"
+
+	defaultCertificateValidity = 7 * 24 * time.Hour
+	defaultRenewalWindowRatio  = 1.0 / 3.0
+	defaultCheckInterval       = 10 * time.Minute
+
+	// tolerate clock skew between the server and the clients
+	certificateBackdate = 5 * time.Minute
+)
+
+func init() {
+	caddy.RegisterModule(Certificate{})
+}
+
+// Certificate presents OpenSSH host certificates alongside the host keys, so clients can trust
+// a fleet of servers through a single `@cert-authority` line in their known_hosts file.
+//
+// The host keys are loaded from the `keys` files, if any, otherwise they're loaded from the storage
+// and generated if missing in the same manner as the `fallback` signer. The certificate of each key is
+// loaded from the file named after the key with the `-cert.pub` suffix, e.g. `ssh_host_ed25519_key-cert.pub`.
+// If an `authority` is configured, the host keys lacking a certificate are signed by the authority,
+// and the certificates are re-signed before they expire. The certificates of keys kept in storage are
+// stored next to the keys, while the certificates of keys loaded from files are only kept in memory.
+// Without an authority, the certificate files are re-read periodically to pick up externally renewed certificates.
+type Certificate struct {
+	// The Caddy storage module to load/store the host keys, the authority key, and the
+	// issued certificates. If absent or null, the default storage is loaded.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+
+	// The file system implementation to load the `keys` from. The default is the local disk file system.
+	// File system modules used here must implement the fs.FS interface
+	FileSystemRaw json.RawMessage `json:"file_system,omitempty" caddy:"namespace=caddy.fs inline_key=backend"`
+
+	// The collection of `signer.Key` resources of the host keys. If empty, the keys are loaded
+	// from the storage, and the RSA and Ed25519 keys are generated if absent.
+	Keys []Key `json:"keys,omitempty"`
+
+	// The certificate authority key used to sign the host keys. The `source` is the name of the key
+	// in the storage under the `ssh/signer/` prefix, which defaults to `ssh_host_ca_key`. If the key
+	// is absent from the storage, an Ed25519 key is generated and stored, and its public key is logged.
+	// If null, the certificates are only loaded from the `-cert.pub` files.
+	Authority *Key `json:"authority,omitempty"`
+
+	// The principals, i.e. the host names, the certificates are valid for. Defaults to the hostname of the machine.
+	Principals []string `json:"principals,omitempty"`
+
+	// The validity period of the signed certificates. Defaults to 7 days.
+	Validity caddy.Duration `json:"validity,omitempty"`
+
+	// The ratio of the certificate lifetime remaining at which it's re-signed. Defaults to 1/3, so a certificate
+	// valid for 7 days is re-signed when less than ~2.3 days remain.
+	RenewalWindowRatio float64 `json:"renewal_window_ratio,omitempty"`
+
+	// How often the certificates are checked for renewal. Defaults to 10 minutes.
+	CheckInterval caddy.Duration `json:"check_interval,omitempty"`
+
+	storage    certmagic.Storage
+	fileSystem fs.FS
+	authority  gossh.Signer
+
+	mu       *sync.RWMutex
+	hostKeys []*hostKey
+	logger   *zap.Logger
+}
+
+// hostKey is a host key and its certificate, if any
+type hostKey struct {
+	// the name of the key in storage or its path in the file system
+	name      string
+	inStorage bool
+	signer    gossh.Signer
+
+	cert       *gossh.Certificate
+	certSigner gossh.Signer
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (c Certificate) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "ssh.signers.certificate",
+		New: func() caddy.Module {
+			return new(Certificate)
+		},
+	}
+}
+
+// Provision loads the host keys, their certificates, and the authority key, signs the keys lacking valid
+// certificates, then starts the maintenance routine re-signing the certificates before their expiry.
+func (c *Certificate) Provision(ctx caddy.Context) error {
+	c.logger = ctx.Logger(c)
+	c.mu = new(sync.RWMutex)
+	if c.StorageRaw != nil {
+		val, err := ctx.LoadModule(c, "StorageRaw")
+		if err != nil {
+			return fmt.Errorf("loading storage module: %v", err)
+		}
+		st, err := val.(caddy.StorageConverter).CertMagicStorage()
+		if err != nil {
+			return fmt.Errorf("creating storage configuration: %v", err)
+		}
+		c.storage = st
+	}
+	if c.storage == nil {
+		c.storage = ctx.Storage()
+	}
+	if len(c.FileSystemRaw) > 0 {
+		mod, err := ctx.LoadModule(c, "FileSystemRaw")
+		if err != nil {
+			return fmt.Errorf("loading file system module: %v", err)
+		}
+		c.fileSystem = mod.(fs.FS)
+	}
+	if c.fileSystem == nil {
+		c.fileSystem = osReadFS{}
+	}
+	if c.Validity <= 0 {
+		c.Validity = caddy.Duration(defaultCertificateValidity)
+	}
+	if c.RenewalWindowRatio <= 0 || c.RenewalWindowRatio >= 1 {
+		c.RenewalWindowRatio = defaultRenewalWindowRatio
+	}
+	if c.CheckInterval <= 0 {
+		c.CheckInterval = caddy.Duration(defaultCheckInterval)
+	}
+	if len(c.Principals) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("determining the default principal: %v", err)
+		}
+		c.Principals = []string{hostname}
+	}
+
+	repl, ok := ctx.Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		repl = caddy.NewReplacer()
+	}
+
+	if c.Authority != nil {
+		name := repl.ReplaceKnown(c.Authority.Source, "")
+		if name == "" {
+			name = host_ca_key
+		}
+		ca, err := c.loadOrGenerateAuthority(ctx, name, repl.ReplaceKnown(c.Authority.Passphrase, ""))
+		if err != nil {
+			return fmt.Errorf("loading host certificate authority: %v", err)
+		}
+		c.authority = ca
+	}
+
+	if err := c.loadHostKeys(ctx, repl); err != nil {
+		return err
+	}
+	c.maintain(ctx, time.Now())
+
+	go c.maintenance(ctx)
+	return nil
+}
+
+func (c *Certificate) loadOrGenerateAuthority(ctx context.Context, name, passphrase string) (gossh.Signer, error) {
+	if c.storage.Exists(ctx, filepath.Join(keyPath(name)...)) {
+		bs, err := c.storage.Load(ctx, filepath.Join(keyPath(name)...))
+		if err != nil {
+			return nil, err
+		}
+		return parseSigner(bs, passphrase)
+	}
+	if passphrase != "" {
+		return nil, fmt.Errorf("authority key '%s' is passphrase-protected but absent from storage", name)
+	}
+	signersBytes := [][]byte{}
+	if err := loadOrGenerateAndStore(ctx, c.storage, name, generateEd25519, &signersBytes); err != nil {
+		return nil, err
+	}
+	ca, err := parseSigner(signersBytes[0], "")
+	if err != nil {
+		return nil, err
+	}
+	c.logger.Warn("generated a new host certificate authority; add it to the known_hosts of the clients",
+		zap.String("key", name),
+		zap.String("known_hosts", "@cert-authority * "+string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(ca.PublicKey())))),
+	)
+	return ca, nil
+}
+
+func (c *Certificate) loadHostKeys(ctx context.Context, repl *caddy.Replacer) error {
+	if len(c.Keys) == 0 {
+		signersBytes := [][]byte{}
+		names := []string{rsa_host_key, ed25519_host_key}
+		if err := loadOrGenerateAndStore(ctx, c.storage, rsa_host_key, generateRSA, &signersBytes); err != nil {
+			return err
+		}
+		if err := loadOrGenerateAndStore(ctx, c.storage, ed25519_host_key, generateEd25519, &signersBytes); err != nil {
+			return err
+		}
+		// ECDSA is only loaded, not generated
+		if c.storage.Exists(ctx, filepath.Join(keyPath(ecdsa_host_key)...)) {
+			if err := loadFromStorage(ctx, c.storage, ecdsa_host_key, &signersBytes); err != nil {
+				return err
+			}
+			names = append(names, ecdsa_host_key)
+		}
+		for i, sb := range signersBytes {
+			s, err := pemutil.ParseOpenSSHPrivateKey(sb)
+			if err != nil {
+				return err
+			}
+			sig, err := gossh.NewSignerFromKey(s)
+			if err != nil {
+				return err
+			}
+			c.hostKeys = append(c.hostKeys, &hostKey{name: names[i], inStorage: true, signer: sig})
+		}
+		return nil
+	}
+
+	for i, v := range c.Keys {
+		keyPath := repl.ReplaceKnown(v.Source, "")
+		if !filepath.IsAbs(keyPath) {
+			abs, err := filepath.Abs(keyPath)
+			if err != nil {
+				return fmt.Errorf("error absoluting key at index %d with file path '%s': %s", i, keyPath, err)
+			}
+			keyPath = abs
+		}
+		keyBytes, err := readFile(c.fileSystem, keyPath)
+		if err != nil {
+			return fmt.Errorf("error reading key at index %d with file name '%s': %s", i, keyPath, err)
+		}
+		signer, err := parseSigner(keyBytes, repl.ReplaceKnown(v.Passphrase, ""))
+		if err != nil {
+			return fmt.Errorf("error parsing the private key: %s", err)
+		}
+		c.hostKeys = append(c.hostKeys, &hostKey{name: keyPath, signer: signer})
+	}
+	return nil
+}
+
+// maintenance checks the certificates every CheckInterval until the context is canceled, i.e. the config is unloaded
+func (c *Certificate) maintenance(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(c.CheckInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.maintain(ctx, now)
+		}
+	}
+}
+
+// maintain loads the certificates of the host keys and re-signs the ones missing, expiring, or not issued by the configured authority
+func (c *Certificate) maintain(ctx context.Context, now time.Time) {
+	for _, hk := range c.hostKeys {
+		c.mu.RLock()
+		current := hk.cert
+		c.mu.RUnlock()
+
+		cert, err := c.loadCertificate(ctx, hk)
+		if err != nil {
+			c.logger.Error("loading host certificate", zap.String("key", hk.name), zap.Error(err))
+		}
+		if cert == nil || !c.acceptable(hk, cert, now) {
+			cert = current
+		}
+		if cert != nil && !c.acceptable(hk, cert, now) {
+			c.logger.Warn("dropping unusable host certificate", zap.String("key", hk.name), zap.Uint64("serial", cert.Serial))
+			cert = nil
+		}
+		if c.authority != nil && (cert == nil || c.needsRenewal(cert, now)) {
+			signed, err := signHostCertificate(c.authority, hk.signer.PublicKey(), c.Principals, time.Duration(c.Validity), now)
+			if err != nil {
+				c.logger.Error("signing host certificate", zap.String("key", hk.name), zap.Error(err))
+			} else {
+				if hk.inStorage {
+					if err := c.storage.Store(ctx, filepath.Join(keyPath(hk.name+certSuffix)...), gossh.MarshalAuthorizedKey(signed)); err != nil {
+						c.logger.Error("storing host certificate", zap.String("key", hk.name), zap.Error(err))
+					}
+				}
+				c.logger.Info("signed host certificate",
+					zap.String("key", hk.name),
+					zap.String("key_type", hk.signer.PublicKey().Type()),
+					zap.Uint64("serial", signed.Serial),
+					zap.Strings("principals", signed.ValidPrincipals),
+					zap.Time("valid_before", certTime(signed.ValidBefore)),
+				)
+				cert = signed
+			}
+		}
+		if cert == current {
+			continue
+		}
+		var certSigner gossh.Signer
+		if cert != nil {
+			if certSigner, err = gossh.NewCertSigner(cert, hk.signer); err != nil {
+				c.logger.Error("creating certificate signer", zap.String("key", hk.name), zap.Error(err))
+				continue
+			}
+		}
+		c.mu.Lock()
+		hk.cert, hk.certSigner = cert, certSigner
+		c.mu.Unlock()
+	}
+}
+
+// loadCertificate loads the certificate of the host key from storage or the file system, returning nil if absent
+func (c *Certificate) loadCertificate(ctx context.Context, hk *hostKey) (*gossh.Certificate, error) {
+	var (
+		bs  []byte
+		err error
+	)
+	if hk.inStorage {
+		bs, err = c.storage.Load(ctx, filepath.Join(keyPath(hk.name+certSuffix)...))
+	} else {
+		bs, err = readFile(c.fileSystem, hk.name+certSuffix)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := gossh.ParseAuthorizedKey(bs)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*gossh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("not a certificate: %s", pub.Type())
+	}
+	return cert, nil
+}
+
+// acceptable reports whether the certificate is a currently valid host certificate of the key.
+// If an authority is configured, the certificate must be issued by it.
+func (c *Certificate) acceptable(hk *hostKey, cert *gossh.Certificate, now time.Time) bool {
+	if cert.CertType != gossh.HostCert {
+		return false
+	}
+	if !bytes.Equal(cert.Key.Marshal(), hk.signer.PublicKey().Marshal()) {
+		return false
+	}
+	if c.authority != nil && !bytes.Equal(cert.SignatureKey.Marshal(), c.authority.PublicKey().Marshal()) {
+		return false
+	}
+	if now.Before(certTime(cert.ValidAfter)) && cert.ValidAfter != 0 {
+		return false
+	}
+	return cert.ValidBefore == gossh.CertTimeInfinity || now.Before(certTime(cert.ValidBefore))
+}
+
+// needsRenewal reports whether the remaining lifetime of the certificate is within the renewal window
+func (c *Certificate) needsRenewal(cert *gossh.Certificate, now time.Time) bool {
+	if cert.ValidBefore == gossh.CertTimeInfinity {
+		return false
+	}
+	before := certTime(cert.ValidBefore)
+	lifetime := before.Sub(certTime(cert.ValidAfter))
+	return before.Sub(now) < time.Duration(float64(lifetime)*c.RenewalWindowRatio)
+}
+
+// Configure adds the host keys and their certificates to the session
+func (c *Certificate) Configure(ctx session.Context, cfg internalcaddyssh.SignerAdder) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, hk := range c.hostKeys {
+		cfg.AddHostKey(hk.signer)
+		if hk.certSigner != nil {
+			cfg.AddHostKey(hk.certSigner)
+		}
+	}
+}
+
+func signHostCertificate(ca gossh.Signer, key gossh.PublicKey, principals []string, validity time.Duration, now time.Time) (*gossh.Certificate, error) {
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	cert := &gossh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        gossh.HostCert,
+		KeyId:           principals[0],
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-certificateBackdate).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+func certTime(t uint64) time.Time {
+	if t > math.MaxInt64 {
+		return time.Unix(math.MaxInt64, 0)
+	}
+	return time.Unix(int64(t), 0)
+}
+
+func readFile(fsys fs.FS, name string) ([]byte, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
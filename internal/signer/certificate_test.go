@@ -0,0 +1,202 @@
+package signer
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type fakeSignerAdder struct {
+	keys []gossh.Signer
+}
+
+func (f *fakeSignerAdder) AddHostKey(key gossh.Signer) {
+	f.keys = append(f.keys, key)
+}
+
+func (f *fakeSignerAdder) certificates(t *testing.T) []*gossh.Certificate {
+	t.Helper()
+	certs := []*gossh.Certificate{}
+	for _, k := range f.keys {
+		if cert, ok := k.PublicKey().(*gossh.Certificate); ok {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+func newTestCertificate(t *testing.T, withAuthority bool) *Certificate {
+	t.Helper()
+	c := &Certificate{
+		storage:            &certmagic.FileStorage{Path: t.TempDir()},
+		fileSystem:         osReadFS{},
+		Principals:         []string{"ssh.example.com"},
+		Validity:           caddy.Duration(24 * time.Hour),
+		RenewalWindowRatio: defaultRenewalWindowRatio,
+		mu:                 new(sync.RWMutex),
+		logger:             zap.NewNop(),
+	}
+	if withAuthority {
+		ca, err := c.loadOrGenerateAuthority(context.TODO(), host_ca_key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.authority = ca
+	}
+	return c
+}
+
+func TestCertificate_SignsStoredHostKeys(t *testing.T) {
+	ctx := context.TODO()
+	c := newTestCertificate(t, true)
+	c.hostKeys = []*hostKey{{name: ed25519_host_key, inStorage: true}}
+	signersBytes := [][]byte{}
+	if err := loadOrGenerateAndStore(ctx, c.storage, ed25519_host_key, generateEd25519, &signersBytes); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := parseSigner(signersBytes[0], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.hostKeys[0].signer = signer
+
+	now := time.Now()
+	c.maintain(ctx, now)
+
+	adder := &fakeSignerAdder{}
+	c.Configure(nil, adder)
+	if len(adder.keys) != 2 {
+		t.Fatalf("expected the host key and its certificate, got %d keys", len(adder.keys))
+	}
+	certs := adder.certificates(t)
+	if len(certs) != 1 {
+		t.Fatalf("expected 1 certificate, got %d", len(certs))
+	}
+	first := certs[0]
+	checker := gossh.CertChecker{
+		IsHostAuthority: func(auth gossh.PublicKey, _ string) bool {
+			return string(auth.Marshal()) == string(c.authority.PublicKey().Marshal())
+		},
+	}
+	if err := checker.CheckCert("ssh.example.com", first); err != nil {
+		t.Fatalf("the signed certificate does not verify: %v", err)
+	}
+	if !c.storage.Exists(ctx, filepath.Join(keyPath(ed25519_host_key+certSuffix)...)) {
+		t.Error("the signed certificate is not stored")
+	}
+
+	// not yet due for renewal
+	c.maintain(ctx, now.Add(time.Hour))
+	adder = &fakeSignerAdder{}
+	c.Configure(nil, adder)
+	if got := adder.certificates(t)[0]; got.Serial != first.Serial {
+		t.Errorf("certificate re-signed before the renewal window: serial %d, want %d", got.Serial, first.Serial)
+	}
+
+	// within the last third of the lifetime
+	c.maintain(ctx, now.Add(20*time.Hour))
+	adder = &fakeSignerAdder{}
+	c.Configure(nil, adder)
+	renewed := adder.certificates(t)[0]
+	if renewed.Serial == first.Serial {
+		t.Error("certificate not re-signed within the renewal window")
+	}
+	if renewed.ValidBefore <= first.ValidBefore {
+		t.Errorf("renewed certificate expires at %d, before the previous one at %d", renewed.ValidBefore, first.ValidBefore)
+	}
+}
+
+func TestCertificate_LoadsCertificateFiles(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, ed25519_host_key)
+	private := generateEd25519()
+	block, err := pemEncode(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pemBytes(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCertificate(t, false)
+	c.Keys = []Key{{Source: keyFile}}
+	if err := c.loadHostKeys(ctx, caddy.NewReplacer()); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a certificate file or an authority, only the key is presented
+	c.maintain(ctx, time.Now())
+	adder := &fakeSignerAdder{}
+	c.Configure(nil, adder)
+	if len(adder.keys) != 1 || len(adder.certificates(t)) != 0 {
+		t.Fatalf("expected only the host key, got %d keys", len(adder.keys))
+	}
+
+	// the externally issued certificate is picked up on the next check
+	ca := generateEd25519()
+	caSigner, err := gossh.NewSignerFromKey(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := signHostCertificate(caSigner, c.hostKeys[0].signer.PublicKey(), []string{"ssh.example.com"}, time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile+certSuffix, gossh.MarshalAuthorizedKey(cert), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c.maintain(ctx, time.Now())
+	adder = &fakeSignerAdder{}
+	c.Configure(nil, adder)
+	if certs := adder.certificates(t); len(certs) != 1 || certs[0].Serial != cert.Serial {
+		t.Fatalf("expected the certificate from the file, got %v", certs)
+	}
+
+	// expired certificates are no longer presented
+	c.maintain(ctx, time.Now().Add(2*time.Hour))
+	adder = &fakeSignerAdder{}
+	c.Configure(nil, adder)
+	if len(adder.certificates(t)) != 0 {
+		t.Fatal("expected the expired certificate to be dropped")
+	}
+}
+
+func TestCertificate_RejectsForeignCertificate(t *testing.T) {
+	c := newTestCertificate(t, true)
+	private := generateEd25519()
+	signer, err := gossh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hk := &hostKey{name: "key", signer: signer}
+
+	other, err := gossh.NewSignerFromKey(generateEd25519())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := signHostCertificate(other, signer.PublicKey(), c.Principals, time.Hour, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.acceptable(hk, cert, time.Now()) {
+		t.Error("certificate issued by another authority is acceptable")
+	}
+
+	userCert := &gossh.Certificate{Key: signer.PublicKey(), CertType: gossh.UserCert, ValidBefore: gossh.CertTimeInfinity}
+	if err := userCert.SignCert(rand.Reader, c.authority); err != nil {
+		t.Fatal(err)
+	}
+	if c.acceptable(hk, userCert, time.Now()) {
+		t.Error("user certificate is acceptable as a host certificate")
+	}
+}
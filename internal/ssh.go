@@ -3,18 +3,26 @@ package internalcaddyssh
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/agentforward"
 	"github.com/kadeessh/kadeessh/internal/authorization"
 	"github.com/kadeessh/kadeessh/internal/localforward"
+	"github.com/kadeessh/kadeessh/internal/metrics"
 	caddypty "github.com/kadeessh/kadeessh/internal/pty"
+	"github.com/kadeessh/kadeessh/internal/pty/passwd"
 	"github.com/kadeessh/kadeessh/internal/reverseforward"
+	"github.com/kadeessh/kadeessh/internal/session"
 	"github.com/kadeessh/kadeessh/internal/ssh"
+	"github.com/kadeessh/kadeessh/internal/streamlocal"
 	"github.com/kadeessh/kadeessh/internal/subsystem"
+	"github.com/kadeessh/kadeessh/internal/tunnel"
+	"github.com/kadeessh/kadeessh/internal/x11forward"
 	"go.uber.org/zap"
 	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
@@ -73,6 +81,31 @@ type Server struct {
 	ReverseForwardRaw json.RawMessage                    `json:"reverseforward,omitempty" caddy:"namespace=ssh.ask.reverseforward inline_key=forward"`
 	reverseForward    reverseforward.PortForwardingAsker `json:"-"`
 
+	// The reverse port forwardings of hostnames turned into tunnels for the `ssh_tunnel` upstreams of
+	// Caddy's reverse proxy, in place of binding the requested hostname. Disabled if absent.
+	ReverseTunnels *tunnel.Config `json:"reverse_tunnels,omitempty"`
+
+	// The configuration of the permission module for the local forwarding of unix sockets,
+	// i.e. `ssh -L <port|path>:<socket path>`. The config structure is:
+	// "localforward_streamlocal": {
+	// 		"forward": "<module name>"
+	// 		... config
+	// }
+	// defaults to: { "forward": "deny" }
+	LocalStreamLocalRaw json.RawMessage                        `json:"localforward_streamlocal,omitempty" caddy:"namespace=ssh.ask.streamlocal inline_key=forward"`
+	localStreamLocal    streamlocal.StreamLocalForwardingAsker `json:"-"`
+
+	// The configuration of the permission module for the reverse forwarding of unix sockets,
+	// i.e. `ssh -R <socket path>:<port|path>`. The socket is created with the ownership of the
+	// session user. The config structure is:
+	// "reverseforward_streamlocal": {
+	// 		"forward": "<module name>"
+	// 		... config
+	// }
+	// defaults to: { "forward": "deny" }
+	ReverseStreamLocalRaw json.RawMessage                        `json:"reverseforward_streamlocal,omitempty" caddy:"namespace=ssh.ask.streamlocal inline_key=forward"`
+	reverseStreamLocal    streamlocal.StreamLocalForwardingAsker `json:"-"`
+
 	// The configuration of PTY permission module. The config structure is:
 	// "pty": {
 	// 		"pty": "<module name>"
@@ -82,6 +115,26 @@ type Server struct {
 	PtyAskRaw json.RawMessage   `json:"pty,omitempty" caddy:"namespace=ssh.ask.pty inline_key=pty"`
 	ptyAsk    caddypty.PtyAsker `json:"-"`
 
+	// The configuration of agent-forwarding permission module. The config structure is:
+	// "agent_forwarding": {
+	// 		"forward": "<module name>"
+	// 		... config
+	// }
+	// defaults to: { "forward": "deny" }
+	// The module is asked only if the options of the key or the certificate the user authenticated with permit agent forwarding.
+	AgentForwardRaw json.RawMessage                   `json:"agent_forwarding,omitempty" caddy:"namespace=ssh.ask.agent_forwarding inline_key=forward"`
+	agentForward    agentforward.AgentForwardingAsker `json:"-"`
+
+	// The configuration of X11-forwarding permission module. The config structure is:
+	// "x11_forwarding": {
+	// 		"forward": "<module name>"
+	// 		... config
+	// }
+	// defaults to: { "forward": "deny" }
+	// The module is asked only if the options of the key or the certificate the user authenticated with permit X11 forwarding.
+	X11ForwardRaw json.RawMessage               `json:"x11_forwarding,omitempty" caddy:"namespace=ssh.ask.x11 inline_key=forward"`
+	x11Forward    x11forward.X11ForwardingAsker `json:"-"`
+
 	// connection timeout when no activity, none if empty
 	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
 	// absolute connection timeout, none if empty
@@ -109,6 +162,7 @@ type Server struct {
 
 	name        string
 	listenRange caddy.NetworkAddress
+	sessions    *liveSessions
 	logger      *zap.Logger
 }
 
@@ -128,6 +182,11 @@ func (app *SSH) Provision(ctx caddy.Context) error {
 	app.ctx = ctx
 	app.log = ctx.Logger(app)
 	app.serverIndexer = make(map[string][]int)
+	if registry := ctx.GetMetricsRegistry(); registry != nil {
+		if err := metrics.Register(registry); err != nil {
+			return fmt.Errorf("registering metrics: %v", err)
+		}
+	}
 	for srvName, srv := range app.Servers {
 		add, err := caddy.ParseNetworkAddress(srv.Address)
 		if err != nil {
@@ -138,6 +197,7 @@ func (app *SSH) Provision(ctx caddy.Context) error {
 		}
 		ctx.Context = context.WithValue(ctx, CtxServerName, srvName)
 		srv.name = srvName
+		srv.sessions = newLiveSessions()
 		srv.logger = app.log.Named(srvName)
 		srv.listenRange = add
 
@@ -192,6 +252,40 @@ func (app *SSH) Provision(ctx caddy.Context) error {
 			}
 			srv.reverseForward = rforwarder
 		}
+		{
+			// default to disable for strict reasons
+			if len(srv.LocalStreamLocalRaw) == 0 {
+				srv.LocalStreamLocalRaw = json.RawMessage(
+					[]byte(`{"forward": "deny" }`),
+				)
+			}
+			mods, err := ctx.LoadModule(srv, "LocalStreamLocalRaw")
+			if err != nil {
+				return fmt.Errorf("loading localforward_streamlocal callback: %v", err)
+			}
+			asker, ok := mods.(streamlocal.StreamLocalForwardingAsker)
+			if !ok {
+				return fmt.Errorf("loading localforward_streamlocal callback: specified callback is not streamlocal.StreamLocalForwardingAsker")
+			}
+			srv.localStreamLocal = asker
+		}
+		{
+			// default to disable for strict reasons
+			if len(srv.ReverseStreamLocalRaw) == 0 {
+				srv.ReverseStreamLocalRaw = json.RawMessage(
+					[]byte(`{"forward": "deny" }`),
+				)
+			}
+			mods, err := ctx.LoadModule(srv, "ReverseStreamLocalRaw")
+			if err != nil {
+				return fmt.Errorf("loading reverseforward_streamlocal callback: %v", err)
+			}
+			asker, ok := mods.(streamlocal.StreamLocalForwardingAsker)
+			if !ok {
+				return fmt.Errorf("loading reverseforward_streamlocal callback: specified callback is not streamlocal.StreamLocalForwardingAsker")
+			}
+			srv.reverseStreamLocal = asker
+		}
 		{
 			// default to disable for strict reasons
 			if len(srv.PtyAskRaw) == 0 {
@@ -209,6 +303,40 @@ func (app *SSH) Provision(ctx caddy.Context) error {
 			}
 			srv.ptyAsk = ptyasker
 		}
+		{
+			// default to disable for strict reasons
+			if len(srv.AgentForwardRaw) == 0 {
+				srv.AgentForwardRaw = json.RawMessage(
+					[]byte(`{"forward": "deny" }`),
+				)
+			}
+			mods, err := ctx.LoadModule(srv, "AgentForwardRaw")
+			if err != nil {
+				return fmt.Errorf("loading agent_forwarding callback: %v", err)
+			}
+			agentforwarder, ok := mods.(agentforward.AgentForwardingAsker)
+			if !ok {
+				return fmt.Errorf("loading agent_forwarding callback: specified callback is not agentforward.AgentForwardingAsker")
+			}
+			srv.agentForward = agentforwarder
+		}
+		{
+			// default to disable for strict reasons
+			if len(srv.X11ForwardRaw) == 0 {
+				srv.X11ForwardRaw = json.RawMessage(
+					[]byte(`{"forward": "deny" }`),
+				)
+			}
+			mods, err := ctx.LoadModule(srv, "X11ForwardRaw")
+			if err != nil {
+				return fmt.Errorf("loading x11_forwarding callback: %v", err)
+			}
+			x11forwarder, ok := mods.(x11forward.X11ForwardingAsker)
+			if !ok {
+				return fmt.Errorf("loading x11_forwarding callback: specified callback is not x11forward.X11ForwardingAsker")
+			}
+			srv.x11Forward = x11forwarder
+		}
 		if srv.SubsystemRaw != nil || len(srv.SubsystemRaw) == 0 {
 			srv.subsystems = make(map[string]subsystem.Handler)
 			mods, err := ctx.LoadModule(srv, "SubsystemRaw")
@@ -222,20 +350,40 @@ func (app *SSH) Provision(ctx caddy.Context) error {
 		if err := srv.Config.Provision(ctx); err != nil {
 			return err
 		}
+		if err := srv.ReverseTunnels.Provision(ctx); err != nil {
+			return err
+		}
 
 		if err := srv.Actors.Provision(ctx); err != nil {
 			return err
 		}
+		dialUnix, listenUnix := dialStreamLocal(srv.localStreamLocal, passwd.New()), listenStreamLocal(srv.reverseStreamLocal, passwd.New())
 		for portOffset := uint(0); portOffset < srv.listenRange.PortRangeSize(); portOffset++ {
 			sshsrv := &sshServer{
 				Server: &ssh.Server{
 					// used in this manner to preserve the *relative* NetworkAddress
-					Addr:                          caddy.JoinNetworkAddress(add.Network, add.Host, strconv.Itoa(int(srv.listenRange.StartPort+portOffset))), //nolint:gosec
-					IdleTimeout:                   time.Duration(srv.IdleTimeout),
-					MaxTimeout:                    time.Duration(srv.MaxTimeout),
-					LocalPortForwardingCallback:   srv.localForward.Allow,
-					ReversePortForwardingCallback: srv.reverseForward.Allow,
-					PtyCallback:                   srv.ptyAsk.Allow,
+					Addr:        caddy.JoinNetworkAddress(add.Network, add.Host, strconv.Itoa(int(srv.listenRange.StartPort+portOffset))), //nolint:gosec
+					IdleTimeout: time.Duration(srv.IdleTimeout),
+					MaxTimeout:  time.Duration(srv.MaxTimeout),
+					LocalPortForwardingCallback: func(ctx ssh.Context, host string, port uint32) bool {
+						return observeForward(srv.name, "local", srv.localForward.Allow(ctx, host, port))
+					},
+					ReversePortForwardingCallback: func(ctx ssh.Context, host string, port uint32) bool {
+						return observeForward(srv.name, "reverse", srv.reverseForward.Allow(ctx, host, port))
+					},
+					LocalUnixForwardingCallback: func(ctx ssh.Context, socketPath string) (net.Conn, error) {
+						conn, err := dialUnix(ctx, socketPath)
+						observeForwardErr(srv.name, "local_streamlocal", err)
+						return conn, err
+					},
+					ReverseUnixForwardingCallback: func(ctx ssh.Context, socketPath string) (net.Listener, error) {
+						l, err := listenUnix(ctx, socketPath)
+						observeForwardErr(srv.name, "reverse_streamlocal", err)
+						return l, err
+					},
+					PtyCallback:             srv.ptyAsk.Allow,
+					AgentForwardingCallback: allowAgentForwarding(srv.agentForward),
+					X11Callback:             allowX11Forwarding(srv.x11Forward),
 					ServerConfigCallback: func(ctx ssh.Context) *gossh.ServerConfig {
 						for _, cfger := range srv.Config {
 							if cfger.matcherSets.AnyMatch(ctx) {
@@ -246,6 +394,17 @@ func (app *SSH) Provision(ctx caddy.Context) error {
 					},
 				},
 			}
+			observeConnections(sshsrv.Server, srv.name)
+			sshsrv.LocalPortForwardingDoneCallback = auditLocalForward(srv.logger.Named("localforward"))
+			if rw, ok := srv.reverseForward.(reverseforward.BindAddressRewriter); ok {
+				sshsrv.ReversePortForwardingBindCallback = rw.BindAddress
+			}
+			if rl, ok := srv.reverseForward.(reverseforward.ListenerReleaser); ok {
+				sshsrv.ReversePortForwardingReleaseCallback = rl.Release
+			}
+			if srv.ReverseTunnels != nil {
+				sshsrv.ReversePortForwardingListenCallback = srv.ReverseTunnels.Listen
+			}
 			if srv.localForward != nil || srv.reverseForward != nil {
 				forwardHandler := &ssh.ForwardedTCPHandler{}
 				if sshsrv.RequestHandlers == nil {
@@ -256,15 +415,37 @@ func (app *SSH) Provision(ctx caddy.Context) error {
 					// re-plug the default session handler
 					sshsrv.ChannelHandlers["session"] = ssh.DefaultSessionHandler
 				}
-				sshsrv.RequestHandlers["tcpip-forward"] = forwardHandler.HandleSSHRequest
-				sshsrv.RequestHandlers["cancel-tcpip-forward"] = forwardHandler.HandleSSHRequest
-				sshsrv.ChannelHandlers["direct-tcpip"] = ssh.DirectTCPIPHandler
+				sshsrv.RequestHandlers["tcpip-forward"] = trackReverseForward(srv.sessions, "reverse", false, forwardHandler.HandleSSHRequest)
+				sshsrv.RequestHandlers["cancel-tcpip-forward"] = trackReverseForward(srv.sessions, "reverse", true, forwardHandler.HandleSSHRequest)
+				sshsrv.ChannelHandlers["direct-tcpip"] = trackLocalForward(srv.sessions, "local", ssh.DirectTCPIPHandler)
+			}
+			if srv.localStreamLocal != nil || srv.reverseStreamLocal != nil {
+				forwardHandler := &ssh.ForwardedUnixHandler{}
+				if sshsrv.RequestHandlers == nil {
+					sshsrv.RequestHandlers = make(map[string]ssh.RequestHandler)
+				}
+				if sshsrv.ChannelHandlers == nil {
+					sshsrv.ChannelHandlers = make(map[string]ssh.ChannelHandler)
+					// re-plug the default session handler
+					sshsrv.ChannelHandlers["session"] = ssh.DefaultSessionHandler
+				}
+				sshsrv.RequestHandlers["streamlocal-forward@openssh.com"] = trackReverseForward(srv.sessions, "reverse_streamlocal", false, forwardHandler.HandleSSHRequest)
+				sshsrv.RequestHandlers["cancel-streamlocal-forward@openssh.com"] = trackReverseForward(srv.sessions, "reverse_streamlocal", true, forwardHandler.HandleSSHRequest)
+				sshsrv.ChannelHandlers["direct-streamlocal@openssh.com"] = trackLocalForward(srv.sessions, "local_streamlocal", ssh.DirectStreamLocalHandler)
+			}
+			if sshsrv.ChannelHandlers == nil {
+				sshsrv.ChannelHandlers = map[string]ssh.ChannelHandler{"session": ssh.DefaultSessionHandler}
+			}
+			for channelType, handler := range sshsrv.ChannelHandlers {
+				sshsrv.ChannelHandlers[channelType] = countChannelBytes(srv.name, channelType, handler)
 			}
 			if len(srv.subsystems) > 0 {
 				sshsrv.SubsystemHandlers = make(map[string]ssh.SubsystemHandler)
 			}
 			for ss, hndler := range srv.subsystems {
 				sshsrv.SubsystemHandlers[ss] = func(s ssh.Session) {
+					_, untrack := srv.sessions.add(s)
+					defer untrack()
 					hndler.Handle(s)
 				}
 			}
@@ -290,6 +471,9 @@ func (app *SSH) Provision(ctx caddy.Context) error {
 				// TODO: error checking
 				defer deauth(sess) // nolint
 
+				live, untrack := srv.sessions.add(sess)
+				defer untrack()
+
 				defer srv.logger.Info("session ended",
 					zap.String("user", sess.User()),
 					zap.String("remote_ip", sess.RemoteAddr().String()),
@@ -297,10 +481,15 @@ func (app *SSH) Provision(ctx caddy.Context) error {
 				)
 
 				var errs []error
+				exit := &session.ExitError{}
 				for _, actor := range srv.Actors {
 					if actor.matcherSets.AnyMatch(sess) {
-						err := actor.handler.Handle(sess)
-						if err != nil {
+						srv.sessions.act(live, actor.name)
+						err := observeActor(srv.name, actor, sess)
+						var exitErr *session.ExitError
+						if errors.As(err, &exitErr) {
+							exit = exitErr
+						} else if err != nil {
 							errs = append(errs, err)
 						}
 						if actor.Final {
@@ -309,12 +498,17 @@ func (app *SSH) Provision(ctx caddy.Context) error {
 					}
 				}
 
-				exitCode := 0
 				if len(errs) != 0 {
-					exitCode = 1
+					exit = &session.ExitError{Status: 1}
 					srv.logger.Error("actors errors", zap.Errors("errors", errs))
 				}
-				if err := sess.Exit(exitCode); err != nil {
+				var err error
+				if exit.Signal != "" {
+					err = sess.ExitSignal(exit.Signal, exit.CoreDumped, exit.Message)
+				} else {
+					err = sess.Exit(int(exit.Status))
+				}
+				if err != nil {
 					srv.logger.Error("error on exit",
 						zap.Error(err),
 						zap.String("remote_ip", sess.RemoteAddr().String()),
@@ -329,6 +523,22 @@ func (app *SSH) Provision(ctx caddy.Context) error {
 	return nil
 }
 
+// lookupServer returns the server of the name along with the live connections of its listeners
+func (app *SSH) lookupServer(name string) (*Server, []ssh.ConnInfo, bool) {
+	if app == nil {
+		return nil, nil, false
+	}
+	srv, ok := app.Servers[name]
+	if !ok {
+		return nil, nil, false
+	}
+	var conns []ssh.ConnInfo
+	for _, i := range app.serverIndexer[name] {
+		conns = append(conns, app.servers[i].Connections()...)
+	}
+	return srv, conns, true
+}
+
 // Start starts the SSH app.
 func (app *SSH) Start() error {
 	app.errGroup = &errgroup.Group{}
@@ -1,6 +1,7 @@
 package ssh
 
 import (
+	"context"
 	"io"
 	"net"
 	"os"
@@ -30,7 +31,13 @@ func SetAgentRequested(ctx Context) {
 
 // AgentRequested returns true if the client requested agent forwarding.
 func AgentRequested(sess Session) bool {
-	return sess.Context().Value(contextKeyAgentRequest) == true
+	return AgentRequestedContext(sess.Context())
+}
+
+// AgentRequestedContext returns true if the client of the session context
+// requested agent forwarding.
+func AgentRequestedContext(ctx context.Context) bool {
+	return ctx.Value(contextKeyAgentRequest) == true
 }
 
 // NewAgentListener sets up a temporary Unix socket that can be communicated
@@ -51,7 +58,13 @@ func NewAgentListener() (net.Listener, error) {
 // session on the OpenSSH channel for agent connections. It blocks and services
 // connections until the listener stop accepting.
 func ForwardAgentConnections(l net.Listener, s Session) {
-	sshConn := s.Context().Value(ContextKeyConn).(gossh.Conn)
+	ForwardAgentConnectionsContext(l, s.Context())
+}
+
+// ForwardAgentConnectionsContext is ForwardAgentConnections for the connection
+// of the session context.
+func ForwardAgentConnectionsContext(l net.Listener, ctx context.Context) {
+	sshConn := ctx.Value(ContextKeyConn).(gossh.Conn)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -81,3 +94,15 @@ func ForwardAgentConnections(l net.Listener, s Session) {
 		}(conn)
 	}
 }
+
+// DialAgentContext opens a connection to the agent forwarded by the client of the
+// session context, e.g. to authenticate onward with the keys of the client.
+func DialAgentContext(ctx context.Context) (io.ReadWriteCloser, error) {
+	sshConn := ctx.Value(ContextKeyConn).(gossh.Conn)
+	channel, reqs, err := sshConn.OpenChannel(agentChannelType, nil)
+	if err != nil {
+		return nil, err
+	}
+	go gossh.DiscardRequests(reqs)
+	return channel, nil
+}
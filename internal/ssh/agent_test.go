@@ -0,0 +1,37 @@
+package ssh
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestAgentForwardingCallback(t *testing.T) {
+	t.Parallel()
+	for _, allow := range []bool{true, false} {
+		requested := make(chan bool, 1)
+		session, _, cleanup := newTestSession(t, &Server{
+			noClientAuth: true,
+			Handler: func(s Session) {
+				requested <- AgentRequested(s)
+			},
+			AgentForwardingCallback: func(ctx Context) bool {
+				return allow
+			},
+		}, nil)
+		err := agent.RequestAgentForwarding(session)
+		if allow && err != nil {
+			t.Fatalf("expected agent forwarding to be accepted, got %v", err)
+		}
+		if !allow && err == nil {
+			t.Fatal("expected agent forwarding to be rejected")
+		}
+		if err := session.Run(""); err != nil {
+			t.Fatalf("expected nil but got %v", err)
+		}
+		if got := <-requested; got != allow {
+			t.Fatalf("AgentRequested() = %v; want %v", got, allow)
+		}
+		cleanup()
+	}
+}
@@ -102,6 +102,7 @@ func newContext(srv *Server) (*sshContext, context.CancelFunc) {
 	ctx.SetValue(ContextKeyServer, srv)
 	perms := &Permissions{&gossh.Permissions{}}
 	ctx.SetValue(ContextKeyPermissions, perms)
+	ctx.SetValue(contextKeyDialAddresses, &dialAddresses{addrs: make(map[string][]net.IP)})
 	return ctx, cancel
 }
 
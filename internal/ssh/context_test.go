@@ -1,6 +1,10 @@
 package ssh
 
-import "testing"
+import (
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
 
 func TestSetPermissions(t *testing.T) {
 	t.Parallel()
@@ -23,6 +27,28 @@ func TestSetPermissions(t *testing.T) {
 	}
 }
 
+func TestPermissionsOfServerConfigCallback(t *testing.T) {
+	t.Parallel()
+	session, _, cleanup := newTestSession(t, &Server{
+		Handler: func(s Session) {
+			if got := s.Permissions().CriticalOptions["permitopen"]; got != "localhost:80" {
+				t.Errorf("permitopen = %#v; want %#v", got, "localhost:80")
+			}
+		},
+		ServerConfigCallback: func(ctx Context) *gossh.ServerConfig {
+			return &gossh.ServerConfig{
+				PasswordCallback: func(conn gossh.ConnMetadata, password []byte) (*gossh.Permissions, error) {
+					return &gossh.Permissions{CriticalOptions: map[string]string{"permitopen": "localhost:80"}}, nil
+				},
+			}
+		},
+	}, nil)
+	defer cleanup()
+	if err := session.Run(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestSetValue(t *testing.T) {
 	t.Parallel()
 	value := map[string]string{
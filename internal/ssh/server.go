@@ -15,6 +15,9 @@ import (
 // and ListenAndServeTLS methods after a call to Shutdown or Close.
 var ErrServerClosed = errors.New("ssh: Server closed")
 
+// ErrRejected is returned by the unix forwarding callbacks to deny the forwarding
+var ErrRejected = errors.New("ssh: rejected")
+
 type SubsystemHandler func(s Session)
 
 var DefaultSubsystemHandlers = map[string]SubsystemHandler{}
@@ -45,11 +48,20 @@ type Server struct {
 	ConnCallback                  ConnCallback                  // optional callback for wrapping net.Conn before handling
 	LocalPortForwardingCallback   LocalPortForwardingCallback   // callback for allowing local port forwarding, denies all if nil
 	ReversePortForwardingCallback ReversePortForwardingCallback // callback for allowing reverse port forwarding, denies all if nil
+	AgentForwardingCallback       AgentForwardingCallback       // callback for allowing agent forwarding, allows all if nil
+	LocalUnixForwardingCallback   LocalUnixForwardingCallback   // callback for allowing local unix socket forwarding, denies all if nil
+	ReverseUnixForwardingCallback ReverseUnixForwardingCallback // callback for allowing reverse unix socket forwarding, denies all if nil
+	X11Callback                   X11Callback                   // callback for allowing X11 forwarding, denies all if nil
 	ServerConfigCallback          ServerConfigCallback          // callback for configuring detailed SSH options
 	SessionRequestCallback        SessionRequestCallback        // callback for allowing or denying SSH sessions
 
 	ConnectionFailedCallback ConnectionFailedCallback // callback to report connection failures
 
+	LocalPortForwardingDoneCallback      LocalPortForwardingDoneCallback      // optional callback notified with the statistics of a local port forwarding once it's done
+	ReversePortForwardingBindCallback    ReversePortForwardingBindCallback    // optional callback for rewriting the bind address of reverse port forwarding
+	ReversePortForwardingReleaseCallback ReversePortForwardingReleaseCallback // optional callback notified when a reverse port forwarding stops listening
+	ReversePortForwardingListenCallback  ReversePortForwardingListenCallback  // optional callback for listening in place of binding the address of reverse port forwarding
+
 	IdleTimeout time.Duration // connection timeout when no activity, none if empty
 	MaxTimeout  time.Duration // absolute connection timeout, none if empty
 
@@ -70,7 +82,7 @@ type Server struct {
 	listenerWg sync.WaitGroup
 	mu         sync.RWMutex
 	listeners  map[net.Listener]struct{}
-	conns      map[*gossh.ServerConn]struct{}
+	conns      map[*gossh.ServerConn]ConnInfo
 	connWg     sync.WaitGroup
 	doneChan   chan struct{}
 
@@ -262,6 +274,7 @@ func (srv *Server) Serve(l net.Listener) error {
 }
 
 func (srv *Server) HandleConn(newConn net.Conn) {
+	start := time.Now()
 	ctx, cancel := newContext(srv)
 	if srv.ConnCallback != nil {
 		cbConn := srv.ConnCallback(ctx, newConn)
@@ -289,11 +302,23 @@ func (srv *Server) HandleConn(newConn net.Conn) {
 		return
 	}
 
-	srv.trackConn(sshConn, true)
-	defer srv.trackConn(sshConn, false)
-
 	ctx.SetValue(ContextKeyConn, sshConn)
 	applyConnMetadata(ctx, sshConn)
+	srv.trackConn(sshConn, ConnInfo{
+		Conn:          sshConn,
+		SessionID:     ctx.SessionID(),
+		User:          ctx.User(),
+		ClientVersion: ctx.ClientVersion(),
+		RemoteAddr:    ctx.RemoteAddr(),
+		Start:         start,
+	}, true)
+	defer srv.trackConn(sshConn, ConnInfo{}, false)
+
+	// the auth callbacks of a custom ServerConfigCallback return their own permissions,
+	// e.g. the options of the authorized key, so expose them through the context as well
+	if sshConn.Permissions != nil {
+		ctx.Permissions().Permissions = sshConn.Permissions
+	}
 	// go gossh.DiscardRequests(reqs)
 	go srv.handleRequests(ctx, reqs)
 	for ch := range chans {
@@ -434,15 +459,37 @@ func (srv *Server) trackListener(ln net.Listener, add bool) {
 	}
 }
 
-func (srv *Server) trackConn(c *gossh.ServerConn, add bool) {
+// ConnInfo describes a connection being served once its handshake is done
+type ConnInfo struct {
+	Conn          *gossh.ServerConn
+	SessionID     string
+	User          string
+	ClientVersion string
+	RemoteAddr    net.Addr
+	Start         time.Time // when the connection was accepted
+}
+
+// Connections returns the connections being served
+func (srv *Server) Connections() []ConnInfo {
+	srv.mu.RLock()
+	defer srv.mu.RUnlock()
+
+	conns := make([]ConnInfo, 0, len(srv.conns))
+	for _, info := range srv.conns {
+		conns = append(conns, info)
+	}
+	return conns
+}
+
+func (srv *Server) trackConn(c *gossh.ServerConn, info ConnInfo, add bool) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
 	if srv.conns == nil {
-		srv.conns = make(map[*gossh.ServerConn]struct{})
+		srv.conns = make(map[*gossh.ServerConn]ConnInfo)
 	}
 	if add {
-		srv.conns[c] = struct{}{}
+		srv.conns[c] = info
 		srv.connWg.Add(1)
 	} else {
 		delete(srv.conns, c)
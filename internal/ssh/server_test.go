@@ -126,3 +126,33 @@ func TestServerClose(t *testing.T) {
 		return
 	}
 }
+
+func TestConnections(t *testing.T) {
+	t.Parallel()
+	srv := &Server{
+		noClientAuth: true,
+		Handler: func(s Session) {
+			conns := s.Context().Value(ContextKeyServer).(*Server).Connections()
+			if len(conns) != 1 {
+				t.Errorf("Connections() = %v; want one connection", conns)
+				return
+			}
+			c := conns[0]
+			if c.SessionID != s.Context().Value(ContextKeySessionID) || c.User != "testuser" || c.RemoteAddr.String() != s.RemoteAddr().String() || c.Start.IsZero() {
+				t.Errorf("Connections() = %+v; want the connection of the session", c)
+			}
+		},
+	}
+	session, _, cleanup := newTestSession(t, srv, nil)
+	defer cleanup()
+	if err := session.Run(""); err != nil {
+		t.Fatal(err)
+	}
+	cleanup()
+	for i := 0; len(srv.Connections()) != 0; i++ {
+		if i == 100 {
+			t.Fatal("the connection is still listed after closing it")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -39,6 +39,10 @@ type Session interface {
 	// Exit sends an exit status and then closes the session.
 	Exit(code int) error
 
+	// ExitSignal sends the signal which terminated the command, whether the
+	// command dumped core, and an error message, and then closes the session.
+	ExitSignal(signal Signal, coreDumped bool, message string) error
+
 	// Command returns a shell parsed slice of arguments that were provided by the
 	// user. Shell parsing splits the command string according to POSIX shell rules,
 	// which considers quoting not just whitespace.
@@ -62,6 +66,10 @@ type Session interface {
 	// operation fails.
 	Context() context.Context
 
+	// Closed returns a channel which is closed once the channel of the session is
+	// closed by either side, e.g. when the client hangs up.
+	Closed() <-chan struct{}
+
 	// Permissions returns a copy of the Permissions object that was available for
 	// setup in the auth handlers via the Context.
 	Permissions() Permissions
@@ -100,9 +108,12 @@ func DefaultSessionHandler(srv *Server, conn *gossh.ServerConn, newChan gossh.Ne
 		conn:              conn,
 		handler:           srv.Handler,
 		ptyCb:             srv.PtyCallback,
+		agentCb:           srv.AgentForwardingCallback,
+		x11Cb:             srv.X11Callback,
 		sessReqCb:         srv.SessionRequestCallback,
 		subsystemHandlers: srv.SubsystemHandlers,
 		ctx:               ctx,
+		closed:            make(chan struct{}),
 	}
 	sess.handleRequests(reqs)
 }
@@ -116,9 +127,12 @@ type session struct {
 	handled           bool
 	exited            bool
 	pty               *Pty
+	ptyMu             sync.Mutex // guards pty against the window changes
 	winch             chan Window
 	env               []string
 	ptyCb             PtyCallback
+	agentCb           AgentForwardingCallback
+	x11Cb             X11Callback
 	sessReqCb         SessionRequestCallback
 	rawCmd            string
 	subsystem         string
@@ -126,6 +140,7 @@ type session struct {
 	sigCh             chan<- Signal
 	sigBuf            []Signal
 	breakCh           chan<- bool
+	closed            chan struct{}
 }
 
 func (sess *session) Write(p []byte) (n int, err error) {
@@ -163,6 +178,10 @@ func (sess *session) Context() context.Context {
 	return sess.ctx
 }
 
+func (sess *session) Closed() <-chan struct{} {
+	return sess.closed
+}
+
 func (sess *session) Exit(code int) error {
 	sess.Lock()
 	defer sess.Unlock()
@@ -179,6 +198,28 @@ func (sess *session) Exit(code int) error {
 	return sess.Close()
 }
 
+func (sess *session) ExitSignal(signal Signal, coreDumped bool, message string) error {
+	sess.Lock()
+	defer sess.Unlock()
+	if sess.exited {
+		return errors.New("Session.ExitSignal called multiple times")
+	}
+	sess.exited = true
+
+	// RFC 4254 Section 6.10
+	exitSignal := struct {
+		Signal     string
+		CoreDumped bool
+		Message    string
+		Lang       string
+	}{string(signal), coreDumped, message, ""}
+	_, err := sess.SendRequest("exit-signal", false, gossh.Marshal(&exitSignal))
+	if err != nil {
+		return err
+	}
+	return sess.Close()
+}
+
 func (sess *session) User() string {
 	return sess.conn.User()
 }
@@ -209,6 +250,8 @@ func (sess *session) Subsystem() string {
 }
 
 func (sess *session) Pty() (Pty, <-chan Window, bool) {
+	sess.ptyMu.Lock()
+	defer sess.ptyMu.Unlock()
 	if sess.pty != nil {
 		return *sess.pty, sess.winch, true
 	}
@@ -235,6 +278,8 @@ func (sess *session) Break(c chan<- bool) {
 }
 
 func (sess *session) handleRequests(reqs <-chan *gossh.Request) {
+	// the requests are closed along with the channel
+	defer close(sess.closed)
 	for req := range reqs {
 		switch req.Type {
 		case "shell", "exec":
@@ -334,8 +379,10 @@ func (sess *session) handleRequests(reqs <-chan *gossh.Request) {
 					continue
 				}
 			}
+			sess.ptyMu.Lock()
 			sess.pty = &ptyReq
 			sess.winch = make(chan Window, 1)
+			sess.ptyMu.Unlock()
 			sess.winch <- ptyReq.Window
 			defer func() {
 				// when reqs is closed
@@ -349,14 +396,31 @@ func (sess *session) handleRequests(reqs <-chan *gossh.Request) {
 			}
 			win, ok := parseWinchRequest(req.Payload)
 			if ok {
+				sess.ptyMu.Lock()
 				sess.pty.Window = win
+				sess.ptyMu.Unlock()
 				sess.winch <- win
 			}
 			req.Reply(ok, nil)
 		case agentRequestType:
-			// TODO: option/callback to allow agent forwarding
+			if sess.agentCb != nil && !sess.agentCb(sess.ctx) {
+				req.Reply(false, nil)
+				continue
+			}
 			SetAgentRequested(sess.ctx)
 			req.Reply(true, nil)
+		case x11RequestType:
+			if sess.handled || sess.x11Cb == nil {
+				req.Reply(false, nil)
+				continue
+			}
+			x11Req, ok := parseX11Request(req.Payload)
+			if !ok || !sess.x11Cb(sess.ctx, x11Req) {
+				req.Reply(false, nil)
+				continue
+			}
+			SetX11Requested(sess.ctx, x11Req)
+			req.Reply(true, nil)
 		case "break":
 			ok := false
 			sess.Lock()
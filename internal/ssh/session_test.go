@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"testing"
+	"time"
 
 	gossh "golang.org/x/crypto/ssh"
 )
@@ -20,8 +21,9 @@ func (srv *Server) serveOnce(l net.Listener) error {
 		return e
 	}
 	srv.ChannelHandlers = map[string]ChannelHandler{
-		"session":      DefaultSessionHandler,
-		"direct-tcpip": DirectTCPIPHandler,
+		"session":                        DefaultSessionHandler,
+		"direct-tcpip":                   DirectTCPIPHandler,
+		"direct-streamlocal@openssh.com": DirectStreamLocalHandler,
 	}
 	srv.HandleConn(conn)
 	return nil
@@ -201,6 +203,52 @@ func TestExitStatusNonZero(t *testing.T) {
 	}
 }
 
+func TestExitSignal(t *testing.T) {
+	t.Parallel()
+	session, _, cleanup := newTestSession(t, &Server{
+		noClientAuth: true,
+		Handler: func(s Session) {
+			s.ExitSignal(SIGSEGV, true, "segmentation fault")
+		},
+	}, nil)
+	defer cleanup()
+	err := session.Run("")
+	e, ok := err.(*gossh.ExitError)
+	if !ok {
+		t.Fatalf("expected ExitError but got %T", err)
+	}
+	if e.Signal() != string(SIGSEGV) || e.Msg() != "segmentation fault" {
+		t.Fatalf("exit-signal = %q, %q; want %q, %q", e.Signal(), e.Msg(), SIGSEGV, "segmentation fault")
+	}
+}
+
+func TestClosed(t *testing.T) {
+	t.Parallel()
+	closed := make(chan struct{})
+	session, _, cleanup := newTestSession(t, &Server{
+		noClientAuth: true,
+		Handler: func(s Session) {
+			<-s.Closed()
+			close(closed)
+		},
+	}, nil)
+	defer cleanup()
+	if err := session.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+		t.Fatal("session reported closed before the client closed it")
+	case <-time.After(50 * time.Millisecond):
+	}
+	session.Close()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not reported closed after the client closed it")
+	}
+}
+
 func TestPty(t *testing.T) {
 	t.Parallel()
 	term := "xterm"
@@ -61,6 +61,38 @@ type LocalPortForwardingCallback func(ctx Context, destinationHost string, desti
 // ReversePortForwardingCallback is a hook for allowing reverse port forwarding
 type ReversePortForwardingCallback func(ctx Context, bindHost string, bindPort uint32) bool
 
+// AgentForwardingCallback is a hook for allowing agent forwarding
+type AgentForwardingCallback func(ctx Context) bool
+
+// LocalPortForwardingDoneCallback is a hook notified with the statistics of an
+// allowed local port forwarding once it's done, or once it fails to connect
+type LocalPortForwardingDoneCallback func(ctx Context, stats LocalPortForwardingStats)
+
+// ReversePortForwardingBindCallback is a hook for rewriting the address the
+// allowed reverse port forwarding binds to, e.g. to apply the GatewayPorts semantics
+type ReversePortForwardingBindCallback func(ctx Context, bindHost string) string
+
+// ReversePortForwardingReleaseCallback is a hook notified when an allowed
+// reverse port forwarding stops listening, or fails to listen
+type ReversePortForwardingReleaseCallback func(ctx Context, bindHost string, bindPort uint32)
+
+// ReversePortForwardingListenCallback is a hook for listening on behalf of an
+// allowed reverse port forwarding in place of binding the requested address, e.g.
+// to route the forwarding elsewhere. A nil listener falls back to binding the address.
+type ReversePortForwardingListenCallback func(ctx Context, bindHost string, bindPort uint32) (net.Listener, error)
+
+// LocalUnixForwardingCallback is a hook for allowing unix socket forwarding. It
+// returns the connection to the socket, or ErrRejected if the forwarding is denied.
+type LocalUnixForwardingCallback func(ctx Context, socketPath string) (net.Conn, error)
+
+// ReverseUnixForwardingCallback is a hook for allowing reverse unix socket
+// forwarding. It returns the listener on the socket, or ErrRejected if the
+// forwarding is denied.
+type ReverseUnixForwardingCallback func(ctx Context, socketPath string) (net.Listener, error)
+
+// X11Callback is a hook for allowing X11 forwarding
+type X11Callback func(ctx Context, x11 X11) bool
+
 // ServerConfigCallback is a hook for creating custom default server configs
 type ServerConfigCallback func(ctx Context) *gossh.ServerConfig
 
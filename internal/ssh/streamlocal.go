@@ -0,0 +1,177 @@
+package ssh
+
+import (
+	"io"
+	"net"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	forwardedStreamLocalChannelType = "forwarded-streamlocal@openssh.com"
+)
+
+// direct-streamlocal data struct as specified in the OpenSSH PROTOCOL file, Section 2.4
+type localStreamLocalChannelData struct {
+	SocketPath string
+
+	Reserved0 string
+	Reserved1 uint32
+}
+
+// DirectStreamLocalHandler can be enabled by adding it to the server's
+// ChannelHandlers under direct-streamlocal@openssh.com.
+func DirectStreamLocalHandler(srv *Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx Context) {
+	d := localStreamLocalChannelData{}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing forward data: "+err.Error())
+		return
+	}
+
+	if srv.LocalUnixForwardingCallback == nil {
+		newChan.Reject(gossh.Prohibited, "unix forwarding is disabled")
+		return
+	}
+	dconn, err := srv.LocalUnixForwardingCallback(ctx, d.SocketPath)
+	if err != nil {
+		if err == ErrRejected {
+			newChan.Reject(gossh.Prohibited, "unix forwarding is disabled")
+			return
+		}
+		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	go func() {
+		defer ch.Close()
+		defer dconn.Close()
+		io.Copy(ch, dconn)
+	}()
+	go func() {
+		defer ch.Close()
+		defer dconn.Close()
+		io.Copy(dconn, ch)
+	}()
+}
+
+type remoteStreamLocalForwardRequest struct {
+	SocketPath string
+}
+
+type remoteStreamLocalForwardCancelRequest struct {
+	SocketPath string
+}
+
+type remoteStreamLocalForwardChannelData struct {
+	SocketPath string
+	Reserved   string
+}
+
+// ForwardedUnixHandler can be enabled by creating a ForwardedUnixHandler and
+// adding the HandleSSHRequest callback to the server's RequestHandlers under
+// streamlocal-forward@openssh.com and cancel-streamlocal-forward@openssh.com.
+type ForwardedUnixHandler struct {
+	forwards map[string]net.Listener
+	sync.Mutex
+}
+
+func (h *ForwardedUnixHandler) HandleSSHRequest(ctx Context, srv *Server, req *gossh.Request) (bool, []byte) {
+	h.Lock()
+	if h.forwards == nil {
+		h.forwards = make(map[string]net.Listener)
+	}
+	h.Unlock()
+	conn := ctx.Value(ContextKeyConn).(*gossh.ServerConn)
+	switch req.Type {
+	case "streamlocal-forward@openssh.com":
+		var reqPayload remoteStreamLocalForwardRequest
+		if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+			return false, []byte{}
+		}
+		if srv.ReverseUnixForwardingCallback == nil {
+			return false, []byte("unix forwarding is disabled")
+		}
+		addr := reqPayload.SocketPath
+		h.Lock()
+		_, exists := h.forwards[addr]
+		h.Unlock()
+		if exists {
+			return false, []byte("socket is already forwarded")
+		}
+		ln, err := srv.ReverseUnixForwardingCallback(ctx, addr)
+		if err != nil {
+			if err == ErrRejected {
+				return false, []byte("unix forwarding is disabled")
+			}
+			return false, []byte{}
+		}
+		h.Lock()
+		h.forwards[addr] = ln
+		h.Unlock()
+		go func() {
+			<-ctx.Done()
+			h.Lock()
+			ln, ok := h.forwards[addr]
+			h.Unlock()
+			if ok {
+				ln.Close()
+			}
+		}()
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					break
+				}
+				payload := gossh.Marshal(&remoteStreamLocalForwardChannelData{
+					SocketPath: addr,
+				})
+				go func() {
+					ch, reqs, err := conn.OpenChannel(forwardedStreamLocalChannelType, payload)
+					if err != nil {
+						c.Close()
+						return
+					}
+					go gossh.DiscardRequests(reqs)
+					go func() {
+						defer ch.Close()
+						defer c.Close()
+						io.Copy(ch, c)
+					}()
+					go func() {
+						defer ch.Close()
+						defer c.Close()
+						io.Copy(c, ch)
+					}()
+				}()
+			}
+			h.Lock()
+			delete(h.forwards, addr)
+			h.Unlock()
+		}()
+		return true, nil
+
+	case "cancel-streamlocal-forward@openssh.com":
+		var reqPayload remoteStreamLocalForwardCancelRequest
+		if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+			return false, []byte{}
+		}
+		h.Lock()
+		ln, ok := h.forwards[reqPayload.SocketPath]
+		h.Unlock()
+		if ok {
+			ln.Close()
+		}
+		return true, nil
+	default:
+		return false, nil
+	}
+}
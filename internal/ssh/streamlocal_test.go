@@ -0,0 +1,154 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func sampleUnixSocketServer(t *testing.T) net.Listener {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "sample.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(sampleServerResponse)
+		conn.Close()
+	}()
+
+	return l
+}
+
+func newTestSessionWithUnixForwarding(t *testing.T, forwardingEnabled bool) (net.Listener, *gossh.Client, func()) {
+	l := sampleUnixSocketServer(t)
+
+	_, client, cleanup := newTestSession(t, &Server{
+		noClientAuth: true,
+		Handler:      func(s Session) {},
+		LocalUnixForwardingCallback: func(ctx Context, socketPath string) (net.Conn, error) {
+			if socketPath != l.Addr().String() {
+				panic("unexpected socket path: " + socketPath)
+			}
+			if !forwardingEnabled {
+				return nil, ErrRejected
+			}
+			return net.Dial("unix", socketPath)
+		},
+	}, nil)
+
+	return l, client, func() {
+		cleanup()
+		l.Close()
+	}
+}
+
+func TestLocalUnixForwardingWorks(t *testing.T) {
+	t.Parallel()
+
+	l, client, cleanup := newTestSessionWithUnixForwarding(t, true)
+	defer cleanup()
+
+	conn, err := client.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting to %v: %v", l.Addr().String(), err)
+	}
+	result, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, sampleServerResponse) {
+		t.Fatalf("result = %#v; want %#v", result, sampleServerResponse)
+	}
+}
+
+func TestLocalUnixForwardingRespectsCallback(t *testing.T) {
+	t.Parallel()
+
+	l, client, cleanup := newTestSessionWithUnixForwarding(t, false)
+	defer cleanup()
+
+	_, err := client.Dial("unix", l.Addr().String())
+	if err == nil {
+		t.Fatalf("Expected error connecting to %v but it succeeded", l.Addr().String())
+	}
+	if !strings.Contains(err.Error(), "unix forwarding is disabled") {
+		t.Fatalf("Expected permission error but got %#v", err)
+	}
+}
+
+func TestReverseUnixForwardingWorks(t *testing.T) {
+	t.Parallel()
+
+	socketPath := filepath.Join(t.TempDir(), "reverse.sock")
+	forwardHandler := &ForwardedUnixHandler{}
+	_, client, cleanup := newTestSession(t, &Server{
+		noClientAuth: true,
+		Handler:      func(s Session) {},
+		RequestHandlers: map[string]RequestHandler{
+			"streamlocal-forward@openssh.com":        forwardHandler.HandleSSHRequest,
+			"cancel-streamlocal-forward@openssh.com": forwardHandler.HandleSSHRequest,
+		},
+		ReverseUnixForwardingCallback: func(ctx Context, socketPath string) (net.Listener, error) {
+			return net.Listen("unix", socketPath)
+		},
+	}, nil)
+	defer cleanup()
+
+	l, err := client.ListenUnix(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(sampleServerResponse)
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	result, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, sampleServerResponse) {
+		t.Fatalf("result = %#v; want %#v", result, sampleServerResponse)
+	}
+}
+
+func TestReverseUnixForwardingRespectsCallback(t *testing.T) {
+	t.Parallel()
+
+	forwardHandler := &ForwardedUnixHandler{}
+	_, client, cleanup := newTestSession(t, &Server{
+		noClientAuth: true,
+		Handler:      func(s Session) {},
+		RequestHandlers: map[string]RequestHandler{
+			"streamlocal-forward@openssh.com": forwardHandler.HandleSSHRequest,
+		},
+		ReverseUnixForwardingCallback: func(ctx Context, socketPath string) (net.Listener, error) {
+			return nil, ErrRejected
+		},
+	}, nil)
+	defer cleanup()
+
+	if _, err := client.ListenUnix(filepath.Join(t.TempDir(), "reverse.sock")); err == nil {
+		t.Fatal("Expected the reverse unix forwarding to be rejected")
+	}
+}
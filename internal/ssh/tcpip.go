@@ -6,6 +6,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"time"
 
 	gossh "golang.org/x/crypto/ssh"
 )
@@ -14,6 +15,59 @@ const (
 	forwardedTCPChannelType = "forwarded-tcpip"
 )
 
+// contextKeyDialAddresses is the context key of the addresses pinned for the local forwardings of the
+// connection. The associated value will be of type *dialAddresses.
+var contextKeyDialAddresses = &contextKey{"dial-addresses"}
+
+// dialAddresses holds the addresses the local forwardings connect to, keyed by the destination
+type dialAddresses struct {
+	sync.Mutex
+	addrs map[string][]net.IP
+}
+
+// SetDialAddresses pins the local forwardings of the connection to the destination to the addresses, e.g.
+// the ones checked by the LocalPortForwardingCallback, so the destination isn't resolved again when dialed.
+// It's meant to be called by the callback before it allows the forwarding.
+func SetDialAddresses(ctx Context, host string, port uint32, ips []net.IP) {
+	d, ok := ctx.Value(contextKeyDialAddresses).(*dialAddresses)
+	if !ok {
+		return
+	}
+	d.Lock()
+	defer d.Unlock()
+	d.addrs[net.JoinHostPort(host, strconv.FormatInt(int64(port), 10))] = ips
+}
+
+// pinnedAddresses returns the addresses pinned for the destination, if any
+func pinnedAddresses(ctx Context, dest string) []net.IP {
+	d, ok := ctx.Value(contextKeyDialAddresses).(*dialAddresses)
+	if !ok {
+		return nil
+	}
+	d.Lock()
+	defer d.Unlock()
+	return d.addrs[dest]
+}
+
+// dialDestination connects to the pinned addresses of the destination in order, or to the destination
+// by name if none is pinned
+func dialDestination(ctx Context, dest string, port uint32) (net.Conn, error) {
+	var dialer net.Dialer
+	ips := pinnedAddresses(ctx, dest)
+	if len(ips) == 0 {
+		return dialer.DialContext(ctx, "tcp", dest)
+	}
+	var err error
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), strconv.FormatInt(int64(port), 10)))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
 // direct-tcpip data struct as specified in RFC4254, Section 7.2
 type localForwardChannelData struct {
 	DestAddr string
@@ -23,6 +77,20 @@ type localForwardChannelData struct {
 	OriginPort uint32
 }
 
+// LocalPortForwardingStats describes an allowed local port forwarding once it's done
+type LocalPortForwardingStats struct {
+	DestinationHost string
+	DestinationPort uint32
+	OriginHost      string
+	OriginPort      uint32
+
+	Start    time.Time     // when the forwarding was allowed
+	Duration time.Duration // from the start until both directions are closed
+	BytesIn  int64         // bytes copied from the client to the destination
+	BytesOut int64         // bytes copied from the destination to the client
+	Err      error         // the failure to connect to the destination, if any
+}
+
 // DirectTCPIPHandler can be enabled by adding it to the server's
 // ChannelHandlers under direct-tcpip.
 func DirectTCPIPHandler(srv *Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx Context) {
@@ -37,31 +105,56 @@ func DirectTCPIPHandler(srv *Server, conn *gossh.ServerConn, newChan gossh.NewCh
 		return
 	}
 
+	stats := LocalPortForwardingStats{
+		DestinationHost: d.DestAddr,
+		DestinationPort: d.DestPort,
+		OriginHost:      d.OriginAddr,
+		OriginPort:      d.OriginPort,
+		Start:           time.Now(),
+	}
+	done := func() {
+		if srv.LocalPortForwardingDoneCallback != nil {
+			stats.Duration = time.Since(stats.Start)
+			srv.LocalPortForwardingDoneCallback(ctx, stats)
+		}
+	}
+
 	dest := net.JoinHostPort(d.DestAddr, strconv.FormatInt(int64(d.DestPort), 10))
 
-	var dialer net.Dialer
-	dconn, err := dialer.DialContext(ctx, "tcp", dest)
+	dconn, err := dialDestination(ctx, dest, d.DestPort)
 	if err != nil {
 		newChan.Reject(gossh.ConnectionFailed, err.Error())
+		stats.Err = err
+		done()
 		return
 	}
 
 	ch, reqs, err := newChan.Accept()
 	if err != nil {
 		dconn.Close()
+		stats.Err = err
+		done()
 		return
 	}
 	go gossh.DiscardRequests(reqs)
 
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
+		defer wg.Done()
 		defer ch.Close()
 		defer dconn.Close()
-		io.Copy(ch, dconn)
+		stats.BytesOut, _ = io.Copy(ch, dconn)
 	}()
 	go func() {
+		defer wg.Done()
 		defer ch.Close()
 		defer dconn.Close()
-		io.Copy(dconn, ch)
+		stats.BytesIn, _ = io.Copy(dconn, ch)
+	}()
+	go func() {
+		wg.Wait()
+		done()
 	}()
 }
 
@@ -90,14 +183,21 @@ type remoteForwardChannelData struct {
 // adding the HandleSSHRequest callback to the server's RequestHandlers under
 // tcpip-forward and cancel-tcpip-forward.
 type ForwardedTCPHandler struct {
-	forwards map[string]net.Listener
+	forwards map[forwardKey]net.Listener
 	sync.Mutex
 }
 
+// forwardKey identifies a forward by the connection which requested it, as
+// connections of different users may request the same address
+type forwardKey struct {
+	sessionID string
+	addr      string
+}
+
 func (h *ForwardedTCPHandler) HandleSSHRequest(ctx Context, srv *Server, req *gossh.Request) (bool, []byte) {
 	h.Lock()
 	if h.forwards == nil {
-		h.forwards = make(map[string]net.Listener)
+		h.forwards = make(map[forwardKey]net.Listener)
 	}
 	h.Unlock()
 	conn := ctx.Value(ContextKeyConn).(*gossh.ServerConn)
@@ -111,25 +211,45 @@ func (h *ForwardedTCPHandler) HandleSSHRequest(ctx Context, srv *Server, req *go
 		if srv.ReversePortForwardingCallback == nil || !srv.ReversePortForwardingCallback(ctx, reqPayload.BindAddr, reqPayload.BindPort) {
 			return false, []byte("port forwarding is disabled")
 		}
-		addr := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))
-		ln, err := net.Listen("tcp", addr)
+		release := func() {
+			if srv.ReversePortForwardingReleaseCallback != nil {
+				srv.ReversePortForwardingReleaseCallback(ctx, reqPayload.BindAddr, reqPayload.BindPort)
+			}
+		}
+		var ln net.Listener
+		var err error
+		if srv.ReversePortForwardingListenCallback != nil {
+			ln, err = srv.ReversePortForwardingListenCallback(ctx, reqPayload.BindAddr, reqPayload.BindPort)
+		}
+		if ln == nil && err == nil {
+			// the forward is tracked by the requested host, which the client cancels by,
+			// while the listener binds to the host the server chooses
+			bindAddr := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))
+			if srv.ReversePortForwardingBindCallback != nil {
+				bindAddr = net.JoinHostPort(srv.ReversePortForwardingBindCallback(ctx, reqPayload.BindAddr), strconv.Itoa(int(reqPayload.BindPort)))
+			}
+			ln, err = net.Listen("tcp", bindAddr)
+		}
 		if err != nil {
 			// TODO: log listen failure
+			release()
 			return false, []byte{}
 		}
-		_, destPortStr, _ := net.SplitHostPort(ln.Addr().String())
-		destPort, _ := strconv.Atoi(destPortStr)
+		// the client matches the forwarded connections by the requested port, unless it asked
+		// for a dynamically allocated one, which it then matches and cancels by its number
+		destPort := int(reqPayload.BindPort)
+		if destPort == 0 {
+			if tcpAddr, ok := ln.Addr().(*net.TCPAddr); ok {
+				destPort = tcpAddr.Port
+			}
+		}
+		key := forwardKey{ctx.SessionID(), net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(destPort))}
 		h.Lock()
-		h.forwards[addr] = ln
+		h.forwards[key] = ln
 		h.Unlock()
 		go func() {
 			<-ctx.Done()
-			h.Lock()
-			ln, ok := h.forwards[addr]
-			h.Unlock()
-			if ok {
-				ln.Close()
-			}
+			ln.Close()
 		}()
 		go func() {
 			for {
@@ -168,8 +288,12 @@ func (h *ForwardedTCPHandler) HandleSSHRequest(ctx Context, srv *Server, req *go
 				}()
 			}
 			h.Lock()
-			delete(h.forwards, addr)
+			// the entry may hold a later forward of the same address by now
+			if h.forwards[key] == ln {
+				delete(h.forwards, key)
+			}
 			h.Unlock()
+			release()
 		}()
 		return true, gossh.Marshal(&remoteForwardSuccess{uint32(destPort)})
 
@@ -179,9 +303,9 @@ func (h *ForwardedTCPHandler) HandleSSHRequest(ctx Context, srv *Server, req *go
 			// TODO: log parse failure
 			return false, []byte{}
 		}
-		addr := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))
+		key := forwardKey{ctx.SessionID(), net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))}
 		h.Lock()
-		ln, ok := h.forwards[addr]
+		ln, ok := h.forwards[key]
 		h.Unlock()
 		if ok {
 			ln.Close()
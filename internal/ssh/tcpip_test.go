@@ -82,3 +82,297 @@ func TestLocalPortForwardingRespectsCallback(t *testing.T) {
 		t.Fatalf("Expected permission error but got %#v", err)
 	}
 }
+
+func TestLocalPortForwardingDialsPinnedAddresses(t *testing.T) {
+	t.Parallel()
+
+	l := sampleSocketServer()
+	defer l.Close()
+	addr := l.Addr().(*net.TCPAddr)
+
+	_, client, cleanup := newTestSession(t, &Server{
+		noClientAuth: true,
+		Handler:      func(s Session) {},
+		LocalPortForwardingCallback: func(ctx Context, destinationHost string, destinationPort uint32) bool {
+			// the name doesn't resolve, so the forwarding succeeds only by the pinned addresses
+			SetDialAddresses(ctx, destinationHost, destinationPort, []net.IP{addr.IP})
+			return true
+		},
+	}, nil)
+	defer cleanup()
+
+	conn, err := client.Dial("tcp", net.JoinHostPort("pinned.invalid", strconv.Itoa(addr.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, sampleServerResponse) {
+		t.Fatalf("result = %#v; want %#v", result, sampleServerResponse)
+	}
+}
+
+func TestLocalPortForwardingDoneCallback(t *testing.T) {
+	t.Parallel()
+
+	l := newLocalListener()
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.ReadFull(conn, make([]byte, 4))
+		conn.Write(sampleServerResponse)
+		conn.Close()
+	}()
+
+	done := make(chan LocalPortForwardingStats, 1)
+	_, client, cleanup := newTestSession(t, &Server{
+		noClientAuth: true,
+		Handler:      func(s Session) {},
+		LocalPortForwardingCallback: func(ctx Context, destinationHost string, destinationPort uint32) bool {
+			return true
+		},
+		LocalPortForwardingDoneCallback: func(ctx Context, stats LocalPortForwardingStats) {
+			done <- stats
+		},
+	}, nil)
+	defer cleanup()
+
+	conn, err := client.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	stats := <-done
+	if got := net.JoinHostPort(stats.DestinationHost, strconv.Itoa(int(stats.DestinationPort))); got != l.Addr().String() {
+		t.Errorf("destination = %q; want %q", got, l.Addr().String())
+	}
+	if stats.BytesIn != 4 || stats.BytesOut != int64(len(sampleServerResponse)) {
+		t.Errorf("bytes in/out = %d/%d; want %d/%d", stats.BytesIn, stats.BytesOut, 4, len(sampleServerResponse))
+	}
+	if stats.Err != nil || stats.Duration <= 0 {
+		t.Errorf("err = %v, duration = %v; want no error and a positive duration", stats.Err, stats.Duration)
+	}
+
+	// a failure to connect is reported as well
+	l.Close()
+	if _, err := client.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("dialing the closed listener succeeded")
+	}
+	if stats := <-done; stats.Err == nil {
+		t.Error("err = nil; want the connection failure")
+	}
+}
+
+func TestReversePortForwardingBindAndRelease(t *testing.T) {
+	t.Parallel()
+
+	forwardHandler := &ForwardedTCPHandler{}
+	released := make(chan string, 1)
+	_, client, cleanup := newTestSession(t, &Server{
+		noClientAuth: true,
+		Handler:      func(s Session) {},
+		RequestHandlers: map[string]RequestHandler{
+			"tcpip-forward":        forwardHandler.HandleSSHRequest,
+			"cancel-tcpip-forward": forwardHandler.HandleSSHRequest,
+		},
+		ReversePortForwardingCallback: func(ctx Context, bindHost string, bindPort uint32) bool {
+			return true
+		},
+		ReversePortForwardingBindCallback: func(ctx Context, bindHost string) string {
+			if bindHost != "0.0.0.0" {
+				t.Errorf("bindHost = %q; want %q", bindHost, "0.0.0.0")
+			}
+			return "127.0.0.1"
+		},
+		ReversePortForwardingReleaseCallback: func(ctx Context, bindHost string, bindPort uint32) {
+			released <- net.JoinHostPort(bindHost, strconv.Itoa(int(bindPort)))
+		},
+	}, nil)
+	defer cleanup()
+
+	l, err := client.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(sampleServerResponse)
+		conn.Close()
+	}()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, sampleServerResponse) {
+		t.Fatalf("result = %#v; want %#v", result, sampleServerResponse)
+	}
+
+	l.Close()
+	if got := <-released; got != "0.0.0.0:0" {
+		t.Fatalf("released = %q; want %q", got, "0.0.0.0:0")
+	}
+}
+
+func TestReversePortForwardingListenCallback(t *testing.T) {
+	t.Parallel()
+
+	forwardHandler := &ForwardedTCPHandler{}
+	tunnel := newLocalListener()
+	released := make(chan string, 1)
+	_, client, cleanup := newTestSession(t, &Server{
+		noClientAuth: true,
+		Handler:      func(s Session) {},
+		RequestHandlers: map[string]RequestHandler{
+			"tcpip-forward":        forwardHandler.HandleSSHRequest,
+			"cancel-tcpip-forward": forwardHandler.HandleSSHRequest,
+		},
+		ReversePortForwardingCallback: func(ctx Context, bindHost string, bindPort uint32) bool {
+			return true
+		},
+		ReversePortForwardingBindCallback: func(ctx Context, bindHost string) string {
+			t.Error("the bind callback was called for a listener of the listen callback")
+			return bindHost
+		},
+		ReversePortForwardingListenCallback: func(ctx Context, bindHost string, bindPort uint32) (net.Listener, error) {
+			if bindHost != "192.0.2.1" || bindPort != 80 {
+				t.Errorf("listen callback got %s:%d; want 192.0.2.1:80", bindHost, bindPort)
+			}
+			return tunnel, nil
+		},
+		ReversePortForwardingReleaseCallback: func(ctx Context, bindHost string, bindPort uint32) {
+			released <- net.JoinHostPort(bindHost, strconv.Itoa(int(bindPort)))
+		},
+	}, nil)
+	defer cleanup()
+
+	// the forwarded connections must carry the requested address for the client to match them
+	l, err := client.Listen("tcp", "192.0.2.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(sampleServerResponse)
+		conn.Close()
+	}()
+
+	conn, err := net.Dial("tcp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result, sampleServerResponse) {
+		t.Fatalf("result = %#v; want %#v", result, sampleServerResponse)
+	}
+
+	l.Close()
+	if got := <-released; got != "192.0.2.1:80" {
+		t.Fatalf("released = %q; want %q", got, "192.0.2.1:80")
+	}
+}
+
+func TestReversePortForwardingPerConnection(t *testing.T) {
+	t.Parallel()
+
+	forwardHandler := &ForwardedTCPHandler{}
+	tunnels := make(chan net.Listener, 2)
+	released := make(chan string, 2)
+	srv := &Server{
+		noClientAuth: true,
+		Handler:      func(s Session) {},
+		ChannelHandlers: map[string]ChannelHandler{
+			"session": DefaultSessionHandler,
+		},
+		RequestHandlers: map[string]RequestHandler{
+			"tcpip-forward":        forwardHandler.HandleSSHRequest,
+			"cancel-tcpip-forward": forwardHandler.HandleSSHRequest,
+		},
+		ReversePortForwardingCallback: func(ctx Context, bindHost string, bindPort uint32) bool {
+			return true
+		},
+		ReversePortForwardingListenCallback: func(ctx Context, bindHost string, bindPort uint32) (net.Listener, error) {
+			l := newLocalListener()
+			tunnels <- l
+			return l, nil
+		},
+		ReversePortForwardingReleaseCallback: func(ctx Context, bindHost string, bindPort uint32) {
+			released <- ctx.User()
+		},
+	}
+	sl := newLocalListener()
+	go srv.Serve(sl)
+	defer srv.Close()
+
+	// both users forward the same requested address, each to a tunnel of their own
+	forward := func(user string) (*gossh.Client, net.Listener) {
+		_, client, _ := newClientSession(t, sl.Addr().String(), &gossh.ClientConfig{User: user})
+		l, err := client.Listen("tcp", "192.0.2.1:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(user))
+				conn.Close()
+			}
+		}()
+		return client, <-tunnels
+	}
+	alice, aliceTunnel := forward("alice")
+	bob, bobTunnel := forward("bob")
+	defer bob.Close()
+
+	alice.Close()
+	if got := <-released; got != "alice" {
+		t.Fatalf("released the forward of %q; want alice", got)
+	}
+	if conn, err := net.Dial("tcp", aliceTunnel.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("the tunnel of the disconnected user is still open")
+	}
+	conn, err := net.Dial("tcp", bobTunnel.Addr().String())
+	if err != nil {
+		t.Fatalf("the tunnel of the other user was closed: %v", err)
+	}
+	result, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "bob" {
+		t.Fatalf("result = %q; want %q", result, "bob")
+	}
+}
@@ -0,0 +1,136 @@
+package ssh
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	x11RequestType = "x11-req"
+	x11ChannelType = "x11"
+)
+
+// X11 represents the X11 forwarding request of a session.
+type X11 struct {
+	// SingleConnection is true when only one connection should be forwarded.
+	SingleConnection bool
+
+	// AuthProtocol is the X11 authentication protocol, e.g. MIT-MAGIC-COOKIE-1.
+	AuthProtocol string
+
+	// AuthCookie is the hex-encoded X11 authentication cookie.
+	AuthCookie string
+
+	// ScreenNumber is the X11 screen number.
+	ScreenNumber uint32
+}
+
+// x11AuthProtocol matches the valid authentication protocols, as OpenSSH restricts them
+var x11AuthProtocol = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// ValidAuth reports whether the authentication protocol and cookie are well formed, i.e. the cookie is
+// non-empty even-length hex. They're passed to `xauth`, whose commands they must not break out of.
+func (x X11) ValidAuth() bool {
+	if !x11AuthProtocol.MatchString(x.AuthProtocol) || x.AuthCookie == "" {
+		return false
+	}
+	_, err := hex.DecodeString(x.AuthCookie)
+	return err == nil
+}
+
+// contextKeyX11Request is an internal context key for storing the X11
+// forwarding request of the client
+var contextKeyX11Request = &contextKey{"x11-req"}
+
+// SetX11Requested sets up the session context so that X11Requested
+// returns the request.
+func SetX11Requested(ctx Context, x11 X11) {
+	ctx.SetValue(contextKeyX11Request, x11)
+}
+
+// X11Requested returns the X11 forwarding request and true if the client
+// requested X11 forwarding.
+func X11Requested(sess Session) (X11, bool) {
+	return X11RequestedContext(sess.Context())
+}
+
+// X11RequestedContext returns the X11 forwarding request and true if the
+// client of the session context requested X11 forwarding.
+func X11RequestedContext(ctx context.Context) (X11, bool) {
+	x11, ok := ctx.Value(contextKeyX11Request).(X11)
+	return x11, ok
+}
+
+// ForwardX11ConnectionsContext takes connections from a listener to proxy into
+// the session on the x11 channels. It blocks and services connections until the
+// listener stop accepting, or after the first connection when the client
+// requested a single connection.
+func ForwardX11ConnectionsContext(l net.Listener, ctx context.Context) {
+	sshConn := ctx.Value(ContextKeyConn).(gossh.Conn)
+	x11, _ := X11RequestedContext(ctx)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if x11.SingleConnection {
+			l.Close()
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			originator := struct {
+				Address string
+				Port    uint32
+			}{}
+			if host, port, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+				p, _ := strconv.ParseUint(port, 10, 32)
+				originator.Address, originator.Port = host, uint32(p)
+			}
+			channel, reqs, err := sshConn.OpenChannel(x11ChannelType, gossh.Marshal(&originator))
+			if err != nil {
+				return
+			}
+			defer channel.Close()
+			go gossh.DiscardRequests(reqs)
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				io.Copy(conn, channel)
+				if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+				wg.Done()
+			}()
+			go func() {
+				io.Copy(channel, conn)
+				channel.CloseWrite()
+				wg.Done()
+			}()
+			wg.Wait()
+		}(conn)
+		if x11.SingleConnection {
+			return
+		}
+	}
+}
+
+func parseX11Request(payload []byte) (x11 X11, ok bool) {
+	req := struct {
+		SingleConnection bool
+		AuthProtocol     string
+		AuthCookie       string
+		ScreenNumber     uint32
+	}{}
+	if err := gossh.Unmarshal(payload, &req); err != nil {
+		return
+	}
+	x11 = X11(req)
+	return x11, x11.ValidAuth()
+}
@@ -0,0 +1,157 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func requestX11(t *testing.T, session *gossh.Session, x11 X11) bool {
+	t.Helper()
+	ok, err := session.SendRequest(x11RequestType, true, gossh.Marshal(&x11))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestX11Callback(t *testing.T) {
+	t.Parallel()
+	want := X11{
+		SingleConnection: true,
+		AuthProtocol:     "MIT-MAGIC-COOKIE-1",
+		AuthCookie:       "0123456789abcdef0123456789abcdef",
+		ScreenNumber:     1,
+	}
+	for _, allow := range []bool{true, false} {
+		requested := make(chan bool, 1)
+		session, _, cleanup := newTestSession(t, &Server{
+			noClientAuth: true,
+			Handler: func(s Session) {
+				_, ok := X11Requested(s)
+				requested <- ok
+			},
+			X11Callback: func(ctx Context, x11 X11) bool {
+				if x11 != want {
+					t.Errorf("x11 = %#v; want %#v", x11, want)
+				}
+				return allow
+			},
+		}, nil)
+		if got := requestX11(t, session, want); got != allow {
+			t.Fatalf("x11-req reply = %v; want %v", got, allow)
+		}
+		if err := session.Run(""); err != nil {
+			t.Fatalf("expected nil but got %v", err)
+		}
+		if got := <-requested; got != allow {
+			t.Fatalf("X11Requested() = %v; want %v", got, allow)
+		}
+		cleanup()
+	}
+}
+
+func TestX11DeniedWithoutCallback(t *testing.T) {
+	t.Parallel()
+	session, _, cleanup := newTestSession(t, &Server{
+		noClientAuth: true,
+		Handler:      func(s Session) {},
+	}, nil)
+	defer cleanup()
+	if requestX11(t, session, X11{AuthProtocol: "MIT-MAGIC-COOKIE-1"}) {
+		t.Fatal("expected x11-req to be rejected")
+	}
+}
+
+func TestX11RejectsMalformedAuth(t *testing.T) {
+	t.Parallel()
+	for _, x11 := range []X11{
+		{AuthProtocol: "MIT-MAGIC-COOKIE-1", AuthCookie: "00ff\nadd evil:0 MIT-MAGIC-COOKIE-1 00ff"},
+		{AuthProtocol: "MIT-MAGIC-COOKIE-1\nremove :0", AuthCookie: "00ff"},
+		{AuthProtocol: "MIT MAGIC", AuthCookie: "00ff"},
+		{AuthProtocol: "MIT-MAGIC-COOKIE-1", AuthCookie: "0ff"},
+		{AuthProtocol: "MIT-MAGIC-COOKIE-1", AuthCookie: "zz"},
+		{AuthProtocol: "MIT-MAGIC-COOKIE-1"},
+		{AuthCookie: "00ff"},
+	} {
+		session, _, cleanup := newTestSession(t, &Server{
+			noClientAuth: true,
+			Handler:      func(s Session) {},
+			X11Callback: func(ctx Context, x11 X11) bool {
+				t.Errorf("callback called for the malformed request %#v", x11)
+				return true
+			},
+		}, nil)
+		if requestX11(t, session, x11) {
+			t.Errorf("x11-req %#v was accepted", x11)
+		}
+		cleanup()
+	}
+}
+
+func TestForwardX11Connections(t *testing.T) {
+	t.Parallel()
+	testBytes := []byte("Hello X11\n")
+	session, client, cleanup := newTestSession(t, &Server{
+		noClientAuth: true,
+		Handler: func(s Session) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer l.Close()
+			go ForwardX11ConnectionsContext(l, s.Context())
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			conn.Write(testBytes)
+			io.ReadAll(conn)
+		},
+		X11Callback: func(ctx Context, x11 X11) bool {
+			return true
+		},
+	}, nil)
+	defer cleanup()
+
+	chans := client.HandleChannelOpen(x11ChannelType)
+	if !requestX11(t, session, X11{SingleConnection: true, AuthProtocol: "MIT-MAGIC-COOKIE-1", AuthCookie: "00ff"}) {
+		t.Fatal("expected x11-req to be accepted")
+	}
+	if err := session.Start(""); err != nil {
+		t.Fatal(err)
+	}
+	newChan := <-chans
+	var originator struct {
+		Address string
+		Port    uint32
+	}
+	if err := gossh.Unmarshal(newChan.ExtraData(), &originator); err != nil {
+		t.Fatal(err)
+	}
+	if originator.Address != "127.0.0.1" || originator.Port == 0 {
+		t.Fatalf("originator = %#v; want 127.0.0.1 and a port", originator)
+	}
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gossh.DiscardRequests(reqs)
+	got := make([]byte, len(testBytes))
+	if _, err := io.ReadFull(ch, got); err != nil {
+		t.Fatal(err)
+	}
+	ch.Close()
+	if !bytes.Equal(got, testBytes) {
+		t.Fatalf("x11 channel = %#v; want %#v", got, testBytes)
+	}
+	if err := session.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+package internalcaddyssh
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/kadeessh/kadeessh/internal/authentication"
+	"github.com/kadeessh/kadeessh/internal/pty/passwd"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"github.com/kadeessh/kadeessh/internal/streamlocal"
+)
+
+// dialStreamLocal returns the callback connecting to the unix socket if the key of the user permits port
+// forwarding and the asker permits it. The socket is connected to with the permissions of the user of the session.
+func dialStreamLocal(asker streamlocal.StreamLocalForwardingAsker, pass passwd.Passwd) ssh.LocalUnixForwardingCallback {
+	return func(ctx ssh.Context, socketPath string) (net.Conn, error) {
+		if !portForwardingPermitted(ctx) || !asker.Allow(ctx, socketPath) {
+			return nil, ssh.ErrRejected
+		}
+		var conn net.Conn
+		err := asSessionUser(pass, ctx.User(), func() error {
+			var dialer net.Dialer
+			var err error
+			conn, err = dialer.DialContext(ctx, "unix", socketPath)
+			return err
+		})
+		return conn, err
+	}
+}
+
+// listenStreamLocal returns the callback listening on the unix socket if the key of the user permits port
+// forwarding and the asker permits it. The socket is created, and removed once closed, with the permissions of the user of the session,
+// who owns it.
+func listenStreamLocal(asker streamlocal.StreamLocalForwardingAsker, pass passwd.Passwd) ssh.ReverseUnixForwardingCallback {
+	return func(ctx ssh.Context, socketPath string) (net.Listener, error) {
+		if !portForwardingPermitted(ctx) || !asker.Allow(ctx, socketPath) {
+			return nil, ssh.ErrRejected
+		}
+		var l *net.UnixListener
+		err := asSessionUser(pass, ctx.User(), func() error {
+			var err error
+			l, err = net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		// the socket is removed by the user rather than by the server
+		l.SetUnlinkOnClose(false)
+		return &userUnixListener{UnixListener: l, unlink: func() error {
+			return asSessionUser(pass, ctx.User(), func() error { return os.Remove(socketPath) })
+		}}, nil
+	}
+}
+
+// portForwardingPermitted returns true if the options of the key or the certificate the user authenticated
+// with permit port forwarding, which covers the forwarding of unix sockets as in OpenSSH
+func portForwardingPermitted(ctx ssh.Context) bool {
+	perms := ctx.Permissions()
+	return perms == nil || authentication.PortForwardingPermitted(perms.Permissions)
+}
+
+// asSessionUser runs fn with the permissions of the user on the file system. Only root can take them
+// on; otherwise the server runs as the user already.
+func asSessionUser(pass passwd.Passwd, username string, fn func() error) error {
+	if os.Getuid() != 0 {
+		return fn()
+	}
+	user := pass.Get(username)
+	if user == nil {
+		return fmt.Errorf("error finding user details")
+	}
+	return passwd.AsUser(user, fn)
+}
+
+// userUnixListener removes the socket with the permissions of the user once closed
+type userUnixListener struct {
+	*net.UnixListener
+	unlink func() error
+}
+
+func (l *userUnixListener) Close() error {
+	err := l.UnixListener.Close()
+	if unlinkErr := l.unlink(); unlinkErr != nil && !os.IsNotExist(unlinkErr) && err == nil {
+		err = unlinkErr
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+package streamlocal
+
+import (
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+// StreamLocalForwardingAsker is the interface necessary to ask whether a session is
+// permitted to forward the unix socket, either locally or in reverse
+type StreamLocalForwardingAsker interface {
+	Allow(ctx ssh.Context, socketPath string) bool
+}
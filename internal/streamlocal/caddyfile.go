@@ -0,0 +1,50 @@
+package streamlocal
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ caddyfile.Unmarshaler = (*Allow)(nil)
+	_ caddyfile.Unmarshaler = (*Deny)(nil)
+	_ caddyfile.Unmarshaler = (*Path)(nil)
+)
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. The module takes no options. Syntax:
+//
+//	allow
+func (e *Allow) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return noOptions(d)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. The module takes no options. Syntax:
+//
+//	deny
+func (e *Deny) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	return noOptions(d)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	path <patterns...>
+func (m *Path) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Paths = append(m.Paths, d.RemainingArgs()...)
+		if d.NextBlock(0) {
+			return d.Err("malformed path: blocks are not supported")
+		}
+	}
+	if len(m.Paths) == 0 {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func noOptions(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
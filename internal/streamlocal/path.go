@@ -0,0 +1,82 @@
+package streamlocal
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Path{})
+}
+
+// Path is StreamLocalForwardingAsker module which allows the forwarding
+// only for the socket paths matching any of the listed patterns
+type Path struct {
+	// The glob patterns, in the syntax of `filepath.Match`, of the permitted socket paths.
+	// The patterns may use the `{ssh.user}` placeholder, e.g. `/run/user/{ssh.user}/*.sock`.
+	// The requested path must be absolute, and it's cleaned before matching,
+	// so `..` can't escape the permitted directories.
+	Paths []string `json:"paths,omitempty"`
+
+	logger *zap.Logger
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (Path) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "ssh.ask.streamlocal.path",
+		New: func() caddy.Module { return new(Path) },
+	}
+}
+
+// Provision sets up the Path module and validates the patterns
+func (m *Path) Provision(ctx caddy.Context) error {
+	m.logger = ctx.Logger(m)
+	for _, p := range m.Paths {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid path pattern '%s': %v", p, err)
+		}
+	}
+	return nil
+}
+
+// Allow returns true if the cleaned socket path matches any of the patterns
+func (m Path) Allow(ctx ssh.Context, socketPath string) bool {
+	allowed := m.match(ctx.User(), socketPath)
+	m.logger.Info(
+		"asking for permission",
+		zap.String("session_id", ctx.SessionID()),
+		zap.String("remote_address", ctx.RemoteAddr().String()),
+		zap.String("user", ctx.User()),
+		zap.String("socket_path", socketPath),
+		zap.Bool("allowed", allowed),
+	)
+	return allowed
+}
+
+func (m Path) match(user, socketPath string) bool {
+	if !filepath.IsAbs(socketPath) {
+		return false
+	}
+	socketPath = filepath.Clean(socketPath)
+	repl := caddy.NewReplacer()
+	repl.Set("ssh.user", user)
+	for _, p := range m.Paths {
+		if ok, _ := filepath.Match(repl.ReplaceAll(p, ""), socketPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	_ caddy.Provisioner          = (*Path)(nil)
+	_ StreamLocalForwardingAsker = Path{}
+)
@@ -0,0 +1,25 @@
+package streamlocal
+
+import "testing"
+
+func TestPathMatch(t *testing.T) {
+	m := Path{Paths: []string{"/var/run/docker.sock", "/run/user/{ssh.user}/*.sock"}}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/var/run/docker.sock", true},
+		{"/run/user/alice/db.sock", true},
+		{"/run/user/alice/nested/db.sock", false},
+		{"/run/user/bob/db.sock", false},
+		{"/run/user/alice/../bob/db.sock", false},
+		{"/run/user/bob/../alice/db.sock", true},
+		{"run/user/alice/db.sock", false},
+		{"/var/run/docker.sock.bak", false},
+	}
+	for _, tt := range tests {
+		if got := m.match("alice", tt.path); got != tt.want {
+			t.Errorf("match(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
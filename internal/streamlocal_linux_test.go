@@ -0,0 +1,90 @@
+package internalcaddyssh
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kadeessh/kadeessh/internal/pty/passwd"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+// userContext is the ssh.Context of a connection of the user
+type userContext struct {
+	ssh.Context
+	user string
+}
+
+func (c userContext) User() string                            { return c.user }
+func (c userContext) Deadline() (deadline time.Time, ok bool) { return time.Time{}, false }
+func (c userContext) Done() <-chan struct{}                   { return nil }
+func (c userContext) Err() error                              { return nil }
+func (c userContext) Value(key any) any                       { return nil }
+func (c userContext) Permissions() *ssh.Permissions           { return nil }
+
+func TestStreamLocalAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("taking on the permissions of another user requires root")
+	}
+	ctx := userContext{user: "nobody"}
+	pass := passwd.New()
+	nobody := pass.Get("nobody")
+	if nobody == nil {
+		t.Skip("no nobody user")
+	}
+	listen := listenStreamLocal(allowAll{}, pass)
+	dial := dialStreamLocal(allowAll{}, pass)
+
+	// the socket is created by the user in the directory of the user, who owns it
+	userDir := t.TempDir()
+	// the parent of the temp directories is private to root
+	if err := os.Chmod(filepath.Dir(userDir), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(userDir, int(nobody.UID), int(nobody.GID)); err != nil { //nolint:gosec
+		t.Fatal(err)
+	}
+	socketPath := filepath.Join(userDir, "fwd.sock")
+	l, err := listen(ctx, socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); st.Uid != uint32(nobody.UID) || st.Gid != uint32(nobody.GID) { //nolint:gosec
+		t.Errorf("socket owned by %d:%d; want %d:%d", st.Uid, st.Gid, nobody.UID, nobody.GID)
+	}
+	conn, err := dial(ctx, socketPath)
+	if err != nil {
+		t.Fatalf("dialing the socket of the user: %v", err)
+	}
+	conn.Close()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("socket wasn't removed: %v", err)
+	}
+
+	// the directories of root are out of reach of the user
+	rootDir := t.TempDir()
+	if l, err := listen(ctx, filepath.Join(rootDir, "fwd.sock")); err == nil {
+		l.Close()
+		t.Error("the user listened in the directory of root")
+	}
+	rootSocket := filepath.Join(rootDir, "root.sock")
+	rl, err := net.Listen("unix", rootSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	if conn, err := dial(ctx, rootSocket); err == nil {
+		conn.Close()
+		t.Error("the user connected to the socket of root")
+	}
+}
@@ -0,0 +1,49 @@
+package internalcaddyssh
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/kadeessh/kadeessh/internal/pty/passwd"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type allowAll struct{}
+
+func (allowAll) Allow(ssh.Context, string) bool { return true }
+
+// permissionsContext is the ssh.Context of a connection authenticated with a key of the options
+type permissionsContext struct {
+	ssh.Context
+	extensions map[string]string
+}
+
+func (c permissionsContext) Permissions() *ssh.Permissions {
+	return &ssh.Permissions{Permissions: &gossh.Permissions{Extensions: c.extensions}}
+}
+
+func TestStreamLocalKeyOptions(t *testing.T) {
+	pass := passwd.New()
+	listen := listenStreamLocal(allowAll{}, pass)
+	dial := dialStreamLocal(allowAll{}, pass)
+	for _, extensions := range []map[string]string{
+		{"no-port-forwarding": ""},
+		{"restrict": ""},
+		{"restrict": "", "pty": ""},
+	} {
+		ctx := permissionsContext{extensions: extensions}
+		if l, err := listen(ctx, "/tmp/fwd.sock"); !errors.Is(err, ssh.ErrRejected) {
+			if l != nil {
+				l.Close()
+			}
+			t.Errorf("listening with key options %v: err = %v; want %v", extensions, err, ssh.ErrRejected)
+		}
+		if conn, err := dial(ctx, "/var/run/docker.sock"); !errors.Is(err, ssh.ErrRejected) {
+			if conn != nil {
+				conn.Close()
+			}
+			t.Errorf("dialing with key options %v: err = %v; want %v", extensions, err, ssh.ErrRejected)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package subsystem
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/kadeessh/kadeessh/internal/caddyfileutil"
+)
+
+var (
+	_ caddyfile.Unmarshaler = (*InMemSFTP)(nil)
+	_ caddyfile.Unmarshaler = (*SFTP)(nil)
+	_ caddyfile.Unmarshaler = (*StorageSFTP)(nil)
+)
+
+// UnmarshalCaddyfile sets up the subsystem from Caddyfile tokens. The module takes no options. Syntax:
+//
+//	inmem_sftp
+func (s *InMemSFTP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the subsystem from Caddyfile tokens. Syntax:
+//
+//	sftp [<root>] {
+//		root <path>
+//		create_root
+//		read_only
+//	}
+func (s *SFTP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			s.Root = d.Val()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "root":
+				if !d.AllArgs(&s.Root) {
+					return d.ArgErr()
+				}
+			case "create_root":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				s.CreateRoot = true
+			case "read_only":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				s.ReadOnly = true
+			default:
+				return d.Errf("unrecognized sftp option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the subsystem from Caddyfile tokens. Syntax:
+//
+//	storage_sftp {
+//		storage       <module> ...
+//		file_system   <backend> ...
+//		prefix        <prefix>
+//		read_only
+//		max_file_size <bytes>
+//	}
+func (s *StorageSFTP) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			var err error
+			switch d.Val() {
+			case "storage":
+				s.StorageRaw, err = caddyfileutil.UnmarshalInlineModule(d, "caddy.storage", "module")
+			case "file_system":
+				s.FileSystemRaw, err = caddyfileutil.UnmarshalInlineModule(d, "caddy.fs", "backend")
+			case "prefix":
+				if !d.AllArgs(&s.Prefix) {
+					return d.ArgErr()
+				}
+			case "read_only":
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				s.ReadOnly = true
+			case "max_file_size":
+				var val string
+				if !d.AllArgs(&val) {
+					return d.ArgErr()
+				}
+				s.MaxFileSize, err = strconv.ParseInt(val, 10, 64)
+				if err != nil {
+					return d.Errf("parsing max_file_size: %v", err)
+				}
+			default:
+				return d.Errf("unrecognized storage_sftp option '%s'", d.Val())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
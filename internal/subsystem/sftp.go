@@ -0,0 +1,134 @@
+package subsystem
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/pty/passwd"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(SFTP{})
+}
+
+var (
+	_ caddy.Provisioner = (*SFTP)(nil)
+	_ caddy.Validator   = (*SFTP)(nil)
+	_ Handler           = SFTP{}
+)
+
+// SFTP serves a directory tree of the local disk over SFTP. Each session is confined to its root
+// directory, which is resolved per session from the `root` template. The paths requested by the
+// client, including `..` components and symbolic links, are never resolved outside of the root.
+// The files and directories created by the user are owned by the OS user of the same username, if any.
+type SFTP struct {
+	// The root directory of the session. The value may contain the session placeholders,
+	// e.g. `/srv/sftp/{ssh.user}`. Required.
+	Root string `json:"root,omitempty"`
+
+	// Create the root directory, owned by the user, if it doesn't exist
+	CreateRoot bool `json:"create_root,omitempty"`
+
+	// Reject all the requests modifying the file system
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	logger *zap.Logger
+	pass   passwd.Passwd
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (s SFTP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "ssh.subsystem.sftp",
+		New: func() caddy.Module {
+			return new(SFTP)
+		},
+	}
+}
+
+// Provision sets up the SFTP module
+func (s *SFTP) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger(s)
+	s.pass = passwd.New()
+	return nil
+}
+
+// Validate ensures the root is defined
+func (s *SFTP) Validate() error {
+	if strings.TrimSpace(s.Root) == "" {
+		return errors.New("sftp: root is required")
+	}
+	return nil
+}
+
+// Handle runs an SFTP request server confined to the root of the session
+func (s SFTP) Handle(sess session.Session) {
+	sessionID, _ := sess.Context().Value(ssh.ContextKeySessionID).(string)
+	logger := s.logger.With(
+		zap.String("session_id", sessionID),
+		zap.String("user", sess.User()),
+		zap.String("remote_addr", sess.RemoteAddr().String()),
+	)
+
+	handlers, closer, err := s.rootHandlers(sess, logger)
+	if err != nil {
+		logger.Error("preparing sftp root", zap.Error(err))
+		return
+	}
+	defer closer.Close()
+
+	logger.Info("handling sftp session", zap.Bool("read_only", s.ReadOnly))
+	server := sftp.NewRequestServer(sess, handlers.handlers())
+	if err := server.Serve(); err == io.EOF {
+		server.Close()
+		logger.Info("sftp client exited session")
+	} else if err != nil {
+		logger.Error("sftp server completed with error", zap.Error(err))
+	}
+}
+
+func (s SFTP) rootHandlers(sess session.Session, logger *zap.Logger) (*rootHandlers, io.Closer, error) {
+	if err := session.CheckPathSafeUser(sess.User()); err != nil {
+		return nil, nil, err
+	}
+	rootPath := filepath.Clean(session.NewReplacer(sess).ReplaceAll(s.Root, ""))
+
+	var own *owner
+	if entry := s.pass.Get(sess.User()); entry != nil && runtime.GOOS != "windows" {
+		own = &owner{uid: int(entry.UID), gid: int(entry.GID)} //nolint:gosec
+	}
+	if s.CreateRoot {
+		if _, err := os.Stat(rootPath); errors.Is(err, os.ErrNotExist) {
+			if err := os.MkdirAll(rootPath, 0o750); err != nil {
+				return nil, nil, err
+			}
+			if own != nil && os.Getuid() != own.uid {
+				if err := os.Chown(rootPath, own.uid, own.gid); err != nil {
+					logger.Warn("changing root ownership", zap.String("root", rootPath), zap.Error(err))
+				}
+			}
+		}
+	}
+	root, err := os.OpenRoot(rootPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &rootHandlers{
+		root:     root,
+		readOnly: s.ReadOnly,
+		owner:    own,
+		logger:   logger,
+	}, root, nil
+}
@@ -0,0 +1,258 @@
+package subsystem
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+)
+
+// owner is the OS user the created files and directories are handed to
+type owner struct {
+	uid, gid int
+}
+
+// rootHandlers implements the sftp.Handlers over an os.Root, which confines
+// all the file system operations to the root directory, including the resolution of
+// symbolic links and `..` components.
+type rootHandlers struct {
+	root     *os.Root
+	readOnly bool
+	owner    *owner
+	logger   *zap.Logger
+}
+
+var (
+	_ sftp.FileReader           = (*rootHandlers)(nil)
+	_ sftp.OpenFileWriter       = (*rootHandlers)(nil)
+	_ sftp.PosixRenameFileCmder = (*rootHandlers)(nil)
+	_ sftp.LstatFileLister      = (*rootHandlers)(nil)
+	_ sftp.ReadlinkFileLister   = (*rootHandlers)(nil)
+)
+
+func (h *rootHandlers) handlers() sftp.Handlers {
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+// rootRelative converts the absolute SFTP path into a path relative to the root
+func rootRelative(p string) string {
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		return "."
+	}
+	return p
+}
+
+// chown hands the path to the owner, if any. The operation is skipped when the server
+// already runs as the owner, e.g. when it's not running as root.
+func (h *rootHandlers) chown(name string) {
+	if h.owner == nil || runtime.GOOS == "windows" || os.Getuid() == h.owner.uid {
+		return
+	}
+	if err := h.root.Lchown(name, h.owner.uid, h.owner.gid); err != nil {
+		h.logger.Warn("changing file ownership", zap.String("path", name), zap.Error(err))
+	}
+}
+
+// Fileread opens the file for reading
+func (h *rootHandlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.root.Open(rootRelative(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Filewrite opens the file for writing
+func (h *rootHandlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.openFile(r)
+}
+
+// OpenFile opens the file for reading and writing
+func (h *rootHandlers) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.openFile(r)
+}
+
+func (h *rootHandlers) openFile(r *sftp.Request) (*os.File, error) {
+	if h.readOnly {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	name := rootRelative(r.Filepath)
+	pflags := r.Pflags()
+	// O_APPEND is deliberately omitted as it conflicts with WriteAt, and the clients
+	// provide the offsets anyway.
+	flags := os.O_WRONLY
+	if pflags.Read {
+		flags = os.O_RDWR
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	_, statErr := h.root.Lstat(name)
+	f, err := h.root.OpenFile(name, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if errors.Is(statErr, fs.ErrNotExist) {
+		h.chown(name)
+	}
+	return f, nil
+}
+
+// Filecmd handles the commands altering the file system
+func (h *rootHandlers) Filecmd(r *sftp.Request) error {
+	if h.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	name := rootRelative(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(name, r)
+	case "Rename":
+		// SFTP rename must not overwrite an existing file
+		if _, err := h.root.Lstat(rootRelative(r.Target)); err == nil {
+			return os.ErrExist
+		}
+		return h.root.Rename(name, rootRelative(r.Target))
+	case "Rmdir":
+		info, err := h.root.Lstat(name)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return sftp.ErrSSHFxFailure
+		}
+		return h.root.Remove(name)
+	case "Remove":
+		info, err := h.root.Lstat(name)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return sftp.ErrSSHFxFailure
+		}
+		return h.root.Remove(name)
+	case "Mkdir":
+		if err := h.root.Mkdir(name, 0o755); err != nil {
+			return err
+		}
+		h.chown(name)
+		return nil
+	case "Link":
+		// the link is at Filepath, pointing to Target
+		return h.root.Link(rootRelative(r.Target), name)
+	case "Symlink":
+		// the link is at Filepath, pointing to Target. The target is stored verbatim, but
+		// resolving it never escapes the root.
+		if err := h.root.Symlink(r.Target, name); err != nil {
+			return err
+		}
+		h.chown(name)
+		return nil
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename renames the file, replacing the target if it exists
+func (h *rootHandlers) PosixRename(r *sftp.Request) error {
+	if h.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return h.root.Rename(rootRelative(r.Filepath), rootRelative(r.Target))
+}
+
+func (h *rootHandlers) setstat(name string, r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if flags.UidGid {
+		// the ownership is managed by the server
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if flags.Size {
+		f, err := h.root.OpenFile(name, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(int64(attrs.Size)) //nolint:gosec
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := h.root.Chmod(name, attrs.FileMode()&fs.ModePerm); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := h.root.Chtimes(name, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Filelist handles the listing of directories and the stat of files
+func (h *rootHandlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name := rootRelative(r.Filepath)
+	switch r.Method {
+	case "List":
+		d, err := h.root.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		entries, err := d.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(entries), nil
+	case "Stat":
+		info, err := h.root.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Lstat returns the file info without following symbolic links
+func (h *rootHandlers) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := h.root.Lstat(rootRelative(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+// Readlink returns the target of the symbolic link
+func (h *rootHandlers) Readlink(p string) (string, error) {
+	return h.root.Readlink(rootRelative(p))
+}
+
+type listerAt []os.FileInfo
+
+// ListAt copies the entries starting at the offset into the buffer
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
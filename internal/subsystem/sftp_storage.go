@@ -0,0 +1,523 @@
+package subsystem
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/kadeessh/kadeessh/internal/session"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(StorageSFTP{})
+}
+
+var (
+	_ caddy.Provisioner = (*StorageSFTP)(nil)
+	_ Handler           = StorageSFTP{}
+)
+
+// StorageSFTP serves SFTP from a Caddy storage module, e.g. the file system, Redis, or S3 plugins,
+// or from a read-only `caddy.fs` module. The SFTP paths are mapped to the keys of the same path
+// under the `prefix`. The uploads are buffered in memory and stored when the client closes the file.
+// Directories are implicit, i.e. a directory exists as long as it holds files, so empty directories
+// are not retained.
+type StorageSFTP struct {
+	// The Caddy storage module backing the files. If both `storage` and `file_system` are
+	// absent or null, the default storage is loaded.
+	StorageRaw json.RawMessage `json:"storage,omitempty" caddy:"namespace=caddy.storage inline_key=module"`
+
+	// The file system module backing the files. File system modules used here must implement
+	// the fs.FS interface. The `caddy.fs` modules are read-only, so the session is read-only.
+	// Mutually exclusive with `storage`.
+	FileSystemRaw json.RawMessage `json:"file_system,omitempty" caddy:"namespace=caddy.fs inline_key=backend"`
+
+	// The key prefix under which the files of the session are kept. The value may contain
+	// the session placeholders. Defaults to `sftp/{ssh.user}`.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Reject all the requests modifying the files
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// The maximum size of a file in bytes. As the uploads are buffered in memory, the size
+	// is always limited. Defaults to 100 MiB.
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+
+	store  objectStore
+	logger *zap.Logger
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (s StorageSFTP) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "ssh.subsystem.storage_sftp",
+		New: func() caddy.Module {
+			return new(StorageSFTP)
+		},
+	}
+}
+
+// Provision loads the storage or file system module backing the files
+func (s *StorageSFTP) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger(s)
+	if s.StorageRaw != nil && s.FileSystemRaw != nil {
+		return errors.New("storage and file_system are mutually exclusive")
+	}
+	if s.Prefix == "" {
+		s.Prefix = "sftp/{ssh.user}"
+	}
+	if s.MaxFileSize < 0 {
+		return fmt.Errorf("invalid max_file_size: %d", s.MaxFileSize)
+	}
+
+	switch {
+	case s.FileSystemRaw != nil:
+		mod, err := ctx.LoadModule(s, "FileSystemRaw")
+		if err != nil {
+			return fmt.Errorf("loading file system module: %v", err)
+		}
+		fsys, ok := mod.(fs.FS)
+		if !ok {
+			return fmt.Errorf("file system module is not fs.FS: %T", mod)
+		}
+		s.store = fsStore{fsys: fsys}
+		s.ReadOnly = true
+	case s.StorageRaw != nil:
+		val, err := ctx.LoadModule(s, "StorageRaw")
+		if err != nil {
+			return fmt.Errorf("loading storage module: %v", err)
+		}
+		st, err := val.(caddy.StorageConverter).CertMagicStorage()
+		if err != nil {
+			return fmt.Errorf("creating storage configuration: %v", err)
+		}
+		s.store = storageStore{storage: st}
+	default:
+		s.store = storageStore{storage: ctx.Storage()}
+	}
+	return nil
+}
+
+// Handle runs an SFTP request server over the storage for the session
+func (s StorageSFTP) Handle(sess session.Session) {
+	sessionID, _ := sess.Context().Value(ssh.ContextKeySessionID).(string)
+	logger := s.logger.With(
+		zap.String("session_id", sessionID),
+		zap.String("user", sess.User()),
+		zap.String("remote_addr", sess.RemoteAddr().String()),
+	)
+	if err := session.CheckPathSafeUser(sess.User()); err != nil {
+		logger.Error("preparing sftp storage", zap.Error(err))
+		return
+	}
+
+	handlers := &storageHandlers{
+		ctx:         sess.Context(),
+		store:       s.store,
+		prefix:      storagePrefix(session.NewReplacer(sess).ReplaceAll(s.Prefix, "")),
+		readOnly:    s.ReadOnly,
+		maxFileSize: s.MaxFileSize,
+		logger:      logger,
+	}
+	logger.Info("handling sftp session", zap.String("prefix", handlers.prefix), zap.Bool("read_only", s.ReadOnly))
+	server := sftp.NewRequestServer(sess, handlers.handlers())
+	if err := server.Serve(); err == io.EOF {
+		server.Close()
+		logger.Info("sftp client exited session")
+	} else if err != nil {
+		logger.Error("sftp server completed with error", zap.Error(err))
+	}
+}
+
+// storagePrefix cleans the prefix into the form of a relative key, as expected by both certmagic.Storage and fs.FS
+func storagePrefix(prefix string) string {
+	return rootRelative(prefix)
+}
+
+// errFileTooLarge is returned when an upload exceeds the maximum file size
+var errFileTooLarge = errors.New("file exceeds the maximum allowed size")
+
+// defaultMaxFileSize caps the size of the files unless max_file_size is set, as the uploads are buffered in memory
+const defaultMaxFileSize = 100 << 20
+
+// objectStore is the minimal set of operations the SFTP requests are translated into
+type objectStore interface {
+	load(ctx context.Context, key string) ([]byte, error)
+	stat(ctx context.Context, key string) (fs.FileInfo, error)
+	list(ctx context.Context, dir string) ([]fs.FileInfo, error)
+	store(ctx context.Context, key string, value []byte) error
+	delete(ctx context.Context, key string) error
+}
+
+// storageStore adapts the certmagic.Storage of the `caddy.storage` modules
+type storageStore struct {
+	storage certmagic.Storage
+}
+
+func (s storageStore) load(ctx context.Context, key string) ([]byte, error) {
+	return s.storage.Load(ctx, key)
+}
+
+func (s storageStore) stat(ctx context.Context, key string) (fs.FileInfo, error) {
+	ki, err := s.storage.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return keyInfo{name: path.Base(ki.Key), size: ki.Size, modTime: ki.Modified, dir: !ki.IsTerminal}, nil
+}
+
+func (s storageStore) list(ctx context.Context, dir string) ([]fs.FileInfo, error) {
+	keys, err := s.storage.List(ctx, dir, false)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(keys))
+	for _, k := range keys {
+		info, err := s.stat(ctx, k)
+		if err != nil {
+			// the key may be deleted between the listing and the stat
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (s storageStore) store(ctx context.Context, key string, value []byte) error {
+	return s.storage.Store(ctx, key, value)
+}
+
+func (s storageStore) delete(ctx context.Context, key string) error {
+	return s.storage.Delete(ctx, key)
+}
+
+// fsStore adapts the read-only fs.FS of the `caddy.fs` modules
+type fsStore struct {
+	fsys fs.FS
+}
+
+func (s fsStore) load(_ context.Context, key string) ([]byte, error) {
+	return fs.ReadFile(s.fsys, key)
+}
+
+func (s fsStore) stat(_ context.Context, key string) (fs.FileInfo, error) {
+	return fs.Stat(s.fsys, key)
+}
+
+func (s fsStore) list(_ context.Context, dir string) ([]fs.FileInfo, error) {
+	entries, err := fs.ReadDir(s.fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (fsStore) store(context.Context, string, []byte) error {
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+func (fsStore) delete(context.Context, string) error {
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+// storageHandlers implements the sftp.Handlers over an objectStore. Each SFTP path is mapped to the key
+// of the same path under the prefix. Directories are implicit, i.e. they exist as long as they hold files.
+type storageHandlers struct {
+	ctx         context.Context
+	store       objectStore
+	prefix      string
+	readOnly    bool
+	maxFileSize int64
+	logger      *zap.Logger
+}
+
+var (
+	_ sftp.FileReader     = (*storageHandlers)(nil)
+	_ sftp.OpenFileWriter = (*storageHandlers)(nil)
+	_ sftp.FileCmder      = (*storageHandlers)(nil)
+	_ sftp.FileLister     = (*storageHandlers)(nil)
+)
+
+func (h *storageHandlers) handlers() sftp.Handlers {
+	return sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h}
+}
+
+// fileSizeLimit returns the maximum size of a file
+func (h *storageHandlers) fileSizeLimit() int64 {
+	if h.maxFileSize > 0 {
+		return h.maxFileSize
+	}
+	return defaultMaxFileSize
+}
+
+// key maps the SFTP path to the storage key under the prefix
+func (h *storageHandlers) key(p string) string {
+	return path.Join(h.prefix, rootRelative(p))
+}
+
+func (h *storageHandlers) isRoot(p string) bool {
+	return rootRelative(p) == "."
+}
+
+// Fileread loads the object
+func (h *storageHandlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	info, err := h.store.stat(h.ctx, h.key(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, sftp.ErrSSHFxFailure
+	}
+	bs, err := h.store.load(h.ctx, h.key(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(bs), nil
+}
+
+// Filewrite opens the object for writing. The content is stored when the handle is closed.
+func (h *storageHandlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.openObject(r)
+}
+
+// OpenFile opens the object for reading and writing. The content is stored when the handle is closed.
+func (h *storageHandlers) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.openObject(r)
+}
+
+func (h *storageHandlers) openObject(r *sftp.Request) (*bufferedObject, error) {
+	if h.readOnly {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	if h.isRoot(r.Filepath) {
+		return nil, sftp.ErrSSHFxFailure
+	}
+	key := h.key(r.Filepath)
+	pflags := r.Pflags()
+	obj := &bufferedObject{h: h, key: key}
+
+	info, err := h.store.stat(h.ctx, key)
+	switch {
+	case err == nil && info.IsDir():
+		return nil, sftp.ErrSSHFxFailure
+	case err == nil && pflags.Creat && pflags.Excl:
+		return nil, os.ErrExist
+	case err == nil && !pflags.Trunc:
+		if obj.buf, err = h.store.load(h.ctx, key); err != nil {
+			return nil, err
+		}
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	case err != nil && !pflags.Creat:
+		return nil, os.ErrNotExist
+	}
+	return obj, nil
+}
+
+// Filecmd translates the commands into storage operations
+func (h *storageHandlers) Filecmd(r *sftp.Request) error {
+	if h.readOnly {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	key := h.key(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		// only truncation is meaningful for storage; the modes, times, and ownership are not retained
+		if !r.AttrFlags().Size {
+			return nil
+		}
+		bs, err := h.store.load(h.ctx, key)
+		if err != nil {
+			return err
+		}
+		size := int64(r.Attributes().Size) //nolint:gosec
+		if size < 0 {
+			return os.ErrInvalid
+		}
+		if size > h.fileSizeLimit() {
+			return errFileTooLarge
+		}
+		if size <= int64(len(bs)) {
+			bs = bs[:size]
+		} else {
+			bs = append(bs, make([]byte, size-int64(len(bs)))...)
+		}
+		return h.store.store(h.ctx, key, bs)
+	case "Rename":
+		target := h.key(r.Target)
+		if _, err := h.store.stat(h.ctx, target); err == nil {
+			return os.ErrExist
+		}
+		info, err := h.store.stat(h.ctx, key)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return sftp.ErrSSHFxOpUnsupported
+		}
+		bs, err := h.store.load(h.ctx, key)
+		if err != nil {
+			return err
+		}
+		if err := h.store.store(h.ctx, target, bs); err != nil {
+			return err
+		}
+		return h.store.delete(h.ctx, key)
+	case "Rmdir":
+		if h.isRoot(r.Filepath) {
+			return sftp.ErrSSHFxPermissionDenied
+		}
+		entries, err := h.store.list(h.ctx, key)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if len(entries) > 0 {
+			return sftp.ErrSSHFxFailure
+		}
+		if err := h.store.delete(h.ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	case "Remove":
+		info, err := h.store.stat(h.ctx, key)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return sftp.ErrSSHFxFailure
+		}
+		return h.store.delete(h.ctx, key)
+	case "Mkdir":
+		// directories are implicit, so there's nothing to create unless a file holds the name
+		if info, err := h.store.stat(h.ctx, key); err == nil && !info.IsDir() {
+			return os.ErrExist
+		}
+		return nil
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// Filelist lists the keys under the path or stats the key
+func (h *storageHandlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	key := h.key(r.Filepath)
+	switch r.Method {
+	case "List":
+		entries, err := h.store.list(h.ctx, key)
+		if errors.Is(err, fs.ErrNotExist) && h.isRoot(r.Filepath) {
+			return listerAt{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return listerAt(entries), nil
+	case "Stat":
+		if h.isRoot(r.Filepath) {
+			return listerAt{keyInfo{name: "/", dir: true}}, nil
+		}
+		info, err := h.store.stat(h.ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// bufferedObject holds the content of the object in memory until the handle is closed
+type bufferedObject struct {
+	h   *storageHandlers
+	key string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// ReadAt reads from the buffered content
+func (o *bufferedObject) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if off >= int64(len(o.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, o.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes into the buffered content, growing it as necessary
+func (o *bufferedObject) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	// the offset is checked on its own, as the end overflows for the offsets close to the maximum
+	if limit := o.h.fileSizeLimit(); off > limit || off+int64(len(p)) > limit {
+		return 0, errFileTooLarge
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	end := off + int64(len(p))
+	if end > int64(len(o.buf)) {
+		o.buf = append(o.buf, make([]byte, end-int64(len(o.buf)))...)
+	}
+	return copy(o.buf[off:], p), nil
+}
+
+// Close stores the buffered content
+func (o *bufferedObject) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.h.store.store(o.h.ctx, o.key, o.buf); err != nil {
+		o.h.logger.Error("storing sftp upload", zap.String("key", o.key), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// keyInfo is the fs.FileInfo of a storage key
+type keyInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (k keyInfo) Name() string       { return k.name }
+func (k keyInfo) Size() int64        { return k.size }
+func (k keyInfo) ModTime() time.Time { return k.modTime }
+func (k keyInfo) IsDir() bool        { return k.dir }
+func (k keyInfo) Sys() any           { return nil }
+func (k keyInfo) Mode() fs.FileMode {
+	if k.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
@@ -0,0 +1,172 @@
+package subsystem
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/caddyserver/certmagic"
+	"go.uber.org/zap"
+)
+
+func TestStorageHandlers_ReadWrite(t *testing.T) {
+	ctx := context.Background()
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	h := &storageHandlers{
+		ctx:    ctx,
+		store:  storageStore{storage: storage},
+		prefix: "sftp/alice",
+		logger: zap.NewNop(),
+	}
+	client := newTestClient(t, h.handlers())
+
+	f, err := client.Create("/docs/../hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := storage.Load(ctx, "sftp/alice/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("stored content = %q, want %q", got, "hello")
+	}
+
+	f, err = client.Open("/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("read content = %q, want %q", got, "hello")
+	}
+
+	entries, err := client.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "hello.txt" || entries[0].Size() != 5 {
+		t.Errorf("unexpected listing: %v", entries)
+	}
+
+	if err := client.Rename("/hello.txt", "/nested/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Exists(ctx, "sftp/alice/hello.txt") || !storage.Exists(ctx, "sftp/alice/nested/renamed.txt") {
+		t.Error("rename did not move the key")
+	}
+	if err := client.RemoveDirectory("/nested"); err == nil {
+		t.Error("removed a non-empty directory")
+	}
+	if err := client.Remove("/nested/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Exists(ctx, "sftp/alice/nested/renamed.txt") {
+		t.Error("remove did not delete the key")
+	}
+}
+
+func TestStorageHandlers_MaxFileSize(t *testing.T) {
+	h := &storageHandlers{
+		ctx:         context.Background(),
+		store:       storageStore{storage: &certmagic.FileStorage{Path: t.TempDir()}},
+		prefix:      "sftp",
+		maxFileSize: 4,
+		logger:      zap.NewNop(),
+	}
+	client := newTestClient(t, h.handlers())
+
+	f, err := client.Create("/big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("too large")); err == nil {
+		t.Error("wrote beyond the maximum file size")
+	}
+}
+
+func TestStorageHandlers_FileSystem(t *testing.T) {
+	h := &storageHandlers{
+		ctx: context.Background(),
+		store: fsStore{fsys: fstest.MapFS{
+			"public/readme.txt": {Data: []byte("read me")},
+		}},
+		prefix:   storagePrefix("/public"),
+		readOnly: true,
+		logger:   zap.NewNop(),
+	}
+	client := newTestClient(t, h.handlers())
+
+	f, err := client.Open("/readme.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "read me" {
+		t.Errorf("read content = %q, want %q", got, "read me")
+	}
+	if _, err := client.Create("/new.txt"); err == nil {
+		t.Error("created a file on a read-only file system")
+	}
+	if _, err := client.Open("/../../etc/passwd"); !os.IsNotExist(err) {
+		t.Errorf("expected not-exist error for path outside the prefix, got %v", err)
+	}
+}
+
+func TestStorageHandlers_InvalidOffsets(t *testing.T) {
+	h := &storageHandlers{
+		ctx:    context.Background(),
+		store:  storageStore{storage: &certmagic.FileStorage{Path: t.TempDir()}},
+		prefix: "sftp",
+		logger: zap.NewNop(),
+	}
+	client := newTestClient(t, h.handlers())
+
+	f, err := client.OpenFile("/file.txt", os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int64{-1, -1 << 62, 1 << 62, 1<<63 - 1} {
+		if _, err := f.WriteAt([]byte("x"), off); err == nil {
+			t.Errorf("wrote at the offset %d", off)
+		}
+		if _, err := f.ReadAt(make([]byte, 1), off); err == nil {
+			t.Errorf("read at the offset %d", off)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{-1, 1 << 62} {
+		if err := client.Truncate("/file.txt", size); err == nil {
+			t.Errorf("truncated to the size %d", size)
+		}
+	}
+
+	// the server survives the requests
+	info, err := client.Stat("/file.txt")
+	if err != nil || info.Size() != 5 {
+		t.Errorf("stat = %v, %v; want the 5 bytes written", info, err)
+	}
+}
@@ -0,0 +1,159 @@
+package subsystem
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+)
+
+type pipeConn struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p pipeConn) Close() error {
+	p.PipeReader.Close()
+	return p.PipeWriter.Close()
+}
+
+// newTestClient serves the handlers over in-memory pipes and returns a connected client
+func newTestClient(t *testing.T, h sftp.Handlers) *sftp.Client {
+	t.Helper()
+	serverRead, clientWrite := io.Pipe()
+	clientRead, serverWrite := io.Pipe()
+	server := sftp.NewRequestServer(pipeConn{serverRead, serverWrite}, h)
+	go server.Serve() //nolint:errcheck
+	client, err := sftp.NewClientPipe(clientRead, clientWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return client
+}
+
+func newRootHandlers(t *testing.T, dir string, readOnly bool) *rootHandlers {
+	t.Helper()
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+	return &rootHandlers{root: root, readOnly: readOnly, logger: zap.NewNop()}
+}
+
+func TestRootHandlers_ReadWrite(t *testing.T) {
+	dir := t.TempDir()
+	client := newTestClient(t, newRootHandlers(t, dir, false).handlers())
+
+	if err := client.Mkdir("/uploads"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := client.Create("/uploads/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	got, err := os.ReadFile(filepath.Join(dir, "uploads", "hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("file content = %q, want %q", got, "hello")
+	}
+
+	entries, err := client.ReadDir("/uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "hello.txt" {
+		t.Errorf("unexpected listing: %v", entries)
+	}
+
+	if err := client.Rename("/uploads/hello.txt", "/uploads/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Remove("/uploads/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RemoveDirectory("/uploads"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRootHandlers_Traversal(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "root")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(parent, "secret"), []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(parent, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, newRootHandlers(t, dir, false).handlers())
+
+	// `..` is resolved against the virtual root
+	f, err := client.Create("/../../outside.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, err := os.Stat(filepath.Join(dir, "outside.txt")); err != nil {
+		t.Errorf("file not created inside the root: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "outside.txt")); err == nil {
+		t.Error("file created outside the root")
+	}
+
+	// symbolic links are not followed outside the root
+	if _, err := client.Open("/escape/secret"); err == nil {
+		t.Error("read a file outside the root through a symbolic link")
+	}
+	if _, err := client.Create("/escape/planted"); err == nil {
+		t.Error("created a file outside the root through a symbolic link")
+	}
+}
+
+func TestRootHandlers_ReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, newRootHandlers(t, dir, true).handlers())
+
+	f, err := client.Open("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "content" {
+		t.Errorf("file content = %q, want %q", got, "content")
+	}
+
+	if _, err := client.Create("/new.txt"); err == nil {
+		t.Error("created a file in read-only mode")
+	}
+	if err := client.Remove("/file.txt"); err == nil {
+		t.Error("removed a file in read-only mode")
+	}
+	if err := client.Mkdir("/dir"); err == nil {
+		t.Error("created a directory in read-only mode")
+	}
+}
@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+var (
+	_ caddyfile.Unmarshaler = (*Config)(nil)
+	_ caddyfile.Unmarshaler = (*Upstreams)(nil)
+)
+
+// UnmarshalCaddyfile sets up the tunnels config from Caddyfile tokens. Syntax:
+//
+//	reverse_tunnels {
+//		name  <template>
+//		hosts <patterns...>
+//	}
+func (c *Config) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "name":
+				if !d.AllArgs(&c.Name) {
+					return d.ArgErr()
+				}
+			case "hosts":
+				hosts := d.RemainingArgs()
+				if len(hosts) == 0 {
+					return d.ArgErr()
+				}
+				c.Hosts = append(c.Hosts, hosts...)
+			default:
+				return d.Errf("unrecognized reverse_tunnels option '%s'", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the upstreams from Caddyfile tokens. Syntax:
+//
+//	dynamic ssh_tunnel <name>
+func (u *Upstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.AllArgs(&u.Name) {
+			return d.ArgErr()
+		}
+		if d.NextBlock(0) {
+			return d.Err("malformed ssh_tunnel upstreams: blocks are not supported")
+		}
+	}
+	return nil
+}
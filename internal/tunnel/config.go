@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+)
+
+// defaultName is the default template of the tunnel names. The bind hosts containing `-` are rejected with it,
+// so the names of the users and hosts can't collide, e.g. of `a` with `b-c` and of `a-b` with `c`.
+const defaultName = "{ssh.user}-{ssh.bind_host}"
+
+// Config turns the reverse port forwardings of hostnames, e.g. `ssh -R dev:80:localhost:3000`, into
+// named tunnels in place of binding the hostname. The tunnel listens on a dynamically allocated port
+// of the loopback address, and it's reachable through the `ssh_tunnel` upstreams of Caddy's reverse
+// proxy for as long as the forwarding lasts, so no public port is opened.
+//
+// The forwarding must still be allowed by the `reverseforward` module of the server, which is asked
+// about the requested hostname and port.
+type Config struct {
+	// The template of the tunnel names, which may use the placeholders `{ssh.user}`, `{ssh.bind_host}`,
+	// and `{ssh.bind_port}`. The names are case-insensitive. Defaults to `{ssh.user}-{ssh.bind_host}`, with
+	// which the bind hosts containing `-` aren't tunneled, as the names of different users could collide.
+	Name string `json:"name,omitempty"`
+
+	// The glob patterns, in the syntax of `path.Match`, of the requested bind hosts turned into tunnels,
+	// e.g. `*.dev`. Defaults to any hostname, i.e. other than an IP address, `localhost`, `*`, or empty.
+	Hosts []string `json:"hosts,omitempty"`
+
+	logger *zap.Logger
+}
+
+// Provision sets up the defaults and validates the patterns
+func (c *Config) Provision(ctx caddy.Context) error {
+	if c == nil {
+		return nil
+	}
+	c.logger = ctx.Logger().Named("tunnel")
+	if c.Name == "" {
+		c.Name = defaultName
+	}
+	for i, h := range c.Hosts {
+		if _, err := path.Match(h, ""); err != nil {
+			return fmt.Errorf("invalid host pattern '%s': %v", h, err)
+		}
+		c.Hosts[i] = strings.ToLower(h)
+	}
+	return nil
+}
+
+// Listen registers the tunnel of the forwarding and returns its listener, which unregisters the tunnel
+// when closed. It returns a nil listener for the bind hosts which aren't tunneled.
+func (c *Config) Listen(ctx ssh.Context, bindHost string, bindPort uint32) (net.Listener, error) {
+	if !c.tunnels(bindHost) {
+		return nil, nil
+	}
+	if c.Name == defaultName && strings.Contains(bindHost, "-") {
+		c.logger.Warn(
+			"tunnel rejected",
+			zap.String("session_id", ctx.SessionID()),
+			zap.String("user", ctx.User()),
+			zap.String("bind_host", bindHost),
+		)
+		return nil, fmt.Errorf("bind host '%s' contains '-', which is ambiguous in the tunnel name", bindHost)
+	}
+	repl := caddy.NewReplacer()
+	repl.Set("ssh.user", ctx.User())
+	repl.Set("ssh.bind_host", strings.ToLower(bindHost))
+	repl.Set("ssh.bind_port", strconv.FormatUint(uint64(bindPort), 10))
+	name := repl.ReplaceAll(c.Name, "")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := ln.Addr().String()
+	if err := tunnels.register(name, addr); err != nil {
+		ln.Close()
+		c.logger.Warn(
+			"tunnel rejected",
+			zap.String("session_id", ctx.SessionID()),
+			zap.String("user", ctx.User()),
+			zap.String("name", name),
+			zap.Error(err),
+		)
+		return nil, err
+	}
+	c.logger.Info(
+		"tunnel opened",
+		zap.String("session_id", ctx.SessionID()),
+		zap.String("user", ctx.User()),
+		zap.String("name", name),
+		zap.String("address", addr),
+	)
+	return &listener{Listener: ln, close: func() {
+		tunnels.unregister(name, addr)
+		c.logger.Info(
+			"tunnel closed",
+			zap.String("session_id", ctx.SessionID()),
+			zap.String("user", ctx.User()),
+			zap.String("name", name),
+		)
+	}}, nil
+}
+
+// tunnels returns true if the forwarding of the bind host is tunneled
+func (c *Config) tunnels(bindHost string) bool {
+	bindHost = strings.ToLower(strings.TrimSuffix(bindHost, "."))
+	if len(c.Hosts) == 0 {
+		switch bindHost {
+		case "", "*", "localhost":
+			return false
+		}
+		return net.ParseIP(bindHost) == nil
+	}
+	for _, h := range c.Hosts {
+		if ok, _ := path.Match(h, bindHost); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listener unregisters the tunnel once closed
+type listener struct {
+	net.Listener
+	once  sync.Once
+	close func()
+}
+
+func (l *listener) Close() error {
+	l.once.Do(l.close)
+	return l.Listener.Close()
+}
@@ -0,0 +1,50 @@
+// Package tunnel exposes the reverse port forwardings of the SSH connections as the
+// upstreams of Caddy's HTTP reverse proxy, e.g. to serve `https://alice-dev.example.com`
+// from the machine of the user who ran `ssh -R dev:80:localhost:3000`.
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// tunnels holds the tunnels of all the servers. It outlives config reloads, where the
+// tunnels are removed along with the connections of the stopped servers.
+var tunnels = &registry{addrs: make(map[string]string)}
+
+// registry maps the tunnel names to the loopback addresses of their listeners
+type registry struct {
+	mu    sync.RWMutex
+	addrs map[string]string
+}
+
+// Lookup returns the address of the listener of the tunnel by its case-insensitive name
+func Lookup(name string) (string, bool) {
+	tunnels.mu.RLock()
+	defer tunnels.mu.RUnlock()
+	addr, ok := tunnels.addrs[strings.ToLower(name)]
+	return addr, ok
+}
+
+func (r *registry) register(name, addr string) error {
+	name = strings.ToLower(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.addrs[name]; ok {
+		return fmt.Errorf("tunnel '%s' is already registered", name)
+	}
+	r.addrs[name] = addr
+	return nil
+}
+
+// unregister removes the tunnel only if it's still of the address, so a closing
+// listener can't remove the tunnel registered after it under the same name
+func (r *registry) unregister(name, addr string) {
+	name = strings.ToLower(name)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.addrs[name] == addr {
+		delete(r.addrs, name)
+	}
+}
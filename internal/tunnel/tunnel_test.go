@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"go.uber.org/zap"
+)
+
+type fakeContext struct {
+	context.Context
+	sync.Mutex
+	user string
+}
+
+func (c *fakeContext) User() string          { return c.user }
+func (c *fakeContext) SessionID() string     { return "session-" + c.user }
+func (c *fakeContext) ClientVersion() string { return "SSH-2.0-test" }
+func (c *fakeContext) ServerVersion() string { return "SSH-2.0-kadeessh" }
+func (c *fakeContext) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+}
+func (c *fakeContext) LocalAddr() net.Addr           { return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 22} }
+func (c *fakeContext) Permissions() *ssh.Permissions { return &ssh.Permissions{} }
+func (c *fakeContext) SetValue(key, value any) {
+	c.Context = context.WithValue(c.Context, key, value)
+}
+
+func newFakeContext(user string) *fakeContext {
+	return &fakeContext{Context: context.Background(), user: user}
+}
+
+func TestConfigTunnels(t *testing.T) {
+	tests := []struct {
+		hosts    []string
+		bindHost string
+		want     bool
+	}{
+		{bindHost: "dev", want: true},
+		{bindHost: "dev.example.com.", want: true},
+		{bindHost: "", want: false},
+		{bindHost: "*", want: false},
+		{bindHost: "LocalHost", want: false},
+		{bindHost: "127.0.0.1", want: false},
+		{bindHost: "::", want: false},
+		{hosts: []string{"*.dev"}, bindHost: "App.Dev", want: true},
+		{hosts: []string{"*.dev"}, bindHost: "dev", want: false},
+	}
+	for _, tt := range tests {
+		c := Config{Hosts: tt.hosts}
+		if got := c.tunnels(tt.bindHost); got != tt.want {
+			t.Errorf("tunnels(%q) with hosts %v = %v, want %v", tt.bindHost, tt.hosts, got, tt.want)
+		}
+	}
+}
+
+func TestConfigListen(t *testing.T) {
+	c := &Config{Name: defaultName, logger: zap.NewNop()}
+
+	ln, err := c.Listen(newFakeContext("alice"), "127.0.0.1", 8080)
+	if ln != nil || err != nil {
+		t.Fatalf("Listen() of an IP address = %v, %v; want nil, nil", ln, err)
+	}
+
+	ln, err = c.Listen(newFakeContext("alice"), "Dev", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, ok := Lookup("ALICE-dev")
+	if !ok || addr != ln.Addr().String() {
+		t.Fatalf("Lookup() = %q, %v; want %q, true", addr, ok, ln.Addr().String())
+	}
+	if ip := ln.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Fatalf("the tunnel listens on %s; want a loopback address", ip)
+	}
+
+	if _, err := c.Listen(newFakeContext("alice"), "dev", 8080); err == nil {
+		t.Fatal("Listen() of a registered name succeeded")
+	}
+	if _, ok := Lookup("alice-dev"); !ok {
+		t.Fatal("a rejected tunnel unregistered the open one")
+	}
+
+	ln.Close()
+	ln.Close()
+	if _, ok := Lookup("alice-dev"); ok {
+		t.Fatal("the tunnel is still registered after closing its listener")
+	}
+	ln, err = c.Listen(newFakeContext("alice"), "dev", 80)
+	if err != nil {
+		t.Fatalf("Listen() after the tunnel was closed: %v", err)
+	}
+	ln.Close()
+}
+
+func TestConfigListenCollision(t *testing.T) {
+	c := &Config{Name: defaultName, logger: zap.NewNop()}
+
+	// a-b forwarding c is named as a forwarding b-c would be
+	ln, err := c.Listen(newFakeContext("a-b"), "c", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if _, err := c.Listen(newFakeContext("a"), "b-c", 80); err == nil {
+		t.Fatal("Listen() of a bind host containing '-' succeeded with the default name")
+	}
+	if addr, ok := Lookup("a-b-c"); !ok || addr != ln.Addr().String() {
+		t.Fatalf("Lookup() = %q, %v; want the tunnel of a-b", addr, ok)
+	}
+
+	// the bind hosts are unrestricted with other names
+	custom := &Config{Name: "{ssh.bind_host}.{ssh.user}", logger: zap.NewNop()}
+	ln, err = custom.Listen(newFakeContext("a"), "b-c", 80)
+	if err != nil {
+		t.Fatalf("Listen() with a custom name: %v", err)
+	}
+	ln.Close()
+}
+
+func TestUpstreams(t *testing.T) {
+	c := &Config{Name: defaultName, logger: zap.NewNop()}
+	ln, err := c.Listen(newFakeContext("bob"), "web", 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+		conn.Close()
+	}()
+
+	u := Upstreams{Name: "{http.request.host.labels.2}"}
+	newRequest := func(host string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "https://"+host+"/", nil)
+		repl := caddy.NewReplacer()
+		repl.Set("http.request.host.labels.2", host[:len(host)-len(".example.com")])
+		return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	}
+
+	upstreams, err := u.GetUpstreams(newRequest("bob-web.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upstreams) != 1 || upstreams[0].Dial != ln.Addr().String() {
+		t.Fatalf("GetUpstreams() = %v; want the tunnel at %s", upstreams, ln.Addr())
+	}
+	conn, err := net.Dial("tcp", upstreams[0].Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := u.GetUpstreams(newRequest("carol-web.example.com")); err == nil {
+		t.Fatal("GetUpstreams() of an unknown tunnel succeeded")
+	}
+}
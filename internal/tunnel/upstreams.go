@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+func init() {
+	caddy.RegisterModule(Upstreams{})
+}
+
+// Upstreams is the dynamic upstreams module of Caddy's reverse proxy which proxies the request
+// through the SSH tunnel of the given name. The request fails if no such tunnel is open.
+type Upstreams struct {
+	// The name of the tunnel, which may use the placeholders of the request,
+	// e.g. `{http.request.host.labels.2}` for the `alice-dev` of `alice-dev.example.com`. Required.
+	Name string `json:"name,omitempty"`
+}
+
+// This method indicates that the type is a Caddy
+// module. The returned ModuleInfo must have both
+// a name and a constructor function. This method
+// must not have any side-effects.
+func (Upstreams) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.upstreams.ssh_tunnel",
+		New: func() caddy.Module { return new(Upstreams) },
+	}
+}
+
+// Provision validates the module
+func (u *Upstreams) Provision(ctx caddy.Context) error {
+	if u.Name == "" {
+		return fmt.Errorf("the tunnel name is required")
+	}
+	return nil
+}
+
+// GetUpstreams returns the listener of the tunnel as the upstream of the request
+func (u Upstreams) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	name := repl.ReplaceAll(u.Name, "")
+	addr, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("no open tunnel named '%s'", name)
+	}
+	return []*reverseproxy.Upstream{{Dial: addr}}, nil
+}
+
+var (
+	_ caddy.Provisioner           = (*Upstreams)(nil)
+	_ reverseproxy.UpstreamSource = Upstreams{}
+)
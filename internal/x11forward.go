@@ -0,0 +1,18 @@
+package internalcaddyssh
+
+import (
+	"github.com/kadeessh/kadeessh/internal/authentication"
+	"github.com/kadeessh/kadeessh/internal/ssh"
+	"github.com/kadeessh/kadeessh/internal/x11forward"
+)
+
+// allowX11Forwarding returns the callback permitting X11 forwarding if the key of the user permits it
+// and the asker permits it
+func allowX11Forwarding(asker x11forward.X11ForwardingAsker) ssh.X11Callback {
+	return func(ctx ssh.Context, x11 ssh.X11) bool {
+		if perms := ctx.Permissions(); perms != nil && !authentication.X11ForwardingPermitted(perms.Permissions) {
+			return false
+		}
+		return asker.Allow(ctx, x11)
+	}
+}
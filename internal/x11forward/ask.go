@@ -0,0 +1,11 @@
+package x11forward
+
+import (
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+// X11ForwardingAsker is the interface necessary to ask whether a session is
+// permitted to have X11-forwarding
+type X11ForwardingAsker interface {
+	Allow(ctx ssh.Context, x11 ssh.X11) bool
+}
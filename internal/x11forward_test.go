@@ -0,0 +1,30 @@
+package internalcaddyssh
+
+import (
+	"testing"
+
+	"github.com/kadeessh/kadeessh/internal/ssh"
+)
+
+type allowX11 struct{}
+
+func (allowX11) Allow(ssh.Context, ssh.X11) bool { return true }
+
+func TestX11ForwardingKeyOptions(t *testing.T) {
+	allow := allowX11Forwarding(allowX11{})
+	for _, tt := range []struct {
+		name       string
+		extensions map[string]string
+		want       bool
+	}{
+		{"no options", nil, true},
+		{"no-X11-forwarding", map[string]string{"no-X11-forwarding": ""}, false},
+		{"restrict", map[string]string{"restrict": ""}, false},
+		{"restrict and X11-forwarding", map[string]string{"restrict": "", "X11-forwarding": ""}, true},
+		{"no-agent-forwarding", map[string]string{"no-agent-forwarding": ""}, true},
+	} {
+		if got := allow(permissionsContext{extensions: tt.extensions}, ssh.X11{}); got != tt.want {
+			t.Errorf("%s: allowed = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Package recording seals and verifies the asciinema recordings saved by the `asciinema_recorder` actor
+// of kadeessh.
+//
+// A sealed recording may be encrypted to age recipients, in which case it's saved with the EncryptedSuffix,
+// and signed with an Ed25519 key, in which case the detached signature is saved next to it with the
+// SignatureSuffix. The signature covers the storage key and the saved payload as well as a hash chain over
+// the lines of the cast, i.e. its header followed by its events, so the events of an encrypted recording are
+// verified once it's decrypted.
+package recording
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"filippo.io/age"
+)
+
+const (
+	// EncryptedSuffix is appended to the storage key of the recordings encrypted to age recipients
+	EncryptedSuffix = ".age"
+
+	// SignatureSuffix is appended to the storage key of a recording for the key of its detached signature
+	SignatureSuffix = ".sig"
+
+	signatureVersion   = 1
+	signatureAlgorithm = "ed25519"
+	signatureContext   = "kadeessh-recording-v1"
+)
+
+// ageHeader starts the payloads encrypted by age
+var ageHeader = []byte("age-encryption.org/v1\n")
+
+// Signature is the detached signature of a recording
+type Signature struct {
+	Version   int    `json:"version"`
+	Algorithm string `json:"algorithm"`
+
+	// The Ed25519 public key of the signer. It only hints at the key to verify with, which must be trusted
+	// out of band.
+	PublicKey []byte `json:"public_key"`
+
+	// The storage key of the recording, which names the user and the session, so a recording can't be passed
+	// off as another one
+	Key string `json:"key"`
+
+	// The hex SHA-256 digest of the saved payload, which is encrypted when Encrypted is set
+	PayloadSHA256 string `json:"payload_sha256"`
+	Encrypted     bool   `json:"encrypted,omitempty"`
+
+	// The hex head of the SHA-256 hash chain over the lines of the cast, and the number of its events
+	ChainSHA256 string `json:"chain_sha256"`
+	Events      int    `json:"events"`
+
+	// Whether the recording was recovered from the temp file of a process that didn't finish it, in which
+	// case it's signed at the recovery
+	Recovered bool `json:"recovered,omitempty"`
+
+	Signature []byte `json:"signature"`
+}
+
+// message returns the signed message, binding all the fields of the signature but the signature itself
+func (s Signature) message() []byte {
+	var b bytes.Buffer
+	b.WriteString(signatureContext + "\n")
+	b.WriteString(s.Algorithm + "\n")
+	b.Write(s.PublicKey)
+	b.WriteString("\n" + strconv.Quote(s.Key) + "\n")
+	b.WriteString(s.PayloadSHA256 + "\n")
+	b.WriteString(strconv.FormatBool(s.Encrypted) + "\n")
+	b.WriteString(s.ChainSHA256 + "\n")
+	b.WriteString(strconv.Itoa(s.Events) + "\n")
+	b.WriteString(strconv.FormatBool(s.Recovered) + "\n")
+	return b.Bytes()
+}
+
+// Chain computes the head of the hash chain over the lines of the cast, where the link of the header
+// line is its SHA-256 digest, and the link of each following event line is the SHA-256 digest of the
+// previous link followed by the line. It returns the head along with the number of events.
+func Chain(cast []byte) ([]byte, int) {
+	var link []byte
+	events := -1
+	for len(cast) > 0 {
+		line := cast
+		if i := bytes.IndexByte(cast, '\n'); i >= 0 {
+			line, cast = cast[:i], cast[i+1:]
+		} else {
+			cast = nil
+		}
+		h := sha256.New()
+		h.Write(link)
+		h.Write(line)
+		link = h.Sum(nil)
+		events++
+	}
+	return link, max(events, 0)
+}
+
+// IsEncrypted reports whether the payload is encrypted by age
+func IsEncrypted(payload []byte) bool {
+	return bytes.HasPrefix(payload, ageHeader)
+}
+
+// Encrypt encrypts the cast to the age recipients
+func Encrypt(cast []byte, recipients ...age.Recipient) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := age.Encrypt(&b, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting recording: %v", err)
+	}
+	if _, err := w.Write(cast); err != nil {
+		return nil, fmt.Errorf("encrypting recording: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("encrypting recording: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+// Decrypt decrypts the payload encrypted to one of the age identities
+func Decrypt(payload []byte, identities ...age.Identity) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(payload), identities...)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting recording: %v", err)
+	}
+	cast, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting recording: %v", err)
+	}
+	return cast, nil
+}
+
+// Seal encrypts the cast to the recipients, if any, and signs it with the key, if any, for the storage key it's
+// saved under. It returns the payload to save and its marshaled signature, which is nil without a key.
+func Seal(storageKey string, cast []byte, recipients []age.Recipient, key ed25519.PrivateKey, recovered bool) ([]byte, []byte, error) {
+	payload := cast
+	if len(recipients) > 0 {
+		var err error
+		if payload, err = Encrypt(cast, recipients...); err != nil {
+			return nil, nil, err
+		}
+	}
+	if key == nil {
+		return payload, nil, nil
+	}
+	digest := sha256.Sum256(payload)
+	chain, events := Chain(cast)
+	sig := Signature{
+		Version:       signatureVersion,
+		Algorithm:     signatureAlgorithm,
+		PublicKey:     key.Public().(ed25519.PublicKey),
+		Key:           storageKey,
+		PayloadSHA256: hex.EncodeToString(digest[:]),
+		Encrypted:     len(recipients) > 0,
+		ChainSHA256:   hex.EncodeToString(chain),
+		Events:        events,
+		Recovered:     recovered,
+	}
+	sig.Signature = ed25519.Sign(key, sig.message())
+	signature, err := json.Marshal(sig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("marshaling signature: %v", err)
+	}
+	return payload, signature, nil
+}
+
+// Result is the outcome of a successful verification
+type Result struct {
+	Signature Signature
+
+	// The verified cast, which is nil if the payload is encrypted and no identity was given to decrypt it,
+	// in which case only the payload is verified
+	Cast []byte
+}
+
+// Verify verifies the payload saved under the storage key against its marshaled signature, which must be made
+// by one of the trusted keys. If the payload is encrypted, it's decrypted with the identities, if any, to
+// verify the events of the cast too.
+func Verify(storageKey string, payload, signature []byte, trusted []ed25519.PublicKey, identities ...age.Identity) (*Result, error) {
+	var sig Signature
+	if err := json.Unmarshal(signature, &sig); err != nil {
+		return nil, fmt.Errorf("parsing signature: %v", err)
+	}
+	if sig.Version != signatureVersion || sig.Algorithm != signatureAlgorithm {
+		return nil, fmt.Errorf("unsupported signature: version %d, algorithm %q", sig.Version, sig.Algorithm)
+	}
+	if len(sig.PublicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key in signature")
+	}
+	var known bool
+	for _, k := range trusted {
+		if bytes.Equal(k, sig.PublicKey) {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return nil, errors.New("recording is signed by an untrusted key")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(sig.PublicKey), sig.message(), sig.Signature) {
+		return nil, errors.New("invalid signature")
+	}
+	if sig.Key != storageKey {
+		return nil, fmt.Errorf("recording is signed for %q rather than %q", sig.Key, storageKey)
+	}
+
+	digest := sha256.Sum256(payload)
+	if hex.EncodeToString(digest[:]) != sig.PayloadSHA256 {
+		return nil, errors.New("recording does not match its signature")
+	}
+	if sig.Encrypted != IsEncrypted(payload) {
+		return nil, errors.New("recording encryption does not match its signature")
+	}
+
+	cast := payload
+	if sig.Encrypted {
+		if len(identities) == 0 {
+			return &Result{Signature: sig}, nil
+		}
+		var err error
+		if cast, err = Decrypt(payload, identities...); err != nil {
+			return nil, err
+		}
+	}
+	chain, events := Chain(cast)
+	if hex.EncodeToString(chain) != sig.ChainSHA256 || events != sig.Events {
+		return nil, errors.New("recording events do not match their signature")
+	}
+	return &Result{Signature: sig, Cast: cast}, nil
+}
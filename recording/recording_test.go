@@ -0,0 +1,167 @@
+package recording
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"filippo.io/age"
+)
+
+const (
+	testKey       = "ssh/recordings/2025-10-24/alice-a1b2c3d4e5f6.cast"
+	testSealedKey = testKey + EncryptedSuffix
+)
+
+const testCast = `{"version":2,"width":80,"height":24,"timestamp":1730000000}
+[0.1,"o","$ "]
+[0.5,"o","ls\r\n"]
+[0.9,"r","120x50"]
+`
+
+func TestChain(t *testing.T) {
+	head, events := Chain([]byte(testCast))
+	if events != 3 {
+		t.Errorf("events = %d; want 3", events)
+	}
+	if again, _ := Chain([]byte(testCast)); !bytes.Equal(head, again) {
+		t.Error("chain isn't deterministic")
+	}
+	for _, cast := range []string{
+		// reordered events
+		`{"version":2,"width":80,"height":24,"timestamp":1730000000}
+[0.5,"o","ls\r\n"]
+[0.1,"o","$ "]
+[0.9,"r","120x50"]
+`,
+		// dropped event
+		`{"version":2,"width":80,"height":24,"timestamp":1730000000}
+[0.1,"o","$ "]
+[0.9,"r","120x50"]
+`,
+	} {
+		if other, _ := Chain([]byte(cast)); bytes.Equal(head, other) {
+			t.Errorf("chain of %q matches the original", cast)
+		}
+	}
+	if _, events := Chain(nil); events != 0 {
+		t.Errorf("events of an empty cast = %d; want 0", events)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := []ed25519.PublicKey{pub}
+	recipients := []age.Recipient{identity.Recipient()}
+
+	plain, plainSig, err := Seal(testKey, []byte(testCast), nil, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, []byte(testCast)) {
+		t.Error("plaintext recording was modified")
+	}
+	res, err := Verify(testKey, plain, plainSig, trusted)
+	if err != nil || string(res.Cast) != testCast || res.Signature.Events != 3 || res.Signature.Key != testKey {
+		t.Fatalf("Verify = %+v, %v; want the cast", res, err)
+	}
+
+	sealed, sealedSig, err := Seal(testSealedKey, []byte(testCast), recipients, key, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(sealed) || IsEncrypted(plain) {
+		t.Fatal("IsEncrypted doesn't tell the encrypted recording")
+	}
+	res, err = Verify(testSealedKey, sealed, sealedSig, trusted, identity)
+	if err != nil || string(res.Cast) != testCast || !res.Signature.Recovered || !res.Signature.Encrypted {
+		t.Fatalf("Verify = %+v, %v; want the decrypted cast", res, err)
+	}
+	// the payload is verified without the identity to decrypt it
+	res, err = Verify(testSealedKey, sealed, sealedSig, trusted)
+	if err != nil || res.Cast != nil {
+		t.Fatalf("Verify without identity = %+v, %v; want the payload verified", res, err)
+	}
+
+	// a signature forged over a tampered cast doesn't verify, even with the fields made consistent
+	forged := func(sig []byte, edit func(*Signature)) []byte {
+		var s Signature
+		if err := json.Unmarshal(sig, &s); err != nil {
+			t.Fatal(err)
+		}
+		edit(&s)
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tampered := []byte(testCast[:len(testCast)-len("[0.9,\"r\",\"120x50\"]\n")])
+	head, events := Chain(tampered)
+	otherKey := "ssh/recordings/2025-10-24/bob-0f1e2d3c4b5a.cast"
+	bobPlain, bobSig, err := Seal(otherKey, []byte(testCast), nil, key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		key        string
+		payload    []byte
+		signature  []byte
+		identities []age.Identity
+		trusted    []ed25519.PublicKey
+	}{
+		{"tampered payload", testKey, tampered, plainSig, nil, trusted},
+		{"untrusted key", testKey, plain, plainSig, nil, []ed25519.PublicKey{otherPub}},
+		{"no trusted keys", testKey, plain, plainSig, nil, nil},
+		{"swapped signature", testKey, plain, sealedSig, nil, trusted},
+		{"edited events", testKey, plain, forged(plainSig, func(s *Signature) { s.Events = 2 }), nil, trusted},
+		{"edited chain", testKey, tampered, forged(plainSig, func(s *Signature) {
+			s.ChainSHA256, s.Events = hex.EncodeToString(head), events
+		}), nil, trusted},
+		{"unsupported version", testKey, plain, forged(plainSig, func(s *Signature) { s.Version = 2 }), nil, trusted},
+		{"wrong identity", testSealedKey, sealed, sealedSig, []age.Identity{otherIdentity}, trusted},
+		{"malformed signature", testKey, plain, []byte("{"), nil, trusted},
+		{"recording of another session", testKey, bobPlain, bobSig, nil, trusted},
+		{"recording under another key", otherKey, plain, plainSig, nil, trusted},
+		{"edited key", otherKey, plain, forged(plainSig, func(s *Signature) { s.Key = otherKey }), nil, trusted},
+	} {
+		if _, err := Verify(tt.key, tt.payload, tt.signature, tt.trusted, tt.identities...); err == nil {
+			t.Errorf("%s: verified", tt.name)
+		}
+	}
+}
+
+func TestSealWithoutKey(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, err := Seal(testSealedKey, []byte(testCast), []age.Recipient{identity.Recipient()}, nil, false)
+	if err != nil || sig != nil {
+		t.Fatalf("Seal = %v, signature %q; want no signature", err, sig)
+	}
+	cast, err := Decrypt(payload, identity)
+	if err != nil || string(cast) != testCast {
+		t.Errorf("Decrypt = %q, %v; want the cast", cast, err)
+	}
+}